@@ -6,31 +6,59 @@ import (
 	"fmt"
 	"log/slog"
 	"net/http"
+	"net/url"
 	"os"
 	"os/signal"
 	"path/filepath"
+	"strings"
 	"syscall"
+	"time"
 
 	"github.com/caskos/caskos/internal/api"
 	"github.com/caskos/caskos/internal/hashring"
 	"github.com/caskos/caskos/internal/metadata"
+	"github.com/caskos/caskos/internal/nodeapi"
+	"github.com/caskos/caskos/internal/scrubber"
 	"github.com/caskos/caskos/internal/storage"
+	"github.com/caskos/caskos/internal/upload"
 )
 
 const (
 	defaultPort         = "8080"
 	defaultReplication  = 2
 	defaultVirtualNodes = 150
+	defaultScrubRate    = 32 << 20
+	defaultMinFreeBytes = 1 << 30
 )
 
 func main() {
+	// "caskos node" runs a single storage node for a coordinator to use
+	if len(os.Args) > 1 && os.Args[1] == "node" {
+		runNode(os.Args[2:])
+		return
+	}
+
 	// Parse command line flags
 	port := flag.String("port", defaultPort, "HTTP server port")
 	dataDir := flag.String("data-dir", "./data", "Base directory for data storage")
 	metadataDir := flag.String("metadata-dir", "./metadata", "Directory for metadata storage")
 	nodeCount := flag.Int("nodes", 3, "Number of storage nodes")
+	remoteNodes := flag.String("remote-nodes", "", "Remote storage nodes to add, as comma-separated id=url pairs (see caskos node)")
 	replication := flag.Int("replication", defaultReplication, "Replication factor")
 	virtualNodes := flag.Int("virtual-nodes", defaultVirtualNodes, "Number of virtual nodes per physical node")
+	writeConsistency := flag.String("write-consistency", string(storage.DefaultConsistency), "Replicas an upload must reach: one, quorum or all")
+	nodeTimeout := flag.Duration("node-timeout", storage.DefaultNodeTimeout, "How long a write waits on a stalled node before dropping it (0 waits indefinitely); also how long requests to remote nodes may stall")
+	durabilityPolicy := flag.String("durability", string(storage.DurabilityReplicated), "Default protection of new objects: replicated, or ec:K+M for erasure coding")
+	compression := flag.String("compression", "none", "Codec nodes compress new objects with unless set per node: none or gzip")
+	keyFile := flag.String("key-file", "", "JSON file of master keys to encrypt new objects, metadata and staged uploads with (empty disables encryption)")
+	chunkSize := flag.Int("chunk-size", storage.DefaultChunkSize, "Average size in bytes of the chunks objects are split into for deduplication")
+	uploadTTL := flag.Duration("upload-ttl", upload.DefaultTTL, "How long an idle resumable or S3 multipart upload is kept before it is discarded")
+	s3Port := flag.String("s3-port", "", "Port of the S3-compatible API (empty disables it)")
+	s3Region := flag.String("s3-region", "us-east-1", "Region S3 clients sign requests for")
+	scrubInterval := flag.Duration("scrub-interval", 24*time.Hour, "Pause between background scrub passes (0 disables scrubbing)")
+	scrubRate := flag.Int64("scrub-rate", defaultScrubRate, "Maximum scrub read rate in bytes per second (0 is unlimited)")
+	healthInterval := flag.Duration("health-interval", storage.DefaultProbeInterval, "Pause between health probes of every node (0 disables health checking)")
+	minFreeBytes := flag.Int64("min-free-bytes", defaultMinFreeBytes, "Free disk space below which a node is reported as suspect (0 disables the check)")
 	flag.Parse()
 
 	// Setup structured logging
@@ -41,8 +69,22 @@ func main() {
 
 	logger.Info("starting CaskOS", "port", *port, "nodes", *nodeCount, "replication", *replication)
 
+	// Load the master keys first, since metadata is sealed with them too
+	var keyring *storage.Keyring
+	if *keyFile != "" {
+		var err error
+		if keyring, err = storage.LoadKeyring(*keyFile); err != nil {
+			logger.Error("failed to load key file", "error", err)
+			os.Exit(1)
+		}
+		if info, err := os.Stat(*keyFile); err == nil && info.Mode().Perm()&0077 != 0 {
+			logger.Warn("key file is readable by other users", "path", *keyFile, "mode", info.Mode().Perm().String())
+		}
+		logger.Info("encryption at rest enabled", "active_key", keyring.Active())
+	}
+
 	// Create metadata store
-	metadataStore, err := metadata.NewStore(*metadataDir)
+	metadataStore, err := metadata.NewEncryptedStore(*metadataDir, keyring)
 	if err != nil {
 		logger.Error("failed to create metadata store", "error", err)
 		os.Exit(1)
@@ -51,39 +93,242 @@ func main() {
 	// Create hash ring
 	ring := hashring.NewHashRing(*virtualNodes)
 
+	// Load the node membership saved by the previous run, if any
+	membershipPath := filepath.Join(*dataDir, "nodes.json")
+	previous, err := storage.LoadMembership(membershipPath)
+	if err != nil {
+		logger.Error("failed to load node membership", "error", err)
+		os.Exit(1)
+	}
+
+	consistency, err := storage.ParseConsistency(*writeConsistency)
+	if err != nil {
+		logger.Error("invalid write consistency", "error", err)
+		os.Exit(1)
+	}
+	durability, err := storage.ParseDurability(*durabilityPolicy)
+	if err != nil {
+		logger.Error("invalid durability policy", "error", err)
+		os.Exit(1)
+	}
+	codec, err := storage.ParseCodec(*compression)
+	if err != nil {
+		logger.Error("invalid compression", "error", err)
+		os.Exit(1)
+	}
+	remotes, err := parseRemoteNodes(*remoteNodes)
+	if err != nil {
+		logger.Error("invalid remote nodes", "error", err)
+		os.Exit(1)
+	}
+	clientConfig := nodeapi.ClientConfig{
+		Token:   os.Getenv("CASKOS_NODE_TOKEN"),
+		Timeout: *nodeTimeout,
+	}
+
 	// Create storage nodes
 	storageManager := storage.NewManager(ring, *replication, logger)
-	for i := 0; i < *nodeCount; i++ {
-		nodeID := fmt.Sprintf("node%d", i+1)
-		nodePath := filepath.Join(*dataDir, nodeID)
+	storageManager.SetWriteConsistency(consistency)
+	storageManager.SetNodeTimeout(*nodeTimeout)
+	storageManager.SetChunkSize(*chunkSize)
+	storageManager.SetDurability(durability)
+	storageManager.SetCompression(codec)
+	if keyring != nil {
+		storageManager.SetKeyring(keyring)
+	}
+	var draining []string
+	for _, record := range nodeRecords(previous, *nodeCount, *dataDir, remotes) {
+		if record.URL != "" {
+			// Remote nodes are configured, and may be down, on their own
+			client := nodeapi.NewClient(record.URL, clientConfig)
+			if err := client.Ping(); err != nil {
+				logger.Warn("remote storage node is unreachable", "node_id", record.ID, "url", record.URL, "error", err)
+			}
+			storageManager.RestoreNode(record, client)
+			if record.State != storage.NodeActive {
+				draining = append(draining, record.ID)
+			}
+			logger.Info("added remote storage node",
+				"node_id", record.ID,
+				"url", record.URL,
+				"state", record.State,
+				"weight", record.Weight,
+				"labels", record.Labels)
+			continue
+		}
 
-		node, err := storage.NewNode(nodeID, nodePath)
+		node, err := storage.NewNode(record.ID, record.Path)
+		if err != nil {
+			logger.Error("failed to create storage node", "node_id", record.ID, "error", err)
+			os.Exit(1)
+		}
+		nodeCodec, err := storage.ParseCodec(record.Compression)
 		if err != nil {
-			logger.Error("failed to create storage node", "node_id", nodeID, "error", err)
+			logger.Error("invalid node compression", "node_id", record.ID, "error", err)
 			os.Exit(1)
 		}
+		if record.Compression == "" {
+			nodeCodec = codec
+		}
+		node.SetCompression(nodeCodec)
 
-		ring.AddNode(nodeID)
-		storageManager.AddNode(nodeID, node)
-		logger.Info("created storage node", "node_id", nodeID, "path", nodePath)
+		storageManager.RestoreNode(record, node)
+		if record.State != storage.NodeActive {
+			draining = append(draining, record.ID)
+		}
+		logger.Info("created storage node",
+			"node_id", record.ID,
+			"path", record.Path,
+			"state", record.State,
+			"weight", record.Weight,
+			"labels", record.Labels,
+			"compression", nodeCodec.String())
 	}
 
 	// Create API server
 	server := api.NewServer(storageManager, metadataStore, logger, *replication)
+	server.SetNodeClientConfig(clientConfig)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Resumable uploads are staged locally until they are complete
+	sessions, err := upload.New(upload.Config{
+		Dir:     filepath.Join(*dataDir, "uploads"),
+		TTL:     *uploadTTL,
+		Keyring: keyring,
+	}, logger)
+	if err != nil {
+		logger.Error("failed to create upload sessions", "error", err)
+		os.Exit(1)
+	}
+	server.SetUploadSessions(sessions)
+	go sessions.Run(ctx)
+
+	// Move objects whose placement changed since the last run, e.g. after -nodes changed
+	if previous != nil {
+		before := hashring.NewHashRing(previous.VirtualNodes)
+		for _, record := range previous.Nodes {
+			if record.State == storage.NodeActive {
+				before.AddLabeledNode(record.ID, record.Weight, record.Labels)
+			}
+		}
+
+		if ranges := hashring.MovedRanges(before, ring, *replication); len(ranges) > 0 {
+			logger.Info("ring changed since last run, rebalancing", "moved_ranges", len(ranges))
+			go storageManager.Rebalance(ctx, storage.RebalanceOptions{
+				Filter: func(objectID string) bool {
+					return hashring.ContainsKey(ranges, objectID)
+				},
+			})
+		}
+	}
+
+	var removed []string
+	if previous != nil {
+		removed = previous.Removed
+	}
+	if err := storageManager.EnableMembershipFile(membershipPath, *virtualNodes, removed); err != nil {
+		logger.Error("failed to save node membership", "error", err)
+		os.Exit(1)
+	}
+
+	// Resume drains interrupted by the previous shutdown
+	for _, nodeID := range draining {
+		go func(nodeID string) {
+			if err := storageManager.DrainNode(ctx, nodeID); err != nil {
+				logger.Error("failed to resume drain", "node_id", nodeID, "error", err)
+			}
+		}(nodeID)
+	}
+
+	// Replicas written for down nodes are tracked until the nodes are back
+	if err := storageManager.EnableHintDir(filepath.Join(*dataDir, "hints")); err != nil {
+		logger.Error("failed to load hints", "error", err)
+		os.Exit(1)
+	}
+	if hints := storageManager.Hints(); len(hints) > 0 {
+		logger.Info("loaded hints to replay", "count", len(hints))
+	}
+
+	// Probe nodes so down nodes are skipped by reads and writes, and replay
+	// hints once they recover
+	if *healthInterval > 0 {
+		storageManager.SetHealthConfig(storage.HealthConfig{
+			Interval:     *healthInterval,
+			MinFreeBytes: *minFreeBytes,
+		})
+		go storageManager.RunHealthChecks(ctx)
+		logger.Info("started node health checks", "interval", *healthInterval)
+	}
+
+	// Start background scrubber
+	if *scrubInterval > 0 {
+		scrub, err := scrubber.New(storageManager, metadataStore, scrubber.Config{
+			Interval:       *scrubInterval,
+			BytesPerSecond: *scrubRate,
+			StatePath:      filepath.Join(*dataDir, "scrubber.json"),
+		}, logger)
+		if err != nil {
+			logger.Error("failed to create scrubber", "error", err)
+			os.Exit(1)
+		}
+		go scrub.Run(ctx)
+		logger.Info("started background scrubber", "interval", *scrubInterval, "rate", *scrubRate)
+	}
 
 	// Setup HTTP routes
 	mux := http.NewServeMux()
 
 	// API endpoints
 	mux.HandleFunc("POST /upload", server.UploadHandler)
+	mux.HandleFunc("GET /objects", server.ListObjectsHandler)
+	mux.HandleFunc("POST /uploads", server.CreateUploadHandler)
+	mux.HandleFunc("GET /uploads/{id}", server.GetUploadHandler)
+	mux.HandleFunc("PUT /uploads/{id}", server.PutUploadPartHandler)
+	mux.HandleFunc("POST /uploads/{id}/complete", server.CompleteUploadHandler)
+	mux.HandleFunc("DELETE /uploads/{id}", server.DeleteUploadHandler)
+	mux.HandleFunc("OPTIONS /files/{$}", server.TusOptionsHandler)
+	mux.HandleFunc("POST /files/{$}", server.TusCreateHandler)
+	mux.HandleFunc("HEAD /files/{id}", server.TusHeadHandler)
+	mux.HandleFunc("PATCH /files/{id}", server.TusPatchHandler)
+	mux.HandleFunc("DELETE /files/{id}", server.TusDeleteHandler)
 	mux.HandleFunc("GET /object/{id}", server.GetObjectHandler)
+	mux.HandleFunc("DELETE /object/{id}", server.DeleteObjectHandler)
 	mux.HandleFunc("GET /metadata/{id}", server.GetMetadataHandler)
 
+	// Bucket and key endpoints
+	mux.HandleFunc("GET /buckets", server.ListBucketsHandler)
+	mux.HandleFunc("PUT /buckets/{bucket}", server.CreateBucketHandler)
+	mux.HandleFunc("GET /buckets/{bucket}", server.ListKeysHandler)
+	mux.HandleFunc("DELETE /buckets/{bucket}", server.DeleteBucketHandler)
+	mux.HandleFunc("PUT /buckets/{bucket}/{key...}", server.PutKeyHandler)
+	mux.HandleFunc("GET /buckets/{bucket}/{key...}", server.GetKeyHandler)
+	mux.HandleFunc("DELETE /buckets/{bucket}/{key...}", server.DeleteKeyHandler)
+
+	// Admin endpoints require the admin token
+	adminToken := os.Getenv("CASKOS_ADMIN_TOKEN")
+	if adminToken == "" {
+		logger.Warn("admin API disabled; set CASKOS_ADMIN_TOKEN to enable it")
+	}
+	admin := func(handler http.HandlerFunc) http.HandlerFunc {
+		return api.AdminOnly(adminToken, handler)
+	}
+	mux.HandleFunc("GET /admin/rebalance", admin(server.RebalanceStatusHandler))
+	mux.HandleFunc("POST /admin/rebalance", admin(server.RebalanceHandler))
+	mux.HandleFunc("GET /admin/nodes", admin(server.ListNodesHandler))
+	mux.HandleFunc("POST /admin/nodes", admin(server.AddNodeHandler))
+	mux.HandleFunc("PUT /admin/nodes/{id}/weight", admin(server.SetNodeWeightHandler))
+	mux.HandleFunc("PUT /admin/nodes/{id}/labels", admin(server.SetNodeLabelsHandler))
+	mux.HandleFunc("PUT /admin/nodes/{id}/compression", admin(server.SetNodeCompressionHandler))
+	mux.HandleFunc("POST /admin/nodes/{id}/drain", admin(server.DrainNodeHandler))
+	mux.HandleFunc("DELETE /admin/nodes/{id}", admin(server.RemoveNodeHandler))
+	mux.HandleFunc("GET /admin/stats", admin(server.StatsHandler))
+	mux.HandleFunc("GET /admin/cluster", admin(server.ClusterStatusHandler))
+	mux.HandleFunc("POST /admin/keys/rotate", admin(server.RotateKeysHandler))
+
 	// Health check endpoint
-	mux.HandleFunc("GET /health", func(w http.ResponseWriter, r *http.Request) {
-		w.WriteHeader(http.StatusOK)
-		w.Write([]byte("OK"))
-	})
+	mux.HandleFunc("GET /health", server.HealthHandler)
 
 	// Serve static files for web UI (must be before root handler)
 	fs := http.FileServer(http.Dir("web/static"))
@@ -101,6 +346,40 @@ func main() {
 		Handler: mux,
 	}
 
+	// The S3 gateway listens on its own port, since it owns the whole path space
+	var s3Server *http.Server
+	if *s3Port != "" {
+		accessKey, secretKey := os.Getenv("CASKOS_S3_ACCESS_KEY"), os.Getenv("CASKOS_S3_SECRET_KEY")
+		if accessKey == "" || secretKey == "" {
+			logger.Error("CASKOS_S3_ACCESS_KEY and CASKOS_S3_SECRET_KEY must be set to enable the S3 API")
+			os.Exit(1)
+		}
+
+		gateway, err := api.NewS3Gateway(server, api.S3Config{
+			Region:      *s3Region,
+			Credentials: map[string]string{accessKey: secretKey},
+			StagingDir:  filepath.Join(*dataDir, "s3-uploads"),
+			UploadTTL:   *uploadTTL,
+		})
+		if err != nil {
+			logger.Error("failed to create S3 gateway", "error", err)
+			os.Exit(1)
+		}
+		go gateway.Run(ctx)
+
+		s3Server = &http.Server{
+			Addr:    fmt.Sprintf(":%s", *s3Port),
+			Handler: gateway,
+		}
+		go func() {
+			logger.Info("S3 gateway starting", "address", s3Server.Addr, "region", *s3Region)
+			if err := s3Server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				logger.Error("S3 gateway error", "error", err)
+				os.Exit(1)
+			}
+		}()
+	}
+
 	// Graceful shutdown
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
@@ -115,7 +394,84 @@ func main() {
 
 	<-sigChan
 	logger.Info("shutting down server")
+	cancel()
 	if err := httpServer.Shutdown(context.Background()); err != nil {
 		logger.Error("error shutting down server", "error", err)
 	}
+	if s3Server != nil {
+		if err := s3Server.Shutdown(context.Background()); err != nil {
+			logger.Error("error shutting down S3 gateway", "error", err)
+		}
+	}
+}
+
+// nodeRecords returns the nodes to start with. The -nodes flag seeds node1
+// to nodeN under the data directory and -remote-nodes seeds remote nodes;
+// once a membership file exists it is authoritative, so nodes added, drained
+// or removed at runtime keep their state, and seed nodes that were removed
+// stay removed.
+func nodeRecords(previous *storage.Membership, nodeCount int, dataDir string, remotes []storage.NodeRecord) []storage.NodeRecord {
+	var records []storage.NodeRecord
+	known := make(map[string]bool)
+	if previous != nil {
+		records = append(records, previous.Nodes...)
+		for _, record := range previous.Nodes {
+			known[record.ID] = true
+		}
+		for _, nodeID := range previous.Removed {
+			known[nodeID] = true
+		}
+	}
+
+	for i := 0; i < nodeCount; i++ {
+		nodeID := fmt.Sprintf("node%d", i+1)
+		if known[nodeID] {
+			continue
+		}
+		records = append(records, storage.NodeRecord{
+			ID:     nodeID,
+			Path:   filepath.Join(dataDir, nodeID),
+			State:  storage.NodeActive,
+			Weight: storage.DefaultWeight,
+		})
+	}
+
+	for _, remote := range remotes {
+		if !known[remote.ID] {
+			records = append(records, remote)
+		}
+	}
+
+	return records
+}
+
+// parseRemoteNodes parses the -remote-nodes flag, a comma-separated list of
+// id=url pairs
+func parseRemoteNodes(value string) ([]storage.NodeRecord, error) {
+	var records []storage.NodeRecord
+	seen := make(map[string]bool)
+	for _, pair := range strings.Split(value, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		nodeID, nodeURL, ok := strings.Cut(pair, "=")
+		if !ok || nodeID == "" || nodeURL == "" {
+			return nil, fmt.Errorf("expected id=url, got %q", pair)
+		}
+		if seen[nodeID] {
+			return nil, fmt.Errorf("duplicate node %s", nodeID)
+		}
+		if parsed, err := url.Parse(nodeURL); err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+			return nil, fmt.Errorf("invalid URL of node %s: %q", nodeID, nodeURL)
+		}
+		seen[nodeID] = true
+		records = append(records, storage.NodeRecord{
+			ID:     nodeID,
+			URL:    nodeURL,
+			State:  storage.NodeActive,
+			Weight: storage.DefaultWeight,
+		})
+	}
+	return records, nil
 }
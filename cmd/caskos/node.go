@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/caskos/caskos/internal/nodeapi"
+	"github.com/caskos/caskos/internal/storage"
+)
+
+const defaultNodePort = "9100"
+
+// runNode runs "caskos node": a single storage node served over the internal
+// node API, for a coordinator started with -remote-nodes to store replicas on
+func runNode(args []string) {
+	flags := flag.NewFlagSet("node", flag.ExitOnError)
+	nodeID := flags.String("id", "node1", "ID of the storage node")
+	port := flags.String("port", defaultNodePort, "HTTP port of the node API")
+	dataDir := flags.String("data-dir", "./data/node1", "Directory the node stores its objects in")
+	compression := flags.String("compression", "none", "Codec the node compresses new objects with: none or gzip")
+	keyFile := flags.String("key-file", "", "JSON file of master keys to encrypt new objects with (empty disables encryption)")
+	flags.Parse(args)
+
+	logger := slog.New(slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{
+		Level: slog.LevelInfo,
+	})).With("node_id", *nodeID)
+	slog.SetDefault(logger)
+
+	token := os.Getenv("CASKOS_NODE_TOKEN")
+	if token == "" {
+		logger.Warn("CASKOS_NODE_TOKEN is not set, the node API accepts unauthenticated requests")
+	}
+
+	codec, err := storage.ParseCodec(*compression)
+	if err != nil {
+		logger.Error("invalid compression", "error", err)
+		os.Exit(1)
+	}
+	node, err := storage.NewNode(*nodeID, *dataDir)
+	if err != nil {
+		logger.Error("failed to create storage node", "error", err)
+		os.Exit(1)
+	}
+	node.SetCompression(codec)
+	if *keyFile != "" {
+		keyring, err := storage.LoadKeyring(*keyFile)
+		if err != nil {
+			logger.Error("failed to load key file", "error", err)
+			os.Exit(1)
+		}
+		node.SetKeyring(keyring)
+		logger.Info("encryption at rest enabled", "active_key", keyring.Active())
+	}
+
+	httpServer := &http.Server{
+		Addr:    fmt.Sprintf(":%s", *port),
+		Handler: nodeapi.NewServer(node, token, logger),
+	}
+
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
+
+	go func() {
+		logger.Info("storage node starting", "address", httpServer.Addr, "path", *dataDir, "compression", codec.String())
+		if err := httpServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			logger.Error("server error", "error", err)
+			os.Exit(1)
+		}
+	}()
+
+	<-sigChan
+	logger.Info("shutting down storage node")
+	if err := httpServer.Shutdown(context.Background()); err != nil {
+		logger.Error("error shutting down storage node", "error", err)
+	}
+}
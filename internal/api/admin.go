@@ -0,0 +1,515 @@
+package api
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+
+	"github.com/caskos/caskos/internal/nodeapi"
+	"github.com/caskos/caskos/internal/storage"
+)
+
+// validNodeID restricts node IDs to names that are safe in paths and URLs
+var validNodeID = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+// addNodeRequest is the body of an add-node request
+type addNodeRequest struct {
+	ID          string            `json:"id"`
+	Path        string            `json:"path"`
+	URL         string            `json:"url"` // Address of a remote node, instead of a path
+	Weight      float64           `json:"weight"`
+	Labels      map[string]string `json:"labels"`
+	Compression string            `json:"compression"` // Empty for the server default
+}
+
+// setWeightRequest is the body of a set-weight request
+type setWeightRequest struct {
+	Weight float64 `json:"weight"`
+}
+
+// setCompressionRequest is the body of a set-compression request
+type setCompressionRequest struct {
+	Compression string `json:"compression"`
+}
+
+// setLabelsRequest is the body of a set-labels request
+type setLabelsRequest struct {
+	Labels map[string]string `json:"labels"`
+}
+
+// AdminOnly wraps an admin handler so it requires the admin token as a
+// bearer token. With no token configured, admin requests are refused.
+func AdminOnly(token string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if token == "" {
+			http.Error(w, "Admin API is disabled", http.StatusForbidden)
+			return
+		}
+		given := []byte(r.Header.Get("Authorization"))
+		if subtle.ConstantTimeCompare(given, []byte("Bearer "+token)) != 1 {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		handler(w, r)
+	}
+}
+
+// nodeStatus is a node as listed by ListNodesHandler
+type nodeStatus struct {
+	storage.NodeRecord
+	Share float64 `json:"share"` // Expected fraction of objects stored on the node
+}
+
+// ListNodesHandler lists the storage nodes with their states, weights and
+// expected share of the objects
+func (s *Server) ListNodesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	shares := s.storageManager.KeyspaceShares()
+	records := s.storageManager.Nodes()
+	nodes := make([]nodeStatus, 0, len(records))
+	for _, record := range records {
+		nodes = append(nodes, nodeStatus{NodeRecord: record, Share: shares[record.ID]})
+	}
+
+	s.respondWithJSON(w, nodes, http.StatusOK)
+}
+
+// AddNodeHandler adds a storage node, backed either by a new directory or by
+// a remote node process, and moves the objects the ring now places on it in
+// the background
+func (s *Server) AddNodeHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req addNodeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid request body: %v", err), http.StatusBadRequest)
+		return
+	}
+	if !validNodeID.MatchString(req.ID) {
+		http.Error(w, "Invalid node ID", http.StatusBadRequest)
+		return
+	}
+	if (req.Path == "") == (req.URL == "") {
+		http.Error(w, "Exactly one of node path or URL is required", http.StatusBadRequest)
+		return
+	}
+	if req.Weight == 0 {
+		req.Weight = storage.DefaultWeight
+	}
+	if !storage.ValidWeight(req.Weight) {
+		http.Error(w, fmt.Sprintf("Node weight must be positive and at most %g", storage.MaxWeight), http.StatusBadRequest)
+		return
+	}
+	if req.URL != "" && req.Compression != "" {
+		http.Error(w, "Compression of a remote node is set on the node itself", http.StatusBadRequest)
+		return
+	}
+	codec := s.storageManager.Compression()
+	if req.Compression != "" {
+		var err error
+		if codec, err = storage.ParseCodec(req.Compression); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid compression: %v", err), http.StatusBadRequest)
+			return
+		}
+	}
+	if _, exists := s.storageManager.Node(req.ID); exists {
+		http.Error(w, "Node already exists", http.StatusConflict)
+		return
+	}
+
+	var backend storage.Backend
+	if req.URL != "" {
+		// A remote node compresses with its own settings
+		client := nodeapi.NewClient(req.URL, s.nodeClients)
+		if err := client.Ping(); err != nil {
+			s.logger.Error("failed to reach remote node", "node_id", req.ID, "url", req.URL, "error", err)
+			http.Error(w, fmt.Sprintf("Failed to reach node: %v", err), http.StatusBadGateway)
+			return
+		}
+		backend = client
+	} else {
+		node, err := storage.NewNode(req.ID, req.Path)
+		if err != nil {
+			s.logger.Error("failed to create storage node", "node_id", req.ID, "error", err)
+			http.Error(w, fmt.Sprintf("Failed to create node: %v", err), http.StatusInternalServerError)
+			return
+		}
+		node.SetCompression(codec)
+		backend = node
+	}
+
+	if err := s.storageManager.JoinNode(req.ID, backend, req.Weight, req.Labels); err != nil {
+		s.logger.Error("failed to add storage node", "node_id", req.ID, "error", err)
+		http.Error(w, fmt.Sprintf("Failed to add node: %v", err), http.StatusConflict)
+		return
+	}
+
+	go func() {
+		if err := s.storageManager.Rebalance(context.Background(), storage.RebalanceOptions{
+			Filter: s.storageManager.PlacedOn(req.ID),
+		}); err != nil {
+			s.logger.Error("failed to move objects to new node", "node_id", req.ID, "error", err)
+		}
+	}()
+
+	record := storage.NodeRecord{
+		ID:     req.ID,
+		Path:   req.Path,
+		URL:    req.URL,
+		State:  storage.NodeActive,
+		Weight: req.Weight,
+		Labels: req.Labels,
+	}
+	if req.URL == "" {
+		record.Compression = codec.String()
+	}
+	s.respondWithJSON(w, record, http.StatusCreated)
+}
+
+// SetNodeWeightHandler changes the weight of a node and moves the objects
+// whose placement changed in the background
+func (s *Server) SetNodeWeightHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	nodeID := r.PathValue("id")
+	if _, exists := s.storageManager.Node(nodeID); !exists {
+		http.Error(w, "Node not found", http.StatusNotFound)
+		return
+	}
+
+	var req setWeightRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid request body: %v", err), http.StatusBadRequest)
+		return
+	}
+	if !storage.ValidWeight(req.Weight) {
+		http.Error(w, fmt.Sprintf("Node weight must be positive and at most %g", storage.MaxWeight), http.StatusBadRequest)
+		return
+	}
+
+	if err := s.storageManager.SetNodeWeight(nodeID, req.Weight); err != nil {
+		s.logger.Warn("failed to set node weight", "node_id", nodeID, "error", err)
+		http.Error(w, fmt.Sprintf("Failed to set node weight: %v", err), http.StatusConflict)
+		return
+	}
+
+	go func() {
+		if err := s.storageManager.Rebalance(context.Background(), storage.RebalanceOptions{
+			Filter: s.storageManager.HeldOrPlacedOn(nodeID),
+		}); err != nil {
+			s.logger.Error("failed to move objects after weight change", "node_id", nodeID, "error", err)
+		}
+	}()
+
+	s.respondWithJSON(w, map[string]interface{}{"id": nodeID, "weight": req.Weight}, http.StatusAccepted)
+}
+
+// SetNodeCompressionHandler changes the codec a node compresses new objects
+// with. Objects already stored keep theirs and are read either way.
+func (s *Server) SetNodeCompressionHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	nodeID := r.PathValue("id")
+	if _, exists := s.storageManager.Node(nodeID); !exists {
+		http.Error(w, "Node not found", http.StatusNotFound)
+		return
+	}
+
+	var req setCompressionRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid request body: %v", err), http.StatusBadRequest)
+		return
+	}
+	codec, err := storage.ParseCodec(req.Compression)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid compression: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	if err := s.storageManager.SetNodeCompression(nodeID, codec); err != nil {
+		s.logger.Warn("failed to set node compression", "node_id", nodeID, "error", err)
+		http.Error(w, fmt.Sprintf("Failed to set node compression: %v", err), http.StatusConflict)
+		return
+	}
+
+	s.respondWithJSON(w, map[string]interface{}{"id": nodeID, "compression": codec.String()}, http.StatusOK)
+}
+
+// SetNodeLabelsHandler replaces the failure domain labels of a node, such as
+// its zone, rack and disk. Labels affect how every object's replicas spread,
+// so a full rebalance is started in the background.
+func (s *Server) SetNodeLabelsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	nodeID := r.PathValue("id")
+	if _, exists := s.storageManager.Node(nodeID); !exists {
+		http.Error(w, "Node not found", http.StatusNotFound)
+		return
+	}
+
+	var req setLabelsRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid request body: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	if err := s.storageManager.SetNodeLabels(nodeID, req.Labels); err != nil {
+		s.logger.Warn("failed to set node labels", "node_id", nodeID, "error", err)
+		http.Error(w, fmt.Sprintf("Failed to set node labels: %v", err), http.StatusConflict)
+		return
+	}
+
+	go func() {
+		if err := s.storageManager.Rebalance(context.Background(), storage.RebalanceOptions{}); err != nil {
+			s.logger.Error("failed to move objects after label change", "node_id", nodeID, "error", err)
+		}
+	}()
+
+	s.respondWithJSON(w, map[string]interface{}{"id": nodeID, "labels": req.Labels}, http.StatusAccepted)
+}
+
+// DrainNodeHandler takes a node out of the ring and moves its objects to the
+// remaining nodes in the background. A node that cannot be drained is
+// refused with 409; otherwise its state in ListNodesHandler turns to drained
+// once it is empty.
+func (s *Server) DrainNodeHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	nodeID := r.PathValue("id")
+	if _, exists := s.storageManager.Node(nodeID); !exists {
+		http.Error(w, "Node not found", http.StatusNotFound)
+		return
+	}
+
+	if err := s.storageManager.StartDrain(nodeID); err != nil {
+		s.logger.Warn("failed to drain node", "node_id", nodeID, "error", err)
+		http.Error(w, fmt.Sprintf("Failed to drain node: %v", err), http.StatusConflict)
+		return
+	}
+
+	go func() {
+		if err := s.storageManager.MoveDrainedObjects(context.Background(), nodeID); err != nil {
+			s.logger.Error("failed to drain node", "node_id", nodeID, "error", err)
+		}
+	}()
+
+	s.respondWithJSON(w, map[string]string{"id": nodeID, "state": storage.NodeDraining}, http.StatusAccepted)
+}
+
+// RemoveNodeHandler removes a drained node. With ?force=true a node is removed
+// even if it still holds objects, relying on self-healing to restore replicas.
+func (s *Server) RemoveNodeHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	nodeID := r.PathValue("id")
+	if _, exists := s.storageManager.Node(nodeID); !exists {
+		http.Error(w, "Node not found", http.StatusNotFound)
+		return
+	}
+
+	force := r.URL.Query().Get("force") == "true"
+	if err := s.storageManager.RemoveNode(nodeID, force); err != nil {
+		s.logger.Warn("failed to remove node", "node_id", nodeID, "error", err)
+		http.Error(w, fmt.Sprintf("Failed to remove node: %v", err), http.StatusConflict)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// RebalanceHandler starts moving every object onto the nodes the hash ring
+// currently assigns to it. The rebalance runs in the background; its progress
+// is reported by RebalanceStatusHandler.
+func (s *Server) RebalanceHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if s.storageManager.RebalanceProgress().Running {
+		http.Error(w, "Rebalance already running", http.StatusConflict)
+		return
+	}
+
+	go func() {
+		if err := s.storageManager.Rebalance(context.Background(), storage.RebalanceOptions{}); err != nil {
+			s.logger.Error("rebalance failed", "error", err)
+		}
+	}()
+
+	s.respondWithJSON(w, map[string]string{"status": "started"}, http.StatusAccepted)
+}
+
+// RebalanceStatusHandler reports the progress of the current or last rebalance
+func (s *Server) RebalanceStatusHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	s.respondWithJSON(w, s.storageManager.RebalanceProgress(), http.StatusOK)
+}
+
+// Cluster statuses reported by HealthHandler and ClusterStatusHandler
+const (
+	clusterOK          = "ok"          // Every node is up
+	clusterDegraded    = "degraded"    // Some nodes are suspect or down, or too few are up to place every replica
+	clusterUnavailable = "unavailable" // No node can serve reads or writes
+)
+
+// clusterNode is a node as listed by ClusterStatusHandler
+type clusterNode struct {
+	storage.NodeRecord
+	Health storage.NodeHealth `json:"health"`
+}
+
+// clusterStatus sums up node health into a cluster status and the number of
+// nodes in each health state
+func (s *Server) clusterStatus(health map[string]storage.NodeHealth) (string, map[string]int) {
+	counts := map[string]int{storage.HealthUp: 0, storage.HealthSuspect: 0, storage.HealthDown: 0}
+	for _, nodeHealth := range health {
+		counts[nodeHealth.State]++
+	}
+
+	switch {
+	case counts[storage.HealthUp]+counts[storage.HealthSuspect] == 0:
+		return clusterUnavailable, counts
+	case counts[storage.HealthUp] < len(health) || counts[storage.HealthUp] < s.replication:
+		return clusterDegraded, counts
+	default:
+		return clusterOK, counts
+	}
+}
+
+// HealthHandler reports whether the service can serve requests, with the
+// number of nodes in each health state. It fails with 503 only if no node
+// can be used, so a load balancer keeps a degraded server in rotation.
+func (s *Server) HealthHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	status, counts := s.clusterStatus(s.storageManager.NodeHealth())
+	statusCode := http.StatusOK
+	if status == clusterUnavailable {
+		statusCode = http.StatusServiceUnavailable
+	}
+
+	s.respondWithJSON(w, map[string]interface{}{
+		"status": status,
+		"nodes":  counts,
+	}, statusCode)
+}
+
+// ClusterStatusHandler reports the cluster status and, for every node, its
+// membership and the outcome of its last health probe
+func (s *Server) ClusterStatusHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	health := s.storageManager.NodeHealth()
+	status, counts := s.clusterStatus(health)
+	records := s.storageManager.Nodes()
+	nodes := make([]clusterNode, 0, len(records))
+	for _, record := range records {
+		nodes = append(nodes, clusterNode{NodeRecord: record, Health: health[record.ID]})
+	}
+
+	s.respondWithJSON(w, map[string]interface{}{
+		"status":      status,
+		"replication": s.replication,
+		"counts":      counts,
+		"nodes":       nodes,
+	}, http.StatusOK)
+}
+
+// StatsHandler reports the logical size of the stored objects and the
+// physical size of the distinct chunks they are stored as, before
+// replication. The difference is what deduplication saves.
+func (s *Server) StatsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	stats := s.metadataStore.Stats()
+	ratio := 1.0
+	if stats.PhysicalBytes > 0 {
+		ratio = float64(stats.LogicalBytes) / float64(stats.PhysicalBytes)
+	}
+
+	s.respondWithJSON(w, map[string]interface{}{
+		"objects":        stats.Objects,
+		"chunks":         stats.Chunks,
+		"logical_bytes":  stats.LogicalBytes,
+		"physical_bytes": stats.PhysicalBytes,
+		"saved_bytes":    stats.LogicalBytes - stats.PhysicalBytes,
+		"dedup_ratio":    ratio,
+	}, http.StatusOK)
+}
+
+// RotateKeysHandler rewraps the data keys of encrypted objects with the active
+// master key after the key file was changed to make a new key active, and
+// seals the metadata files again with it. Object files are not rewritten, so
+// rotation only takes as long as reading and writing the small key and
+// metadata files.
+func (s *Server) RotateKeysHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	keyring := s.storageManager.Keyring()
+	if keyring == nil {
+		http.Error(w, "Encryption is not enabled", http.StatusConflict)
+		return
+	}
+
+	rewrapped, err := s.storageManager.RotateKeys()
+	if err != nil {
+		s.logger.Error("failed to rotate keys", "error", err)
+		http.Error(w, fmt.Sprintf("Failed to rotate keys: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	resealed, err := s.metadataStore.Reseal()
+	if err != nil {
+		s.logger.Error("failed to reseal metadata", "error", err)
+		http.Error(w, fmt.Sprintf("Failed to reseal metadata: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	s.respondWithJSON(w, map[string]interface{}{
+		"active_key": keyring.Active(),
+		"rewrapped":  rewrapped,
+		"resealed":   resealed,
+	}, http.StatusOK)
+}
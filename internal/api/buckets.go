@@ -0,0 +1,346 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"path"
+	"strconv"
+	"time"
+
+	"github.com/caskos/caskos/internal/metadata"
+	"github.com/caskos/caskos/internal/storage"
+)
+
+// maxListKeys is the largest page of keys a listing returns
+const maxListKeys = 1000
+
+// errContentMD5Mismatch is returned when content does not match the
+// Content-MD5 it was sent with
+var errContentMD5Mismatch = errors.New("content does not match Content-MD5")
+
+// ListBucketsHandler lists all buckets
+func (s *Server) ListBucketsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	buckets, err := s.metadataStore.ListBuckets()
+	if err != nil {
+		s.logger.Error("failed to list buckets", "error", err)
+		http.Error(w, fmt.Sprintf("Failed to list buckets: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if buckets == nil {
+		buckets = []metadata.Bucket{}
+	}
+
+	s.respondWithJSON(w, buckets, http.StatusOK)
+}
+
+// CreateBucketHandler creates an empty bucket. The durability header sets
+// the default durability of the objects written to it.
+func (s *Server) CreateBucketHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	name := r.PathValue("bucket")
+	if !metadata.ValidBucketName(name) {
+		http.Error(w, "Invalid bucket name", http.StatusBadRequest)
+		return
+	}
+	durability, err := requestDurability(r)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid %s header: %v", DurabilityHeader, err), http.StatusBadRequest)
+		return
+	}
+
+	bucket, err := s.metadataStore.CreateBucket(name, string(durability))
+	if errors.Is(err, metadata.ErrBucketExists) {
+		http.Error(w, "Bucket already exists", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		s.logger.Error("failed to create bucket", "bucket", name, "error", err)
+		http.Error(w, fmt.Sprintf("Failed to create bucket: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	s.logger.Info("created bucket", "bucket", name)
+	s.respondWithJSON(w, bucket, http.StatusCreated)
+}
+
+// DeleteBucketHandler deletes an empty bucket
+func (s *Server) DeleteBucketHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	name := r.PathValue("bucket")
+	if err := s.metadataStore.DeleteBucket(name); err != nil {
+		s.namespaceError(w, err, "Failed to delete bucket")
+		return
+	}
+
+	s.logger.Info("deleted bucket", "bucket", name)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ListKeysHandler lists the keys of a bucket in lexicographic order. The
+// prefix, delimiter, after and limit query parameters select a page; pass
+// the returned next value as after to continue.
+func (s *Server) ListKeysHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := r.URL.Query()
+	opts := metadata.ListOptions{
+		Prefix:    query.Get("prefix"),
+		Delimiter: query.Get("delimiter"),
+		After:     query.Get("after"),
+		Limit:     maxListKeys,
+	}
+	if value := query.Get("limit"); value != "" {
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit < 1 {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+		opts.Limit = min(limit, maxListKeys)
+	}
+
+	bucket := r.PathValue("bucket")
+	result, err := s.metadataStore.ListKeys(bucket, opts)
+	if err != nil {
+		s.namespaceError(w, err, "Failed to list keys")
+		return
+	}
+
+	keys := make([]map[string]interface{}, 0, len(result.Entries))
+	for i := range result.Entries {
+		keys = append(keys, keyResponse(&result.Entries[i]))
+	}
+	commonPrefixes := result.CommonPrefixes
+	if commonPrefixes == nil {
+		commonPrefixes = []string{}
+	}
+
+	s.respondWithJSON(w, map[string]interface{}{
+		"bucket":          bucket,
+		"keys":            keys,
+		"common_prefixes": commonPrefixes,
+		"truncated":       result.Truncated,
+		"next":            result.Next,
+	}, http.StatusOK)
+}
+
+// PutKeyHandler stores the request body under a key, replacing any earlier
+// content of the key. Content already stored under another key or ID is
+// not stored again.
+func (s *Server) PutKeyHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	bucket, key := r.PathValue("bucket"), r.PathValue("key")
+	if key == "" {
+		http.Error(w, "Key is required", http.StatusBadRequest)
+		return
+	}
+
+	consistency, err := requestConsistency(r)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid %s header: %v", ConsistencyHeader, err), http.StatusBadRequest)
+		return
+	}
+	durability, err := requestDurability(r)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid %s header: %v", DurabilityHeader, err), http.StatusBadRequest)
+		return
+	}
+
+	contentType := r.Header.Get("Content-Type")
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+
+	_, err = s.metadataStore.GetKey(bucket, key)
+	existed := err == nil
+	entry := &metadata.KeyEntry{Bucket: bucket, Key: key, ContentType: contentType}
+	result, err := s.putKey(r.Context(), entry, r.Body, consistency, durability, nil)
+	if err != nil {
+		s.putKeyError(w, err)
+		return
+	}
+
+	status := http.StatusCreated
+	if existed {
+		status = http.StatusOK
+	}
+	s.respondWithKeyPut(w, entry, result, status)
+}
+
+// GetKeyHandler serves the content of a key. It answers GET and HEAD and
+// supports ranges and conditional requests like GetObjectHandler, with the
+// content ID as ETag.
+func (s *Server) GetKeyHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	entry, err := s.metadataStore.GetKey(r.PathValue("bucket"), r.PathValue("key"))
+	if err != nil {
+		s.namespaceError(w, err, "Failed to get key")
+		return
+	}
+
+	reader, err := s.openObject(entry.ObjectID)
+	if err != nil {
+		s.logger.Error("key points at missing object", "bucket", entry.Bucket, "key", entry.Key, "object_id", entry.ObjectID, "error", err)
+		http.Error(w, "Object not found", http.StatusNotFound)
+		return
+	}
+	defer reader.Close()
+
+	w.Header().Set("Content-Type", entry.ContentType)
+	w.Header().Set("ETag", `"`+entry.ObjectID+`"`)
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("inline", map[string]string{"filename": path.Base(entry.Key)}))
+
+	http.ServeContent(w, r, "", entry.LastModified, reader)
+}
+
+// DeleteKeyHandler removes a key. The content is deleted along with the
+// last key pointing at it.
+func (s *Server) DeleteKeyHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	bucket, key := r.PathValue("bucket"), r.PathValue("key")
+	entry, err := s.metadataStore.DeleteKey(bucket, key)
+	if err != nil {
+		s.namespaceError(w, err, "Failed to delete key")
+		return
+	}
+
+	s.logger.Info("deleted key", "bucket", bucket, "key", key)
+	s.releaseObject(entry.ObjectID)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// putKey stores content and points a key at it. The caller sets the bucket,
+// key, content type and user metadata of entry, and may set the ETag; the
+// rest is filled in. An empty durability uses the bucket's. If expectedMD5
+// is set the content must match it, or the key is left alone.
+func (s *Server) putKey(ctx context.Context, entry *metadata.KeyEntry, data io.Reader, consistency storage.Consistency, durability storage.Durability, expectedMD5 []byte) (*storage.PutResult, error) {
+	// Fail before storing anything if the bucket is missing
+	bucket, err := s.metadataStore.GetBucket(entry.Bucket)
+	if err != nil {
+		return nil, err
+	}
+	if durability == "" {
+		durability = storage.Durability(bucket.Durability)
+	}
+
+	// The MD5 serves as the ETag S3 clients expect, computed alongside the
+	// SHA-256 that names the object
+	hasher := md5.New()
+	meta, result, created, err := s.putContent(ctx, io.TeeReader(data, hasher), entry.ContentType, consistency, durability)
+	if err != nil {
+		return nil, err
+	}
+	defer s.storageManager.ReleasePut(result)
+	if created {
+		// meta is not used once putKey returns, so repair may update it then
+		defer func() { go s.ensureReplication(meta.ID, meta) }()
+	}
+
+	sum := hasher.Sum(nil)
+	if expectedMD5 != nil && !bytes.Equal(sum, expectedMD5) {
+		return nil, errContentMD5Mismatch
+	}
+
+	entry.ObjectID = meta.ID
+	entry.Size = meta.Size
+	if entry.ETag == "" {
+		entry.ETag = hex.EncodeToString(sum)
+	}
+	entry.LastModified = time.Now()
+	previous, err := s.metadataStore.PutKey(entry)
+	if err != nil {
+		return nil, err
+	}
+
+	s.logger.Info("put key", "bucket", entry.Bucket, "key", entry.Key, "object_id", entry.ObjectID)
+	if previous != nil && previous.ObjectID != entry.ObjectID {
+		s.releaseObject(previous.ObjectID)
+	}
+	return result, nil
+}
+
+// putKeyError reports an error from putKey
+func (s *Server) putKeyError(w http.ResponseWriter, err error) {
+	var quorumErr *storage.QuorumError
+	switch {
+	case errors.As(err, &quorumErr):
+		s.logger.Error("failed to store object", "error", err)
+		http.Error(w, fmt.Sprintf("Failed to store object: %v", err), http.StatusServiceUnavailable)
+	case errors.Is(err, errContentMD5Mismatch):
+		http.Error(w, "Content does not match Content-MD5", http.StatusBadRequest)
+	default:
+		s.namespaceError(w, err, "Failed to store object")
+	}
+}
+
+// namespaceError reports an error from a bucket or key operation
+func (s *Server) namespaceError(w http.ResponseWriter, err error, message string) {
+	switch {
+	case errors.Is(err, metadata.ErrBucketNotFound):
+		http.Error(w, "Bucket not found", http.StatusNotFound)
+	case errors.Is(err, metadata.ErrKeyNotFound):
+		http.Error(w, "Key not found", http.StatusNotFound)
+	case errors.Is(err, metadata.ErrBucketNotEmpty):
+		http.Error(w, "Bucket is not empty", http.StatusConflict)
+	default:
+		s.logger.Error("namespace operation failed", "error", err)
+		http.Error(w, fmt.Sprintf("%s: %v", message, err), http.StatusInternalServerError)
+	}
+}
+
+// respondWithKeyPut sends a stored key as JSON response together with how
+// many replicas the write reached
+func (s *Server) respondWithKeyPut(w http.ResponseWriter, entry *metadata.KeyEntry, result *storage.PutResult, statusCode int) {
+	response := keyResponse(entry)
+	response["consistency"] = result.Consistency
+	response["replicas_written"] = len(result.Replicas)
+	response["replicas_required"] = result.Required
+	s.respondWithJSON(w, response, statusCode)
+}
+
+// keyResponse builds the JSON fields describing a key
+func keyResponse(entry *metadata.KeyEntry) map[string]interface{} {
+	return map[string]interface{}{
+		"bucket":        entry.Bucket,
+		"key":           entry.Key,
+		"id":            entry.ObjectID,
+		"size":          entry.Size,
+		"content_type":  entry.ContentType,
+		"etag":          entry.ETag,
+		"last_modified": entry.LastModified.Format(time.RFC3339),
+	}
+}
@@ -0,0 +1,720 @@
+package api
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/caskos/caskos/internal/metadata"
+	"github.com/caskos/caskos/internal/storage"
+	"github.com/caskos/caskos/internal/upload"
+)
+
+// s3Namespace is the XML namespace of S3 responses
+const s3Namespace = "http://s3.amazonaws.com/doc/2006-03-01/"
+
+// s3TimeFormat is the timestamp format used in S3 XML responses
+const s3TimeFormat = "2006-01-02T15:04:05.000Z"
+
+// maxS3Keys is the largest page a listing returns
+const maxS3Keys = 1000
+
+// s3Error is an S3 error response
+type s3Error struct {
+	Code    string
+	Message string
+	Status  int
+}
+
+// Error implements the error interface
+func (e *s3Error) Error() string {
+	return e.Code + ": " + e.Message
+}
+
+// s3Errorf returns a copy of an S3 error with a more specific message
+func s3Errorf(base *s3Error, format string, args ...interface{}) *s3Error {
+	return &s3Error{Code: base.Code, Message: fmt.Sprintf(format, args...), Status: base.Status}
+}
+
+// S3 errors returned by the gateway
+var (
+	errAccessDenied                      = &s3Error{"AccessDenied", "Access Denied", http.StatusForbidden}
+	errAuthorizationHeaderMalformed      = &s3Error{"AuthorizationHeaderMalformed", "The authorization header is malformed", http.StatusBadRequest}
+	errAuthorizationQueryParametersError = &s3Error{"AuthorizationQueryParametersError", "The presigned URL is malformed", http.StatusBadRequest}
+	errBadDigest                         = &s3Error{"BadDigest", "The Content-MD5 you specified did not match what we received", http.StatusBadRequest}
+	errBucketAlreadyOwnedByYou           = &s3Error{"BucketAlreadyOwnedByYou", "Your previous request to create the named bucket succeeded and you already own it", http.StatusConflict}
+	errBucketNotEmpty                    = &s3Error{"BucketNotEmpty", "The bucket you tried to delete is not empty", http.StatusConflict}
+	errExpiredRequest                    = &s3Error{"AccessDenied", "Request has expired", http.StatusForbidden}
+	errIncompleteBody                    = &s3Error{"IncompleteBody", "The request body is incomplete or malformed", http.StatusBadRequest}
+	errInternalError                     = &s3Error{"InternalError", "We encountered an internal error. Please try again.", http.StatusInternalServerError}
+	errInvalidAccessKeyID                = &s3Error{"InvalidAccessKeyId", "The access key ID you provided does not exist in our records", http.StatusForbidden}
+	errInvalidArgument                   = &s3Error{"InvalidArgument", "Invalid argument", http.StatusBadRequest}
+	errInvalidBucketName                 = &s3Error{"InvalidBucketName", "The specified bucket is not valid", http.StatusBadRequest}
+	errInvalidDigest                     = &s3Error{"InvalidDigest", "The Content-MD5 you specified is not valid", http.StatusBadRequest}
+	errInvalidPart                       = &s3Error{"InvalidPart", "One or more of the specified parts could not be found", http.StatusBadRequest}
+	errInvalidPartOrder                  = &s3Error{"InvalidPartOrder", "The list of parts was not in ascending order", http.StatusBadRequest}
+	errInvalidRequest                    = &s3Error{"InvalidRequest", "Invalid request", http.StatusBadRequest}
+	errMalformedXML                      = &s3Error{"MalformedXML", "The XML you provided was not well-formed", http.StatusBadRequest}
+	errMethodNotAllowed                  = &s3Error{"MethodNotAllowed", "The specified method is not allowed against this resource", http.StatusMethodNotAllowed}
+	errMissingContentLength              = &s3Error{"MissingContentLength", "You must provide the Content-Length HTTP header", http.StatusLengthRequired}
+	errNoSuchBucket                      = &s3Error{"NoSuchBucket", "The specified bucket does not exist", http.StatusNotFound}
+	errNoSuchKey                         = &s3Error{"NoSuchKey", "The specified key does not exist", http.StatusNotFound}
+	errNoSuchUpload                      = &s3Error{"NoSuchUpload", "The specified multipart upload does not exist", http.StatusNotFound}
+	errNotImplemented                    = &s3Error{"NotImplemented", "A header or query you provided implies functionality that is not implemented", http.StatusNotImplemented}
+	errRequestTimeTooSkewed              = &s3Error{"RequestTimeTooSkewed", "The difference between the request time and the server's time is too large", http.StatusForbidden}
+	errServiceUnavailable                = &s3Error{"ServiceUnavailable", "Not enough replicas could be written", http.StatusServiceUnavailable}
+	errSignatureDoesNotMatch             = &s3Error{"SignatureDoesNotMatch", "The request signature we calculated does not match the signature you provided", http.StatusForbidden}
+	errXAmzContentSHA256Mismatch         = &s3Error{"XAmzContentSHA256Mismatch", "The provided x-amz-content-sha256 header does not match what was computed", http.StatusBadRequest}
+)
+
+// S3Config configures the S3 gateway
+type S3Config struct {
+	Region      string            // Region clients sign requests for
+	Credentials map[string]string // Secret keys by access key ID
+	StagingDir  string            // Where multipart upload parts are kept until completed
+	UploadTTL   time.Duration     // Idle time after which a multipart upload is discarded
+}
+
+// S3Gateway serves a subset of the Amazon S3 API on top of the object store.
+// Requests use path-style addressing (/bucket/key) and must be signed with
+// AWS Signature Version 4. Keys map to content-addressed objects, so
+// identical content uploaded under different keys is stored once.
+type S3Gateway struct {
+	server      *Server
+	region      string
+	credentials map[string]string
+	uploads     *multipartUploads
+	now         func() time.Time
+}
+
+// NewS3Gateway creates an S3 gateway in front of an API server
+func NewS3Gateway(server *Server, config S3Config) (*S3Gateway, error) {
+	if len(config.Credentials) == 0 {
+		return nil, fmt.Errorf("at least one access key is required")
+	}
+	if config.Region == "" {
+		config.Region = "us-east-1"
+	}
+
+	if config.UploadTTL <= 0 {
+		config.UploadTTL = upload.DefaultTTL
+	}
+
+	uploads, err := newMultipartUploads(config.StagingDir, config.UploadTTL, server.storageManager.Keyring())
+	if err != nil {
+		return nil, err
+	}
+
+	return &S3Gateway{
+		server:      server,
+		region:      config.Region,
+		credentials: config.Credentials,
+		uploads:     uploads,
+		now:         time.Now,
+	}, nil
+}
+
+// Run removes abandoned multipart uploads periodically until the context is
+// cancelled
+func (g *S3Gateway) Run(ctx context.Context) {
+	interval := max(g.uploads.ttl/4, time.Second)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+
+		removed, err := g.uploads.expire(time.Now())
+		if err != nil {
+			g.server.logger.Error("failed to expire multipart uploads", "error", err)
+		}
+		if removed > 0 {
+			g.server.logger.Info("expired multipart uploads", "count", removed)
+		}
+	}
+}
+
+// ServeHTTP authenticates a request and dispatches it to the S3 operation
+// selected by its method, path and query
+func (g *S3Gateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Server", "CaskOS")
+	w.Header().Set("X-Amz-Request-Id", newRequestID())
+
+	if err := g.authenticate(r); err != nil {
+		g.writeError(w, r, err)
+		return
+	}
+
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	query := r.URL.Query()
+
+	var err error
+	switch {
+	case bucket == "":
+		if r.Method != http.MethodGet {
+			err = errMethodNotAllowed
+			break
+		}
+		err = g.listBuckets(w)
+	case key == "":
+		err = g.serveBucket(w, r, bucket, query)
+	default:
+		err = g.serveObject(w, r, bucket, key, query)
+	}
+
+	if err != nil {
+		g.writeError(w, r, err)
+	}
+}
+
+// serveBucket dispatches operations on a bucket
+func (g *S3Gateway) serveBucket(w http.ResponseWriter, r *http.Request, bucket string, query url.Values) error {
+	switch r.Method {
+	case http.MethodPut:
+		return g.createBucket(w, bucket)
+	case http.MethodDelete:
+		return g.deleteBucket(w, bucket)
+	case http.MethodHead:
+		if _, err := g.server.metadataStore.GetBucket(bucket); err != nil {
+			return namespaceError(err)
+		}
+		w.WriteHeader(http.StatusOK)
+		return nil
+	case http.MethodGet:
+		if query.Has("location") {
+			return g.getBucketLocation(w, bucket)
+		}
+		if query.Has("uploads") || query.Has("versioning") || query.Has("policy") || query.Has("acl") {
+			return errNotImplemented
+		}
+		if query.Get("list-type") == "2" {
+			return g.listObjects(w, bucket, query, true)
+		}
+		return g.listObjects(w, bucket, query, false)
+	default:
+		return errMethodNotAllowed
+	}
+}
+
+// serveObject dispatches operations on an object
+func (g *S3Gateway) serveObject(w http.ResponseWriter, r *http.Request, bucket, key string, query url.Values) error {
+	uploadID := query.Get("uploadId")
+	switch r.Method {
+	case http.MethodPut:
+		if uploadID != "" {
+			return g.uploadPart(w, r, bucket, key, uploadID, query.Get("partNumber"))
+		}
+		if r.Header.Get("X-Amz-Copy-Source") != "" {
+			return g.copyObject(w, r, bucket, key)
+		}
+		return g.putObject(w, r, bucket, key)
+	case http.MethodPost:
+		if query.Has("uploads") {
+			return g.createMultipartUpload(w, r, bucket, key)
+		}
+		if uploadID != "" {
+			return g.completeMultipartUpload(w, r, bucket, key, uploadID)
+		}
+		return errNotImplemented
+	case http.MethodGet, http.MethodHead:
+		if uploadID != "" && r.Method == http.MethodGet {
+			return g.listParts(w, bucket, key, uploadID)
+		}
+		return g.getObject(w, r, bucket, key)
+	case http.MethodDelete:
+		if uploadID != "" {
+			return g.abortMultipartUpload(w, bucket, key, uploadID)
+		}
+		return g.deleteObject(w, bucket, key)
+	default:
+		return errMethodNotAllowed
+	}
+}
+
+// XML documents of S3 responses
+type (
+	s3Owner struct {
+		ID          string `xml:"ID"`
+		DisplayName string `xml:"DisplayName"`
+	}
+
+	s3BucketEntry struct {
+		Name         string `xml:"Name"`
+		CreationDate string `xml:"CreationDate"`
+	}
+
+	listAllMyBucketsResult struct {
+		XMLName xml.Name        `xml:"ListAllMyBucketsResult"`
+		Xmlns   string          `xml:"xmlns,attr"`
+		Owner   s3Owner         `xml:"Owner"`
+		Buckets []s3BucketEntry `xml:"Buckets>Bucket"`
+	}
+
+	locationConstraint struct {
+		XMLName xml.Name `xml:"LocationConstraint"`
+		Xmlns   string   `xml:"xmlns,attr"`
+		Region  string   `xml:",chardata"`
+	}
+
+	s3Object struct {
+		Key          string `xml:"Key"`
+		LastModified string `xml:"LastModified"`
+		ETag         string `xml:"ETag"`
+		Size         int64  `xml:"Size"`
+		StorageClass string `xml:"StorageClass"`
+	}
+
+	s3CommonPrefix struct {
+		Prefix string `xml:"Prefix"`
+	}
+
+	// listBucketResult serves both ListObjects and ListObjectsV2; fields
+	// that belong to only one of them are omitted when empty
+	listBucketResult struct {
+		XMLName               xml.Name         `xml:"ListBucketResult"`
+		Xmlns                 string           `xml:"xmlns,attr"`
+		Name                  string           `xml:"Name"`
+		Prefix                string           `xml:"Prefix"`
+		Marker                *string          `xml:"Marker,omitempty"`
+		NextMarker            string           `xml:"NextMarker,omitempty"`
+		ContinuationToken     string           `xml:"ContinuationToken,omitempty"`
+		NextContinuationToken string           `xml:"NextContinuationToken,omitempty"`
+		StartAfter            string           `xml:"StartAfter,omitempty"`
+		KeyCount              *int             `xml:"KeyCount,omitempty"`
+		MaxKeys               int              `xml:"MaxKeys"`
+		Delimiter             string           `xml:"Delimiter,omitempty"`
+		EncodingType          string           `xml:"EncodingType,omitempty"`
+		IsTruncated           bool             `xml:"IsTruncated"`
+		Contents              []s3Object       `xml:"Contents"`
+		CommonPrefixes        []s3CommonPrefix `xml:"CommonPrefixes"`
+	}
+
+	copyObjectResult struct {
+		XMLName      xml.Name `xml:"CopyObjectResult"`
+		Xmlns        string   `xml:"xmlns,attr"`
+		LastModified string   `xml:"LastModified"`
+		ETag         string   `xml:"ETag"`
+	}
+
+	s3ErrorResponse struct {
+		XMLName   xml.Name `xml:"Error"`
+		Code      string   `xml:"Code"`
+		Message   string   `xml:"Message"`
+		Resource  string   `xml:"Resource"`
+		RequestID string   `xml:"RequestId"`
+	}
+)
+
+// listBuckets lists every bucket
+func (g *S3Gateway) listBuckets(w http.ResponseWriter) error {
+	buckets, err := g.server.metadataStore.ListBuckets()
+	if err != nil {
+		return err
+	}
+
+	result := listAllMyBucketsResult{
+		Xmlns:   s3Namespace,
+		Owner:   s3Owner{ID: "caskos", DisplayName: "caskos"},
+		Buckets: make([]s3BucketEntry, 0, len(buckets)),
+	}
+	for _, bucket := range buckets {
+		result.Buckets = append(result.Buckets, s3BucketEntry{
+			Name:         bucket.Name,
+			CreationDate: bucket.CreatedAt.UTC().Format(s3TimeFormat),
+		})
+	}
+
+	return g.writeXML(w, result, http.StatusOK)
+}
+
+// createBucket creates a bucket. Any location constraint in the body is
+// ignored, since the cluster has a single region.
+func (g *S3Gateway) createBucket(w http.ResponseWriter, bucket string) error {
+	if !metadata.ValidBucketName(bucket) {
+		return errInvalidBucketName
+	}
+
+	if _, err := g.server.metadataStore.CreateBucket(bucket, ""); err != nil {
+		if errors.Is(err, metadata.ErrBucketExists) {
+			return errBucketAlreadyOwnedByYou
+		}
+		return err
+	}
+
+	g.server.logger.Info("created bucket", "bucket", bucket)
+	w.Header().Set("Location", "/"+bucket)
+	w.WriteHeader(http.StatusOK)
+	return nil
+}
+
+// deleteBucket deletes an empty bucket
+func (g *S3Gateway) deleteBucket(w http.ResponseWriter, bucket string) error {
+	if err := g.server.metadataStore.DeleteBucket(bucket); err != nil {
+		if errors.Is(err, metadata.ErrBucketNotEmpty) {
+			return errBucketNotEmpty
+		}
+		return namespaceError(err)
+	}
+
+	g.server.logger.Info("deleted bucket", "bucket", bucket)
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// getBucketLocation reports the region of a bucket; us-east-1 is reported
+// as an empty constraint, as S3 does
+func (g *S3Gateway) getBucketLocation(w http.ResponseWriter, bucket string) error {
+	if _, err := g.server.metadataStore.GetBucket(bucket); err != nil {
+		return namespaceError(err)
+	}
+
+	region := g.region
+	if region == "us-east-1" {
+		region = ""
+	}
+	return g.writeXML(w, locationConstraint{Xmlns: s3Namespace, Region: region}, http.StatusOK)
+}
+
+// listObjects serves ListObjects and, when v2 is set, ListObjectsV2
+func (g *S3Gateway) listObjects(w http.ResponseWriter, bucket string, query url.Values, v2 bool) error {
+	maxKeys := maxS3Keys
+	if value := query.Get("max-keys"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			return s3Errorf(errInvalidArgument, "max-keys must be a non-negative integer")
+		}
+		maxKeys = min(n, maxS3Keys)
+	}
+
+	encodeURL := false
+	switch query.Get("encoding-type") {
+	case "":
+	case "url":
+		encodeURL = true
+	default:
+		return s3Errorf(errInvalidArgument, "invalid encoding-type")
+	}
+	encode := func(s string) string {
+		if encodeURL {
+			return url.QueryEscape(s)
+		}
+		return s
+	}
+
+	opts := metadata.ListOptions{
+		Prefix:    query.Get("prefix"),
+		Delimiter: query.Get("delimiter"),
+		Limit:     maxKeys,
+	}
+	result := listBucketResult{
+		Xmlns:     s3Namespace,
+		Name:      bucket,
+		Prefix:    encode(opts.Prefix),
+		MaxKeys:   maxKeys,
+		Delimiter: encode(opts.Delimiter),
+	}
+	if encodeURL {
+		result.EncodingType = "url"
+	}
+
+	if v2 {
+		result.StartAfter = encode(query.Get("start-after"))
+		opts.After = query.Get("start-after")
+		if token := query.Get("continuation-token"); token != "" {
+			after, err := base64.URLEncoding.DecodeString(token)
+			if err != nil {
+				return s3Errorf(errInvalidArgument, "the continuation token provided is incorrect")
+			}
+			result.ContinuationToken = token
+			opts.After = string(after)
+		}
+	} else {
+		marker := query.Get("marker")
+		result.Marker = &marker
+		opts.After = marker
+	}
+
+	// A zero limit would mean unlimited to the store
+	var page *metadata.ListResult
+	if maxKeys == 0 {
+		if _, err := g.server.metadataStore.GetBucket(bucket); err != nil {
+			return namespaceError(err)
+		}
+		page = &metadata.ListResult{}
+	} else {
+		var err error
+		page, err = g.server.metadataStore.ListKeys(bucket, opts)
+		if err != nil {
+			return namespaceError(err)
+		}
+	}
+
+	for _, entry := range page.Entries {
+		result.Contents = append(result.Contents, s3Object{
+			Key:          encode(entry.Key),
+			LastModified: entry.LastModified.UTC().Format(s3TimeFormat),
+			ETag:         `"` + entry.ETag + `"`,
+			Size:         entry.Size,
+			StorageClass: "STANDARD",
+		})
+	}
+	for _, prefix := range page.CommonPrefixes {
+		result.CommonPrefixes = append(result.CommonPrefixes, s3CommonPrefix{Prefix: encode(prefix)})
+	}
+
+	result.IsTruncated = page.Truncated
+	if v2 {
+		count := len(page.Entries) + len(page.CommonPrefixes)
+		result.KeyCount = &count
+		if page.Truncated {
+			result.NextContinuationToken = base64.URLEncoding.EncodeToString([]byte(page.Next))
+		}
+	} else if page.Truncated {
+		result.NextMarker = encode(page.Next)
+	}
+
+	return g.writeXML(w, result, http.StatusOK)
+}
+
+// putObject stores the request body under a key
+func (g *S3Gateway) putObject(w http.ResponseWriter, r *http.Request, bucket, key string) error {
+	consistency, err := requestConsistency(r)
+	if err != nil {
+		return s3Errorf(errInvalidArgument, "%v", err)
+	}
+	durability, err := requestDurability(r)
+	if err != nil {
+		return s3Errorf(errInvalidArgument, "%v", err)
+	}
+
+	expectedMD5, err := contentMD5(r)
+	if err != nil {
+		return err
+	}
+
+	entry := &metadata.KeyEntry{
+		Bucket:       bucket,
+		Key:          key,
+		ContentType:  requestContentType(r),
+		UserMetadata: userMetadata(r.Header),
+	}
+	if _, err := g.server.putKey(r.Context(), entry, r.Body, consistency, durability, expectedMD5); err != nil {
+		return putError(err)
+	}
+
+	w.Header().Set("ETag", `"`+entry.ETag+`"`)
+	w.WriteHeader(http.StatusOK)
+	return nil
+}
+
+// copyObject points a key at the object of another key. The content is not
+// copied, only the key entry.
+func (g *S3Gateway) copyObject(w http.ResponseWriter, r *http.Request, bucket, key string) error {
+	source, err := url.PathUnescape(r.Header.Get("X-Amz-Copy-Source"))
+	if err != nil {
+		return s3Errorf(errInvalidArgument, "invalid copy source")
+	}
+	source, _, _ = strings.Cut(strings.TrimPrefix(source, "/"), "?")
+	sourceBucket, sourceKey, ok := strings.Cut(source, "/")
+	if !ok || sourceKey == "" {
+		return s3Errorf(errInvalidArgument, "copy source must be bucket/key")
+	}
+
+	entry, err := g.server.metadataStore.GetKey(sourceBucket, sourceKey)
+	if err != nil {
+		return namespaceError(err)
+	}
+
+	switch directive := r.Header.Get("X-Amz-Metadata-Directive"); directive {
+	case "", "COPY":
+		if sourceBucket == bucket && sourceKey == key {
+			return s3Errorf(errInvalidRequest, "copying an object onto itself requires the REPLACE metadata directive")
+		}
+	case "REPLACE":
+		entry.ContentType = requestContentType(r)
+		entry.UserMetadata = userMetadata(r.Header)
+	default:
+		return s3Errorf(errInvalidArgument, "unknown metadata directive %q", directive)
+	}
+
+	entry.Bucket = bucket
+	entry.Key = key
+	entry.LastModified = time.Now()
+	previous, err := g.server.metadataStore.PutKey(entry)
+	if err != nil {
+		return namespaceError(err)
+	}
+
+	g.server.logger.Info("copied key", "bucket", bucket, "key", key, "source", source, "object_id", entry.ObjectID)
+	if previous != nil && previous.ObjectID != entry.ObjectID {
+		g.server.releaseObject(previous.ObjectID)
+	}
+	return g.writeXML(w, copyObjectResult{
+		Xmlns:        s3Namespace,
+		LastModified: entry.LastModified.UTC().Format(s3TimeFormat),
+		ETag:         `"` + entry.ETag + `"`,
+	}, http.StatusOK)
+}
+
+// getObject serves GET and HEAD for a key, with ranges and conditional
+// requests handled as for native objects
+func (g *S3Gateway) getObject(w http.ResponseWriter, r *http.Request, bucket, key string) error {
+	entry, err := g.server.metadataStore.GetKey(bucket, key)
+	if err != nil {
+		return namespaceError(err)
+	}
+
+	reader, err := g.server.openObject(entry.ObjectID)
+	if err != nil {
+		g.server.logger.Error("key points at missing object", "bucket", bucket, "key", key, "object_id", entry.ObjectID, "error", err)
+		return errInternalError
+	}
+	defer reader.Close()
+
+	header := w.Header()
+	header.Set("Content-Type", entry.ContentType)
+	header.Set("ETag", `"`+entry.ETag+`"`)
+	for name, value := range entry.UserMetadata {
+		header.Set("X-Amz-Meta-"+name, value)
+	}
+
+	http.ServeContent(w, r, "", entry.LastModified, reader)
+	return nil
+}
+
+// deleteObject removes a key. Like S3 it succeeds for keys that do not
+// exist. The content is deleted along with the last key pointing at it.
+func (g *S3Gateway) deleteObject(w http.ResponseWriter, bucket, key string) error {
+	entry, err := g.server.metadataStore.DeleteKey(bucket, key)
+	if err != nil && !errors.Is(err, metadata.ErrKeyNotFound) {
+		return namespaceError(err)
+	}
+
+	g.server.logger.Info("deleted key", "bucket", bucket, "key", key)
+	if entry != nil {
+		g.server.releaseObject(entry.ObjectID)
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// writeXML sends a value as XML response
+func (g *S3Gateway) writeXML(w http.ResponseWriter, value interface{}, statusCode int) error {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(statusCode)
+
+	io.WriteString(w, xml.Header)
+	if err := xml.NewEncoder(w).Encode(value); err != nil {
+		g.server.logger.Error("failed to encode response", "error", err)
+	}
+	return nil
+}
+
+// writeError sends an S3 error response. Errors that are not S3 errors are
+// logged and reported as internal errors.
+func (g *S3Gateway) writeError(w http.ResponseWriter, r *http.Request, err error) {
+	var s3Err *s3Error
+	if !errors.As(err, &s3Err) {
+		g.server.logger.Error("s3 request failed", "method", r.Method, "path", r.URL.Path, "error", err)
+		s3Err = errInternalError
+	} else if s3Err.Status >= http.StatusInternalServerError {
+		g.server.logger.Error("s3 request failed", "method", r.Method, "path", r.URL.Path, "error", err)
+	}
+
+	if r.Method == http.MethodHead {
+		w.WriteHeader(s3Err.Status)
+		return
+	}
+
+	g.writeXML(w, s3ErrorResponse{
+		Code:      s3Err.Code,
+		Message:   s3Err.Message,
+		Resource:  r.URL.Path,
+		RequestID: w.Header().Get("X-Amz-Request-Id"),
+	}, s3Err.Status)
+}
+
+// namespaceError translates bucket and key errors to S3 errors
+func namespaceError(err error) error {
+	switch {
+	case errors.Is(err, metadata.ErrBucketNotFound):
+		return errNoSuchBucket
+	case errors.Is(err, metadata.ErrKeyNotFound):
+		return errNoSuchKey
+	default:
+		return err
+	}
+}
+
+// putError translates errors from storing content to S3 errors
+func putError(err error) error {
+	var s3Err *s3Error
+	var quorumErr *storage.QuorumError
+	switch {
+	case errors.As(err, &s3Err):
+		return s3Err
+	case errors.As(err, &quorumErr):
+		return s3Errorf(errServiceUnavailable, "%v", quorumErr)
+	case errors.Is(err, errContentMD5Mismatch):
+		return errBadDigest
+	default:
+		return namespaceError(err)
+	}
+}
+
+// contentMD5 decodes the optional Content-MD5 header of a request
+func contentMD5(r *http.Request) ([]byte, error) {
+	header := r.Header.Get("Content-MD5")
+	if header == "" {
+		return nil, nil
+	}
+	sum, err := base64.StdEncoding.DecodeString(header)
+	if err != nil || len(sum) != md5.Size {
+		return nil, errInvalidDigest
+	}
+	return sum, nil
+}
+
+// requestContentType returns the content type of an upload, defaulting as S3 does
+func requestContentType(r *http.Request) string {
+	if contentType := r.Header.Get("Content-Type"); contentType != "" {
+		return contentType
+	}
+	return "binary/octet-stream"
+}
+
+// userMetadata collects the x-amz-meta-* headers of a request, keyed by the
+// lowercase name without the prefix
+func userMetadata(header http.Header) map[string]string {
+	var meta map[string]string
+	for name, values := range header {
+		suffix, ok := strings.CutPrefix(strings.ToLower(name), "x-amz-meta-")
+		if !ok || len(values) == 0 {
+			continue
+		}
+		if meta == nil {
+			meta = make(map[string]string)
+		}
+		meta[suffix] = strings.Join(values, ",")
+	}
+	return meta
+}
+
+// newRequestID returns a random identifier for a request or upload
+func newRequestID() string {
+	var b [12]byte
+	rand.Read(b[:])
+	return strings.ToUpper(hex.EncodeToString(b[:]))
+}
@@ -0,0 +1,514 @@
+package api
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Values used by AWS Signature Version 4
+const (
+	sigV4Algorithm           = "AWS4-HMAC-SHA256"
+	sigV4TimeFormat          = "20060102T150405Z"
+	sigV4DateFormat          = "20060102"
+	unsignedPayload          = "UNSIGNED-PAYLOAD"
+	streamingSignedPayload   = "STREAMING-AWS4-HMAC-SHA256-PAYLOAD"
+	streamingUnsignedTrailer = "STREAMING-UNSIGNED-PAYLOAD-TRAILER"
+	emptySHA256              = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+	maxClockSkew             = 15 * time.Minute
+	maxPresignExpiry         = 7 * 24 * time.Hour
+)
+
+// sigV4Auth is the parsed authentication of a request, from either the
+// Authorization header or the query string of a presigned URL
+type sigV4Auth struct {
+	accessKey     string
+	date          string // Day of the credential scope, YYYYMMDD
+	region        string
+	service       string
+	signedHeaders []string
+	signature     string
+	amzDate       time.Time
+	payloadHash   string
+	presigned     bool
+	expires       time.Duration
+}
+
+// scope returns the credential scope the signature is bound to
+func (a *sigV4Auth) scope() string {
+	return a.date + "/" + a.region + "/" + a.service + "/aws4_request"
+}
+
+// authenticate verifies the SigV4 signature of a request. On success the
+// request body is replaced by a reader that verifies the signed payload hash
+// or decodes an aws-chunked body, so a tampered body fails while it is read.
+func (g *S3Gateway) authenticate(r *http.Request) error {
+	var auth *sigV4Auth
+	var err error
+	if r.URL.Query().Has("X-Amz-Algorithm") {
+		auth, err = parsePresignedAuth(r)
+	} else {
+		auth, err = parseHeaderAuth(r)
+	}
+	if err != nil {
+		return err
+	}
+
+	secret, ok := g.credentials[auth.accessKey]
+	if !ok {
+		return errInvalidAccessKeyID
+	}
+	if auth.region != g.region || auth.service != "s3" {
+		return s3Errorf(errAuthorizationHeaderMalformed, "the credential scope must be for region %q and service s3", g.region)
+	}
+	if auth.amzDate.Format(sigV4DateFormat) != auth.date {
+		return s3Errorf(errAuthorizationHeaderMalformed, "the credential date does not match the request date")
+	}
+
+	now := g.now()
+	if auth.presigned {
+		if now.After(auth.amzDate.Add(auth.expires)) {
+			return errExpiredRequest
+		}
+		if auth.amzDate.After(now.Add(maxClockSkew)) {
+			return errRequestTimeTooSkewed
+		}
+	} else if d := now.Sub(auth.amzDate); d > maxClockSkew || d < -maxClockSkew {
+		return errRequestTimeTooSkewed
+	}
+
+	signingKey := sigV4SigningKey(secret, auth.date, auth.region, auth.service)
+	canonical := canonicalRequest(r, auth)
+	stringToSign := strings.Join([]string{
+		sigV4Algorithm,
+		auth.amzDate.Format(sigV4TimeFormat),
+		auth.scope(),
+		sha256Hex([]byte(canonical)),
+	}, "\n")
+	expected := hex.EncodeToString(hmacSHA256(signingKey, stringToSign))
+	if !hmac.Equal([]byte(expected), []byte(auth.signature)) {
+		return errSignatureDoesNotMatch
+	}
+
+	switch auth.payloadHash {
+	case unsignedPayload:
+	case streamingSignedPayload, streamingUnsignedTrailer:
+		var signer *chunkSigner
+		if auth.payloadHash == streamingSignedPayload {
+			signer = &chunkSigner{
+				key:      signingKey,
+				amzDate:  auth.amzDate.Format(sigV4TimeFormat),
+				scope:    auth.scope(),
+				previous: auth.signature,
+			}
+		}
+		// The decoded length is what the object's size must come to
+		decoded, err := strconv.ParseInt(r.Header.Get("X-Amz-Decoded-Content-Length"), 10, 64)
+		if err != nil || decoded < 0 {
+			return s3Errorf(errMissingContentLength, "a valid X-Amz-Decoded-Content-Length header is required")
+		}
+		r.Body = newChunkedReader(r.Body, signer, decoded)
+		r.ContentLength = decoded
+	default:
+		if len(auth.payloadHash) != sha256.Size*2 {
+			return s3Errorf(errNotImplemented, "payload signing mode %s is not supported", auth.payloadHash)
+		}
+		r.Body = &payloadHashReader{ReadCloser: r.Body, hasher: sha256.New(), expected: auth.payloadHash}
+	}
+
+	return nil
+}
+
+// parseHeaderAuth parses an Authorization header of the form
+// "AWS4-HMAC-SHA256 Credential=..., SignedHeaders=..., Signature=..."
+func parseHeaderAuth(r *http.Request) (*sigV4Auth, error) {
+	header := r.Header.Get("Authorization")
+	if header == "" {
+		return nil, errAccessDenied
+	}
+	algorithm, params, ok := strings.Cut(header, " ")
+	if !ok || algorithm != sigV4Algorithm {
+		return nil, s3Errorf(errAuthorizationHeaderMalformed, "only %s is supported", sigV4Algorithm)
+	}
+
+	fields := make(map[string]string)
+	for _, field := range strings.Split(params, ",") {
+		name, value, _ := strings.Cut(strings.TrimSpace(field), "=")
+		fields[name] = value
+	}
+
+	auth := &sigV4Auth{
+		signature:   fields["Signature"],
+		payloadHash: r.Header.Get("X-Amz-Content-Sha256"),
+	}
+	if err := auth.parseCredential(fields["Credential"]); err != nil {
+		return nil, err
+	}
+	if fields["SignedHeaders"] == "" || auth.signature == "" {
+		return nil, s3Errorf(errAuthorizationHeaderMalformed, "the authorization header is incomplete")
+	}
+	auth.signedHeaders = strings.Split(fields["SignedHeaders"], ";")
+	if auth.payloadHash == "" {
+		return nil, s3Errorf(errInvalidRequest, "missing required header x-amz-content-sha256")
+	}
+	// The payload hash is only trusted if the signature covers it
+	if !slices.Contains(auth.signedHeaders, "host") || !slices.Contains(auth.signedHeaders, "x-amz-content-sha256") {
+		return nil, s3Errorf(errAuthorizationHeaderMalformed, "host and x-amz-content-sha256 must be signed")
+	}
+
+	amzDate := r.Header.Get("X-Amz-Date")
+	if amzDate == "" {
+		amzDate = r.Header.Get("Date")
+	}
+	date, err := time.Parse(sigV4TimeFormat, amzDate)
+	if err != nil {
+		return nil, s3Errorf(errAccessDenied, "missing or invalid x-amz-date header")
+	}
+	auth.amzDate = date
+
+	return auth, nil
+}
+
+// parsePresignedAuth parses the X-Amz-* query parameters of a presigned URL
+func parsePresignedAuth(r *http.Request) (*sigV4Auth, error) {
+	query := r.URL.Query()
+	if query.Get("X-Amz-Algorithm") != sigV4Algorithm {
+		return nil, s3Errorf(errAuthorizationQueryParametersError, "only %s is supported", sigV4Algorithm)
+	}
+
+	auth := &sigV4Auth{
+		signature:   query.Get("X-Amz-Signature"),
+		payloadHash: unsignedPayload,
+		presigned:   true,
+	}
+	if hash := query.Get("X-Amz-Content-Sha256"); hash != "" {
+		auth.payloadHash = hash
+	}
+	if err := auth.parseCredential(query.Get("X-Amz-Credential")); err != nil {
+		return nil, err
+	}
+	if query.Get("X-Amz-SignedHeaders") == "" || auth.signature == "" {
+		return nil, s3Errorf(errAuthorizationQueryParametersError, "the presigned URL is incomplete")
+	}
+	auth.signedHeaders = strings.Split(query.Get("X-Amz-SignedHeaders"), ";")
+	if !slices.Contains(auth.signedHeaders, "host") {
+		return nil, s3Errorf(errAuthorizationQueryParametersError, "host must be signed")
+	}
+
+	date, err := time.Parse(sigV4TimeFormat, query.Get("X-Amz-Date"))
+	if err != nil {
+		return nil, s3Errorf(errAuthorizationQueryParametersError, "invalid X-Amz-Date")
+	}
+	auth.amzDate = date
+
+	seconds, err := strconv.Atoi(query.Get("X-Amz-Expires"))
+	if err != nil || seconds < 0 || time.Duration(seconds)*time.Second > maxPresignExpiry {
+		return nil, s3Errorf(errAuthorizationQueryParametersError, "X-Amz-Expires must be between 0 and 604800 seconds")
+	}
+	auth.expires = time.Duration(seconds) * time.Second
+
+	return auth, nil
+}
+
+// parseCredential parses "<access key>/<date>/<region>/<service>/aws4_request"
+func (a *sigV4Auth) parseCredential(credential string) error {
+	parts := strings.Split(credential, "/")
+	if len(parts) != 5 || parts[4] != "aws4_request" {
+		return s3Errorf(errAuthorizationHeaderMalformed, "invalid credential %q", credential)
+	}
+	a.accessKey, a.date, a.region, a.service = parts[0], parts[1], parts[2], parts[3]
+	return nil
+}
+
+// canonicalRequest builds the SigV4 canonical form of a request
+func canonicalRequest(r *http.Request, auth *sigV4Auth) string {
+	path := r.URL.Path
+	if path == "" {
+		path = "/"
+	}
+
+	// Query parameters sorted by name and then value, excluding the signature itself
+	var params []string
+	for name, values := range r.URL.Query() {
+		if auth.presigned && name == "X-Amz-Signature" {
+			continue
+		}
+		for _, value := range values {
+			params = append(params, awsURIEncode(name, true)+"="+awsURIEncode(value, true))
+		}
+	}
+	sort.Strings(params)
+
+	var headers strings.Builder
+	for _, name := range auth.signedHeaders {
+		var value string
+		if name == "host" {
+			value = r.Host
+		} else {
+			values := r.Header.Values(name)
+			for i := range values {
+				values[i] = strings.Join(strings.Fields(values[i]), " ")
+			}
+			value = strings.Join(values, ",")
+		}
+		headers.WriteString(name + ":" + value + "\n")
+	}
+
+	return strings.Join([]string{
+		r.Method,
+		awsURIEncode(path, false),
+		strings.Join(params, "&"),
+		headers.String(),
+		strings.Join(auth.signedHeaders, ";"),
+		auth.payloadHash,
+	}, "\n")
+}
+
+// awsURIEncode percent-encodes every byte except the unreserved characters,
+// and slashes unless encodeSlash is set, as SigV4 requires
+func awsURIEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// sigV4SigningKey derives the key that signs requests for one day, region and service
+func sigV4SigningKey(secret, date, region, service string) []byte {
+	key := hmacSHA256([]byte("AWS4"+secret), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+	return hmacSHA256(key, "aws4_request")
+}
+
+// hmacSHA256 returns the HMAC-SHA256 of data under key
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// sha256Hex returns the hex-encoded SHA-256 of data
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// payloadHashReader checks a body against the SHA-256 it was signed with
+// once it has been read to the end
+type payloadHashReader struct {
+	io.ReadCloser
+	hasher   hash.Hash
+	expected string
+}
+
+func (r *payloadHashReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.hasher.Write(p[:n])
+	if err == io.EOF && hex.EncodeToString(r.hasher.Sum(nil)) != r.expected {
+		return n, errXAmzContentSHA256Mismatch
+	}
+	return n, err
+}
+
+// chunkSigner verifies the chain of chunk signatures of a streaming upload.
+// Each chunk is signed over the previous signature, starting from the
+// signature of the request itself.
+type chunkSigner struct {
+	key      []byte
+	amzDate  string
+	scope    string
+	previous string
+}
+
+// verify checks the signature of the next chunk given the hash of its data
+func (s *chunkSigner) verify(signature string, chunkHash []byte) bool {
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256-PAYLOAD",
+		s.amzDate,
+		s.scope,
+		s.previous,
+		emptySHA256,
+		hex.EncodeToString(chunkHash),
+	}, "\n")
+	expected := hex.EncodeToString(hmacSHA256(s.key, stringToSign))
+	if !hmac.Equal([]byte(expected), []byte(signature)) {
+		return false
+	}
+	s.previous = signature
+	return true
+}
+
+// chunkedReader decodes an aws-chunked body: a sequence of
+// "<hex size>[;chunk-signature=<sig>]\r\n<data>\r\n" chunks ending with an
+// empty chunk and optional trailer headers. Trailing checksums are not
+// checked; signed chunks are verified as each one ends. The body only reads
+// to io.EOF once the final chunk was read and verified and the decoded data
+// has the declared length; anything else is an incomplete body.
+type chunkedReader struct {
+	body      io.ReadCloser
+	reader    *bufio.Reader
+	signer    *chunkSigner // nil for unsigned chunks
+	hasher    hash.Hash
+	remaining int64
+	inChunk   bool
+	signature string
+	decoded   int64 // Declared length of the decoded data
+	read      int64
+	err       error
+}
+
+// newChunkedReader decodes body, which must come to decoded bytes; signer
+// verifies chunk signatures if set
+func newChunkedReader(body io.ReadCloser, signer *chunkSigner, decoded int64) *chunkedReader {
+	return &chunkedReader{
+		body:    body,
+		reader:  bufio.NewReader(body),
+		signer:  signer,
+		hasher:  sha256.New(),
+		decoded: decoded,
+	}
+}
+
+func (c *chunkedReader) Read(p []byte) (int, error) {
+	if c.err != nil {
+		return 0, c.err
+	}
+
+	if !c.inChunk {
+		if err := c.nextChunk(); err != nil {
+			c.err = err
+			return 0, err
+		}
+	}
+
+	if int64(len(p)) > c.remaining {
+		p = p[:c.remaining]
+	}
+	n, err := io.ReadFull(c.reader, p)
+	c.hasher.Write(p[:n])
+	c.remaining -= int64(n)
+	c.read += int64(n)
+	if err != nil {
+		c.err = errIncompleteBody
+		return n, c.err
+	}
+
+	if c.remaining == 0 {
+		c.inChunk = false
+		if err := c.endChunk(false); err != nil {
+			c.err = err
+			return 0, err
+		}
+	}
+
+	return n, nil
+}
+
+func (c *chunkedReader) Close() error {
+	return c.body.Close()
+}
+
+// nextChunk reads a chunk header. At the final empty chunk it reads the
+// trailers and returns io.EOF.
+func (c *chunkedReader) nextChunk() error {
+	line, err := c.readLine()
+	if err == io.EOF {
+		return s3Errorf(errIncompleteBody, "body ended before the final chunk")
+	}
+	if err != nil {
+		return err
+	}
+
+	sizeHex, extension, _ := strings.Cut(line, ";")
+	size, err := strconv.ParseInt(sizeHex, 16, 64)
+	if err != nil || size < 0 {
+		return s3Errorf(errIncompleteBody, "invalid chunk size %q", sizeHex)
+	}
+	if c.signer != nil {
+		signature, ok := strings.CutPrefix(extension, "chunk-signature=")
+		if !ok {
+			return s3Errorf(errSignatureDoesNotMatch, "chunk signature missing")
+		}
+		c.signature = signature
+	}
+
+	c.hasher.Reset()
+	if size > 0 {
+		if c.read+size > c.decoded {
+			return s3Errorf(errIncompleteBody, "body is longer than the declared %d bytes", c.decoded)
+		}
+		c.remaining = size
+		c.inChunk = true
+		return nil
+	}
+
+	if err := c.endChunk(true); err != nil {
+		return err
+	}
+	if c.read != c.decoded {
+		return s3Errorf(errIncompleteBody, "body has %d of the declared %d bytes", c.read, c.decoded)
+	}
+	return io.EOF
+}
+
+// endChunk verifies the signature of the chunk just read and consumes the
+// line break after its data, or the trailers after the final chunk
+func (c *chunkedReader) endChunk(final bool) error {
+	if c.signer != nil && !c.signer.verify(c.signature, c.hasher.Sum(nil)) {
+		return errSignatureDoesNotMatch
+	}
+
+	for {
+		line, err := c.readLine()
+		if err == io.EOF && !final {
+			return s3Errorf(errIncompleteBody, "body ended inside a chunk")
+		}
+		if err == io.EOF || (err == nil && line == "") {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if !final || !strings.Contains(line, ":") {
+			return s3Errorf(errIncompleteBody, "malformed chunk")
+		}
+		// A trailer header such as x-amz-checksum-crc32; keep reading
+		// until the blank line that ends the body
+	}
+}
+
+// readLine reads one CRLF-terminated line
+func (c *chunkedReader) readLine() (string, error) {
+	line, err := c.reader.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		return "", s3Errorf(errIncompleteBody, "chunk header too long")
+	}
+	if err == io.EOF && len(line) == 0 {
+		return "", io.EOF
+	}
+	if err != nil && err != io.EOF {
+		return "", errIncompleteBody
+	}
+	return strings.TrimRight(string(line), "\r\n"), nil
+}
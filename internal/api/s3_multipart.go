@@ -0,0 +1,606 @@
+package api
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/caskos/caskos/internal/metadata"
+	"github.com/caskos/caskos/internal/storage"
+)
+
+// maxPartNumber is the highest part number S3 allows
+const maxPartNumber = 10000
+
+// maxCompleteBodySize bounds the part list of a CompleteMultipartUpload request
+const maxCompleteBodySize = 1 << 20
+
+// multipartUpload describes an upload in progress
+type multipartUpload struct {
+	ID           string            `json:"id"`
+	Bucket       string            `json:"bucket"`
+	Key          string            `json:"key"`
+	ContentType  string            `json:"content_type"`
+	UserMetadata map[string]string `json:"user_metadata,omitempty"`
+	Initiated    time.Time         `json:"initiated"`
+}
+
+// uploadedPart describes a part of an upload in progress
+type uploadedPart struct {
+	Number       int       `json:"number"`
+	ETag         string    `json:"etag"`
+	Size         int64     `json:"size"`
+	LastModified time.Time `json:"last_modified"`
+}
+
+// snapshotPrefix starts the names of the directories parts are linked into
+// while an upload completes
+const snapshotPrefix = ".complete-"
+
+// multipartUploads keeps the parts of multipart uploads on local disk until
+// the upload is completed, when they are streamed into the object store in
+// order. Each upload is a directory holding upload.json, and a data file
+// and a JSON description for each part. With a keyring all of them are
+// sealed.
+type multipartUploads struct {
+	mu      sync.Mutex
+	dir     string
+	ttl     time.Duration    // Idle time after which an upload is discarded
+	keyring *storage.Keyring // Nil leaves the files plain
+}
+
+// newMultipartUploads creates the staging directory for multipart uploads
+func newMultipartUploads(dir string, ttl time.Duration, keyring *storage.Keyring) (*multipartUploads, error) {
+	if dir == "" {
+		return nil, fmt.Errorf("a staging directory for multipart uploads is required")
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create multipart staging directory: %w", err)
+	}
+	return &multipartUploads{dir: dir, ttl: ttl, keyring: keyring}, nil
+}
+
+// create starts a new upload
+func (u *multipartUploads) create(upload *multipartUpload) error {
+	dir := filepath.Join(u.dir, upload.ID)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create upload directory: %w", err)
+	}
+
+	data, err := json.MarshalIndent(upload, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal upload: %w", err)
+	}
+	if data, err = u.keyring.Seal(upload.ID+"/upload.json", data); err != nil {
+		return fmt.Errorf("failed to seal upload: %w", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "upload.json"), data, 0644); err != nil {
+		return fmt.Errorf("failed to write upload file: %w", err)
+	}
+	return nil
+}
+
+// get reads an upload, which must be for the given bucket and key
+func (u *multipartUploads) get(id, bucket, key string) (*multipartUpload, error) {
+	if !validUploadID(id) {
+		return nil, errNoSuchUpload
+	}
+
+	data, err := os.ReadFile(filepath.Join(u.dir, id, "upload.json"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, errNoSuchUpload
+		}
+		return nil, fmt.Errorf("failed to read upload file: %w", err)
+	}
+	if data, err = u.keyring.Unseal(id+"/upload.json", data); err != nil {
+		return nil, fmt.Errorf("failed to unseal upload: %w", err)
+	}
+
+	var upload multipartUpload
+	if err := json.Unmarshal(data, &upload); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal upload: %w", err)
+	}
+	if upload.Bucket != bucket || upload.Key != key {
+		return nil, errNoSuchUpload
+	}
+	return &upload, nil
+}
+
+// putPart stores the data of a part, replacing any earlier data for the
+// same part number. If expectedMD5 is set the data must match it.
+func (u *multipartUploads) putPart(id string, number int, data io.Reader, expectedMD5 []byte) (*uploadedPart, error) {
+	dir := filepath.Join(u.dir, id)
+	file, err := os.CreateTemp(dir, "part-*.tmp")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create part file: %w", err)
+	}
+	defer os.Remove(file.Name())
+	sealed, err := u.keyring.NewSealedFile(file, u.partLabel(id, number))
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to create part file: %w", err)
+	}
+
+	hasher := md5.New()
+	size, err := io.Copy(io.NewOffsetWriter(sealed, 0), io.TeeReader(data, hasher))
+	if closeErr := sealed.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to write part: %w", err)
+	}
+	sum := hasher.Sum(nil)
+	if expectedMD5 != nil && !bytes.Equal(sum, expectedMD5) {
+		return nil, errBadDigest
+	}
+
+	part := &uploadedPart{
+		Number:       number,
+		ETag:         hex.EncodeToString(sum),
+		Size:         size,
+		LastModified: time.Now(),
+	}
+	description, err := json.Marshal(part)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal part: %w", err)
+	}
+	if description, err = u.keyring.Seal(u.partLabel(id, number)+".json", description); err != nil {
+		return nil, fmt.Errorf("failed to seal part: %w", err)
+	}
+
+	// The upload may have been completed or aborted meanwhile
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if _, err := os.Stat(filepath.Join(dir, "upload.json")); err != nil {
+		return nil, errNoSuchUpload
+	}
+	if err := os.Rename(file.Name(), u.partPath(id, number)); err != nil {
+		return nil, fmt.Errorf("failed to store part: %w", err)
+	}
+	if err := os.WriteFile(u.partPath(id, number)+".json", description, 0644); err != nil {
+		return nil, fmt.Errorf("failed to write part file: %w", err)
+	}
+	return part, nil
+}
+
+// parts lists the parts of an upload in order
+func (u *multipartUploads) parts(id string) ([]uploadedPart, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.readParts(id)
+}
+
+// snapshot lists the parts of an upload and hard-links their data files
+// into a new directory, returned with the parts. Parts uploaded again, or an
+// abort, while the upload completes cannot change what is stored then. The
+// caller removes the directory when done.
+func (u *multipartUploads) snapshot(id string) (string, []uploadedPart, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if _, err := os.Stat(filepath.Join(u.dir, id, "upload.json")); err != nil {
+		return "", nil, errNoSuchUpload
+	}
+	parts, err := u.readParts(id)
+	if err != nil {
+		return "", nil, err
+	}
+
+	dir, err := os.MkdirTemp(u.dir, snapshotPrefix+"*")
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to create snapshot directory: %w", err)
+	}
+	for _, part := range parts {
+		path := u.partPath(id, part.Number)
+		if err := os.Link(path, filepath.Join(dir, filepath.Base(path))); err != nil {
+			os.RemoveAll(dir)
+			return "", nil, fmt.Errorf("failed to link part: %w", err)
+		}
+	}
+	return dir, parts, nil
+}
+
+// readParts lists the parts of an upload in order; the caller must hold
+// the lock
+func (u *multipartUploads) readParts(id string) ([]uploadedPart, error) {
+	matches, err := filepath.Glob(filepath.Join(u.dir, id, "*.part.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	parts := make([]uploadedPart, 0, len(matches))
+	for _, path := range matches {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read part file: %w", err)
+		}
+		if data, err = u.keyring.Unseal(id+"/"+filepath.Base(path), data); err != nil {
+			return nil, fmt.Errorf("failed to unseal part: %w", err)
+		}
+		var part uploadedPart
+		if err := json.Unmarshal(data, &part); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal part: %w", err)
+		}
+		parts = append(parts, part)
+	}
+
+	sort.Slice(parts, func(i, j int) bool { return parts[i].Number < parts[j].Number })
+	return parts, nil
+}
+
+// remove discards an upload and its parts
+func (u *multipartUploads) remove(id string) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if err := os.RemoveAll(filepath.Join(u.dir, id)); err != nil {
+		return fmt.Errorf("failed to remove upload: %w", err)
+	}
+	return nil
+}
+
+// expire removes the uploads that received nothing for the TTL, and
+// snapshots left behind by a crash, and returns how many uploads were removed
+func (u *multipartUploads) expire(now time.Time) (int, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	entries, err := os.ReadDir(u.dir)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read multipart staging directory: %w", err)
+	}
+
+	removed := 0
+	for _, entry := range entries {
+		isUpload := validUploadID(entry.Name())
+		if !entry.IsDir() || (!isUpload && !strings.HasPrefix(entry.Name(), snapshotPrefix)) {
+			continue
+		}
+
+		// Storing a part renames it into the upload's directory, which
+		// updates its modification time
+		info, err := entry.Info()
+		if err != nil || now.Sub(info.ModTime()) < u.ttl {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(u.dir, entry.Name())); err != nil {
+			return removed, fmt.Errorf("failed to remove upload: %w", err)
+		}
+		if isUpload {
+			removed++
+		}
+	}
+	return removed, nil
+}
+
+// partPath returns the path of the data file of a part
+func (u *multipartUploads) partPath(id string, number int) string {
+	return filepath.Join(u.dir, id, fmt.Sprintf("%05d.part", number))
+}
+
+// partLabel names the data file of a part when it is sealed, whatever path
+// it is linked at
+func (u *multipartUploads) partLabel(id string, number int) string {
+	return id + "/" + filepath.Base(u.partPath(id, number))
+}
+
+// openPart opens the data file of a part, at path since it may be a
+// snapshot's link to it
+func (u *multipartUploads) openPart(path, id string, part uploadedPart) (io.ReadCloser, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open part: %w", err)
+	}
+	sealed, err := u.keyring.OpenSealedFile(file, u.partLabel(id, part.Number))
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to open part: %w", err)
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.NewSectionReader(sealed, 0, part.Size), sealed}, nil
+}
+
+// validUploadID reports whether id could have been issued by newRequestID,
+// so it is safe to use in a path
+func validUploadID(id string) bool {
+	if id == "" {
+		return false
+	}
+	_, err := hex.DecodeString(id)
+	return err == nil
+}
+
+// partsReader streams the data files of parts in a snapshot one after
+// another, opening each only when it is reached
+type partsReader struct {
+	uploads *multipartUploads
+	id      string
+	dir     string
+	parts   []uploadedPart
+	current io.ReadCloser
+}
+
+func (p *partsReader) Read(b []byte) (int, error) {
+	for {
+		if p.current == nil {
+			if len(p.parts) == 0 {
+				return 0, io.EOF
+			}
+			path := filepath.Join(p.dir, filepath.Base(p.uploads.partPath(p.id, p.parts[0].Number)))
+			file, err := p.uploads.openPart(path, p.id, p.parts[0])
+			if err != nil {
+				return 0, err
+			}
+			p.current = file
+			p.parts = p.parts[1:]
+		}
+
+		n, err := p.current.Read(b)
+		if err == io.EOF {
+			p.current.Close()
+			p.current = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+// Close closes the part being read, if any
+func (p *partsReader) Close() error {
+	if p.current == nil {
+		return nil
+	}
+	return p.current.Close()
+}
+
+// XML documents of multipart upload requests and responses
+type (
+	initiateMultipartUploadResult struct {
+		XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+		Xmlns    string   `xml:"xmlns,attr"`
+		Bucket   string   `xml:"Bucket"`
+		Key      string   `xml:"Key"`
+		UploadID string   `xml:"UploadId"`
+	}
+
+	completeMultipartUpload struct {
+		Parts []struct {
+			PartNumber int    `xml:"PartNumber"`
+			ETag       string `xml:"ETag"`
+		} `xml:"Part"`
+	}
+
+	completeMultipartUploadResult struct {
+		XMLName  xml.Name `xml:"CompleteMultipartUploadResult"`
+		Xmlns    string   `xml:"xmlns,attr"`
+		Location string   `xml:"Location"`
+		Bucket   string   `xml:"Bucket"`
+		Key      string   `xml:"Key"`
+		ETag     string   `xml:"ETag"`
+	}
+
+	s3Part struct {
+		PartNumber   int    `xml:"PartNumber"`
+		LastModified string `xml:"LastModified"`
+		ETag         string `xml:"ETag"`
+		Size         int64  `xml:"Size"`
+	}
+
+	listPartsResult struct {
+		XMLName     xml.Name `xml:"ListPartsResult"`
+		Xmlns       string   `xml:"xmlns,attr"`
+		Bucket      string   `xml:"Bucket"`
+		Key         string   `xml:"Key"`
+		UploadID    string   `xml:"UploadId"`
+		IsTruncated bool     `xml:"IsTruncated"`
+		Parts       []s3Part `xml:"Part"`
+	}
+)
+
+// createMultipartUpload starts a multipart upload
+func (g *S3Gateway) createMultipartUpload(w http.ResponseWriter, r *http.Request, bucket, key string) error {
+	if _, err := g.server.metadataStore.GetBucket(bucket); err != nil {
+		return namespaceError(err)
+	}
+
+	upload := &multipartUpload{
+		ID:           strings.ToLower(newRequestID()),
+		Bucket:       bucket,
+		Key:          key,
+		ContentType:  requestContentType(r),
+		UserMetadata: userMetadata(r.Header),
+		Initiated:    time.Now(),
+	}
+	if err := g.uploads.create(upload); err != nil {
+		return err
+	}
+
+	g.server.logger.Info("started multipart upload", "bucket", bucket, "key", key, "upload_id", upload.ID)
+	return g.writeXML(w, initiateMultipartUploadResult{
+		Xmlns:    s3Namespace,
+		Bucket:   bucket,
+		Key:      key,
+		UploadID: upload.ID,
+	}, http.StatusOK)
+}
+
+// uploadPart stores one part of a multipart upload
+func (g *S3Gateway) uploadPart(w http.ResponseWriter, r *http.Request, bucket, key, uploadID, partNumber string) error {
+	number, err := strconv.Atoi(partNumber)
+	if err != nil || number < 1 || number > maxPartNumber {
+		return s3Errorf(errInvalidArgument, "part number must be an integer between 1 and %d", maxPartNumber)
+	}
+	if r.Header.Get("X-Amz-Copy-Source") != "" {
+		return s3Errorf(errNotImplemented, "UploadPartCopy is not supported")
+	}
+
+	if _, err := g.uploads.get(uploadID, bucket, key); err != nil {
+		return err
+	}
+
+	expectedMD5, err := contentMD5(r)
+	if err != nil {
+		return err
+	}
+
+	part, err := g.uploads.putPart(uploadID, number, r.Body, expectedMD5)
+	if err != nil {
+		return putError(err)
+	}
+
+	w.Header().Set("ETag", `"`+part.ETag+`"`)
+	w.WriteHeader(http.StatusOK)
+	return nil
+}
+
+// completeMultipartUpload concatenates the listed parts into one object and
+// points the key at it
+func (g *S3Gateway) completeMultipartUpload(w http.ResponseWriter, r *http.Request, bucket, key, uploadID string) error {
+	upload, err := g.uploads.get(uploadID, bucket, key)
+	if err != nil {
+		return err
+	}
+
+	// The body is read to its end, where its signed payload hash is checked,
+	// before any of it is trusted
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxCompleteBodySize+1))
+	if err != nil {
+		return err
+	}
+	if len(body) > maxCompleteBodySize {
+		return s3Errorf(errMalformedXML, "the part list is larger than %d bytes", maxCompleteBodySize)
+	}
+	var request completeMultipartUpload
+	if err := xml.Unmarshal(body, &request); err != nil {
+		return errMalformedXML
+	}
+	if len(request.Parts) == 0 {
+		return s3Errorf(errMalformedXML, "the upload must list at least one part")
+	}
+
+	// The parts are streamed from links taken now, so parts uploaded
+	// again meanwhile do not change the data the ETag is computed for
+	snapshot, uploaded, err := g.uploads.snapshot(uploadID)
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(snapshot)
+	byNumber := make(map[int]uploadedPart, len(uploaded))
+	for _, part := range uploaded {
+		byNumber[part.Number] = part
+	}
+
+	// The ETag of a multipart object is the MD5 of the part MD5s followed by
+	// the number of parts
+	hasher := md5.New()
+	parts := &partsReader{uploads: g.uploads, id: uploadID, dir: snapshot}
+	defer parts.Close()
+	for i, requested := range request.Parts {
+		if i > 0 && requested.PartNumber <= request.Parts[i-1].PartNumber {
+			return errInvalidPartOrder
+		}
+		part, ok := byNumber[requested.PartNumber]
+		if !ok || strings.Trim(requested.ETag, `"`) != part.ETag {
+			return s3Errorf(errInvalidPart, "part %d was not uploaded or its ETag does not match", requested.PartNumber)
+		}
+		sum, _ := hex.DecodeString(part.ETag)
+		hasher.Write(sum)
+		parts.parts = append(parts.parts, part)
+	}
+	etag := fmt.Sprintf("%s-%d", hex.EncodeToString(hasher.Sum(nil)), len(request.Parts))
+
+	consistency, err := requestConsistency(r)
+	if err != nil {
+		return s3Errorf(errInvalidArgument, "%v", err)
+	}
+
+	entry := &metadata.KeyEntry{
+		Bucket:       bucket,
+		Key:          key,
+		ContentType:  upload.ContentType,
+		ETag:         etag,
+		UserMetadata: upload.UserMetadata,
+	}
+	if _, err := g.server.putKey(r.Context(), entry, parts, consistency, "", nil); err != nil {
+		return putError(err)
+	}
+
+	if err := g.uploads.remove(uploadID); err != nil {
+		g.server.logger.Error("failed to clean up multipart upload", "upload_id", uploadID, "error", err)
+	}
+
+	g.server.logger.Info("completed multipart upload",
+		"bucket", bucket,
+		"key", key,
+		"upload_id", uploadID,
+		"parts", len(request.Parts),
+		"object_id", entry.ObjectID)
+	return g.writeXML(w, completeMultipartUploadResult{
+		Xmlns:    s3Namespace,
+		Location: "/" + bucket + "/" + key,
+		Bucket:   bucket,
+		Key:      key,
+		ETag:     `"` + etag + `"`,
+	}, http.StatusOK)
+}
+
+// abortMultipartUpload discards a multipart upload and its parts
+func (g *S3Gateway) abortMultipartUpload(w http.ResponseWriter, bucket, key, uploadID string) error {
+	if _, err := g.uploads.get(uploadID, bucket, key); err != nil {
+		return err
+	}
+	if err := g.uploads.remove(uploadID); err != nil {
+		return err
+	}
+
+	g.server.logger.Info("aborted multipart upload", "bucket", bucket, "key", key, "upload_id", uploadID)
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// listParts lists the parts uploaded so far
+func (g *S3Gateway) listParts(w http.ResponseWriter, bucket, key, uploadID string) error {
+	if _, err := g.uploads.get(uploadID, bucket, key); err != nil {
+		return err
+	}
+
+	parts, err := g.uploads.parts(uploadID)
+	if err != nil {
+		return err
+	}
+
+	result := listPartsResult{
+		Xmlns:    s3Namespace,
+		Bucket:   bucket,
+		Key:      key,
+		UploadID: uploadID,
+	}
+	for _, part := range parts {
+		result.Parts = append(result.Parts, s3Part{
+			PartNumber:   part.Number,
+			LastModified: part.LastModified.UTC().Format(s3TimeFormat),
+			ETag:         `"` + part.ETag + `"`,
+			Size:         part.Size,
+		})
+	}
+
+	return g.writeXML(w, result, http.StatusOK)
+}
@@ -0,0 +1,118 @@
+package api
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/caskos/caskos/internal/storage"
+)
+
+func TestMultipartUploads_SnapshotAndExpire(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "multipart-test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	uploads, err := newMultipartUploads(tmpDir, time.Hour, nil)
+	if err != nil {
+		t.Fatalf("failed to create multipart uploads: %v", err)
+	}
+	upload := &multipartUpload{ID: "0123abcd", Bucket: "docs", Key: "a.txt", Initiated: time.Now()}
+	if err := uploads.create(upload); err != nil {
+		t.Fatalf("failed to create upload: %v", err)
+	}
+	if _, err := uploads.putPart(upload.ID, 1, strings.NewReader("first"), nil); err != nil {
+		t.Fatalf("failed to put part: %v", err)
+	}
+
+	// A part uploaded again while the upload completes does not change the
+	// data being stored
+	snapshot, parts, err := uploads.snapshot(upload.ID)
+	if err != nil || len(parts) != 1 {
+		t.Fatalf("failed to snapshot upload: %d parts (%v)", len(parts), err)
+	}
+	if _, err := uploads.putPart(upload.ID, 1, strings.NewReader("second"), nil); err != nil {
+		t.Fatalf("failed to put part again: %v", err)
+	}
+	file, err := uploads.openPart(filepath.Join(snapshot, filepath.Base(uploads.partPath(upload.ID, 1))), upload.ID, parts[0])
+	if err != nil {
+		t.Fatalf("failed to open part: %v", err)
+	}
+	data, err := io.ReadAll(file)
+	file.Close()
+	if err != nil || string(data) != "first" || len(parts) != 1 || parts[0].Size != 5 {
+		t.Errorf("expected the snapshot to keep the first part, got %q %+v (%v)", data, parts, err)
+	}
+
+	// Nothing is removed before the TTL, then the idle upload and the
+	// leftover snapshot are
+	if removed, err := uploads.expire(time.Now()); err != nil || removed != 0 {
+		t.Fatalf("expected nothing to expire yet, got %d (%v)", removed, err)
+	}
+	if removed, err := uploads.expire(time.Now().Add(2 * time.Hour)); err != nil || removed != 1 {
+		t.Fatalf("expected the upload to expire, got %d (%v)", removed, err)
+	}
+	if entries, _ := os.ReadDir(tmpDir); len(entries) != 0 {
+		t.Errorf("expected the staging directory to be empty, got %d entries", len(entries))
+	}
+	if _, err := uploads.get(upload.ID, "docs", "a.txt"); err != errNoSuchUpload {
+		t.Errorf("expected errNoSuchUpload for an expired upload, got %v", err)
+	}
+}
+
+func TestMultipartUploads_Sealed(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "multipart-test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	keyPath := filepath.Join(tmpDir, "keys.json")
+	key := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, 32))
+	os.WriteFile(keyPath, []byte(`{"active":"k1","keys":{"k1":"`+key+`"}}`), 0600)
+	keyring, err := storage.LoadKeyring(keyPath)
+	if err != nil {
+		t.Fatalf("failed to load keyring: %v", err)
+	}
+	uploads, err := newMultipartUploads(filepath.Join(tmpDir, "staging"), time.Hour, keyring)
+	if err != nil {
+		t.Fatalf("failed to create multipart uploads: %v", err)
+	}
+
+	upload := &multipartUpload{ID: "0123abcd", Bucket: "docs", Key: "secret.txt", Initiated: time.Now()}
+	if err := uploads.create(upload); err != nil {
+		t.Fatalf("failed to create upload: %v", err)
+	}
+	content := strings.Repeat("confidential ", 10000)
+	if _, err := uploads.putPart(upload.ID, 1, strings.NewReader(content), nil); err != nil {
+		t.Fatalf("failed to put part: %v", err)
+	}
+	entries, _ := os.ReadDir(filepath.Join(tmpDir, "staging", upload.ID))
+	for _, entry := range entries {
+		raw, _ := os.ReadFile(filepath.Join(tmpDir, "staging", upload.ID, entry.Name()))
+		if bytes.Contains(raw, []byte("confidential")) || bytes.Contains(raw, []byte("secret.txt")) {
+			t.Errorf("expected %s to be sealed", entry.Name())
+		}
+	}
+
+	if got, err := uploads.get(upload.ID, "docs", "secret.txt"); err != nil || got.ID != upload.ID {
+		t.Fatalf("expected the upload to read back, got %+v (%v)", got, err)
+	}
+	snapshot, parts, err := uploads.snapshot(upload.ID)
+	if err != nil || len(parts) != 1 {
+		t.Fatalf("failed to snapshot upload: %d parts (%v)", len(parts), err)
+	}
+	reader := &partsReader{uploads: uploads, id: upload.ID, dir: snapshot, parts: parts}
+	data, err := io.ReadAll(reader)
+	reader.Close()
+	if err != nil || string(data) != content {
+		t.Errorf("expected the part to read back, got %d bytes (%v)", len(data), err)
+	}
+}
@@ -1,21 +1,41 @@
 package api
 
 import (
+	"context"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
+	"mime/multipart"
 	"net/http"
+	"strconv"
 	"time"
 
 	"github.com/caskos/caskos/internal/metadata"
+	"github.com/caskos/caskos/internal/nodeapi"
 	"github.com/caskos/caskos/internal/storage"
+	"github.com/caskos/caskos/internal/upload"
 )
 
+// ConsistencyHeader overrides the write consistency of an upload; its value
+// is one, quorum or all
+const ConsistencyHeader = "X-Write-Consistency"
+
+// DurabilityHeader chooses how an upload, or the objects of a new bucket,
+// are protected: replicated, or ec:K+M for erasure coding
+const DurabilityHeader = "X-Durability"
+
+// errObjectNotFound is returned when deleting an object that is not stored
+var errObjectNotFound = errors.New("object not found")
+
 // Server handles HTTP requests for the object storage API
 type Server struct {
 	storageManager *storage.Manager
 	metadataStore  *metadata.Store
+	uploads        *upload.Sessions
+	nodeClients    nodeapi.ClientConfig
 	logger         *slog.Logger
 	replication    int
 }
@@ -27,29 +47,58 @@ func NewServer(
 	logger *slog.Logger,
 	replication int,
 ) *Server {
-	return &Server{
+	s := &Server{
 		storageManager: storageManager,
 		metadataStore:  metadataStore,
 		logger:         logger,
 		replication:    replication,
 	}
+	storageManager.SetRepairHandler(s.repairObject)
+	storageManager.SetChunkReserver(metadataStore)
+	storageManager.SetTombstoneChecker(metadataStore)
+	return s
+}
+
+// SetUploadSessions enables resumable uploads kept in sessions
+func (s *Server) SetUploadSessions(sessions *upload.Sessions) {
+	s.uploads = sessions
+}
+
+// SetNodeClientConfig sets how remote nodes added at runtime are reached
+func (s *Server) SetNodeClientConfig(config nodeapi.ClientConfig) {
+	s.nodeClients = config
 }
 
-// UploadHandler handles object uploads
+// UploadHandler handles object uploads. With a bucket query parameter the
+// object is also stored under a key in that bucket, named by the key
+// parameter or else the uploaded file name.
 func (s *Server) UploadHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
-	// Parse multipart form (max 100MB)
-	if err := r.ParseMultipartForm(100 << 20); err != nil {
+	// The default write consistency can be overridden per request
+	consistency, err := requestConsistency(r)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid %s header: %v", ConsistencyHeader, err), http.StatusBadRequest)
+		return
+	}
+	durability, err := requestDurability(r)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid %s header: %v", DurabilityHeader, err), http.StatusBadRequest)
+		return
+	}
+
+	// Stream the multipart body instead of parsing it into memory or temp files
+	reader, err := r.MultipartReader()
+	if err != nil {
 		s.logger.Error("failed to parse multipart form", "error", err)
 		http.Error(w, fmt.Sprintf("Failed to parse form: %v", err), http.StatusBadRequest)
 		return
 	}
 
-	file, header, err := r.FormFile("file")
+	file, err := nextFilePart(reader, "file")
 	if err != nil {
 		s.logger.Error("failed to get file from form", "error", err)
 		http.Error(w, fmt.Sprintf("Failed to get file: %v", err), http.StatusBadRequest)
@@ -57,48 +106,111 @@ func (s *Server) UploadHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	defer file.Close()
 
-	// Read file data
-	data, err := io.ReadAll(file)
-	if err != nil {
-		s.logger.Error("failed to read file data", "error", err)
-		http.Error(w, fmt.Sprintf("Failed to read file: %v", err), http.StatusInternalServerError)
-		return
+	// Content type recorded in the metadata
+	contentType := file.Header.Get("Content-Type")
+	if contentType == "" {
+		contentType = "application/octet-stream"
 	}
 
-	// Generate object ID from content hash
-	objectID := storage.GenerateObjectID(data)
-
-	// Check if object already exists
-	if s.metadataStore.Exists(objectID) {
-		existingMeta, err := s.metadataStore.Get(objectID)
-		if err == nil {
-			s.respondWithMetadata(w, existingMeta, http.StatusOK)
+	// Uploads into a bucket are stored under a key, the file name by default
+	if bucket := r.URL.Query().Get("bucket"); bucket != "" {
+		key := r.URL.Query().Get("key")
+		if key == "" {
+			key = file.FileName()
+		}
+		entry := &metadata.KeyEntry{Bucket: bucket, Key: key, ContentType: contentType}
+		result, err := s.putKey(r.Context(), entry, file, consistency, durability, nil)
+		if err != nil {
+			s.putKeyError(w, err)
 			return
 		}
+		s.respondWithKeyPut(w, entry, result, http.StatusCreated)
+		return
 	}
 
-	// Store object with replication
-	replicatedNodes, err := s.storageManager.StoreObject(objectID, io.NopCloser(io.NewSectionReader(
-		&byteReader{data: data}, 0, int64(len(data)),
-	)), int64(len(data)))
+	// Store object with replication; the object ID is the content hash
+	// computed while the data streams to the storage nodes
+	meta, result, created, err := s.putContent(r.Context(), file, contentType, consistency, durability)
+	if err == nil {
+		s.storageManager.ReleasePut(result)
+	}
+	var quorumErr *storage.QuorumError
+	if errors.As(err, &quorumErr) {
+		s.logger.Error("failed to store object", "error", err)
+		http.Error(w, fmt.Sprintf("Failed to store object: %v", err), http.StatusServiceUnavailable)
+		return
+	}
 	if err != nil {
-		s.logger.Error("failed to store object", "error", err, "object_id", objectID)
+		s.logger.Error("failed to store object", "error", err)
 		http.Error(w, fmt.Sprintf("Failed to store object: %v", err), http.StatusInternalServerError)
 		return
 	}
 
-	// Create metadata
-	contentType := header.Header.Get("Content-Type")
-	if contentType == "" {
-		contentType = "application/octet-stream"
+	if !created {
+		s.respondWithPut(w, meta, result, http.StatusOK)
+		return
+	}
+
+	s.respondWithPut(w, meta, result, http.StatusCreated)
+
+	// Check for missing replicas and trigger self-healing. This starts after
+	// the response is written because it updates meta.Replicas.
+	go s.ensureReplication(meta.ID, meta)
+}
+
+// putContent stores an object and records its metadata unless the same
+// content is already known. It reports whether new metadata was created; the
+// caller should then run ensureReplication once it is done with meta. The
+// object stays reserved against deletes until the caller releases it with
+// ReleasePut, once a key pointing at it is recorded.
+func (s *Server) putContent(ctx context.Context, data io.Reader, contentType string, consistency storage.Consistency, durability storage.Durability) (*metadata.ObjectMetadata, *storage.PutResult, bool, error) {
+	result, err := s.storageManager.PutObject(ctx, data, consistency, durability)
+	if err != nil {
+		return nil, nil, false, err
+	}
+
+	meta, created := s.recordObject(result, contentType)
+	return meta, result, created, nil
+}
+
+// recordObject records the metadata of stored content unless it is already
+// known, and reports whether new metadata was created. Known content keeps
+// the durability it was first stored with.
+func (s *Server) recordObject(result *storage.PutResult, contentType string) (*metadata.ObjectMetadata, bool) {
+	objectID := result.ObjectID
+	// Uploading deleted content again brings it back on purpose
+	if s.metadataStore.IsDeleted(objectID) {
+		if err := s.metadataStore.ClearTombstone(objectID); err != nil {
+			s.logger.Error("failed to clear tombstone", "error", err, "object_id", objectID)
+		}
+	}
+
+	// Check if object already exists
+	if s.metadataStore.Exists(objectID) {
+		existingMeta, err := s.metadataStore.Get(objectID)
+		if err == nil {
+			return existingMeta, false
+		}
 	}
 
 	meta := &metadata.ObjectMetadata{
 		ID:          objectID,
-		Size:        int64(len(data)),
+		Size:        result.Size,
 		ContentType: contentType,
 		CreatedAt:   time.Now(),
-		Replicas:    replicatedNodes,
+		Replicas:    result.Replicas,
+		Durability:  string(result.Durability),
+	}
+	erasureCoded := len(result.Chunks) > 0 && result.Chunks[0].ErasureCoded()
+	if len(result.Chunks) > 1 || erasureCoded {
+		for _, chunk := range result.Chunks {
+			meta.Chunks = append(meta.Chunks, metadata.ChunkRef{
+				ID:           chunk.ID,
+				Size:         chunk.Size,
+				DataShards:   chunk.DataShards,
+				ParityShards: chunk.ParityShards,
+			})
+		}
 	}
 
 	// Save metadata
@@ -107,27 +219,26 @@ func (s *Server) UploadHandler(w http.ResponseWriter, r *http.Request) {
 		// Object is stored but metadata failed - this is a problem but we'll continue
 	}
 
-	// Check for missing replicas and trigger self-healing
-	go s.ensureReplication(objectID, meta)
-
-	s.respondWithMetadata(w, meta, http.StatusCreated)
+	return meta, true
 }
 
-// GetObjectHandler retrieves an object
+// GetObjectHandler retrieves an object. It answers GET and HEAD and supports
+// Range, If-Range, If-None-Match and If-Modified-Since. Object IDs are
+// content hashes, so the ID is a strong ETag and responses are immutable.
 func (s *Server) GetObjectHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodGet {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
 	objectID := r.PathValue("id")
-	if objectID == "" {
-		http.Error(w, "Object ID is required", http.StatusBadRequest)
+	if !storage.IsValidObjectID(objectID) {
+		http.Error(w, "Invalid object ID", http.StatusBadRequest)
 		return
 	}
 
-	// Retrieve object
-	reader, err := s.storageManager.RetrieveObject(objectID)
+	// Open object
+	reader, err := s.openObject(objectID)
 	if err != nil {
 		s.logger.Warn("object not found", "object_id", objectID, "error", err)
 		http.Error(w, "Object not found", http.StatusNotFound)
@@ -135,17 +246,132 @@ func (s *Server) GetObjectHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	defer reader.Close()
 
-	// Get metadata for content type
+	// Metadata provides the content type and a modification time that is the
+	// same on every replica
+	modTime := reader.ModTime()
+	contentType := "application/octet-stream"
+	if meta, err := s.metadataStore.Get(objectID); err == nil {
+		modTime = meta.CreatedAt
+		if meta.ContentType != "" {
+			contentType = meta.ContentType
+		}
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("ETag", `"`+objectID+`"`)
+	w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+
+	// ServeContent handles ranges, conditional requests and HEAD. A full read
+	// verifies the content, so a corrupt replica ends the response early and
+	// the client sees a body shorter than its Content-Length.
+	http.ServeContent(w, r, "", modTime, reader)
+}
+
+// openObject opens an object for random access, reading it from its chunks
+// if it was stored as several
+func (s *Server) openObject(objectID string) (*storage.ObjectReader, error) {
+	if s.metadataStore.IsDeleted(objectID) {
+		return nil, fmt.Errorf("object deleted: %s", objectID)
+	}
+
 	meta, err := s.metadataStore.Get(objectID)
-	if err == nil && meta.ContentType != "" {
-		w.Header().Set("Content-Type", meta.ContentType)
+	if err != nil || len(meta.Chunks) == 0 {
+		return s.storageManager.OpenObject(objectID)
+	}
+
+	return s.storageManager.OpenChunks(objectID, storageChunks(meta.ChunkRefs()))
+}
+
+// objectReplicas returns the nodes holding an object, or for an object
+// stored as several chunks those holding its least replicated chunk. For an
+// erasure-coded object these are the nodes holding its shards.
+func (s *Server) objectReplicas(meta *metadata.ObjectMetadata) []string {
+	if len(meta.Chunks) == 0 {
+		return s.storageManager.CheckReplicas(meta.ID)
 	}
+	return s.storageManager.CheckChunkReplicas(storageChunks(meta.Chunks))
+}
+
+// wantedReplicas returns how many nodes should hold an object: the
+// replication factor, or the shard count if it is erasure-coded
+func (s *Server) wantedReplicas(meta *metadata.ObjectMetadata) int {
+	if dataShards, parityShards := storage.Durability(meta.Durability).Shards(); dataShards > 0 {
+		return dataShards + parityShards
+	}
+	return s.replication
+}
 
-	// Stream object data
-	if _, err := io.Copy(w, reader); err != nil {
-		s.logger.Error("failed to stream object", "error", err, "object_id", objectID)
+// storageChunks converts chunk references from the metadata store
+func storageChunks(refs []metadata.ChunkRef) []storage.Chunk {
+	chunks := make([]storage.Chunk, 0, len(refs))
+	for _, ref := range refs {
+		chunks = append(chunks, storage.Chunk{
+			ID:           ref.ID,
+			Size:         ref.Size,
+			DataShards:   ref.DataShards,
+			ParityShards: ref.ParityShards,
+		})
+	}
+	return chunks
+}
+
+// ListObjectsHandler lists stored objects in object ID order. The prefix,
+// delimiter, continuation_token and limit query parameters select a page;
+// a truncated page returns the token for the next one.
+func (s *Server) ListObjectsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
+
+	query := r.URL.Query()
+	opts := metadata.ListOptions{
+		Prefix:    query.Get("prefix"),
+		Delimiter: query.Get("delimiter"),
+		Limit:     maxListKeys,
+	}
+	if value := query.Get("limit"); value != "" {
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit < 1 {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+		opts.Limit = min(limit, maxListKeys)
+	}
+	if token := query.Get("continuation_token"); token != "" {
+		after, err := base64.RawURLEncoding.DecodeString(token)
+		if err != nil {
+			http.Error(w, "Invalid continuation token", http.StatusBadRequest)
+			return
+		}
+		opts.After = string(after)
+	}
+
+	result, err := s.metadataStore.List(opts)
+	if err != nil {
+		s.logger.Error("failed to list objects", "error", err)
+		http.Error(w, fmt.Sprintf("Failed to list objects: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	objects := make([]map[string]interface{}, 0, len(result.Objects))
+	for i := range result.Objects {
+		objects = append(objects, metadataResponse(&result.Objects[i]))
+	}
+	commonPrefixes := result.CommonPrefixes
+	if commonPrefixes == nil {
+		commonPrefixes = []string{}
+	}
+
+	response := map[string]interface{}{
+		"objects":         objects,
+		"common_prefixes": commonPrefixes,
+		"truncated":       result.Truncated,
+	}
+	if result.Truncated {
+		response["next_continuation_token"] = base64.RawURLEncoding.EncodeToString([]byte(result.Next))
+	}
+	s.respondWithJSON(w, response, http.StatusOK)
 }
 
 // GetMetadataHandler retrieves object metadata
@@ -156,8 +382,8 @@ func (s *Server) GetMetadataHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	objectID := r.PathValue("id")
-	if objectID == "" {
-		http.Error(w, "Object ID is required", http.StatusBadRequest)
+	if !storage.IsValidObjectID(objectID) {
+		http.Error(w, "Invalid object ID", http.StatusBadRequest)
 		return
 	}
 
@@ -169,31 +395,191 @@ func (s *Server) GetMetadataHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Update replica status
-	availableReplicas := s.storageManager.CheckReplicas(objectID)
+	availableReplicas := s.objectReplicas(meta)
 	meta.Replicas = availableReplicas
 
+	s.respondWithMetadata(w, meta, http.StatusOK)
+
 	// Trigger self-healing if needed
-	if len(availableReplicas) < s.replication {
+	if len(availableReplicas) < s.wantedReplicas(meta) {
 		go s.ensureReplication(objectID, meta)
 	}
+}
 
-	s.respondWithMetadata(w, meta, http.StatusOK)
+// repairObject restores the replicas of an object, for example after the
+// storage manager quarantined a corrupt copy
+func (s *Server) repairObject(objectID string) {
+	// A write that missed a replica hands off before its metadata is saved
+	meta, err := s.metadataStore.Get(objectID)
+	if err != nil {
+		s.logger.Debug("repairing object without metadata", "object_id", objectID, "error", err)
+	}
+	s.ensureReplication(objectID, meta)
+}
+
+// DeleteObjectHandler deletes an object's metadata and removes from every
+// node the chunks no other object references
+func (s *Server) DeleteObjectHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	objectID := r.PathValue("id")
+	if !storage.IsValidObjectID(objectID) {
+		http.Error(w, "Invalid object ID", http.StatusBadRequest)
+		return
+	}
+
+	nodes, err := s.deleteObject(objectID)
+	switch {
+	case errors.Is(err, errObjectNotFound):
+		http.Error(w, "Object not found", http.StatusNotFound)
+		return
+	case errors.Is(err, metadata.ErrObjectReferenced):
+		http.Error(w, "Object is referenced by keys or an upload in progress", http.StatusConflict)
+		return
+	case err != nil:
+		s.logger.Error("failed to delete object", "error", err, "object_id", objectID)
+		http.Error(w, fmt.Sprintf("Failed to delete object: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	s.logger.Info("deleted object", "object_id", objectID, "nodes", nodes)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// deleteObject deletes an object's metadata and removes from every node the
+// chunks no other object references. It returns the nodes the object itself
+// was removed from, and fails with metadata.ErrObjectReferenced while keys
+// point at the object.
+func (s *Server) deleteObject(objectID string) ([]string, error) {
+	// Without metadata the object may still have copies left by a write
+	// that was never recorded or a delete that missed a node, unless those
+	// copies are chunks of other objects
+	meta, err := s.metadataStore.Get(objectID)
+	if err != nil {
+		if s.metadataStore.ChunkReferences(objectID) > 0 || len(s.storageManager.CheckReplicas(objectID)) == 0 {
+			return nil, errObjectNotFound
+		}
+		meta = &metadata.ObjectMetadata{ID: objectID}
+	}
+
+	// Record the tombstone before touching the nodes, so a repair racing with
+	// the delete or a node that misses it cannot resurrect the object
+	if err := s.metadataStore.Delete(objectID); err != nil {
+		return nil, err
+	}
+
+	// Chunks shared with other objects, or reserved by uploads in progress,
+	// stay. Uploads wait while a chunk is removed, so they store it again
+	// rather than finding it about to disappear.
+	var deletedNodes []string
+	for _, ref := range storageChunks(meta.ChunkRefs()) {
+		if !s.metadataStore.StartChunkRemoval(ref.ID) {
+			continue
+		}
+
+		// Chunks get a tombstone of their own, so a pending repair of the
+		// chunk cannot bring it back and the scrubber removes copies left on
+		// a node that missed the delete
+		if ref.ID != objectID {
+			if err := s.metadataStore.Delete(ref.ID); err != nil {
+				s.logger.Error("failed to record deleted chunk", "error", err, "chunk_id", ref.ID)
+			}
+		}
+
+		nodes, err := s.storageManager.DeleteChunk(ref)
+		s.metadataStore.FinishChunkRemoval(ref.ID)
+		if err != nil {
+			// The tombstone stays, so the scrubber removes the remaining
+			// copies later
+			return nil, fmt.Errorf("failed to delete chunk %s from all nodes: %w", ref.ID, err)
+		}
+		if ref.ID == objectID {
+			deletedNodes = nodes
+		}
+	}
+	return deletedNodes, nil
+}
+
+// releaseObject deletes an object once the last key pointing at it is gone.
+// Objects still referenced, or already deleted, are left alone.
+func (s *Server) releaseObject(objectID string) {
+	if s.metadataStore.KeyReferences(objectID) > 0 {
+		return
+	}
+	nodes, err := s.deleteObject(objectID)
+	if errors.Is(err, errObjectNotFound) || errors.Is(err, metadata.ErrObjectReferenced) {
+		return
+	}
+	if err != nil {
+		s.logger.Error("failed to delete unreferenced object", "error", err, "object_id", objectID)
+		return
+	}
+	s.logger.Info("deleted unreferenced object", "object_id", objectID, "nodes", nodes)
 }
 
-// ensureReplication ensures an object has the required number of replicas
+// ensureReplication ensures an object has the required number of replicas.
+// An object stored as several chunks is checked chunk by chunk.
 func (s *Server) ensureReplication(objectID string, meta *metadata.ObjectMetadata) {
-	availableReplicas := s.storageManager.CheckReplicas(objectID)
+	// A shard lost or found corrupt is rebuilt along with the rest of its
+	// chunk, and belongs to whatever its chunk belongs to
+	chunks := []storage.Chunk{{ID: objectID}}
+	chunkID, dataShards, parityShards, _, isShard := storage.ParseShardID(objectID)
+	if isShard {
+		chunks[0] = storage.Chunk{ID: chunkID, DataShards: dataShards, ParityShards: parityShards}
+	} else {
+		chunkID = objectID
+		if meta != nil && len(meta.Chunks) > 0 {
+			chunks = storageChunks(meta.Chunks)
+		}
+	}
+
+	// Deleted objects must not be re-replicated, unless their content is
+	// still a chunk of another object
+	if s.metadataStore.IsTombstoned(chunkID) {
+		return
+	}
+
+	replicated := 0
+	for _, chunk := range chunks {
+		if !chunk.ErasureCoded() {
+			replicated += s.replicateChunk(chunk.ID)
+			continue
+		}
+
+		rebuilt, err := s.storageManager.RepairShards(chunk.ID, chunk.DataShards, chunk.ParityShards)
+		if err != nil {
+			s.logger.Error("failed to repair shards", "error", err, "object_id", objectID, "chunk_id", chunk.ID)
+		}
+		replicated += rebuilt
+	}
+
+	// Update metadata with new replica list
+	if replicated > 0 && meta != nil {
+		meta.Replicas = s.objectReplicas(meta)
+		if err := s.metadataStore.Save(meta); err != nil {
+			s.logger.Error("failed to update metadata after replication", "error", err, "object_id", objectID)
+		}
+	}
+}
+
+// replicateChunk copies a chunk, or an object stored whole, to the target
+// nodes missing it and returns how many copies it made
+func (s *Server) replicateChunk(chunkID string) int {
+	availableReplicas := s.storageManager.CheckReplicas(chunkID)
 	if len(availableReplicas) >= s.replication {
-		return // Already have enough replicas
+		return 0 // Already have enough replicas
 	}
 
 	s.logger.Info("detected missing replicas, starting self-healing",
-		"object_id", objectID,
+		"object_id", chunkID,
 		"current_replicas", len(availableReplicas),
 		"required", s.replication)
 
 	// Get target nodes from hash ring
-	targetNodes := s.storageManager.GetTargetNodes(objectID)
+	targetNodes := s.storageManager.GetTargetNodes(chunkID)
 
 	// Create a set of available replicas for quick lookup
 	availableSet := make(map[string]bool)
@@ -209,17 +595,17 @@ func (s *Server) ensureReplication(objectID string, meta *metadata.ObjectMetadat
 		}
 
 		// Replicate to this node (ReplicateObject will retrieve the object internally)
-		if err := s.storageManager.ReplicateObject(objectID, targetNodeID); err != nil {
+		if err := s.storageManager.ReplicateObject(chunkID, targetNodeID); err != nil {
 			s.logger.Error("failed to replicate object to node",
 				"error", err,
-				"object_id", objectID,
+				"object_id", chunkID,
 				"target_node", targetNodeID)
 			continue
 		}
 
 		replicated++
 		s.logger.Info("replicated object to node",
-			"object_id", objectID,
+			"object_id", chunkID,
 			"node_id", targetNodeID)
 
 		if len(availableReplicas)+replicated >= s.replication {
@@ -227,50 +613,85 @@ func (s *Server) ensureReplication(objectID string, meta *metadata.ObjectMetadat
 		}
 	}
 
-	// Update metadata with new replica list
-	if replicated > 0 {
-		updatedReplicas := s.storageManager.CheckReplicas(objectID)
-		meta.Replicas = updatedReplicas
-		if err := s.metadataStore.Save(meta); err != nil {
-			s.logger.Error("failed to update metadata after replication", "error", err, "object_id", objectID)
-		}
-	}
+	return replicated
 }
 
 // respondWithMetadata sends metadata as JSON response
 func (s *Server) respondWithMetadata(w http.ResponseWriter, meta *metadata.ObjectMetadata, statusCode int) {
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(statusCode)
+	s.respondWithJSON(w, metadataResponse(meta), statusCode)
+}
 
-	response := map[string]interface{}{
+// respondWithPut sends metadata as JSON response together with how many
+// replicas the write reached
+func (s *Server) respondWithPut(w http.ResponseWriter, meta *metadata.ObjectMetadata, result *storage.PutResult, statusCode int) {
+	response := metadataResponse(meta)
+	response["consistency"] = result.Consistency
+	response["replicas_written"] = len(result.Replicas)
+	response["replicas_required"] = result.Required
+	s.respondWithJSON(w, response, statusCode)
+}
+
+// metadataResponse builds the JSON fields describing an object
+func metadataResponse(meta *metadata.ObjectMetadata) map[string]interface{} {
+	durability := meta.Durability
+	if durability == "" {
+		durability = string(storage.DurabilityReplicated)
+	}
+
+	return map[string]interface{}{
 		"id":           meta.ID,
 		"size":         meta.Size,
 		"content_type": meta.ContentType,
 		"created_at":   meta.CreatedAt.Format(time.RFC3339),
-		"replicas":    meta.Replicas,
+		"replicas":     meta.Replicas,
+		"durability":   durability,
 	}
+}
 
-	if err := json.NewEncoder(w).Encode(response); err != nil {
+// respondWithJSON sends a value as JSON response
+func (s *Server) respondWithJSON(w http.ResponseWriter, value interface{}, statusCode int) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+
+	if err := json.NewEncoder(w).Encode(value); err != nil {
 		s.logger.Error("failed to encode response", "error", err)
 	}
 }
 
-// byteReader implements io.ReaderAt for byte slices
-type byteReader struct {
-	data []byte
+// requestDurability reads the optional durability header of a request; an
+// empty result means the bucket's or the manager's default
+func requestDurability(r *http.Request) (storage.Durability, error) {
+	header := r.Header.Get(DurabilityHeader)
+	if header == "" {
+		return "", nil
+	}
+	return storage.ParseDurability(header)
 }
 
-func (br *byteReader) ReadAt(p []byte, off int64) (n int, err error) {
-	if off < 0 {
-		return 0, fmt.Errorf("negative offset")
+// requestConsistency reads the optional write consistency header of a
+// request; an empty result means the manager's default
+func requestConsistency(r *http.Request) (storage.Consistency, error) {
+	header := r.Header.Get(ConsistencyHeader)
+	if header == "" {
+		return "", nil
 	}
-	if off >= int64(len(br.data)) {
-		return 0, io.EOF
-	}
-	n = copy(p, br.data[off:])
-	if n < len(p) {
-		err = io.EOF
-	}
-	return n, err
+	return storage.ParseConsistency(header)
 }
 
+// nextFilePart advances a multipart reader to the form file with the given field name
+func nextFilePart(reader *multipart.Reader, field string) (*multipart.Part, error) {
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			return nil, fmt.Errorf("no %q field in form", field)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if part.FormName() == field && part.FileName() != "" {
+			return part, nil
+		}
+		part.Close()
+	}
+}
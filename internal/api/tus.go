@@ -0,0 +1,378 @@
+package api
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/caskos/caskos/internal/metadata"
+	"github.com/caskos/caskos/internal/storage"
+	"github.com/caskos/caskos/internal/upload"
+)
+
+// ObjectIDHeader carries the ID of the object a finished tus upload was
+// stored as
+const ObjectIDHeader = "X-Object-Id"
+
+const (
+	tusVersion     = "1.0.0"
+	tusExtensions  = "creation,creation-with-upload,termination,checksum,expiration"
+	tusContentType = "application/offset+octet-stream"
+
+	// statusChecksumMismatch is the status tus assigns to a part that fails
+	// its checksum
+	statusChecksumMismatch = 460
+)
+
+// tusChecksumAlgorithms are the algorithms accepted in Upload-Checksum
+var tusChecksumAlgorithms = map[string]func() hash.Hash{
+	"md5":    md5.New,
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+}
+
+// TusOptionsHandler describes the tus protocol support of the server
+func (s *Server) TusOptionsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodOptions {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	algorithms := make([]string, 0, len(tusChecksumAlgorithms))
+	for algorithm := range tusChecksumAlgorithms {
+		algorithms = append(algorithms, algorithm)
+	}
+	sort.Strings(algorithms)
+
+	w.Header().Set("Tus-Resumable", tusVersion)
+	w.Header().Set("Tus-Version", tusVersion)
+	w.Header().Set("Tus-Extension", tusExtensions)
+	w.Header().Set("Tus-Checksum-Algorithm", strings.Join(algorithms, ","))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// TusCreateHandler starts a tus upload. The Upload-Metadata values filetype
+// (or type) set the content type, and bucket, key and filename store the
+// upload under a key like UploadHandler does. The body may carry the first
+// part of the upload.
+func (s *Server) TusCreateHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !tusRequest(w, r) || !s.uploadsEnabled(w) {
+		return
+	}
+
+	if r.Header.Get("Upload-Defer-Length") != "" {
+		http.Error(w, "Deferred upload length is not supported", http.StatusBadRequest)
+		return
+	}
+	size, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || size < 0 {
+		http.Error(w, "Invalid Upload-Length header", http.StatusBadRequest)
+		return
+	}
+
+	values, err := parseTusMetadata(r.Header.Get("Upload-Metadata"))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid Upload-Metadata header: %v", err), http.StatusBadRequest)
+		return
+	}
+	consistency, err := requestConsistency(r)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid %s header: %v", ConsistencyHeader, err), http.StatusBadRequest)
+		return
+	}
+
+	// Fail now rather than once the whole upload has been sent
+	if bucket := values["bucket"]; bucket != "" {
+		if values["key"] == "" && values["filename"] == "" {
+			http.Error(w, "Key is required", http.StatusBadRequest)
+			return
+		}
+		if _, err := s.metadataStore.GetBucket(bucket); err != nil {
+			s.namespaceError(w, err, "Failed to create upload")
+			return
+		}
+	}
+
+	contentType := values["filetype"]
+	if contentType == "" {
+		contentType = values["type"]
+	}
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+
+	session, err := s.uploads.Create(size, contentType, values)
+	if err != nil {
+		s.logger.Error("failed to create upload session", "error", err)
+		http.Error(w, fmt.Sprintf("Failed to create upload: %v", err), http.StatusInternalServerError)
+		return
+	}
+	s.logger.Info("created tus upload", "session_id", session.ID, "size", session.Size)
+	w.Header().Set("Location", "/files/"+session.ID)
+
+	finish := func(session *upload.Session) (*upload.Session, error) {
+		return s.finishTusUpload(r.Context(), session, consistency)
+	}
+
+	if r.ContentLength != 0 && r.Header.Get("Content-Type") == tusContentType {
+		checksum, err := tusChecksum(r.Header.Get("Upload-Checksum"))
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Invalid Upload-Checksum header: %v", err), http.StatusBadRequest)
+			return
+		}
+		written, err := s.uploads.AppendPart(session.ID, 0, r.ContentLength, r.Body, checksum, finish)
+		if err != nil {
+			s.tusError(w, err)
+			return
+		}
+		session = written
+		w.Header().Set("Upload-Offset", strconv.FormatInt(session.Offset(), 10))
+	} else if session.Complete() {
+		if session, err = finish(session); err != nil {
+			s.tusError(w, err)
+			return
+		}
+	}
+	if session.ObjectID != "" {
+		w.Header().Set(ObjectIDHeader, session.ObjectID)
+	}
+
+	w.Header().Set("Upload-Expires", session.ExpiresAt.UTC().Format(http.TimeFormat))
+	w.WriteHeader(http.StatusCreated)
+}
+
+// TusHeadHandler reports the offset of a tus upload. An upload that holds
+// all its data but could not be stored yet reports its last byte as missing,
+// so the client sends it again and the next PATCH retries storing it.
+func (s *Server) TusHeadHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodHead {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !tusRequest(w, r) || !s.uploadsEnabled(w) {
+		return
+	}
+
+	session, err := s.uploads.Get(r.PathValue("id"))
+	if err != nil {
+		s.tusError(w, err)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Upload-Offset", strconv.FormatInt(session.ResumeOffset(), 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(session.Size, 10))
+	if len(session.Metadata) > 0 {
+		w.Header().Set("Upload-Metadata", formatTusMetadata(session.Metadata))
+	}
+	if session.ObjectID != "" {
+		w.Header().Set(ObjectIDHeader, session.ObjectID)
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// TusPatchHandler appends the request body to a tus upload at the offset
+// given by Upload-Offset, and stores the upload once it is complete
+func (s *Server) TusPatchHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPatch {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !tusRequest(w, r) || !s.uploadsEnabled(w) {
+		return
+	}
+
+	if r.Header.Get("Content-Type") != tusContentType {
+		http.Error(w, "Content-Type must be "+tusContentType, http.StatusUnsupportedMediaType)
+		return
+	}
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || offset < 0 {
+		http.Error(w, "Invalid Upload-Offset header", http.StatusBadRequest)
+		return
+	}
+	checksum, err := tusChecksum(r.Header.Get("Upload-Checksum"))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid Upload-Checksum header: %v", err), http.StatusBadRequest)
+		return
+	}
+	consistency, err := requestConsistency(r)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid %s header: %v", ConsistencyHeader, err), http.StatusBadRequest)
+		return
+	}
+
+	finish := func(session *upload.Session) (*upload.Session, error) {
+		return s.finishTusUpload(r.Context(), session, consistency)
+	}
+	session, err := s.uploads.AppendPart(r.PathValue("id"), offset, r.ContentLength, r.Body, checksum, finish)
+	if err != nil {
+		s.tusError(w, err)
+		return
+	}
+	if session.ObjectID != "" {
+		w.Header().Set(ObjectIDHeader, session.ObjectID)
+	}
+
+	w.Header().Set("Upload-Offset", strconv.FormatInt(session.Offset(), 10))
+	w.Header().Set("Upload-Expires", session.ExpiresAt.UTC().Format(http.TimeFormat))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// TusDeleteHandler terminates a tus upload and discards its data
+func (s *Server) TusDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !tusRequest(w, r) || !s.uploadsEnabled(w) {
+		return
+	}
+
+	sessionID := r.PathValue("id")
+	if err := s.uploads.Remove(sessionID); err != nil {
+		s.tusError(w, err)
+		return
+	}
+
+	s.logger.Info("terminated tus upload", "session_id", sessionID)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// finishTusUpload stores a complete upload, under a key if its metadata
+// names a bucket, and records the object on the session
+func (s *Server) finishTusUpload(ctx context.Context, session *upload.Session, consistency storage.Consistency) (*upload.Session, error) {
+	file, _, err := s.uploads.Open(session.ID)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var objectID string
+	if bucket := session.Metadata["bucket"]; bucket != "" {
+		key := session.Metadata["key"]
+		if key == "" {
+			key = session.Metadata["filename"]
+		}
+		entry := &metadata.KeyEntry{Bucket: bucket, Key: key, ContentType: session.ContentType}
+		result, err := s.putKey(ctx, entry, file, consistency, "", nil)
+		if err != nil {
+			return nil, err
+		}
+		objectID = result.ObjectID
+	} else {
+		meta, result, created, err := s.putContent(ctx, file, session.ContentType, consistency, "")
+		if err != nil {
+			return nil, err
+		}
+		s.storageManager.ReleasePut(result)
+		if created {
+			// meta is not used once this returns, so repair may update it then
+			defer func() { go s.ensureReplication(meta.ID, meta) }()
+		}
+		objectID = result.ObjectID
+	}
+
+	s.logger.Info("completed tus upload", "session_id", session.ID, "object_id", objectID, "size", session.Size)
+	return s.uploads.Finish(session.ID, objectID)
+}
+
+// tusError reports an error from a tus upload operation
+func (s *Server) tusError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, upload.ErrChecksumMismatch):
+		http.Error(w, "Checksum mismatch", statusChecksumMismatch)
+	case errors.Is(err, upload.ErrOffsetMismatch), errors.Is(err, upload.ErrFinished):
+		http.Error(w, "Upload-Offset does not match the upload offset", http.StatusConflict)
+	case errors.Is(err, upload.ErrSessionNotFound),
+		errors.Is(err, upload.ErrOutOfRange),
+		errors.Is(err, upload.ErrIncomplete):
+		s.uploadError(w, err)
+	default:
+		s.putKeyError(w, err)
+	}
+}
+
+// tusRequest sets the protocol version on the response and rejects requests
+// made for another version
+func tusRequest(w http.ResponseWriter, r *http.Request) bool {
+	w.Header().Set("Tus-Resumable", tusVersion)
+	if r.Header.Get("Tus-Resumable") != tusVersion {
+		w.Header().Set("Tus-Version", tusVersion)
+		http.Error(w, "Unsupported tus version", http.StatusPreconditionFailed)
+		return false
+	}
+	return true
+}
+
+// tusChecksum parses an Upload-Checksum header, returning nil if it is empty
+func tusChecksum(header string) (*upload.Checksum, error) {
+	if header == "" {
+		return nil, nil
+	}
+
+	algorithm, encoded, _ := strings.Cut(header, " ")
+	newHash, ok := tusChecksumAlgorithms[algorithm]
+	if !ok {
+		return nil, fmt.Errorf("unsupported algorithm %q", algorithm)
+	}
+	sum, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("invalid checksum: %w", err)
+	}
+	return &upload.Checksum{Hash: newHash(), Sum: sum}, nil
+}
+
+// parseTusMetadata parses an Upload-Metadata header of comma-separated keys,
+// each followed by a space and a base64 value unless the value is empty
+func parseTusMetadata(header string) (map[string]string, error) {
+	if header == "" {
+		return nil, nil
+	}
+
+	values := make(map[string]string)
+	for _, pair := range strings.Split(header, ",") {
+		key, encoded, _ := strings.Cut(strings.TrimSpace(pair), " ")
+		if key == "" {
+			return nil, errors.New("empty key")
+		}
+		value, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value for %s: %w", key, err)
+		}
+		values[key] = string(value)
+	}
+	return values, nil
+}
+
+// formatTusMetadata formats values as an Upload-Metadata header
+func formatTusMetadata(values map[string]string) string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	pairs := make([]string, 0, len(keys))
+	for _, key := range keys {
+		if values[key] == "" {
+			pairs = append(pairs, key)
+			continue
+		}
+		pairs = append(pairs, key+" "+base64.StdEncoding.EncodeToString([]byte(values[key])))
+	}
+	return strings.Join(pairs, ",")
+}
@@ -0,0 +1,218 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/caskos/caskos/internal/storage"
+	"github.com/caskos/caskos/internal/upload"
+)
+
+// createUploadRequest is the body of a create-upload request
+type createUploadRequest struct {
+	Size        int64  `json:"size"`
+	ContentType string `json:"content_type"`
+}
+
+// CreateUploadHandler starts a resumable upload session. Parts are then sent
+// with PUT /uploads/{id}?offset=N in any order, and the upload is stored
+// with POST /uploads/{id}/complete once every byte has arrived.
+func (s *Server) CreateUploadHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !s.uploadsEnabled(w) {
+		return
+	}
+
+	var req createUploadRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid request body: %v", err), http.StatusBadRequest)
+		return
+	}
+	if req.Size < 0 {
+		http.Error(w, "Upload size must not be negative", http.StatusBadRequest)
+		return
+	}
+	if req.ContentType == "" {
+		req.ContentType = "application/octet-stream"
+	}
+
+	session, err := s.uploads.Create(req.Size, req.ContentType, nil)
+	if err != nil {
+		s.logger.Error("failed to create upload session", "error", err)
+		http.Error(w, fmt.Sprintf("Failed to create upload: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	s.logger.Info("created upload session", "session_id", session.ID, "size", session.Size)
+	w.Header().Set("Location", "/uploads/"+session.ID)
+	s.respondWithJSON(w, sessionResponse(session), http.StatusCreated)
+}
+
+// GetUploadHandler reports which byte ranges of an upload have been received
+func (s *Server) GetUploadHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !s.uploadsEnabled(w) {
+		return
+	}
+
+	session, err := s.uploads.Get(r.PathValue("id"))
+	if err != nil {
+		s.uploadError(w, err)
+		return
+	}
+
+	s.respondWithJSON(w, sessionResponse(session), http.StatusOK)
+}
+
+// PutUploadPartHandler writes the request body into an upload at the offset
+// given by the offset query parameter. Parts may overlap or be sent again.
+func (s *Server) PutUploadPartHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !s.uploadsEnabled(w) {
+		return
+	}
+
+	offset, err := strconv.ParseInt(r.URL.Query().Get("offset"), 10, 64)
+	if err != nil || offset < 0 {
+		http.Error(w, "Invalid offset", http.StatusBadRequest)
+		return
+	}
+
+	session, err := s.uploads.WritePart(r.PathValue("id"), offset, r.ContentLength, r.Body, nil)
+	if err != nil {
+		s.uploadError(w, err)
+		return
+	}
+
+	s.respondWithJSON(w, sessionResponse(session), http.StatusOK)
+}
+
+// CompleteUploadHandler stores the assembled upload under its content ID
+// and ends the session. If the write misses its quorum the session is kept,
+// so completing it again retries the write.
+func (s *Server) CompleteUploadHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !s.uploadsEnabled(w) {
+		return
+	}
+
+	sessionID := r.PathValue("id")
+	file, session, err := s.uploads.Open(sessionID)
+	if err != nil {
+		s.uploadError(w, err)
+		return
+	}
+	defer file.Close()
+
+	meta, result, created, err := s.putContent(r.Context(), file, session.ContentType, "", "")
+	if err == nil {
+		s.storageManager.ReleasePut(result)
+	}
+	var quorumErr *storage.QuorumError
+	if errors.As(err, &quorumErr) {
+		s.logger.Error("failed to store object", "error", err, "session_id", sessionID)
+		http.Error(w, fmt.Sprintf("Failed to store object: %v", err), http.StatusServiceUnavailable)
+		return
+	}
+	if err != nil {
+		s.logger.Error("failed to store object", "error", err, "session_id", sessionID)
+		http.Error(w, fmt.Sprintf("Failed to store object: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	if err := s.uploads.Remove(sessionID); err != nil {
+		s.logger.Error("failed to remove completed upload session", "session_id", sessionID, "error", err)
+	}
+	s.logger.Info("completed upload session", "session_id", sessionID, "object_id", meta.ID, "size", session.Size)
+
+	if !created {
+		s.respondWithMetadata(w, meta, http.StatusOK)
+		return
+	}
+
+	s.respondWithMetadata(w, meta, http.StatusCreated)
+
+	// Check for missing replicas once the response no longer reads meta
+	go s.ensureReplication(meta.ID, meta)
+}
+
+// DeleteUploadHandler aborts an upload and discards the data received
+func (s *Server) DeleteUploadHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !s.uploadsEnabled(w) {
+		return
+	}
+
+	sessionID := r.PathValue("id")
+	if err := s.uploads.Remove(sessionID); err != nil {
+		s.uploadError(w, err)
+		return
+	}
+
+	s.logger.Info("aborted upload session", "session_id", sessionID)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// uploadsEnabled reports whether upload sessions are configured, and
+// responds with an error if not
+func (s *Server) uploadsEnabled(w http.ResponseWriter) bool {
+	if s.uploads == nil {
+		http.Error(w, "Resumable uploads are not enabled", http.StatusNotFound)
+		return false
+	}
+	return true
+}
+
+// uploadError reports an error from an upload session operation
+func (s *Server) uploadError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, upload.ErrSessionNotFound):
+		http.Error(w, "Upload not found", http.StatusNotFound)
+	case errors.Is(err, upload.ErrOutOfRange):
+		http.Error(w, "Part extends past the upload size", http.StatusBadRequest)
+	case errors.Is(err, upload.ErrIncomplete):
+		http.Error(w, "Upload is missing data", http.StatusConflict)
+	case errors.Is(err, upload.ErrFinished):
+		http.Error(w, "Upload is already finished", http.StatusConflict)
+	default:
+		s.logger.Error("upload session operation failed", "error", err)
+		http.Error(w, fmt.Sprintf("Upload failed: %v", err), http.StatusInternalServerError)
+	}
+}
+
+// sessionResponse builds the JSON fields describing an upload session
+func sessionResponse(session *upload.Session) map[string]interface{} {
+	response := map[string]interface{}{
+		"id":             session.ID,
+		"size":           session.Size,
+		"content_type":   session.ContentType,
+		"received":       session.Received,
+		"received_bytes": session.ReceivedBytes(),
+		"complete":       session.Complete(),
+		"created_at":     session.CreatedAt.Format(time.RFC3339),
+		"expires_at":     session.ExpiresAt.Format(time.RFC3339),
+	}
+	if session.ObjectID != "" {
+		response["object_id"] = session.ObjectID
+	}
+	return response
+}
@@ -3,23 +3,44 @@ package hashring
 import (
 	"crypto/sha256"
 	"fmt"
+	"maps"
+	"math"
+	"slices"
 	"sort"
+	"strings"
 	"sync"
 )
 
+// Labels naming the failure domains of a node, from the widest to the narrowest
+const (
+	LabelZone = "zone"
+	LabelRack = "rack"
+	LabelDisk = "disk"
+)
+
+// maxWeight caps the weight virtual nodes are counted for, so a huge weight
+// cannot make a node allocate an unbounded number of them
+const maxWeight = 100
+
+// failureDomains lists the labels placement spreads replicas over, in order
+var failureDomains = []string{LabelZone, LabelRack, LabelDisk}
+
 // Node represents a storage node in the hash ring
 type Node struct {
 	ID       string
-	Replicas int // Number of virtual nodes (replicas) for this physical node
+	Weight   float64           // Relative capacity; 1 is the default
+	Labels   map[string]string // Failure domains such as zone, rack and disk
+	Replicas int               // Number of virtual nodes (replicas) for this physical node
 }
 
 // HashRing implements consistent hashing for node selection
 type HashRing struct {
-	mu            sync.RWMutex
-	nodes         map[string]*Node
-	sortedHashes  []uint32
-	hashToNode    map[uint32]string
-	virtualNodes  int // Number of virtual nodes per physical node
+	mu           sync.RWMutex
+	nodes        map[string]*Node
+	sortedHashes []uint32
+	hashToNode   map[uint32]string
+	virtualNodes int   // Number of virtual nodes per physical node of weight 1
+	domainCounts []int // Number of distinct domains at each failure domain level
 }
 
 // NewHashRing creates a new hash ring with the specified number of virtual nodes per physical node
@@ -31,8 +52,20 @@ func NewHashRing(virtualNodes int) *HashRing {
 	}
 }
 
-// AddNode adds a physical node to the hash ring
+// AddNode adds a physical node to the hash ring with the default weight of 1
 func (hr *HashRing) AddNode(nodeID string) {
+	hr.AddWeightedNode(nodeID, 1)
+}
+
+// AddWeightedNode adds a physical node whose number of virtual nodes, and so
+// its share of the keys, scales with weight
+func (hr *HashRing) AddWeightedNode(nodeID string, weight float64) {
+	hr.AddLabeledNode(nodeID, weight, nil)
+}
+
+// AddLabeledNode adds a physical node with a weight and the labels of the
+// failure domains it lives in
+func (hr *HashRing) AddLabeledNode(nodeID string, weight float64, labels map[string]string) {
 	hr.mu.Lock()
 	defer hr.mu.Unlock()
 
@@ -41,25 +74,106 @@ func (hr *HashRing) AddNode(nodeID string) {
 	}
 
 	node := &Node{
-		ID:       nodeID,
-		Replicas: hr.virtualNodes,
+		ID:     nodeID,
+		Weight: weight,
+		Labels: maps.Clone(labels),
 	}
 	hr.nodes[nodeID] = node
+	hr.resize(node, hr.replicasFor(weight))
+	hr.countDomains()
+}
+
+// SetLabels replaces the failure domain labels of a node. It returns false if
+// the node is not in the ring.
+func (hr *HashRing) SetLabels(nodeID string, labels map[string]string) bool {
+	hr.mu.Lock()
+	defer hr.mu.Unlock()
+
+	node, exists := hr.nodes[nodeID]
+	if !exists {
+		return false
+	}
+
+	node.Labels = maps.Clone(labels)
+	hr.countDomains()
+	return true
+}
+
+// SetWeight changes the weight of a node in the ring. Virtual nodes are added
+// or removed at the end of the node's sequence, so only keys on those virtual
+// nodes move. It returns false if the node is not in the ring.
+func (hr *HashRing) SetWeight(nodeID string, weight float64) bool {
+	hr.mu.Lock()
+	defer hr.mu.Unlock()
+
+	node, exists := hr.nodes[nodeID]
+	if !exists {
+		return false
+	}
+
+	node.Weight = weight
+	hr.resize(node, hr.replicasFor(weight))
+	return true
+}
+
+// Weight returns the weight of a node, or 0 if it is not in the ring
+func (hr *HashRing) Weight(nodeID string) float64 {
+	hr.mu.RLock()
+	defer hr.mu.RUnlock()
 
+	if node, exists := hr.nodes[nodeID]; exists {
+		return node.Weight
+	}
+	return 0
+}
+
+// replicasFor returns the number of virtual nodes for a weight. Every node
+// keeps at least one so that it stays reachable, and weights above maxWeight
+// count as maxWeight.
+func (hr *HashRing) replicasFor(weight float64) int {
+	if math.IsNaN(weight) {
+		return 1
+	}
+	return max(1, int(math.Round(min(weight, maxWeight)*float64(hr.virtualNodes))))
+}
+
+// resize grows or shrinks the virtual nodes of a node to count. The caller
+// must hold the ring lock.
+func (hr *HashRing) resize(node *Node, count int) {
 	// Add virtual nodes
-	for i := 0; i < hr.virtualNodes; i++ {
-		virtualKey := fmt.Sprintf("%s:%d", nodeID, i)
-		hash := hr.hashKey(virtualKey)
-		hr.hashToNode[hash] = nodeID
+	for i := node.Replicas; i < count; i++ {
+		hash := HashKey(virtualKey(node.ID, i))
+		hr.hashToNode[hash] = node.ID
 		hr.sortedHashes = append(hr.sortedHashes, hash)
 	}
 
+	// Remove virtual nodes
+	if count < node.Replicas {
+		removed := make(map[uint32]bool, node.Replicas-count)
+		for i := count; i < node.Replicas; i++ {
+			hash := HashKey(virtualKey(node.ID, i))
+			if hr.hashToNode[hash] == node.ID {
+				removed[hash] = true
+				delete(hr.hashToNode, hash)
+			}
+		}
+		hr.sortedHashes = slices.DeleteFunc(hr.sortedHashes, func(hash uint32) bool {
+			return removed[hash]
+		})
+	}
+	node.Replicas = count
+
 	// Sort hashes for binary search
 	sort.Slice(hr.sortedHashes, func(i, j int) bool {
 		return hr.sortedHashes[i] < hr.sortedHashes[j]
 	})
 }
 
+// virtualKey returns the key hashed to place the i-th virtual node of a node
+func virtualKey(nodeID string, i int) string {
+	return fmt.Sprintf("%s:%d", nodeID, i)
+}
+
 // RemoveNode removes a physical node from the hash ring
 func (hr *HashRing) RemoveNode(nodeID string) {
 	hr.mu.Lock()
@@ -81,13 +195,26 @@ func (hr *HashRing) RemoveNode(nodeID string) {
 		}
 	}
 	hr.sortedHashes = newHashes
+	hr.countDomains()
 }
 
 // GetNodes returns N nodes for a given key, ensuring they are distinct
 func (hr *HashRing) GetNodes(key string, count int) []string {
 	hr.mu.RLock()
 	defer hr.mu.RUnlock()
+	return hr.nodesForHash(HashKey(key), count)
+}
 
+// nodesForHash returns N distinct nodes for a position on the ring. The
+// caller must hold the ring lock.
+//
+// Replicas are spread over failure domains: walking the ring from the
+// position, the first pass takes nodes in zones not used yet. If there are
+// fewer zones than replicas, the next pass takes nodes in racks not used yet,
+// then disks, and finally any node not chosen yet. Nodes without a label share
+// one domain at that level, so a ring without labels places keys on the next
+// N distinct nodes.
+func (hr *HashRing) nodesForHash(hash uint32, count int) []string {
 	if len(hr.nodes) == 0 {
 		return []string{}
 	}
@@ -96,36 +223,67 @@ func (hr *HashRing) GetNodes(key string, count int) []string {
 		count = len(hr.nodes)
 	}
 
-	hash := hr.hashKey(key)
 	nodes := make([]string, 0, count)
-	seen := make(map[string]bool)
+	chosen := make(map[string]bool, count)
+	start := hr.findNodeIndex(hash)
 
-	// Find the first node
-	idx := hr.findNodeIndex(hash)
-	if idx == -1 {
-		return []string{}
-	}
+	for level := 0; level < len(hr.domainCounts) && len(nodes) < count; level++ {
+		used := make(map[string]bool)
+		for _, nodeID := range nodes {
+			used[hr.domain(nodeID, level)] = true
+		}
 
-	// Collect distinct nodes
-	for len(nodes) < count {
-		nodeHash := hr.sortedHashes[idx]
-		nodeID := hr.hashToNode[nodeHash]
+		for i := 0; i < len(hr.sortedHashes) && len(nodes) < count; i++ {
+			if len(used) == hr.domainCounts[level] {
+				break // Every domain at this level holds a replica
+			}
 
-		if !seen[nodeID] {
-			nodes = append(nodes, nodeID)
-			seen[nodeID] = true
-		}
+			nodeID := hr.hashToNode[hr.sortedHashes[(start+i)%len(hr.sortedHashes)]]
+			if chosen[nodeID] {
+				continue
+			}
+			domain := hr.domain(nodeID, level)
+			if used[domain] {
+				continue
+			}
 
-		idx = (idx + 1) % len(hr.sortedHashes)
-		if idx == hr.findNodeIndex(hash) && len(nodes) < count {
-			// We've wrapped around, break to avoid infinite loop
-			break
+			used[domain] = true
+			chosen[nodeID] = true
+			nodes = append(nodes, nodeID)
 		}
 	}
 
 	return nodes
 }
 
+// domain returns the failure domain of a node at a level: its zone at level
+// 0, its zone and rack at level 1, and so on. The last level is the node
+// itself. The caller must hold the ring lock.
+func (hr *HashRing) domain(nodeID string, level int) string {
+	labels := hr.nodes[nodeID].Labels
+	parts := make([]string, 0, level+1)
+	for _, label := range failureDomains[:min(level+1, len(failureDomains))] {
+		parts = append(parts, labels[label])
+	}
+	if level >= len(failureDomains) {
+		parts = append(parts, nodeID)
+	}
+	return strings.Join(parts, "\x00")
+}
+
+// countDomains recomputes the number of distinct domains at each level after
+// nodes or labels changed. The caller must hold the ring lock.
+func (hr *HashRing) countDomains() {
+	hr.domainCounts = make([]int, len(failureDomains)+1)
+	for level := range hr.domainCounts {
+		domains := make(map[string]bool)
+		for nodeID := range hr.nodes {
+			domains[hr.domain(nodeID, level)] = true
+		}
+		hr.domainCounts[level] = len(domains)
+	}
+}
+
 // findNodeIndex finds the index of the first node with hash >= keyHash
 func (hr *HashRing) findNodeIndex(keyHash uint32) int {
 	idx := sort.Search(len(hr.sortedHashes), func(i int) bool {
@@ -140,8 +298,8 @@ func (hr *HashRing) findNodeIndex(keyHash uint32) int {
 	return idx
 }
 
-// hashKey computes a 32-bit hash of a key
-func (hr *HashRing) hashKey(key string) uint32 {
+// HashKey computes the 32-bit position of a key on the ring
+func HashKey(key string) uint32 {
 	h := sha256.Sum256([]byte(key))
 	return uint32(h[0])<<24 | uint32(h[1])<<16 | uint32(h[2])<<8 | uint32(h[3])
 }
@@ -165,3 +323,148 @@ func (hr *HashRing) NodeCount() int {
 	return len(hr.nodes)
 }
 
+// Shares returns, for each node, the fraction of the keyspace whose count
+// replica nodes include it. With count 1 this is the share of keys the node is
+// the primary owner of; with the replication factor it is the expected share
+// of objects the node stores.
+func (hr *HashRing) Shares(count int) map[string]float64 {
+	hr.mu.RLock()
+	defer hr.mu.RUnlock()
+
+	shares := make(map[string]float64, len(hr.nodes))
+	for nodeID := range hr.nodes {
+		shares[nodeID] = 0
+	}
+	if len(hr.sortedHashes) == 0 {
+		return shares
+	}
+
+	// Placement is constant on the arc that ends at each virtual node, so
+	// every arc is credited to the nodes chosen at its end. Unsigned
+	// subtraction wraps, which measures the first arc across zero.
+	const ringSize = float64(math.MaxUint32) + 1
+	for i, hash := range hr.sortedHashes {
+		length := float64(hash - hr.sortedHashes[(i+len(hr.sortedHashes)-1)%len(hr.sortedHashes)])
+		if len(hr.sortedHashes) == 1 {
+			length = ringSize // A single virtual node owns the whole ring
+		}
+		for _, nodeID := range hr.nodesForHash(hash, count) {
+			shares[nodeID] += length / ringSize
+		}
+	}
+
+	return shares
+}
+
+// Clone returns a copy of the ring that is not affected by later changes to it
+func (hr *HashRing) Clone() *HashRing {
+	hr.mu.RLock()
+	defer hr.mu.RUnlock()
+
+	clone := &HashRing{
+		nodes:        make(map[string]*Node, len(hr.nodes)),
+		sortedHashes: append([]uint32(nil), hr.sortedHashes...),
+		hashToNode:   make(map[uint32]string, len(hr.hashToNode)),
+		virtualNodes: hr.virtualNodes,
+		domainCounts: slices.Clone(hr.domainCounts),
+	}
+	for nodeID, node := range hr.nodes {
+		nodeCopy := *node
+		nodeCopy.Labels = maps.Clone(node.Labels)
+		clone.nodes[nodeID] = &nodeCopy
+	}
+	for hash, nodeID := range hr.hashToNode {
+		clone.hashToNode[hash] = nodeID
+	}
+
+	return clone
+}
+
+// Range is an arc of the ring covering the positions in (Start, End],
+// wrapping past zero when Start >= End. A range with Start == End covers the
+// whole ring.
+type Range struct {
+	Start uint32 `json:"start"`
+	End   uint32 `json:"end"`
+}
+
+// Contains reports whether a position on the ring falls inside the range
+func (r Range) Contains(hash uint32) bool {
+	if r.Start < r.End {
+		return hash > r.Start && hash <= r.End
+	}
+	return hash > r.Start || hash <= r.End
+}
+
+// ContainsKey reports whether any of the ranges contains the position of key
+func ContainsKey(ranges []Range, key string) bool {
+	hash := HashKey(key)
+	for _, r := range ranges {
+		if r.Contains(hash) {
+			return true
+		}
+	}
+	return false
+}
+
+// MovedRanges returns the arcs of the ring whose set of count replica nodes
+// differs between two versions of a ring, e.g. before and after a node joined.
+// Only keys in these ranges need to move when the ring changes.
+func MovedRanges(before, after *HashRing, count int) []Range {
+	before.mu.RLock()
+	defer before.mu.RUnlock()
+	after.mu.RLock()
+	defer after.mu.RUnlock()
+
+	// Placement is constant between consecutive virtual node positions of
+	// either ring, so comparing owners at each boundary covers every key
+	boundaries := make([]uint32, 0, len(before.sortedHashes)+len(after.sortedHashes))
+	boundaries = append(boundaries, before.sortedHashes...)
+	boundaries = append(boundaries, after.sortedHashes...)
+	sort.Slice(boundaries, func(i, j int) bool { return boundaries[i] < boundaries[j] })
+	boundaries = slices.Compact(boundaries)
+	if len(boundaries) == 0 {
+		return nil
+	}
+
+	moved := make([]bool, len(boundaries))
+	for i, hash := range boundaries {
+		moved[i] = !sameNodes(before.nodesForHash(hash, count), after.nodesForHash(hash, count))
+	}
+
+	// Boundary i closes the arc that starts at boundary i-1, and the first
+	// boundary closes the arc that wraps around from the last one
+	var ranges []Range
+	for i := range boundaries {
+		if !moved[i] {
+			continue
+		}
+		start := boundaries[(i+len(boundaries)-1)%len(boundaries)]
+		if len(ranges) > 0 && ranges[len(ranges)-1].End == start {
+			ranges[len(ranges)-1].End = boundaries[i]
+			continue
+		}
+		ranges = append(ranges, Range{Start: start, End: boundaries[i]})
+	}
+
+	// Merge the last arc into the first when they meet across zero
+	if len(ranges) > 1 && ranges[len(ranges)-1].End == ranges[0].Start {
+		ranges[0].Start = ranges[len(ranges)-1].Start
+		ranges = ranges[:len(ranges)-1]
+	}
+
+	return ranges
+}
+
+// sameNodes reports whether two node lists contain the same IDs in any order
+func sameNodes(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for _, nodeID := range a {
+		if !slices.Contains(b, nodeID) {
+			return false
+		}
+	}
+	return true
+}
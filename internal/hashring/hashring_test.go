@@ -1,6 +1,8 @@
 package hashring
 
 import (
+	"fmt"
+	"math"
 	"testing"
 )
 
@@ -90,3 +92,213 @@ func TestHashRing_EmptyRing(t *testing.T) {
 	}
 }
 
+
+func TestHashRing_MovedRanges(t *testing.T) {
+	ring := NewHashRing(10)
+	ring.AddNode("node1")
+	ring.AddNode("node2")
+	ring.AddNode("node3")
+
+	before := ring.Clone()
+	if ranges := MovedRanges(before, ring, 2); len(ranges) != 0 {
+		t.Errorf("expected no moved ranges for an unchanged ring, got %d", len(ranges))
+	}
+
+	ring.AddNode("node4")
+	ranges := MovedRanges(before, ring, 2)
+	if len(ranges) == 0 {
+		t.Fatal("expected moved ranges after adding a node")
+	}
+
+	// Exactly the keys whose replica set changed must fall into a moved range
+	moved := 0
+	for i := 0; i < 2000; i++ {
+		key := fmt.Sprintf("object-%d", i)
+		changed := !sameNodes(before.GetNodes(key, 2), ring.GetNodes(key, 2))
+		if changed {
+			moved++
+		}
+		if ContainsKey(ranges, key) != changed {
+			t.Fatalf("key %s: changed=%v but in moved range=%v", key, changed, !changed)
+		}
+	}
+
+	if moved == 0 || moved == 2000 {
+		t.Errorf("expected only part of the keyspace to move, moved %d of 2000", moved)
+	}
+}
+
+func TestRange_ContainsWrapsAroundZero(t *testing.T) {
+	r := Range{Start: 4000000000, End: 100}
+	if !r.Contains(4100000000) || !r.Contains(0) || !r.Contains(100) {
+		t.Error("expected wrapping range to contain positions on both sides of zero")
+	}
+	if r.Contains(101) || r.Contains(4000000000) {
+		t.Error("expected wrapping range to exclude positions outside it")
+	}
+}
+
+func TestHashRing_WeightedShares(t *testing.T) {
+	ring := NewHashRing(200)
+
+	ring.AddNode("node1")
+	ring.AddNode("node2")
+	ring.AddWeightedNode("node3", 2)
+
+	shares := ring.Shares(1)
+	total := 0.0
+	for _, share := range shares {
+		total += share
+	}
+	if math.Abs(total-1) > 1e-9 {
+		t.Errorf("expected shares to sum to 1, got %f", total)
+	}
+
+	// node3 has twice the weight, so it owns about half of the keyspace
+	if shares["node3"] < 0.4 || shares["node3"] > 0.6 {
+		t.Errorf("expected node3 to own about half the keyspace, got %f", shares["node3"])
+	}
+
+	// With 2 replicas per key every key is counted twice
+	total = 0
+	for _, share := range ring.Shares(2) {
+		total += share
+	}
+	if math.Abs(total-2) > 1e-9 {
+		t.Errorf("expected replica shares to sum to 2, got %f", total)
+	}
+}
+
+func TestHashRing_SetWeightMovesOnlyAffectedKeys(t *testing.T) {
+	ring := NewHashRing(50)
+
+	ring.AddNode("node1")
+	ring.AddNode("node2")
+	ring.AddNode("node3")
+
+	before := make(map[string]string)
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		before[key] = ring.GetNodes(key, 1)[0]
+	}
+
+	if !ring.SetWeight("node2", 2) {
+		t.Fatal("expected node2 to be in the ring")
+	}
+	if ring.Weight("node2") != 2 {
+		t.Errorf("expected weight 2, got %f", ring.Weight("node2"))
+	}
+
+	// Raising a weight only moves keys onto that node
+	moved := 0
+	for key, owner := range before {
+		after := ring.GetNodes(key, 1)[0]
+		if after == owner {
+			continue
+		}
+		moved++
+		if after != "node2" {
+			t.Errorf("key %s moved from %s to %s", key, owner, after)
+		}
+	}
+	if moved == 0 {
+		t.Error("expected some keys to move to node2")
+	}
+
+	// Setting the weight back restores the original placement
+	ring.SetWeight("node2", 1)
+	for key, owner := range before {
+		if after := ring.GetNodes(key, 1)[0]; after != owner {
+			t.Errorf("key %s: expected %s after restoring weight, got %s", key, owner, after)
+		}
+	}
+}
+
+func TestHashRing_PlacementSpansZones(t *testing.T) {
+	ring := NewHashRing(50)
+
+	// Two nodes in each of three zones
+	zones := make(map[string]string)
+	for i := 0; i < 6; i++ {
+		nodeID := fmt.Sprintf("node%d", i+1)
+		zones[nodeID] = fmt.Sprintf("zone%d", i%3)
+		ring.AddLabeledNode(nodeID, 1, map[string]string{LabelZone: zones[nodeID]})
+	}
+
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		nodes := ring.GetNodes(key, 3)
+		if len(nodes) != 3 {
+			t.Fatalf("expected 3 nodes, got %v", nodes)
+		}
+
+		spread := make(map[string]bool)
+		for _, nodeID := range nodes {
+			spread[zones[nodeID]] = true
+		}
+		if len(spread) != 3 {
+			t.Errorf("key %s: replicas %v share a zone", key, nodes)
+		}
+
+		// The primary is still the owner of the key's position
+		if primary := ring.GetNodes(key, 1)[0]; nodes[0] != primary {
+			t.Errorf("key %s: expected primary %s, got %s", key, primary, nodes[0])
+		}
+	}
+}
+
+func TestHashRing_PlacementFallsBackToRacks(t *testing.T) {
+	ring := NewHashRing(50)
+
+	// Two zones with two racks each, and two disks in every rack
+	labels := make(map[string]map[string]string)
+	for i := 0; i < 8; i++ {
+		nodeID := fmt.Sprintf("node%d", i+1)
+		labels[nodeID] = map[string]string{
+			LabelZone: fmt.Sprintf("zone%d", i%2),
+			LabelRack: fmt.Sprintf("rack%d", (i/2)%2),
+			LabelDisk: fmt.Sprintf("disk%d", i/4),
+		}
+		ring.AddLabeledNode(nodeID, 1, labels[nodeID])
+	}
+
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		nodes := ring.GetNodes(key, 4)
+
+		// Only two zones exist, so four replicas use both zones and then
+		// distinct racks within them
+		zones := make(map[string]bool)
+		racks := make(map[string]bool)
+		for _, nodeID := range nodes {
+			zones[labels[nodeID][LabelZone]] = true
+			racks[labels[nodeID][LabelZone]+"/"+labels[nodeID][LabelRack]] = true
+		}
+		if len(zones) != 2 || len(racks) != 4 {
+			t.Errorf("key %s: replicas %v span %d zones and %d racks", key, nodes, len(zones), len(racks))
+		}
+	}
+
+	// With more replicas than racks the remaining ones still go to distinct nodes
+	if nodes := ring.GetNodes("key", 8); len(nodes) != 8 {
+		t.Errorf("expected 8 distinct nodes, got %v", nodes)
+	}
+}
+
+func TestHashRing_WeightBounds(t *testing.T) {
+	ring := NewHashRing(10)
+
+	// Huge weights are capped and invalid ones keep a single virtual node
+	ring.AddWeightedNode("huge", 1e300)
+	ring.AddWeightedNode("nan", math.NaN())
+	ring.AddWeightedNode("inf", math.Inf(1))
+	if replicas := ring.nodes["huge"].Replicas; replicas != maxWeight*10 {
+		t.Errorf("expected %d virtual nodes for a huge weight, got %d", maxWeight*10, replicas)
+	}
+	if replicas := ring.nodes["nan"].Replicas; replicas != 1 {
+		t.Errorf("expected 1 virtual node for a NaN weight, got %d", replicas)
+	}
+	if replicas := ring.nodes["inf"].Replicas; replicas != maxWeight*10 {
+		t.Errorf("expected %d virtual nodes for an infinite weight, got %d", maxWeight*10, replicas)
+	}
+}
@@ -0,0 +1,158 @@
+package metadata
+
+// ChunkRef references a chunk of an object's content. Chunks are stored as
+// objects of their own, named by the hash of their content, so identical
+// chunks of different objects are stored once.
+type ChunkRef struct {
+	ID           string `json:"id"`
+	Size         int64  `json:"size"`
+	DataShards   int    `json:"data_shards,omitempty"` // Set if the chunk is erasure-coded
+	ParityShards int    `json:"parity_shards,omitempty"`
+}
+
+// ChunkRefs returns the chunks an object is made of. An object stored as a
+// single chunk lists none, since that chunk is the object itself.
+func (m *ObjectMetadata) ChunkRefs() []ChunkRef {
+	if len(m.Chunks) > 0 {
+		return m.Chunks
+	}
+	return []ChunkRef{{ID: m.ID, Size: m.Size}}
+}
+
+// chunkUsage counts the objects referencing a chunk
+type chunkUsage struct {
+	refs int
+	size int64
+}
+
+// StoreStats summarizes how much data the stored objects hold
+type StoreStats struct {
+	Objects       int   // Objects with metadata
+	LogicalBytes  int64 // Total size of those objects
+	Chunks        int   // Distinct chunks the objects reference
+	PhysicalBytes int64 // Total size of those chunks, each counted once
+}
+
+// loadChunkRefs counts the chunk references of the given objects. The counts
+// are not persisted, so this reads the metadata file of every object and
+// makes opening the store take time in proportion to the number of objects.
+func (s *Store) loadChunkRefs(objectIDs []string) error {
+	s.chunks = make(map[string]*chunkUsage)
+	for _, objectID := range objectIDs {
+		var meta ObjectMetadata
+		if err := s.readJSON(s.metadataPath(objectID), &meta); err != nil {
+			return err
+		}
+		s.addChunkRefs(&meta)
+	}
+	return nil
+}
+
+// addChunkRefs records that an object references its chunks
+func (s *Store) addChunkRefs(meta *ObjectMetadata) {
+	s.logicalBytes += meta.Size
+	for _, ref := range meta.ChunkRefs() {
+		usage, exists := s.chunks[ref.ID]
+		if !exists {
+			usage = &chunkUsage{size: ref.Size}
+			s.chunks[ref.ID] = usage
+		}
+		usage.refs++
+	}
+}
+
+// releaseChunkRefs drops the references an object holds on its chunks
+func (s *Store) releaseChunkRefs(meta *ObjectMetadata) {
+	s.logicalBytes -= meta.Size
+	for _, ref := range meta.ChunkRefs() {
+		usage, exists := s.chunks[ref.ID]
+		if !exists {
+			continue
+		}
+		if usage.refs--; usage.refs <= 0 {
+			delete(s.chunks, ref.ID)
+		}
+	}
+}
+
+// ChunkReferences returns how many objects reference a chunk, counting
+// writes in progress that reserved it. A chunk that is no longer referenced
+// can be removed from the storage nodes.
+func (s *Store) ChunkReferences(chunkID string) int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.chunkReferences(chunkID)
+}
+
+// chunkReferences counts the references to a chunk; the caller must hold the lock
+func (s *Store) chunkReferences(chunkID string) int {
+	refs := s.reserved[chunkID]
+	if usage, exists := s.chunks[chunkID]; exists {
+		refs += usage.refs
+	}
+	return refs
+}
+
+// ReserveChunk keeps a chunk from being removed while a write that found it
+// already stored, or is storing it, has not saved its metadata yet. If the
+// chunk is being removed, it waits until the removal is finished, so the
+// write knows to store the chunk again.
+func (s *Store) ReserveChunk(chunkID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for s.removing[chunkID] {
+		s.removed.Wait()
+	}
+	s.reserved[chunkID]++
+}
+
+// ReleaseChunk drops a reservation taken with ReserveChunk
+func (s *Store) ReleaseChunk(chunkID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.reserved[chunkID]--; s.reserved[chunkID] <= 0 {
+		delete(s.reserved, chunkID)
+	}
+}
+
+// StartChunkRemoval claims an unreferenced chunk for removal from the
+// storage nodes and reports whether it did. Until FinishChunkRemoval is
+// called, writes reserving the chunk wait.
+func (s *Store) StartChunkRemoval(chunkID string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.removing[chunkID] || s.chunkReferences(chunkID) > 0 {
+		return false
+	}
+	s.removing[chunkID] = true
+	return true
+}
+
+// FinishChunkRemoval ends a removal started with StartChunkRemoval
+func (s *Store) FinishChunkRemoval(chunkID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.removing, chunkID)
+	s.removed.Broadcast()
+}
+
+// Stats returns the logical size of all objects and the physical size of the
+// distinct chunks they are stored as; the difference is saved by deduplication
+func (s *Store) Stats() StoreStats {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	stats := StoreStats{
+		Objects:      s.objects.Len(),
+		LogicalBytes: s.logicalBytes,
+		Chunks:       len(s.chunks),
+	}
+	for _, usage := range s.chunks {
+		stats.PhysicalBytes += usage.size
+	}
+	return stats
+}
@@ -0,0 +1,210 @@
+package metadata
+
+import (
+	"sort"
+	"strings"
+)
+
+// maxBlockSize is the number of names an index block holds before it splits
+const maxBlockSize = 512
+
+// orderedIndex is a sorted set of names kept in memory so listings do not
+// have to read the directory. Names are held in a sequence of sorted
+// blocks, which keeps inserts and deletes cheap with millions of names
+// while lookups stay logarithmic. It is not safe for concurrent use; the
+// store's lock guards it.
+type orderedIndex struct {
+	blocks [][]string // Non-empty, sorted, and every name in a block sorts before the next block
+	size   int
+}
+
+// newOrderedIndex builds an index from names in any order
+func newOrderedIndex(names []string) *orderedIndex {
+	sorted := append([]string(nil), names...)
+	sort.Strings(sorted)
+
+	idx := &orderedIndex{}
+	for i, name := range sorted {
+		if i > 0 && name == sorted[i-1] {
+			continue
+		}
+		if len(idx.blocks) == 0 || len(idx.blocks[len(idx.blocks)-1]) == maxBlockSize/2 {
+			idx.blocks = append(idx.blocks, make([]string, 0, maxBlockSize))
+		}
+		last := len(idx.blocks) - 1
+		idx.blocks[last] = append(idx.blocks[last], name)
+		idx.size++
+	}
+	return idx
+}
+
+// Len returns the number of names in the index
+func (idx *orderedIndex) Len() int {
+	return idx.size
+}
+
+// Insert adds a name and reports whether it was new
+func (idx *orderedIndex) Insert(name string) bool {
+	if len(idx.blocks) == 0 {
+		idx.blocks = [][]string{{name}}
+		idx.size = 1
+		return true
+	}
+
+	// The block whose last name is at or after name, or else the last block
+	b := idx.blockFor(name, true)
+	if b == len(idx.blocks) {
+		b--
+	}
+	block := idx.blocks[b]
+	i := sort.SearchStrings(block, name)
+	if i < len(block) && block[i] == name {
+		return false
+	}
+
+	block = append(block, "")
+	copy(block[i+1:], block[i:])
+	block[i] = name
+	idx.blocks[b] = block
+	idx.size++
+
+	if len(block) > maxBlockSize {
+		half := len(block) / 2
+		upper := append(make([]string, 0, maxBlockSize), block[half:]...)
+		idx.blocks[b] = block[:half:half]
+		idx.blocks = append(idx.blocks, nil)
+		copy(idx.blocks[b+2:], idx.blocks[b+1:])
+		idx.blocks[b+1] = upper
+	}
+	return true
+}
+
+// Remove deletes a name and reports whether it was present
+func (idx *orderedIndex) Remove(name string) bool {
+	b := idx.blockFor(name, true)
+	if b == len(idx.blocks) {
+		return false
+	}
+	block := idx.blocks[b]
+	i := sort.SearchStrings(block, name)
+	if i == len(block) || block[i] != name {
+		return false
+	}
+
+	idx.blocks[b] = append(block[:i], block[i+1:]...)
+	idx.size--
+	if len(idx.blocks[b]) == 0 {
+		idx.blocks = append(idx.blocks[:b], idx.blocks[b+1:]...)
+	}
+	return true
+}
+
+// Seek returns the first name at or after from, or strictly after it when
+// inclusive is false
+func (idx *orderedIndex) Seek(from string, inclusive bool) (string, bool) {
+	b := idx.blockFor(from, inclusive)
+	if b == len(idx.blocks) {
+		return "", false
+	}
+
+	block := idx.blocks[b]
+	i := sort.Search(len(block), func(i int) bool {
+		if inclusive {
+			return block[i] >= from
+		}
+		return block[i] > from
+	})
+	return block[i], true
+}
+
+// blockFor returns the first block holding a name at or after name (or
+// strictly after it), or len(blocks) if there is none
+func (idx *orderedIndex) blockFor(name string, inclusive bool) int {
+	return sort.Search(len(idx.blocks), func(b int) bool {
+		last := idx.blocks[b][len(idx.blocks[b])-1]
+		if inclusive {
+			return last >= name
+		}
+		return last > name
+	})
+}
+
+// indexPage is one page of names from an index
+type indexPage struct {
+	Names          []string
+	CommonPrefixes []string
+	Truncated      bool
+	Next           string
+}
+
+// List returns a page of names, rolling names that contain the delimiter
+// after the prefix up into common prefixes. Every step is a seek, so a
+// page costs O(limit log n) however many names the index or a common
+// prefix holds.
+func (idx *orderedIndex) List(opts ListOptions) indexPage {
+	var page indexPage
+	count := 0
+
+	cursor, inclusive := opts.Prefix, true
+	if opts.After >= opts.Prefix {
+		cursor, inclusive = opts.After, false
+	}
+
+	for {
+		name, ok := idx.Seek(cursor, inclusive)
+		if !ok || !strings.HasPrefix(name, opts.Prefix) {
+			break
+		}
+
+		if opts.Delimiter != "" {
+			rest := name[len(opts.Prefix):]
+			if i := strings.Index(rest, opts.Delimiter); i >= 0 {
+				commonPrefix := opts.Prefix + rest[:i+len(opts.Delimiter)]
+				end, hasEnd := prefixEnd(commonPrefix)
+
+				// The names under a prefix sort after it, so a prefix that
+				// ended an earlier page is reached again and skipped
+				if commonPrefix > opts.After {
+					if opts.Limit > 0 && count == opts.Limit {
+						page.Truncated = true
+						break
+					}
+					page.CommonPrefixes = append(page.CommonPrefixes, commonPrefix)
+					page.Next = commonPrefix
+					count++
+				}
+
+				if !hasEnd {
+					break
+				}
+				cursor, inclusive = end, true
+				continue
+			}
+		}
+
+		if opts.Limit > 0 && count == opts.Limit {
+			page.Truncated = true
+			break
+		}
+		page.Names = append(page.Names, name)
+		page.Next = name
+		count++
+		cursor, inclusive = name, false
+	}
+
+	if !page.Truncated {
+		page.Next = ""
+	}
+	return page
+}
+
+// prefixEnd returns the smallest string that sorts after every string with
+// the given prefix, and false if there is none
+func prefixEnd(prefix string) (string, bool) {
+	for i := len(prefix) - 1; i >= 0; i-- {
+		if prefix[i] < 0xff {
+			return prefix[:i] + string([]byte{prefix[i] + 1}), true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,69 @@
+package metadata
+
+import (
+	"fmt"
+	"math/rand"
+	"slices"
+	"sort"
+	"testing"
+)
+
+func TestOrderedIndex_InsertRemoveKeepsOrder(t *testing.T) {
+	idx := newOrderedIndex(nil)
+	present := make(map[string]bool)
+	rng := rand.New(rand.NewSource(1))
+
+	// Enough names to split blocks many times, with removals mixed in
+	for i := 0; i < 20000; i++ {
+		name := fmt.Sprintf("%06d", rng.Intn(10000))
+		if rng.Intn(3) == 0 {
+			if idx.Remove(name) != present[name] {
+				t.Fatalf("Remove(%s) disagreed with the reference set", name)
+			}
+			delete(present, name)
+		} else {
+			if idx.Insert(name) == present[name] {
+				t.Fatalf("Insert(%s) disagreed with the reference set", name)
+			}
+			present[name] = true
+		}
+	}
+
+	expected := make([]string, 0, len(present))
+	for name := range present {
+		expected = append(expected, name)
+	}
+	sort.Strings(expected)
+
+	var got []string
+	for name, ok := idx.Seek("", true); ok; name, ok = idx.Seek(name, false) {
+		got = append(got, name)
+	}
+	if idx.Len() != len(expected) || !slices.Equal(got, expected) {
+		t.Errorf("index holds %d names, expected %d in order", idx.Len(), len(expected))
+	}
+}
+
+func TestOrderedIndex_ListSkipsWholePrefixes(t *testing.T) {
+	var names []string
+	for i := 0; i < 5000; i++ {
+		names = append(names, fmt.Sprintf("big/%05d", i))
+	}
+	names = append(names, "a", "big", "c/1", "c/2", "d")
+	idx := newOrderedIndex(names)
+
+	page := idx.List(ListOptions{Delimiter: "/", Limit: 3})
+	if !slices.Equal(page.Names, []string{"a", "big"}) || !slices.Equal(page.CommonPrefixes, []string{"big/"}) || !page.Truncated {
+		t.Fatalf("unexpected first page: %+v", page)
+	}
+
+	page = idx.List(ListOptions{Delimiter: "/", Limit: 3, After: page.Next})
+	if !slices.Equal(page.Names, []string{"d"}) || !slices.Equal(page.CommonPrefixes, []string{"c/"}) || page.Truncated {
+		t.Errorf("unexpected second page: %+v", page)
+	}
+
+	page = idx.List(ListOptions{Prefix: "big/0499", Limit: 100})
+	if len(page.Names) != 10 || page.Names[0] != "big/04990" {
+		t.Errorf("unexpected prefix listing: %v", page.Names)
+	}
+}
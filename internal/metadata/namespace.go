@@ -0,0 +1,357 @@
+package metadata
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Directories inside the store that hold the bucket namespace
+const (
+	bucketDir = "buckets"
+	keyDir    = "keys"
+)
+
+// Errors returned by the namespace operations
+var (
+	ErrBucketNotFound = errors.New("bucket not found")
+	ErrBucketExists   = errors.New("bucket already exists")
+	ErrBucketNotEmpty = errors.New("bucket is not empty")
+	ErrKeyNotFound    = errors.New("key not found")
+)
+
+// validBucketName follows the S3 bucket naming rules
+var validBucketName = regexp.MustCompile(`^[a-z0-9][a-z0-9.-]{1,61}[a-z0-9]$`)
+
+// Bucket is a named container of keys
+type Bucket struct {
+	Name       string    `json:"name"`
+	CreatedAt  time.Time `json:"created_at"`
+	Durability string    `json:"durability,omitempty"` // Default for objects written to it; empty for the server's
+}
+
+// KeyEntry maps a user-chosen key in a bucket to a content-addressed object.
+// Any number of keys may point at the same object, so identical content is
+// stored once.
+type KeyEntry struct {
+	Bucket       string            `json:"bucket"`
+	Key          string            `json:"key"`
+	ObjectID     string            `json:"object_id"`
+	Size         int64             `json:"size"`
+	ContentType  string            `json:"content_type"`
+	ETag         string            `json:"etag"` // MD5-based ETag as used by S3 clients
+	LastModified time.Time         `json:"last_modified"`
+	UserMetadata map[string]string `json:"user_metadata,omitempty"`
+}
+
+// ListOptions selects a page of keys
+type ListOptions struct {
+	Prefix    string // Only keys starting with Prefix
+	Delimiter string // Roll keys up to common prefixes ending in Delimiter
+	After     string // Only keys, or common prefixes, sorting after After
+	Limit     int    // Maximum keys plus common prefixes returned; 0 means no limit
+}
+
+// ListResult is a page of keys
+type ListResult struct {
+	Entries        []KeyEntry
+	CommonPrefixes []string
+	Truncated      bool
+	Next           string // Pass as After to get the next page
+}
+
+// ValidBucketName reports whether name is a valid bucket name
+func ValidBucketName(name string) bool {
+	return validBucketName.MatchString(name) && !strings.Contains(name, "..")
+}
+
+// CreateBucket creates an empty bucket
+func (s *Store) CreateBucket(name, durability string) (*Bucket, error) {
+	if !ValidBucketName(name) {
+		return nil, fmt.Errorf("invalid bucket name: %q", name)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, err := os.Stat(s.bucketPath(name)); err == nil {
+		return nil, ErrBucketExists
+	}
+
+	bucket := &Bucket{Name: name, CreatedAt: time.Now(), Durability: durability}
+	if err := os.MkdirAll(filepath.Join(s.basePath, keyDir, name), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create key directory: %w", err)
+	}
+	if err := s.writeJSON(s.bucketPath(name), bucket); err != nil {
+		return nil, err
+	}
+	s.keys[name] = newOrderedIndex(nil)
+
+	return bucket, nil
+}
+
+// GetBucket reads a bucket
+func (s *Store) GetBucket(name string) (*Bucket, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.getBucket(name)
+}
+
+// ListBuckets returns all buckets sorted by name
+func (s *Store) ListBuckets() ([]Bucket, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	entries, err := os.ReadDir(filepath.Join(s.basePath, bucketDir))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to read bucket directory: %w", err)
+	}
+
+	buckets := make([]Bucket, 0, len(entries))
+	for _, entry := range entries {
+		name, ok := strings.CutSuffix(entry.Name(), ".json")
+		if !ok {
+			continue
+		}
+		bucket, err := s.getBucket(name)
+		if err != nil {
+			return nil, err
+		}
+		buckets = append(buckets, *bucket)
+	}
+
+	sort.Slice(buckets, func(i, j int) bool { return buckets[i].Name < buckets[j].Name })
+	return buckets, nil
+}
+
+// DeleteBucket removes an empty bucket
+func (s *Store) DeleteBucket(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, err := s.getBucket(name); err != nil {
+		return err
+	}
+
+	if s.keys[name].Len() > 0 {
+		return ErrBucketNotEmpty
+	}
+
+	if err := os.Remove(s.bucketPath(name)); err != nil {
+		return fmt.Errorf("failed to delete bucket file: %w", err)
+	}
+	if err := os.RemoveAll(filepath.Join(s.basePath, keyDir, name)); err != nil {
+		return fmt.Errorf("failed to delete key directory: %w", err)
+	}
+	delete(s.keys, name)
+
+	return nil
+}
+
+// PutKey creates or replaces a key in an existing bucket and returns the
+// entry it replaced, or nil. The key counts as a reference to its object, see
+// KeyReferences.
+func (s *Store) PutKey(entry *KeyEntry) (*KeyEntry, error) {
+	if entry.Key == "" {
+		return nil, fmt.Errorf("key must not be empty")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, err := s.getBucket(entry.Bucket); err != nil {
+		return nil, err
+	}
+
+	path := s.keyPath(entry.Bucket, entry.Key)
+	previous := &KeyEntry{}
+	if err := s.readJSON(path, previous); os.IsNotExist(err) {
+		previous = nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if err := s.writeJSON(path, entry); err != nil {
+		return nil, err
+	}
+	s.keys[entry.Bucket].Insert(entry.Key)
+	s.objectKeys[entry.ObjectID]++
+	if previous != nil {
+		s.releaseKeyRef(previous.ObjectID)
+	}
+
+	return previous, nil
+}
+
+// GetKey reads a key
+func (s *Store) GetKey(bucket, key string) (*KeyEntry, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if _, err := s.getBucket(bucket); err != nil {
+		return nil, err
+	}
+
+	var entry KeyEntry
+	if err := s.readJSON(s.keyPath(bucket, key), &entry); err != nil {
+		if os.IsNotExist(err) {
+			return nil, ErrKeyNotFound
+		}
+		return nil, err
+	}
+	return &entry, nil
+}
+
+// DeleteKey removes a key and returns its entry. The object it points at is
+// left alone, since other keys may share it; see KeyReferences.
+func (s *Store) DeleteKey(bucket, key string) (*KeyEntry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, err := s.getBucket(bucket); err != nil {
+		return nil, err
+	}
+
+	path := s.keyPath(bucket, key)
+	var entry KeyEntry
+	if err := s.readJSON(path, &entry); err != nil {
+		if os.IsNotExist(err) {
+			return nil, ErrKeyNotFound
+		}
+		return nil, err
+	}
+
+	if err := os.Remove(path); err != nil {
+		return nil, fmt.Errorf("failed to delete key file: %w", err)
+	}
+	s.keys[bucket].Remove(key)
+	s.releaseKeyRef(entry.ObjectID)
+
+	return &entry, nil
+}
+
+// KeyReferences returns how many keys point at an object. An object keys
+// point at cannot be deleted.
+func (s *Store) KeyReferences(objectID string) int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.objectKeys[objectID]
+}
+
+// releaseKeyRef drops the reference a key held on an object; the caller
+// must hold the lock
+func (s *Store) releaseKeyRef(objectID string) {
+	if s.objectKeys[objectID]--; s.objectKeys[objectID] <= 0 {
+		delete(s.objectKeys, objectID)
+	}
+}
+
+// ListKeys returns a page of the keys in a bucket in lexicographic order.
+// With a delimiter, keys that contain it after the prefix are rolled up into
+// a single common prefix, as in S3 listings.
+func (s *Store) ListKeys(bucket string, opts ListOptions) (*ListResult, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if _, err := s.getBucket(bucket); err != nil {
+		return nil, err
+	}
+
+	page := s.keys[bucket].List(opts)
+	result := &ListResult{
+		Entries:        make([]KeyEntry, 0, len(page.Names)),
+		CommonPrefixes: page.CommonPrefixes,
+		Truncated:      page.Truncated,
+		Next:           page.Next,
+	}
+	for _, key := range page.Names {
+		var entry KeyEntry
+		if err := s.readJSON(s.keyPath(bucket, key), &entry); err != nil {
+			return nil, err
+		}
+		result.Entries = append(result.Entries, entry)
+	}
+
+	return result, nil
+}
+
+// getBucket reads a bucket; the caller must hold the lock
+func (s *Store) getBucket(name string) (*Bucket, error) {
+	if !ValidBucketName(name) {
+		return nil, ErrBucketNotFound
+	}
+
+	var bucket Bucket
+	if err := s.readJSON(s.bucketPath(name), &bucket); err != nil {
+		if os.IsNotExist(err) {
+			return nil, ErrBucketNotFound
+		}
+		return nil, err
+	}
+	return &bucket, nil
+}
+
+// bucketPath returns the path of the file describing a bucket
+func (s *Store) bucketPath(name string) string {
+	return filepath.Join(s.basePath, bucketDir, name+".json")
+}
+
+// keyPath returns the path of the file for a key. Keys may be long and
+// contain any character, so the file is named after the key's hash.
+func (s *Store) keyPath(bucket, key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(s.basePath, keyDir, bucket, hex.EncodeToString(sum[:])+".json")
+}
+
+// writeJSON atomically replaces a file with the JSON encoding of value,
+// sealed if the store has a keyring
+func (s *Store) writeJSON(path string, value interface{}) error {
+	data, err := json.MarshalIndent(value, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal %s: %w", filepath.Base(path), err)
+	}
+	if data, err = s.keyring.Seal(s.label(path), data); err != nil {
+		return fmt.Errorf("failed to seal %s: %w", filepath.Base(path), err)
+	}
+	return writeFile(path, data)
+}
+
+// writeFile atomically replaces a file
+func writeFile(path string, data []byte) error {
+	tmpPath := path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0644); err != nil {
+		return fmt.Errorf("failed to write %s: %w", filepath.Base(path), err)
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		return fmt.Errorf("failed to write %s: %w", filepath.Base(path), err)
+	}
+	return nil
+}
+
+// readJSON decodes a JSON file, sealed or not, into value. Errors from
+// opening the file are returned unwrapped so callers can check
+// os.IsNotExist.
+func (s *Store) readJSON(path string, value interface{}) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if data, err = s.keyring.Unseal(s.label(path), data); err != nil {
+		return fmt.Errorf("failed to unseal %s: %w", filepath.Base(path), err)
+	}
+	if err := json.Unmarshal(data, value); err != nil {
+		return fmt.Errorf("failed to unmarshal %s: %w", filepath.Base(path), err)
+	}
+	return nil
+}
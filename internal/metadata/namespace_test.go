@@ -0,0 +1,180 @@
+package metadata
+
+import (
+	"errors"
+	"os"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestStore_BucketLifecycle(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "metadata-test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	store, err := NewStore(tmpDir)
+	if err != nil {
+		t.Fatalf("failed to create store: %v", err)
+	}
+
+	if _, err := store.CreateBucket("Invalid_Name", ""); err == nil {
+		t.Error("expected invalid bucket name to be rejected")
+	}
+	if _, err := store.CreateBucket("photos", ""); err != nil {
+		t.Fatalf("failed to create bucket: %v", err)
+	}
+	if _, err := store.CreateBucket("photos", ""); !errors.Is(err, ErrBucketExists) {
+		t.Errorf("expected ErrBucketExists, got %v", err)
+	}
+
+	entry := &KeyEntry{Bucket: "photos", Key: "2024/cat.jpg", ObjectID: "abc", Size: 3, LastModified: time.Now()}
+	if _, err := store.PutKey(entry); err != nil {
+		t.Fatalf("failed to put key: %v", err)
+	}
+	if _, err := store.PutKey(&KeyEntry{Bucket: "missing", Key: "k"}); !errors.Is(err, ErrBucketNotFound) {
+		t.Errorf("expected ErrBucketNotFound, got %v", err)
+	}
+
+	got, err := store.GetKey("photos", "2024/cat.jpg")
+	if err != nil {
+		t.Fatalf("failed to get key: %v", err)
+	}
+	if got.ObjectID != "abc" || got.Size != 3 {
+		t.Errorf("key mismatch: expected %+v, got %+v", entry, got)
+	}
+
+	if err := store.DeleteBucket("photos"); !errors.Is(err, ErrBucketNotEmpty) {
+		t.Errorf("expected ErrBucketNotEmpty, got %v", err)
+	}
+	if deleted, err := store.DeleteKey("photos", "2024/cat.jpg"); err != nil || deleted.ObjectID != "abc" {
+		t.Fatalf("failed to delete key: %+v (%v)", deleted, err)
+	}
+	if _, err := store.GetKey("photos", "2024/cat.jpg"); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("expected ErrKeyNotFound, got %v", err)
+	}
+	if err := store.DeleteBucket("photos"); err != nil {
+		t.Fatalf("failed to delete bucket: %v", err)
+	}
+
+	buckets, err := store.ListBuckets()
+	if err != nil {
+		t.Fatalf("failed to list buckets: %v", err)
+	}
+	if len(buckets) != 0 {
+		t.Errorf("expected no buckets, got %v", buckets)
+	}
+}
+
+func TestStore_ListKeysWithDelimiterAndPages(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "metadata-test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	store, err := NewStore(tmpDir)
+	if err != nil {
+		t.Fatalf("failed to create store: %v", err)
+	}
+	if _, err := store.CreateBucket("docs", ""); err != nil {
+		t.Fatalf("failed to create bucket: %v", err)
+	}
+
+	for _, key := range []string{"a.txt", "dir/1.txt", "dir/2.txt", "dir/sub/3.txt", "other/4.txt", "z.txt"} {
+		if _, err := store.PutKey(&KeyEntry{Bucket: "docs", Key: key}); err != nil {
+			t.Fatalf("failed to put key %s: %v", key, err)
+		}
+	}
+
+	// Walk the bucket two results at a time, rolling up directories
+	var keys, prefixes []string
+	opts := ListOptions{Delimiter: "/", Limit: 2}
+	for pages := 0; ; pages++ {
+		if pages > 5 {
+			t.Fatal("listing did not terminate")
+		}
+		result, err := store.ListKeys("docs", opts)
+		if err != nil {
+			t.Fatalf("failed to list keys: %v", err)
+		}
+		for _, entry := range result.Entries {
+			keys = append(keys, entry.Key)
+		}
+		prefixes = append(prefixes, result.CommonPrefixes...)
+		if !result.Truncated {
+			break
+		}
+		opts.After = result.Next
+	}
+
+	if !slices.Equal(keys, []string{"a.txt", "z.txt"}) {
+		t.Errorf("unexpected keys: %v", keys)
+	}
+	if !slices.Equal(prefixes, []string{"dir/", "other/"}) {
+		t.Errorf("unexpected common prefixes: %v", prefixes)
+	}
+
+	// Within a prefix, deeper levels roll up again
+	result, err := store.ListKeys("docs", ListOptions{Prefix: "dir/", Delimiter: "/"})
+	if err != nil {
+		t.Fatalf("failed to list keys: %v", err)
+	}
+	if len(result.Entries) != 2 || !slices.Equal(result.CommonPrefixes, []string{"dir/sub/"}) {
+		t.Errorf("unexpected listing of dir/: %+v", result)
+	}
+}
+
+func TestStore_KeyReferences(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "metadata-test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	store, err := NewStore(tmpDir)
+	if err != nil {
+		t.Fatalf("failed to create store: %v", err)
+	}
+	store.CreateBucket("docs", "")
+	store.Save(&ObjectMetadata{ID: "object1", CreatedAt: time.Now()})
+
+	store.PutKey(&KeyEntry{Bucket: "docs", Key: "a", ObjectID: "object1"})
+	store.PutKey(&KeyEntry{Bucket: "docs", Key: "b", ObjectID: "object1"})
+	if refs := store.KeyReferences("object1"); refs != 2 {
+		t.Errorf("expected 2 key references, got %d", refs)
+	}
+
+	// Objects keys point at cannot be deleted
+	if err := store.Delete("object1"); !errors.Is(err, ErrObjectReferenced) {
+		t.Errorf("expected ErrObjectReferenced, got %v", err)
+	}
+
+	// Overwriting a key moves its reference and returns the old entry
+	previous, err := store.PutKey(&KeyEntry{Bucket: "docs", Key: "a", ObjectID: "object2"})
+	if err != nil || previous == nil || previous.ObjectID != "object1" {
+		t.Fatalf("expected the replaced entry, got %+v (%v)", previous, err)
+	}
+	if refs := store.KeyReferences("object1"); refs != 1 {
+		t.Errorf("expected 1 key reference after the overwrite, got %d", refs)
+	}
+
+	// References are rebuilt when the store is opened again
+	store, err = NewStore(tmpDir)
+	if err != nil {
+		t.Fatalf("failed to reopen store: %v", err)
+	}
+	if refs := store.KeyReferences("object2"); refs != 1 {
+		t.Errorf("expected 1 key reference after reopening, got %d", refs)
+	}
+
+	store.DeleteKey("docs", "b")
+	if refs := store.KeyReferences("object1"); refs != 0 {
+		t.Errorf("expected no key references, got %d", refs)
+	}
+	if err := store.Delete("object1"); err != nil {
+		t.Errorf("failed to delete unreferenced object: %v", err)
+	}
+}
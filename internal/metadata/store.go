@@ -0,0 +1,359 @@
+package metadata
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/caskos/caskos/internal/storage"
+)
+
+// ObjectMetadata holds information about a stored object
+type ObjectMetadata struct {
+	ID          string     `json:"id"`
+	Size        int64      `json:"size"`
+	ContentType string     `json:"content_type"`
+	CreatedAt   time.Time  `json:"created_at"`
+	Replicas    []string   `json:"replicas"`
+	Chunks      []ChunkRef `json:"chunks,omitempty"`     // Empty if stored as a single replicated chunk
+	Durability  string     `json:"durability,omitempty"` // Empty for objects stored before erasure coding
+}
+
+// ErrObjectReferenced is returned when deleting an object that is still in use
+var ErrObjectReferenced = errors.New("object is referenced")
+
+// tombstoneDir is the directory inside the store that records deleted objects
+const tombstoneDir = "tombstones"
+
+// Tombstone records that an object was deleted, so that self-healing or a
+// node that missed the delete cannot bring it back
+type Tombstone struct {
+	ID        string    `json:"id"`
+	DeletedAt time.Time `json:"deleted_at"`
+}
+
+// Store persists object metadata as JSON files on disk. Object IDs and the
+// keys of each bucket are also kept in ordered in-memory indexes, built when
+// the store is opened, so listings never scan the directories. The chunk
+// references of all objects are counted in memory as well, which reads every
+// metadata file when the store is opened. With a keyring the files are
+// sealed, as the objects they describe are encrypted.
+type Store struct {
+	mu           sync.RWMutex
+	basePath     string
+	keyring      *storage.Keyring // Nil leaves the files plain
+	objects      *orderedIndex
+	keys         map[string]*orderedIndex // Keys of each bucket
+	chunks       map[string]*chunkUsage
+	logicalBytes int64
+	objectKeys   map[string]int  // Keys pointing at each object
+	reserved     map[string]int  // Chunks held by writes in progress
+	removing     map[string]bool // Chunks being removed from the nodes
+	removed      *sync.Cond      // Signaled when a chunk removal finishes
+}
+
+// NewStore creates a new metadata store
+func NewStore(basePath string) (*Store, error) {
+	return NewEncryptedStore(basePath, nil)
+}
+
+// NewEncryptedStore creates a metadata store that seals the files it writes
+// with keyring. Files written before encryption was enabled stay readable.
+func NewEncryptedStore(basePath string, keyring *storage.Keyring) (*Store, error) {
+	for _, dir := range []string{tombstoneDir, bucketDir, keyDir} {
+		if err := os.MkdirAll(filepath.Join(basePath, dir), 0755); err != nil {
+			return nil, fmt.Errorf("failed to create metadata directory: %w", err)
+		}
+	}
+
+	s := &Store{
+		basePath:   basePath,
+		keyring:    keyring,
+		keys:       make(map[string]*orderedIndex),
+		objectKeys: make(map[string]int),
+		reserved:   make(map[string]int),
+		removing:   make(map[string]bool),
+	}
+	s.removed = sync.NewCond(&s.mu)
+	if err := s.loadIndexes(); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// loadIndexes builds the object and key indexes from the files on disk
+func (s *Store) loadIndexes() error {
+	files, err := os.ReadDir(s.basePath)
+	if err != nil {
+		return fmt.Errorf("failed to read metadata directory: %w", err)
+	}
+	var objectIDs []string
+	for _, file := range files {
+		if objectID, ok := strings.CutSuffix(file.Name(), ".json"); ok && !file.IsDir() {
+			objectIDs = append(objectIDs, objectID)
+		}
+	}
+	s.objects = newOrderedIndex(objectIDs)
+	if err := s.loadChunkRefs(objectIDs); err != nil {
+		return fmt.Errorf("failed to count chunk references: %w", err)
+	}
+
+	// Key files are named by hash, so each one is read for its key
+	buckets, err := os.ReadDir(filepath.Join(s.basePath, bucketDir))
+	if err != nil {
+		return fmt.Errorf("failed to read bucket directory: %w", err)
+	}
+	for _, bucket := range buckets {
+		name, ok := strings.CutSuffix(bucket.Name(), ".json")
+		if !ok {
+			continue
+		}
+
+		dir := filepath.Join(s.basePath, keyDir, name)
+		files, err := os.ReadDir(dir)
+		if err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to read key directory: %w", err)
+		}
+		keys := make([]string, 0, len(files))
+		for _, file := range files {
+			if !strings.HasSuffix(file.Name(), ".json") {
+				continue // Leftover of an interrupted write
+			}
+			var entry KeyEntry
+			if err := s.readJSON(filepath.Join(dir, file.Name()), &entry); err != nil {
+				return err
+			}
+			keys = append(keys, entry.Key)
+			s.objectKeys[entry.ObjectID]++
+		}
+		s.keys[name] = newOrderedIndex(keys)
+	}
+
+	return nil
+}
+
+// Save writes metadata for an object. Saving an object for the first time
+// adds a reference to each of its chunks.
+func (s *Store) Save(meta *ObjectMetadata) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.writeJSON(s.metadataPath(meta.ID), meta); err != nil {
+		return err
+	}
+	if s.objects.Insert(meta.ID) {
+		s.addChunkRefs(meta)
+	}
+
+	return nil
+}
+
+// Get reads metadata for an object
+func (s *Store) Get(objectID string) (*ObjectMetadata, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var meta ObjectMetadata
+	if err := s.readJSON(s.metadataPath(objectID), &meta); err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("metadata not found: %s", objectID)
+		}
+		return nil, fmt.Errorf("failed to read metadata file: %w", err)
+	}
+
+	return &meta, nil
+}
+
+// Exists checks if metadata exists for an object
+func (s *Store) Exists(objectID string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	_, err := os.Stat(s.metadataPath(objectID))
+	return err == nil
+}
+
+// Delete removes the metadata for an object and leaves a tombstone in its
+// place, releasing its chunk references. The tombstone is written first, so
+// a failure part way never leaves an object that is gone from the store but
+// free to be resurrected. It fails with ErrObjectReferenced while keys point
+// at the object or an upload of the same content holds a reservation on it.
+func (s *Store) Delete(objectID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.objectKeys[objectID] > 0 || s.reserved[objectID] > 0 {
+		return ErrObjectReferenced
+	}
+
+	var existing ObjectMetadata
+	if err := s.readJSON(s.metadataPath(objectID), &existing); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	if err := s.writeJSON(s.tombstonePath(objectID), &Tombstone{ID: objectID, DeletedAt: time.Now()}); err != nil {
+		return err
+	}
+
+	if err := os.Remove(s.metadataPath(objectID)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to delete metadata file: %w", err)
+	}
+	if s.objects.Remove(objectID) {
+		s.releaseChunkRefs(&existing)
+	}
+
+	return nil
+}
+
+// IsDeleted checks if an object has a tombstone
+func (s *Store) IsDeleted(objectID string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	_, err := os.Stat(s.tombstonePath(objectID))
+	return err == nil
+}
+
+// IsTombstoned reports whether an object has a tombstone and its content is
+// not a chunk of another object, so copies of it must not be restored
+func (s *Store) IsTombstoned(objectID string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if _, err := os.Stat(s.tombstonePath(objectID)); err != nil {
+		return false
+	}
+	return s.chunkReferences(objectID) == 0
+}
+
+// ClearTombstone removes the tombstone of an object, for example when the
+// same content is uploaded again after a delete
+func (s *Store) ClearTombstone(objectID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := os.Remove(s.tombstonePath(objectID)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove tombstone file: %w", err)
+	}
+
+	return nil
+}
+
+// ObjectListResult is a page of objects
+type ObjectListResult struct {
+	Objects        []ObjectMetadata
+	CommonPrefixes []string
+	Truncated      bool
+	Next           string // Pass as After to get the next page
+}
+
+// List returns a page of objects in object ID order. With a delimiter, IDs
+// that contain it after the prefix are rolled up into common prefixes.
+func (s *Store) List(opts ListOptions) (*ObjectListResult, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	page := s.objects.List(opts)
+	result := &ObjectListResult{
+		Objects:        make([]ObjectMetadata, 0, len(page.Names)),
+		CommonPrefixes: page.CommonPrefixes,
+		Truncated:      page.Truncated,
+		Next:           page.Next,
+	}
+	for _, objectID := range page.Names {
+		var meta ObjectMetadata
+		if err := s.readJSON(s.metadataPath(objectID), &meta); err != nil {
+			return nil, err
+		}
+		result.Objects = append(result.Objects, meta)
+	}
+
+	return result, nil
+}
+
+// metadataPath returns the path of the metadata file for an object
+func (s *Store) metadataPath(objectID string) string {
+	return filepath.Join(s.basePath, objectID+".json")
+}
+
+// tombstonePath returns the path of the tombstone file for an object
+func (s *Store) tombstonePath(objectID string) string {
+	return filepath.Join(s.basePath, tombstoneDir, objectID+".json")
+}
+
+// label names a file of the store when it is sealed: its path inside the
+// store, so a sealed file cannot be moved to another
+func (s *Store) label(path string) string {
+	rel, err := filepath.Rel(s.basePath, path)
+	if err != nil {
+		return path
+	}
+	return filepath.ToSlash(rel)
+}
+
+// Reseal seals every file of the store again that is plain or sealed with a
+// master key other than the active one, after the key file was changed to
+// make a new key active, and returns how many it sealed
+func (s *Store) Reseal() (int, error) {
+	if s.keyring == nil {
+		return 0, nil
+	}
+
+	var paths []string
+	err := filepath.WalkDir(s.basePath, func(path string, entry fs.DirEntry, err error) error {
+		if err == nil && !entry.IsDir() && strings.HasSuffix(path, ".json") {
+			paths = append(paths, path)
+		}
+		return err
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to walk metadata directory: %w", err)
+	}
+
+	resealed := 0
+	for _, path := range paths {
+		ok, err := s.reseal(path)
+		if err != nil {
+			return resealed, err
+		}
+		if ok {
+			resealed++
+		}
+	}
+	return resealed, nil
+}
+
+// reseal seals one file again, unless it is sealed with the active key
+func (s *Store) reseal(path string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil // Removed meanwhile
+		}
+		return false, fmt.Errorf("failed to read %s: %w", filepath.Base(path), err)
+	}
+	if !s.keyring.NeedsSealing(data) {
+		return false, nil
+	}
+
+	label := s.label(path)
+	if data, err = s.keyring.Unseal(label, data); err != nil {
+		return false, fmt.Errorf("failed to unseal %s: %w", filepath.Base(path), err)
+	}
+	if data, err = s.keyring.Seal(label, data); err != nil {
+		return false, fmt.Errorf("failed to seal %s: %w", filepath.Base(path), err)
+	}
+	if err := writeFile(path, data); err != nil {
+		return false, err
+	}
+	return true, nil
+}
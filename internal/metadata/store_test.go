@@ -0,0 +1,287 @@
+package metadata
+
+import (
+	"bytes"
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/caskos/caskos/internal/storage"
+)
+
+func TestStore_SaveAndGet(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "metadata-test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	store, err := NewStore(tmpDir)
+	if err != nil {
+		t.Fatalf("failed to create store: %v", err)
+	}
+
+	meta := &ObjectMetadata{
+		ID:          "abcdef1234567890",
+		Size:        42,
+		ContentType: "text/plain",
+		CreatedAt:   time.Now(),
+		Replicas:    []string{"node1", "node2"},
+	}
+	if err := store.Save(meta); err != nil {
+		t.Fatalf("failed to save metadata: %v", err)
+	}
+
+	if !store.Exists(meta.ID) {
+		t.Error("expected metadata to exist after save")
+	}
+
+	got, err := store.Get(meta.ID)
+	if err != nil {
+		t.Fatalf("failed to get metadata: %v", err)
+	}
+	if got.Size != meta.Size || got.ContentType != meta.ContentType || len(got.Replicas) != 2 {
+		t.Errorf("metadata mismatch: expected %+v, got %+v", meta, got)
+	}
+}
+
+func TestStore_DeleteLeavesTombstone(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "metadata-test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	store, err := NewStore(tmpDir)
+	if err != nil {
+		t.Fatalf("failed to create store: %v", err)
+	}
+
+	objectID := "abcdef1234567890"
+	store.Save(&ObjectMetadata{ID: objectID, CreatedAt: time.Now()})
+
+	if err := store.Delete(objectID); err != nil {
+		t.Fatalf("failed to delete metadata: %v", err)
+	}
+
+	if store.Exists(objectID) {
+		t.Error("expected metadata to be gone after delete")
+	}
+	if !store.IsDeleted(objectID) {
+		t.Error("expected tombstone after delete")
+	}
+	if !store.IsTombstoned(objectID) {
+		t.Error("expected an unreferenced deleted object to be tombstoned")
+	}
+
+	// Content still used by a write in progress is not tombstoned
+	store.ReserveChunk(objectID)
+	if store.IsTombstoned(objectID) {
+		t.Error("expected a reserved object not to be tombstoned")
+	}
+	store.ReleaseChunk(objectID)
+
+	if err := store.ClearTombstone(objectID); err != nil {
+		t.Fatalf("failed to clear tombstone: %v", err)
+	}
+	if store.IsDeleted(objectID) {
+		t.Error("expected tombstone to be cleared")
+	}
+}
+
+func TestStore_ChunkReferences(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "metadata-test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	store, err := NewStore(tmpDir)
+	if err != nil {
+		t.Fatalf("failed to create store: %v", err)
+	}
+
+	// Two objects sharing a chunk, and one stored as a single chunk
+	store.Save(&ObjectMetadata{ID: "object1", Size: 30, Chunks: []ChunkRef{{ID: "chunk1", Size: 10}, {ID: "chunk2", Size: 20}}})
+	store.Save(&ObjectMetadata{ID: "object2", Size: 25, Chunks: []ChunkRef{{ID: "chunk1", Size: 10}, {ID: "chunk3", Size: 15}}})
+	store.Save(&ObjectMetadata{ID: "object3", Size: 5})
+
+	// Saving again, as after a repair, adds no references
+	store.Save(&ObjectMetadata{ID: "object3", Size: 5, Replicas: []string{"node1"}})
+
+	if refs := store.ChunkReferences("chunk1"); refs != 2 {
+		t.Errorf("expected 2 references to the shared chunk, got %d", refs)
+	}
+	if refs := store.ChunkReferences("object3"); refs != 1 {
+		t.Errorf("expected a single-chunk object to reference itself, got %d", refs)
+	}
+
+	stats := store.Stats()
+	if stats.Objects != 3 || stats.LogicalBytes != 60 || stats.Chunks != 4 || stats.PhysicalBytes != 50 {
+		t.Errorf("unexpected stats: %+v", stats)
+	}
+
+	// References are rebuilt when the store is opened again
+	store, err = NewStore(tmpDir)
+	if err != nil {
+		t.Fatalf("failed to reopen store: %v", err)
+	}
+	if reopened := store.Stats(); reopened != stats {
+		t.Errorf("expected %+v after reopening, got %+v", stats, reopened)
+	}
+
+	if err := store.Delete("object1"); err != nil {
+		t.Fatalf("failed to delete metadata: %v", err)
+	}
+	if refs := store.ChunkReferences("chunk1"); refs != 1 {
+		t.Errorf("expected 1 reference after delete, got %d", refs)
+	}
+	if refs := store.ChunkReferences("chunk2"); refs != 0 {
+		t.Errorf("expected chunk2 to be unreferenced, got %d", refs)
+	}
+
+	// Deleting twice releases nothing more
+	store.Delete("object1")
+	if stats := store.Stats(); stats.LogicalBytes != 30 || stats.PhysicalBytes != 30 {
+		t.Errorf("unexpected stats after delete: %+v", stats)
+	}
+}
+
+func TestStore_ChunkReservations(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "metadata-test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	store, err := NewStore(tmpDir)
+	if err != nil {
+		t.Fatalf("failed to create store: %v", err)
+	}
+
+	// A write in progress keeps the chunk from being removed
+	store.ReserveChunk("chunk1")
+	if refs := store.ChunkReferences("chunk1"); refs != 1 {
+		t.Errorf("expected the reservation to count as a reference, got %d", refs)
+	}
+	if store.StartChunkRemoval("chunk1") {
+		t.Error("expected a reserved chunk not to be removed")
+	}
+	store.ReleaseChunk("chunk1")
+	if stats := store.Stats(); stats.Chunks != 0 {
+		t.Errorf("expected reservations to stay out of the stats, got %+v", stats)
+	}
+
+	// A write reserving a chunk being removed waits for the removal
+	if !store.StartChunkRemoval("chunk1") {
+		t.Fatal("expected an unreferenced chunk to be removed")
+	}
+	if store.StartChunkRemoval("chunk1") {
+		t.Error("expected a chunk to be removed once at a time")
+	}
+	reserved := make(chan struct{})
+	go func() {
+		store.ReserveChunk("chunk1")
+		close(reserved)
+	}()
+	select {
+	case <-reserved:
+		t.Fatal("expected the reservation to wait for the removal")
+	case <-time.After(50 * time.Millisecond):
+	}
+	store.FinishChunkRemoval("chunk1")
+	select {
+	case <-reserved:
+	case <-time.After(time.Second):
+		t.Fatal("expected the reservation once the removal finished")
+	}
+	if refs := store.ChunkReferences("chunk1"); refs != 1 {
+		t.Errorf("expected 1 reference after the removal, got %d", refs)
+	}
+}
+
+func TestStore_Encrypted(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "metadata-test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	keyPath := filepath.Join(tmpDir, "keys.json")
+	key := func(fill byte) string {
+		return `"` + base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{fill}, 32)) + `"`
+	}
+	os.WriteFile(keyPath, []byte(`{"active":"k1","keys":{"k1":`+key(1)+`}}`), 0600)
+	keyring, err := storage.LoadKeyring(keyPath)
+	if err != nil {
+		t.Fatalf("failed to load keyring: %v", err)
+	}
+
+	// Metadata written before encryption was enabled stays readable
+	dir := filepath.Join(tmpDir, "metadata")
+	plain, err := NewStore(dir)
+	if err != nil {
+		t.Fatalf("failed to create store: %v", err)
+	}
+	plain.Save(&ObjectMetadata{ID: "0000aaaa", Size: 1, ContentType: "text/old"})
+	store, err := NewEncryptedStore(dir, keyring)
+	if err != nil {
+		t.Fatalf("failed to create encrypted store: %v", err)
+	}
+
+	if err := store.Save(&ObjectMetadata{ID: "1111bbbb", Size: 42, ContentType: "text/secret"}); err != nil {
+		t.Fatalf("failed to save metadata: %v", err)
+	}
+	if _, err := store.CreateBucket("docs", ""); err != nil {
+		t.Fatalf("failed to create bucket: %v", err)
+	}
+	if _, err := store.PutKey(&KeyEntry{Bucket: "docs", Key: "report.pdf", ObjectID: "1111bbbb"}); err != nil {
+		t.Fatalf("failed to put key: %v", err)
+	}
+	filepath.WalkDir(dir, func(path string, entry os.DirEntry, err error) error {
+		data, _ := os.ReadFile(path)
+		if bytes.Contains(data, []byte("text/secret")) || bytes.Contains(data, []byte("report.pdf")) {
+			t.Errorf("expected %s to be sealed", path)
+		}
+		return nil
+	})
+
+	// The indexes are built from the sealed files, which only read with the
+	// key file
+	if _, err := NewStore(dir); err == nil {
+		t.Error("expected sealed metadata not to load without a keyring")
+	}
+	store, err = NewEncryptedStore(dir, keyring)
+	if err != nil {
+		t.Fatalf("failed to reopen encrypted store: %v", err)
+	}
+	if entry, err := store.GetKey("docs", "report.pdf"); err != nil || entry.ObjectID != "1111bbbb" {
+		t.Errorf("expected the key to be read back, got %+v (%v)", entry, err)
+	}
+	for id, contentType := range map[string]string{"0000aaaa": "text/old", "1111bbbb": "text/secret"} {
+		if meta, err := store.Get(id); err != nil || meta.ContentType != contentType {
+			t.Errorf("expected %s to be read back, got %+v (%v)", id, meta, err)
+		}
+	}
+
+	// Rotation seals every file with the new key, the plain one included,
+	// so the old key can be dropped
+	os.WriteFile(keyPath, []byte(`{"active":"k2","keys":{"k1":`+key(1)+`,"k2":`+key(2)+`}}`), 0600)
+	keyring.Reload()
+	if resealed, err := store.Reseal(); err != nil || resealed != 4 {
+		t.Fatalf("expected 4 files resealed, got %d (%v)", resealed, err)
+	}
+	if resealed, _ := store.Reseal(); resealed != 0 {
+		t.Errorf("expected nothing left to reseal, got %d", resealed)
+	}
+	os.WriteFile(keyPath, []byte(`{"active":"k2","keys":{"k2":`+key(2)+`}}`), 0600)
+	keyring.Reload()
+	if _, err := NewEncryptedStore(dir, keyring); err != nil {
+		t.Errorf("failed to reopen store with the new key only: %v", err)
+	}
+	if meta, err := store.Get("0000aaaa"); err != nil || meta.ContentType != "text/old" {
+		t.Errorf("expected the resealed file to be read back, got %+v (%v)", meta, err)
+	}
+}
@@ -0,0 +1,558 @@
+package nodeapi
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/caskos/caskos/internal/storage"
+)
+
+// DefaultTimeout is how long a client waits on a remote node that stopped
+// responding: for a request without a body to complete, for response
+// headers, and for each read or write of a streamed object to progress
+const DefaultTimeout = 10 * time.Second
+
+// DefaultRetries is how many times a request without a body is retried
+// after a network error or a server error
+const DefaultRetries = 2
+
+// retryBackoff is the pause before the first retry; it doubles with each one
+const retryBackoff = 100 * time.Millisecond
+
+// errAborted ends the request of a pending write that was aborted
+var errAborted = errors.New("pending write aborted")
+
+// ClientConfig configures how a coordinator reaches remote nodes
+type ClientConfig struct {
+	Token   string        // Shared token the nodes require, if any
+	Timeout time.Duration // Zero uses DefaultTimeout
+	Retries int           // Negative disables retries; zero uses DefaultRetries
+}
+
+// Client reaches a storage node served by Server. It implements
+// storage.Backend, so the manager uses a remote node like a local one.
+// Objects are streamed both ways; a request that stalls for longer than the
+// timeout fails, and requests without a body are retried.
+type Client struct {
+	url     string
+	token   string
+	timeout time.Duration
+	retries int
+	http    *http.Client
+}
+
+// NewClient creates a client for the node served at baseURL
+func NewClient(baseURL string, config ClientConfig) *Client {
+	if config.Timeout <= 0 {
+		config.Timeout = DefaultTimeout
+	}
+	switch {
+	case config.Retries == 0:
+		config.Retries = DefaultRetries
+	case config.Retries < 0:
+		config.Retries = 0
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.ResponseHeaderTimeout = config.Timeout
+
+	return &Client{
+		url:     strings.TrimSuffix(baseURL, "/"),
+		token:   config.Token,
+		timeout: config.Timeout,
+		retries: config.Retries,
+		http:    &http.Client{Transport: transport},
+	}
+}
+
+// URL returns the base URL of the node
+func (c *Client) URL() string {
+	return c.url
+}
+
+// Ping checks that the node is up and accepts the client's token
+func (c *Client) Ping() error {
+	resp, cancel, err := c.send(http.MethodGet, "/health", true)
+	if err != nil {
+		return err
+	}
+	defer cancel()
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return responseError(resp, "")
+	}
+	return nil
+}
+
+// Probe asks the node to probe its backend. It is not retried: the manager
+// counts failed probes itself.
+func (c *Client) Probe() (storage.ProbeResult, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+	defer cancel()
+
+	req, err := c.newRequest(ctx, http.MethodGet, "/health", nil)
+	if err != nil {
+		return storage.ProbeResult{}, err
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return storage.ProbeResult{}, fmt.Errorf("failed to reach node: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return storage.ProbeResult{}, responseError(resp, "")
+	}
+
+	var result storage.ProbeResult
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return storage.ProbeResult{}, fmt.Errorf("failed to decode node response: %w", err)
+	}
+	return result, nil
+}
+
+// Store streams an object to the node. The data cannot be replayed, so the
+// request is not retried.
+func (c *Client) Store(objectID string, data io.Reader) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	req, err := c.newRequest(ctx, http.MethodPut, objectPath(objectID), &stallReader{reader: data, timeout: c.timeout, cancel: cancel})
+	if err != nil {
+		return err
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to store object on node: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		return responseError(resp, objectID)
+	}
+	return nil
+}
+
+// Retrieve opens an object on the node. The content is streamed as it is
+// read; seeking opens a new stream at the new position.
+func (c *Client) Retrieve(objectID string) (storage.Object, error) {
+	object := &remoteObject{client: c, objectID: objectID}
+	if err := object.open(0); err != nil {
+		return nil, err
+	}
+	return object, nil
+}
+
+// Exists reports whether the node holds an object. A node that cannot be
+// reached holds nothing.
+func (c *Client) Exists(objectID string) bool {
+	resp, cancel, err := c.send(http.MethodHead, objectPath(objectID), true)
+	if err != nil {
+		return false
+	}
+	defer cancel()
+	resp.Body.Close()
+	return resp.StatusCode == http.StatusOK
+}
+
+func (c *Client) Delete(objectID string) error {
+	resp, cancel, err := c.send(http.MethodDelete, objectPath(objectID), true)
+	if err != nil {
+		return err
+	}
+	defer cancel()
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		return responseError(resp, objectID)
+	}
+	return nil
+}
+
+func (c *Client) Stat(objectID string) (storage.ObjectInfo, error) {
+	var info objectInfo
+	if err := c.getJSON(objectPath(objectID)+"/stat", objectID, &info); err != nil {
+		return storage.ObjectInfo{}, err
+	}
+	return storage.ObjectInfo{Size: info.Size, StoredSize: info.StoredSize, ModTime: info.ModTime}, nil
+}
+
+// List pages through the node's objects. fn runs between requests, so it
+// may use the node.
+func (c *Client) List(after string, fn func(objectID string) error) error {
+	for {
+		query := url.Values{"after": {after}, "limit": {strconv.Itoa(listPageSize)}}
+		var page listResponse
+		if err := c.getJSON("/objects?"+query.Encode(), "", &page); err != nil {
+			return err
+		}
+
+		for _, objectID := range page.Objects {
+			if err := fn(objectID); err != nil {
+				return err
+			}
+		}
+		if len(page.Objects) < listPageSize {
+			return nil
+		}
+		after = page.Objects[len(page.Objects)-1]
+	}
+}
+
+// CreatePending starts streaming an object to the node in a single request.
+// Its ID is sent in a trailer by Commit, once the caller has hashed the
+// content.
+func (c *Client) CreatePending() (storage.PendingWrite, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	reader, writer := io.Pipe()
+	req, err := c.newRequest(ctx, http.MethodPost, "/objects", reader)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	req.Trailer = http.Header{objectIDTrailer: nil}
+
+	pending := &remotePending{
+		writer:  writer,
+		trailer: req.Trailer,
+		timeout: c.timeout,
+		cancel:  cancel,
+		done:    make(chan struct{}),
+	}
+	go func() {
+		defer cancel()
+		resp, err := c.http.Do(req)
+		if err == nil {
+			if resp.StatusCode != http.StatusCreated {
+				err = responseError(resp, "")
+			}
+			resp.Body.Close()
+		} else {
+			err = fmt.Errorf("failed to stream object to node: %w", err)
+		}
+		// Unblock writes if the node answered before reading everything
+		reader.CloseWithError(err)
+		pending.err = err
+		close(pending.done)
+	}()
+	return pending, nil
+}
+
+func (c *Client) Quarantine(objectID string) error {
+	resp, cancel, err := c.send(http.MethodPost, objectPath(objectID)+"/quarantine", true)
+	if err != nil {
+		return err
+	}
+	defer cancel()
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		return responseError(resp, objectID)
+	}
+	return nil
+}
+
+// RewrapKeys asks the node to reload its key file and wrap its data keys with
+// the active master key. It returns the number of keys rewrapped.
+func (c *Client) RewrapKeys() (int, error) {
+	resp, cancel, err := c.send(http.MethodPost, "/keys/rewrap", false)
+	if err != nil {
+		return 0, err
+	}
+	defer cancel()
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, responseError(resp, "")
+	}
+
+	var result rewrapResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return 0, fmt.Errorf("failed to decode node response: %w", err)
+	}
+	return result.Rewrapped, nil
+}
+
+// getJSON makes a GET request and decodes its JSON response into value
+func (c *Client) getJSON(path, objectID string, value interface{}) error {
+	resp, cancel, err := c.send(http.MethodGet, path, true)
+	if err != nil {
+		return err
+	}
+	defer cancel()
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return responseError(resp, objectID)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(value); err != nil {
+		return fmt.Errorf("failed to decode node response: %w", err)
+	}
+	return nil
+}
+
+// send makes a request without a body, retrying after network errors and
+// server errors with a growing pause. If bounded, each attempt, reading the
+// response included, must finish within the timeout; otherwise only the
+// response headers must arrive within it, so large bodies can stream. The
+// returned cancel function releases the request once the body is read.
+func (c *Client) send(method, path string, bounded bool) (*http.Response, context.CancelFunc, error) {
+	var lastErr error
+	for attempt := 0; attempt <= c.retries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(retryBackoff << (attempt - 1))
+		}
+
+		var ctx context.Context
+		var cancel context.CancelFunc
+		if bounded {
+			ctx, cancel = context.WithTimeout(context.Background(), c.timeout)
+		} else {
+			ctx, cancel = context.WithCancel(context.Background())
+		}
+		req, err := c.newRequest(ctx, method, path, nil)
+		if err != nil {
+			cancel()
+			return nil, nil, err
+		}
+
+		resp, err := c.http.Do(req)
+		if err != nil {
+			cancel()
+			lastErr = fmt.Errorf("failed to reach node: %w", err)
+			continue
+		}
+		if resp.StatusCode >= http.StatusInternalServerError {
+			lastErr = responseError(resp, "")
+			resp.Body.Close()
+			cancel()
+			continue
+		}
+		return resp, cancel, nil
+	}
+	return nil, nil, lastErr
+}
+
+// newRequest creates a request to the node carrying the client's token
+func (c *Client) newRequest(ctx context.Context, method, path string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, c.url+path, body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create node request: %w", err)
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	return req, nil
+}
+
+// objectPath returns the path of an object in the node API
+func objectPath(objectID string) string {
+	return "/objects/" + url.PathEscape(objectID)
+}
+
+// responseError turns an error response into the error the backend call
+// returns: ErrObjectNotFound and ErrChecksumMismatch are kept, so the
+// manager treats them as it does for a local node
+func responseError(resp *http.Response, objectID string) error {
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	message := strings.TrimSpace(string(body))
+
+	switch resp.StatusCode {
+	case http.StatusNotFound:
+		return fmt.Errorf("%w: %s", storage.ErrObjectNotFound, objectID)
+	case http.StatusUnprocessableEntity:
+		return fmt.Errorf("%w: %s", storage.ErrChecksumMismatch, objectID)
+	default:
+		return fmt.Errorf("node returned %s: %s", resp.Status, message)
+	}
+}
+
+// remoteObject streams an object from a node. Reads continue the current
+// response; a read at another position, after a seek, opens a new one.
+type remoteObject struct {
+	client   *Client
+	objectID string
+	size     int64
+	modTime  time.Time
+	pos      int64
+	resp     *http.Response
+	respPos  int64 // Position in the object the response body has reached
+	cancel   context.CancelFunc
+	err      error // Failure the node reported after sending the content
+}
+
+// open starts streaming the object from offset
+func (o *remoteObject) open(offset int64) error {
+	o.closeResponse()
+
+	query := url.Values{"offset": {strconv.FormatInt(offset, 10)}}
+	resp, cancel, err := o.client.send(http.MethodGet, objectPath(o.objectID)+"?"+query.Encode(), false)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer cancel()
+		defer resp.Body.Close()
+		return responseError(resp, o.objectID)
+	}
+
+	size, err := strconv.ParseInt(resp.Header.Get(sizeHeader), 10, 64)
+	if err != nil {
+		cancel()
+		resp.Body.Close()
+		return fmt.Errorf("node sent an invalid object size: %w", err)
+	}
+	o.size = size
+	o.modTime, _ = http.ParseTime(resp.Header.Get("Last-Modified"))
+	o.resp, o.respPos, o.cancel = resp, offset, cancel
+	return nil
+}
+
+func (o *remoteObject) Size() int64 {
+	return o.size
+}
+
+func (o *remoteObject) ModTime() time.Time {
+	return o.modTime
+}
+
+func (o *remoteObject) Read(p []byte) (int, error) {
+	if o.err != nil {
+		return 0, o.err
+	}
+	if o.pos >= o.size {
+		return 0, io.EOF
+	}
+	if o.resp == nil || o.respPos != o.pos {
+		if err := o.open(o.pos); err != nil {
+			return 0, err
+		}
+	}
+
+	// A node that stops sending fails the read instead of hanging it
+	timer := time.AfterFunc(o.client.timeout, o.cancel)
+	n, err := o.resp.Body.Read(p[:min(int64(len(p)), o.size-o.pos)])
+	o.pos += int64(n)
+	o.respPos += int64(n)
+	if err == nil && o.pos == o.size {
+		// The node may still report a failure, such as a bad gzip
+		// checksum, after the last byte; drain the body to see it
+		_, err = io.Copy(io.Discard, o.resp.Body)
+		if err == nil {
+			err = io.EOF
+		}
+	}
+	timer.Stop()
+
+	if err != io.EOF {
+		return n, err
+	}
+	// Trailers are only known once the body is read to its end
+	switch o.resp.Trailer.Get(errorTrailer) {
+	case "":
+		if o.pos < o.size {
+			return n, io.ErrUnexpectedEOF
+		}
+		if n > 0 {
+			return n, nil
+		}
+		return 0, io.EOF
+	case readChecksumMismatch:
+		o.err = fmt.Errorf("%w: %s", storage.ErrChecksumMismatch, o.objectID)
+	default:
+		o.err = fmt.Errorf("node failed to read object %s", o.objectID)
+	}
+	return n, o.err
+}
+
+func (o *remoteObject) Seek(offset int64, whence int) (int64, error) {
+	var pos int64
+	switch whence {
+	case io.SeekStart:
+		pos = offset
+	case io.SeekCurrent:
+		pos = o.pos + offset
+	case io.SeekEnd:
+		pos = o.size + offset
+	default:
+		return o.pos, fmt.Errorf("invalid whence %d", whence)
+	}
+	if pos < 0 {
+		return o.pos, fmt.Errorf("negative position")
+	}
+
+	o.pos = pos
+	return pos, nil
+}
+
+// Close ends the current response, if any
+func (o *remoteObject) Close() error {
+	o.closeResponse()
+	return nil
+}
+
+// closeResponse closes the current response and releases its request
+func (o *remoteObject) closeResponse() {
+	if o.resp != nil {
+		o.resp.Body.Close()
+		o.cancel()
+		o.resp, o.cancel = nil, nil
+	}
+}
+
+// remotePending is an object being streamed to a node through the body of a
+// single request
+type remotePending struct {
+	writer  *io.PipeWriter
+	trailer http.Header
+	timeout time.Duration
+	cancel  context.CancelFunc
+	done    chan struct{} // Closed once the request has finished
+	err     error         // Outcome of the request, set before done is closed
+}
+
+// Write sends data to the node. A node that stops accepting data fails the
+// write, and the request, instead of blocking it.
+func (p *remotePending) Write(data []byte) (int, error) {
+	timer := time.AfterFunc(p.timeout, p.cancel)
+	defer timer.Stop()
+	return p.writer.Write(data)
+}
+
+// Commit ends the content with the object's ID and waits for the node to
+// make it durable
+func (p *remotePending) Commit(objectID string) error {
+	p.trailer.Set(objectIDTrailer, objectID)
+	timer := time.AfterFunc(p.timeout, p.cancel)
+	defer timer.Stop()
+	p.writer.Close()
+	<-p.done
+	return p.err
+}
+
+// Abort ends the request early, so the node discards what it received
+func (p *remotePending) Abort() error {
+	p.writer.CloseWithError(errAborted)
+	<-p.done
+	return nil
+}
+
+// stallReader fails a request whose body the node stops accepting for longer
+// than the timeout
+type stallReader struct {
+	reader  io.Reader
+	timeout time.Duration
+	cancel  context.CancelFunc
+	timer   *time.Timer
+}
+
+func (r *stallReader) Read(p []byte) (int, error) {
+	if r.timer == nil {
+		r.timer = time.AfterFunc(r.timeout, r.cancel)
+	} else {
+		r.timer.Reset(r.timeout)
+	}
+	return r.reader.Read(p)
+}
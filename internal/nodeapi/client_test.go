@@ -0,0 +1,386 @@
+package nodeapi
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/caskos/caskos/internal/hashring"
+	"github.com/caskos/caskos/internal/storage"
+)
+
+var testLogger = slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelError}))
+
+// newRemoteNode serves a backend over the node API and returns a client for it
+func newRemoteNode(backend storage.Backend, config ClientConfig) (*Client, func()) {
+	server := httptest.NewServer(NewServer(backend, config.Token, testLogger))
+	return NewClient(server.URL, config), server.Close
+}
+
+func TestClient_Backend(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "nodeapi-test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	node, err := storage.NewNode("node1", tmpDir)
+	if err != nil {
+		t.Fatalf("failed to create node: %v", err)
+	}
+	client, stop := newRemoteNode(node, ClientConfig{})
+	defer stop()
+
+	if err := client.Ping(); err != nil {
+		t.Fatalf("failed to ping node: %v", err)
+	}
+	if result, err := client.Probe(); err != nil || result.FreeBytes == 0 {
+		t.Errorf("expected the node to probe its disk, got %+v (%v)", result, err)
+	}
+
+	content := make([]byte, 200<<10)
+	rand.New(rand.NewSource(1)).Read(content)
+	objectID := storage.GenerateObjectID(content)
+	if err := client.Store(objectID, bytes.NewReader(content)); err != nil {
+		t.Fatalf("failed to store object: %v", err)
+	}
+	if !client.Exists(objectID) || !node.Exists(objectID) {
+		t.Fatal("expected the object to exist on the node")
+	}
+
+	info, err := client.Stat(objectID)
+	if err != nil || info.Size != int64(len(content)) || info.ModTime.IsZero() {
+		t.Errorf("expected %d bytes with a modification time, got %+v (%v)", len(content), info, err)
+	}
+
+	object, err := client.Retrieve(objectID)
+	if err != nil {
+		t.Fatalf("failed to retrieve object: %v", err)
+	}
+	if object.Size() != int64(len(content)) {
+		t.Errorf("expected size %d, got %d", len(content), object.Size())
+	}
+	retrieved, err := io.ReadAll(object)
+	if err != nil || !bytes.Equal(retrieved, content) {
+		t.Fatalf("retrieved content does not match (%v)", err)
+	}
+
+	// Ranges are served by seeking either way
+	part := make([]byte, 100)
+	for _, offset := range []int64{150000, 1000, 199950} {
+		if _, err := object.Seek(offset, io.SeekStart); err != nil {
+			t.Fatalf("failed to seek to %d: %v", offset, err)
+		}
+		n, err := io.ReadFull(object, part)
+		end := min(offset+100, int64(len(content)))
+		if int64(n) != end-offset || !bytes.Equal(part[:n], content[offset:end]) {
+			t.Errorf("range at %d does not match (%v)", offset, err)
+		}
+	}
+	object.Close()
+
+	// Pending writes get their ID once the content is sent
+	other := []byte("written through a pending write")
+	otherID := storage.GenerateObjectID(other)
+	pending, err := client.CreatePending()
+	if err != nil {
+		t.Fatalf("failed to create pending write: %v", err)
+	}
+	pending.Write(other[:10])
+	pending.Write(other[10:])
+	if err := pending.Commit(otherID); err != nil {
+		t.Fatalf("failed to commit pending write: %v", err)
+	}
+	if !node.Exists(otherID) {
+		t.Error("expected the committed object on the node")
+	}
+
+	aborted, err := client.CreatePending()
+	if err != nil {
+		t.Fatalf("failed to create pending write: %v", err)
+	}
+	aborted.Write([]byte("never committed"))
+	aborted.Abort()
+	var listed []string
+	if err := client.List("", func(objectID string) error {
+		listed = append(listed, objectID)
+		return nil
+	}); err != nil {
+		t.Fatalf("failed to list objects: %v", err)
+	}
+	if len(listed) != 2 {
+		t.Errorf("expected only the two committed objects, got %v", listed)
+	}
+	entries, _ := os.ReadDir(filepath.Join(tmpDir, ".pending"))
+	if len(entries) != 0 {
+		t.Errorf("expected the aborted write to be discarded, got %d pending files", len(entries))
+	}
+
+	// A cursor that is not an object ID is refused rather than crashing a
+	// node that places objects by the ID's prefix
+	for _, after := range []string{"a", "abc", "../x"} {
+		if err := client.List(after, func(string) error { return nil }); err == nil {
+			t.Errorf("expected after %q to be rejected", after)
+		}
+	}
+
+	if err := client.Delete(objectID); err != nil {
+		t.Fatalf("failed to delete object: %v", err)
+	}
+	if _, err := client.Retrieve(objectID); !errors.Is(err, storage.ErrObjectNotFound) {
+		t.Errorf("expected ErrObjectNotFound, got %v", err)
+	}
+	if _, err := client.Stat(objectID); !errors.Is(err, storage.ErrObjectNotFound) {
+		t.Errorf("expected ErrObjectNotFound from stat, got %v", err)
+	}
+}
+
+func TestClient_List(t *testing.T) {
+	backend := storage.NewMemoryBackend()
+	client, stop := newRemoteNode(backend, ClientConfig{})
+	defer stop()
+
+	// More objects than fit on one page
+	count := listPageSize + 10
+	for i := 0; i < count; i++ {
+		backend.Store(fmt.Sprintf("%08x", i), strings.NewReader("x"))
+	}
+
+	var listed []string
+	if err := client.List("0000000a", func(objectID string) error {
+		listed = append(listed, objectID)
+		return nil
+	}); err != nil {
+		t.Fatalf("failed to list objects: %v", err)
+	}
+	if len(listed) != count-11 || listed[0] != "0000000b" || listed[len(listed)-1] != fmt.Sprintf("%08x", count-1) {
+		t.Errorf("expected %d objects after 0000000a in order, got %d", count-11, len(listed))
+	}
+}
+
+func TestClient_Corruption(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "nodeapi-test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	node, err := storage.NewNode("node1", tmpDir)
+	if err != nil {
+		t.Fatalf("failed to create node: %v", err)
+	}
+	node.SetCompression(storage.CodecGzip)
+	client, stop := newRemoteNode(node, ClientConfig{})
+	defer stop()
+
+	content := strings.Repeat("compressible content ", 10000)
+	objectID := storage.GenerateObjectID([]byte(content))
+	if err := client.Store(objectID, strings.NewReader(content)); err != nil {
+		t.Fatalf("failed to store object: %v", err)
+	}
+
+	// Cut the compressed data short; the node only notices while streaming
+	path := filepath.Join(tmpDir, objectID[0:2], objectID[2:4], objectID)
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("failed to stat object file: %v", err)
+	}
+	if err := os.Truncate(path, info.Size()-20); err != nil {
+		t.Fatalf("failed to truncate object file: %v", err)
+	}
+
+	object, err := client.Retrieve(objectID)
+	if err != nil {
+		t.Fatalf("failed to retrieve object: %v", err)
+	}
+	_, err = io.ReadAll(object)
+	object.Close()
+	if !errors.Is(err, storage.ErrChecksumMismatch) {
+		t.Errorf("expected ErrChecksumMismatch, got %v", err)
+	}
+
+	if err := client.Quarantine(objectID); err != nil {
+		t.Fatalf("failed to quarantine object: %v", err)
+	}
+	if node.Exists(objectID) {
+		t.Error("expected the quarantined object to be gone")
+	}
+}
+
+func TestClient_Token(t *testing.T) {
+	backend := storage.NewMemoryBackend()
+	server := httptest.NewServer(NewServer(backend, "secret", testLogger))
+	defer server.Close()
+
+	if err := NewClient(server.URL, ClientConfig{Token: "wrong", Retries: -1}).Ping(); err == nil {
+		t.Error("expected a wrong token to be rejected")
+	}
+	if NewClient(server.URL, ClientConfig{Retries: -1}).Store("abcd1234", strings.NewReader("x")) == nil {
+		t.Error("expected a missing token to be rejected")
+	}
+	if err := NewClient(server.URL, ClientConfig{Token: "secret"}).Ping(); err != nil {
+		t.Errorf("expected the right token to be accepted, got %v", err)
+	}
+
+	// Object IDs must not escape the node's directory
+	if err := NewClient(server.URL, ClientConfig{Token: "secret"}).Store("../../etc", strings.NewReader("x")); err == nil {
+		t.Error("expected an invalid object ID to be rejected")
+	}
+}
+
+// writeKeyFile writes a key file whose keys are each filled with one byte
+func writeKeyFile(t *testing.T, path, active string, keys map[string]byte) {
+	t.Helper()
+	encoded := make(map[string]string, len(keys))
+	for id, fill := range keys {
+		encoded[id] = base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{fill}, 32))
+	}
+	data, _ := json.Marshal(map[string]interface{}{"active": active, "keys": encoded})
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatalf("failed to write key file: %v", err)
+	}
+}
+
+func TestClient_RewrapKeys(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "nodeapi-test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	// The coordinator and the node process each have a key file
+	coordinatorKeys := filepath.Join(tmpDir, "coordinator.json")
+	nodeKeys := filepath.Join(tmpDir, "node.json")
+	writeKeyFile(t, coordinatorKeys, "k1", map[string]byte{"k1": 1})
+	writeKeyFile(t, nodeKeys, "k1", map[string]byte{"k1": 1})
+	coordinatorKeyring, err := storage.LoadKeyring(coordinatorKeys)
+	if err != nil {
+		t.Fatalf("failed to load keyring: %v", err)
+	}
+	nodeKeyring, err := storage.LoadKeyring(nodeKeys)
+	if err != nil {
+		t.Fatalf("failed to load keyring: %v", err)
+	}
+
+	node, err := storage.NewNode("node1", filepath.Join(tmpDir, "node1"))
+	if err != nil {
+		t.Fatalf("failed to create node: %v", err)
+	}
+	node.SetKeyring(nodeKeyring)
+	client, stop := newRemoteNode(node, ClientConfig{})
+	defer stop()
+
+	ring := hashring.NewHashRing(50)
+	ring.AddNode("node1")
+	manager := storage.NewManager(ring, 1, testLogger)
+	manager.AddNode("node1", client)
+	manager.SetKeyring(coordinatorKeyring)
+
+	content := []byte("encrypted on a remote node")
+	objectID := storage.GenerateObjectID(content)
+	if err := client.Store(objectID, bytes.NewReader(content)); err != nil {
+		t.Fatalf("failed to store object: %v", err)
+	}
+
+	// Rotation reaches the remote node, which reloads its own key file
+	writeKeyFile(t, coordinatorKeys, "k2", map[string]byte{"k1": 1, "k2": 2})
+	writeKeyFile(t, nodeKeys, "k2", map[string]byte{"k1": 1, "k2": 2})
+	rewrapped, err := manager.RotateKeys()
+	if err != nil || rewrapped["node1"] != 1 {
+		t.Fatalf("expected the remote node to rewrap 1 key, got %v (%v)", rewrapped, err)
+	}
+
+	// So the old key can be dropped from its file
+	writeKeyFile(t, nodeKeys, "k2", map[string]byte{"k2": 2})
+	if err := nodeKeyring.Reload(); err != nil {
+		t.Fatalf("failed to reload keyring: %v", err)
+	}
+	object, err := client.Retrieve(objectID)
+	if err != nil {
+		t.Fatalf("failed to retrieve object after rotation: %v", err)
+	}
+	retrieved, err := io.ReadAll(object)
+	object.Close()
+	if err != nil || !bytes.Equal(retrieved, content) {
+		t.Errorf("content does not match after rotation (%v)", err)
+	}
+}
+
+func TestClient_Manager(t *testing.T) {
+	ring := hashring.NewHashRing(50)
+	manager := storage.NewManager(ring, 2, testLogger)
+	manager.SetNodeTimeout(200 * time.Millisecond)
+
+	faulty := make(map[string]*storage.FaultyBackend)
+	for i := 1; i <= 3; i++ {
+		nodeID := fmt.Sprintf("node%d", i)
+		faulty[nodeID] = storage.NewFaultyBackend(storage.NewMemoryBackend())
+		client, stop := newRemoteNode(faulty[nodeID], ClientConfig{Timeout: 200 * time.Millisecond, Retries: -1})
+		defer stop()
+		ring.AddNode(nodeID)
+		manager.AddNode(nodeID, client)
+	}
+
+	content := make([]byte, 300<<10)
+	rand.New(rand.NewSource(2)).Read(content)
+	result, err := manager.PutObject(context.Background(), bytes.NewReader(content), "", "")
+	if err != nil {
+		t.Fatalf("failed to put object: %v", err)
+	}
+	reader, err := manager.OpenChunks(result.ObjectID, result.Chunks)
+	if err != nil {
+		t.Fatalf("failed to open object: %v", err)
+	}
+	retrieved, err := io.ReadAll(reader)
+	reader.Close()
+	if err != nil || !bytes.Equal(retrieved, content) {
+		t.Fatalf("retrieved content does not match (%v)", err)
+	}
+
+	// Reads fail over from a remote node that went down
+	other := []byte("stored on remote nodes")
+	otherID := storage.GenerateObjectID(other)
+	if _, err := manager.StoreObject(context.Background(), otherID, bytes.NewReader(other), int64(len(other))); err != nil {
+		t.Fatalf("failed to store object: %v", err)
+	}
+	targets := manager.GetTargetNodes(otherID)
+	faulty[targets[0]].SetDown(true)
+	manager.ProbeNodes(context.Background())
+	if health := manager.NodeHealth()[targets[0]]; health.State != storage.HealthSuspect {
+		t.Errorf("expected a failed probe through the node API, got %+v", health)
+	}
+	object, err := manager.RetrieveObject(otherID)
+	if err != nil {
+		t.Fatalf("failed to retrieve object with a node down: %v", err)
+	}
+	retrieved, _ = io.ReadAll(object)
+	object.Close()
+	if !bytes.Equal(retrieved, other) {
+		t.Errorf("expected %q, got %q", other, retrieved)
+	}
+	faulty[targets[0]].Heal()
+	manager.ProbeNodes(context.Background())
+
+	// A remote node that stalls times out instead of hanging reads
+	faulty[targets[0]].SetDelay(time.Second)
+	start := time.Now()
+	if _, err := manager.RetrieveObject(otherID); err != nil {
+		t.Errorf("failed to retrieve object with a node stalled: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 900*time.Millisecond {
+		t.Errorf("expected the stalled node to time out, took %v", elapsed)
+	}
+	faulty[targets[0]].Heal()
+}
@@ -0,0 +1,378 @@
+// Package nodeapi serves a storage node over an internal HTTP API and
+// provides the client a coordinator reaches it with, so the replicas of an
+// object can live in separate processes or on separate machines.
+package nodeapi
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/caskos/caskos/internal/storage"
+)
+
+const (
+	// objectIDTrailer carries the ID of an object written through a
+	// pending write, which is only known once its content has been hashed
+	objectIDTrailer = "X-Object-Id"
+
+	// errorTrailer reports a read that failed after the response started
+	errorTrailer = "X-Object-Error"
+
+	// sizeHeader and storedSizeHeader carry the logical size of an object
+	// and its size as stored
+	sizeHeader       = "X-Object-Size"
+	storedSizeHeader = "X-Object-Stored-Size"
+)
+
+// Values of errorTrailer
+const (
+	readChecksumMismatch = "checksum-mismatch"
+	readFailed           = "read-failed"
+)
+
+// listPageSize is the number of object IDs returned per list request
+const listPageSize = 1000
+
+// validObjectID matches object IDs and shard IDs. Node places objects by the
+// first four characters of their ID, and IDs must never form paths.
+var validObjectID = regexp.MustCompile(`^[0-9a-f]{4,64}(\.ec[0-9]+-[0-9]+\.[0-9]+)?$`)
+
+// errPageFull stops a list once a page is full
+var errPageFull = errors.New("page full")
+
+// objectInfo is the JSON form of storage.ObjectInfo
+type objectInfo struct {
+	Size       int64     `json:"size"`
+	StoredSize int64     `json:"stored_size"`
+	ModTime    time.Time `json:"mod_time"`
+}
+
+// rewrapResponse reports how many data keys a node rewrapped
+type rewrapResponse struct {
+	Rewrapped int `json:"rewrapped"`
+}
+
+// keyedBackend is implemented by backends that encrypt with master keys of
+// their own, such as storage.Node
+type keyedBackend interface {
+	Keyring() *storage.Keyring
+	RewrapKeys() (int, error)
+}
+
+// listResponse is a page of object IDs
+type listResponse struct {
+	Objects []string `json:"objects"`
+}
+
+// Server serves the objects of one storage backend over HTTP. Requests must
+// carry the shared token, if one is set.
+type Server struct {
+	backend storage.Backend
+	token   string
+	logger  *slog.Logger
+	mux     *http.ServeMux
+}
+
+// NewServer creates a server for a backend, normally a storage.Node
+func NewServer(backend storage.Backend, token string, logger *slog.Logger) *Server {
+	s := &Server{
+		backend: backend,
+		token:   token,
+		logger:  logger,
+		mux:     http.NewServeMux(),
+	}
+
+	s.mux.HandleFunc("GET /health", s.healthHandler)
+	s.mux.HandleFunc("GET /objects", s.listHandler)
+	s.mux.HandleFunc("POST /objects", s.createHandler)
+	s.mux.HandleFunc("PUT /objects/{id}", s.storeHandler)
+	s.mux.HandleFunc("HEAD /objects/{id}", s.existsHandler)
+	s.mux.HandleFunc("GET /objects/{id}", s.retrieveHandler)
+	s.mux.HandleFunc("GET /objects/{id}/stat", s.statHandler)
+	s.mux.HandleFunc("DELETE /objects/{id}", s.deleteHandler)
+	s.mux.HandleFunc("POST /objects/{id}/quarantine", s.quarantineHandler)
+	s.mux.HandleFunc("POST /keys/rewrap", s.rewrapHandler)
+	return s
+}
+
+// ServeHTTP checks the request's token and dispatches it
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if s.token != "" {
+		given := []byte(r.Header.Get("Authorization"))
+		if subtle.ConstantTimeCompare(given, []byte("Bearer "+s.token)) != 1 {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+	}
+	s.mux.ServeHTTP(w, r)
+}
+
+// objectID returns the validated object ID of a request, or writes an error
+func (s *Server) objectID(w http.ResponseWriter, r *http.Request) (string, bool) {
+	objectID := r.PathValue("id")
+	if !validObjectID.MatchString(objectID) {
+		http.Error(w, "Invalid object ID", http.StatusBadRequest)
+		return "", false
+	}
+	return objectID, true
+}
+
+// writeError writes the status a backend error maps to
+func (s *Server) writeError(w http.ResponseWriter, objectID, action string, err error) {
+	switch {
+	case errors.Is(err, storage.ErrObjectNotFound):
+		http.Error(w, "Object not found", http.StatusNotFound)
+	case errors.Is(err, storage.ErrChecksumMismatch):
+		s.logger.Warn("replica failed checksum verification", "object_id", objectID, "error", err)
+		http.Error(w, "Object is corrupt", http.StatusUnprocessableEntity)
+	default:
+		s.logger.Error("failed to "+action+" object", "object_id", objectID, "error", err)
+		http.Error(w, fmt.Sprintf("Failed to %s object: %v", action, err), http.StatusInternalServerError)
+	}
+}
+
+// healthHandler probes the backend, so the coordinator's health checks cover
+// the node's disk and not just its process
+func (s *Server) healthHandler(w http.ResponseWriter, r *http.Request) {
+	result, err := storage.ProbeBackend(s.backend)
+	if err != nil {
+		s.logger.Warn("health probe failed", "error", err)
+		http.Error(w, fmt.Sprintf("Probe failed: %v", err), http.StatusServiceUnavailable)
+		return
+	}
+	s.respondWithJSON(w, result)
+}
+
+// listHandler returns the IDs of up to limit objects after the given ID
+func (s *Server) listHandler(w http.ResponseWriter, r *http.Request) {
+	limit := listPageSize
+	if value := r.URL.Query().Get("limit"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed <= 0 {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+		limit = min(parsed, listPageSize)
+	}
+	after := r.URL.Query().Get("after")
+	if after != "" && !validObjectID.MatchString(after) {
+		http.Error(w, "Invalid after", http.StatusBadRequest)
+		return
+	}
+
+	page := listResponse{Objects: make([]string, 0)}
+	err := s.backend.List(after, func(objectID string) error {
+		page.Objects = append(page.Objects, objectID)
+		if len(page.Objects) == limit {
+			return errPageFull
+		}
+		return nil
+	})
+	if err != nil && err != errPageFull {
+		s.logger.Error("failed to list objects", "error", err)
+		http.Error(w, fmt.Sprintf("Failed to list objects: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	s.respondWithJSON(w, page)
+}
+
+// createHandler stores an object whose ID arrives in a trailer after its
+// content, as the coordinator streams uploads before it has hashed them
+func (s *Server) createHandler(w http.ResponseWriter, r *http.Request) {
+	pending, err := s.backend.CreatePending()
+	if err != nil {
+		s.writeError(w, "", "store", err)
+		return
+	}
+
+	if _, err := io.Copy(pending, r.Body); err != nil {
+		// Also how a coordinator that gave up on the write aborts it
+		pending.Abort()
+		s.logger.Warn("pending write ended early", "error", err)
+		http.Error(w, fmt.Sprintf("Failed to read object data: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	objectID := r.Trailer.Get(objectIDTrailer)
+	if !validObjectID.MatchString(objectID) {
+		pending.Abort()
+		http.Error(w, "Invalid or missing object ID trailer", http.StatusBadRequest)
+		return
+	}
+	if err := pending.Commit(objectID); err != nil {
+		s.writeError(w, objectID, "store", err)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+}
+
+func (s *Server) storeHandler(w http.ResponseWriter, r *http.Request) {
+	objectID, ok := s.objectID(w, r)
+	if !ok {
+		return
+	}
+
+	if err := s.backend.Store(objectID, r.Body); err != nil {
+		s.writeError(w, objectID, "store", err)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+}
+
+func (s *Server) existsHandler(w http.ResponseWriter, r *http.Request) {
+	objectID, ok := s.objectID(w, r)
+	if !ok {
+		return
+	}
+
+	if !s.backend.Exists(objectID) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// retrieveHandler streams an object from the offset given in the query.
+// The body is chunked so that a read failing partway, such as content that
+// fails to decompress, can still be reported in a trailer.
+func (s *Server) retrieveHandler(w http.ResponseWriter, r *http.Request) {
+	objectID, ok := s.objectID(w, r)
+	if !ok {
+		return
+	}
+
+	var offset int64
+	if value := r.URL.Query().Get("offset"); value != "" {
+		parsed, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || parsed < 0 {
+			http.Error(w, "Invalid offset", http.StatusBadRequest)
+			return
+		}
+		offset = parsed
+	}
+
+	object, err := s.backend.Retrieve(objectID)
+	if err != nil {
+		s.writeError(w, objectID, "retrieve", err)
+		return
+	}
+	defer object.Close()
+
+	if offset > object.Size() {
+		http.Error(w, "Offset beyond the end of the object", http.StatusRequestedRangeNotSatisfiable)
+		return
+	}
+	if _, err := object.Seek(offset, io.SeekStart); err != nil {
+		s.writeError(w, objectID, "retrieve", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set(sizeHeader, strconv.FormatInt(object.Size(), 10))
+	w.Header().Set("Last-Modified", object.ModTime().UTC().Format(http.TimeFormat))
+	w.Header().Set("Trailer", errorTrailer)
+	w.WriteHeader(http.StatusOK)
+
+	copied, err := io.Copy(w, object)
+	if err == nil && copied < object.Size()-offset {
+		// A file shorter than its header says is corrupt
+		err = fmt.Errorf("%w: object ends early", storage.ErrChecksumMismatch)
+	}
+	switch {
+	case errors.Is(err, storage.ErrChecksumMismatch):
+		s.logger.Warn("replica failed checksum verification", "object_id", objectID, "error", err)
+		w.Header().Set(errorTrailer, readChecksumMismatch)
+	case err != nil:
+		s.logger.Error("failed to stream object", "object_id", objectID, "error", err)
+		w.Header().Set(errorTrailer, readFailed)
+	}
+}
+
+func (s *Server) statHandler(w http.ResponseWriter, r *http.Request) {
+	objectID, ok := s.objectID(w, r)
+	if !ok {
+		return
+	}
+
+	info, err := s.backend.Stat(objectID)
+	if err != nil {
+		s.writeError(w, objectID, "stat", err)
+		return
+	}
+
+	s.respondWithJSON(w, objectInfo{Size: info.Size, StoredSize: info.StoredSize, ModTime: info.ModTime})
+}
+
+func (s *Server) deleteHandler(w http.ResponseWriter, r *http.Request) {
+	objectID, ok := s.objectID(w, r)
+	if !ok {
+		return
+	}
+
+	if err := s.backend.Delete(objectID); err != nil {
+		s.writeError(w, objectID, "delete", err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) quarantineHandler(w http.ResponseWriter, r *http.Request) {
+	objectID, ok := s.objectID(w, r)
+	if !ok {
+		return
+	}
+
+	if err := s.backend.Quarantine(objectID); err != nil {
+		s.writeError(w, objectID, "quarantine", err)
+		return
+	}
+
+	s.logger.Warn("quarantined corrupt replica", "object_id", objectID)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// rewrapHandler reloads the node's key file and wraps its data keys with the
+// active master key. A node that does not encrypt has none to rewrap.
+func (s *Server) rewrapHandler(w http.ResponseWriter, r *http.Request) {
+	backend, ok := s.backend.(keyedBackend)
+	if !ok || backend.Keyring() == nil {
+		s.respondWithJSON(w, rewrapResponse{})
+		return
+	}
+
+	keyring := backend.Keyring()
+	if err := keyring.Reload(); err != nil {
+		s.logger.Error("failed to reload key file", "error", err)
+		http.Error(w, fmt.Sprintf("Failed to reload key file: %v", err), http.StatusInternalServerError)
+		return
+	}
+	rewrapped, err := backend.RewrapKeys()
+	if err != nil {
+		s.logger.Error("failed to rewrap keys", "rewrapped", rewrapped, "error", err)
+		http.Error(w, fmt.Sprintf("Failed to rewrap keys: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	s.logger.Info("master key rotated", "active_key", keyring.Active(), "rewrapped", rewrapped)
+	s.respondWithJSON(w, rewrapResponse{Rewrapped: rewrapped})
+}
+
+// respondWithJSON writes a JSON response
+func (s *Server) respondWithJSON(w http.ResponseWriter, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(value); err != nil {
+		s.logger.Error("failed to encode response", "error", err)
+	}
+}
@@ -0,0 +1,380 @@
+package scrubber
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/caskos/caskos/internal/metadata"
+	"github.com/caskos/caskos/internal/storage"
+)
+
+// checkpointInterval is how many objects are scrubbed between progress saves
+const checkpointInterval = 100
+
+// Config controls how often and how fast the scrubber runs
+type Config struct {
+	Interval       time.Duration // Pause between full passes
+	BytesPerSecond int64         // Read rate limit; 0 means unlimited
+	StatePath      string        // File the scrub progress is persisted to
+}
+
+// Stats counts what a scrub pass found
+type Stats struct {
+	Objects   int64 `json:"objects"`
+	Bytes     int64 `json:"bytes"`
+	Corrupt   int64 `json:"corrupt"`
+	Repaired  int64 `json:"repaired"`
+	Orphaned  int64 `json:"orphaned"`
+	Misplaced int64 `json:"misplaced"`
+	Deleted   int64 `json:"deleted"`
+	Errors    int64 `json:"errors"`
+}
+
+// add adds the counts of other to s
+func (s *Stats) add(other Stats) {
+	s.Objects += other.Objects
+	s.Bytes += other.Bytes
+	s.Corrupt += other.Corrupt
+	s.Repaired += other.Repaired
+	s.Orphaned += other.Orphaned
+	s.Misplaced += other.Misplaced
+	s.Deleted += other.Deleted
+	s.Errors += other.Errors
+}
+
+// Progress is the persisted state of the scrubber. A pass visits nodes in
+// sorted order and objects in ID order, so the last node and object visited
+// are enough to resume an interrupted pass. Stats counts the pass in
+// progress, or the last completed pass until the next one starts; Total sums
+// every completed pass.
+type Progress struct {
+	PassStartedAt   time.Time `json:"pass_started_at"`
+	LastCompletedAt time.Time `json:"last_completed_at,omitempty"`
+	CompletedNodes  []string  `json:"completed_nodes"`
+	CurrentNode     string    `json:"current_node,omitempty"`
+	LastObjectID    string    `json:"last_object_id,omitempty"`
+	Stats           Stats     `json:"stats"`
+	Total           Stats     `json:"total"`
+}
+
+// Scrubber walks every storage node, rehashes each object, cross-checks it
+// against the metadata store and the ring placement, and repairs missing or
+// corrupt replicas
+type Scrubber struct {
+	mu             sync.Mutex
+	storageManager *storage.Manager
+	metadataStore  *metadata.Store
+	config         Config
+	logger         *slog.Logger
+	progress       Progress
+}
+
+// New creates a scrubber, loading any progress saved by a previous run
+func New(storageManager *storage.Manager, metadataStore *metadata.Store, config Config, logger *slog.Logger) (*Scrubber, error) {
+	s := &Scrubber{
+		storageManager: storageManager,
+		metadataStore:  metadataStore,
+		config:         config,
+		logger:         logger,
+	}
+
+	data, err := os.ReadFile(config.StatePath)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read scrubber state: %w", err)
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, &s.progress); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal scrubber state: %w", err)
+		}
+	}
+
+	return s, nil
+}
+
+// Run scrubs all nodes repeatedly until the context is cancelled
+func (s *Scrubber) Run(ctx context.Context) {
+	for {
+		if err := s.ScrubOnce(ctx); err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			s.logger.Error("scrub pass failed", "error", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(s.config.Interval):
+		}
+	}
+}
+
+// ScrubOnce completes one pass over every node, resuming an interrupted pass
+// if there is one
+func (s *Scrubber) ScrubOnce(ctx context.Context) error {
+	s.mu.Lock()
+	if s.progress.PassStartedAt.IsZero() {
+		s.progress.PassStartedAt = time.Now()
+		s.progress.Stats = Stats{}
+	} else {
+		s.logger.Info("resuming scrub pass",
+			"started_at", s.progress.PassStartedAt,
+			"node_id", s.progress.CurrentNode,
+			"after", s.progress.LastObjectID)
+	}
+	s.mu.Unlock()
+
+	limiter := newThrottle(s.config.BytesPerSecond)
+	for _, nodeID := range s.storageManager.NodeIDs() {
+		s.mu.Lock()
+		done := slices.Contains(s.progress.CompletedNodes, nodeID)
+		after := ""
+		if s.progress.CurrentNode == nodeID {
+			after = s.progress.LastObjectID
+		}
+		s.mu.Unlock()
+		if done {
+			continue
+		}
+
+		if err := s.scrubNode(ctx, nodeID, after, limiter); err != nil {
+			s.saveProgress()
+			return err
+		}
+
+		s.mu.Lock()
+		s.progress.CompletedNodes = append(s.progress.CompletedNodes, nodeID)
+		s.progress.CurrentNode = ""
+		s.progress.LastObjectID = ""
+		s.mu.Unlock()
+		s.saveProgress()
+	}
+
+	s.mu.Lock()
+	stats, total := s.progress.Stats, s.progress.Total
+	total.add(stats)
+	s.progress = Progress{LastCompletedAt: time.Now(), Stats: stats, Total: total}
+	s.mu.Unlock()
+	s.saveProgress()
+
+	s.logger.Info("scrub pass completed",
+		"objects", stats.Objects,
+		"bytes", stats.Bytes,
+		"corrupt", stats.Corrupt,
+		"repaired", stats.Repaired,
+		"orphaned", stats.Orphaned,
+		"misplaced", stats.Misplaced,
+		"deleted", stats.Deleted,
+		"errors", stats.Errors)
+	return nil
+}
+
+// Progress returns a snapshot of the scrubber's progress
+func (s *Scrubber) Progress() Progress {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	progress := s.progress
+	progress.CompletedNodes = slices.Clone(s.progress.CompletedNodes)
+	return progress
+}
+
+// scrubNode checks every object on one node, starting after the given object ID
+func (s *Scrubber) scrubNode(ctx context.Context, nodeID, after string, limiter *throttle) error {
+	node, exists := s.storageManager.Node(nodeID)
+	if !exists {
+		return nil
+	}
+
+	s.mu.Lock()
+	s.progress.CurrentNode = nodeID
+	s.mu.Unlock()
+
+	scanned := 0
+	return node.List(after, func(objectID string) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		s.scrubObject(ctx, nodeID, node, objectID, limiter)
+
+		s.mu.Lock()
+		s.progress.LastObjectID = objectID
+		s.mu.Unlock()
+
+		scanned++
+		if scanned%checkpointInterval == 0 {
+			s.saveProgress()
+		}
+		return nil
+	})
+}
+
+// scrubObject verifies one replica and repairs the object's placement if needed
+func (s *Scrubber) scrubObject(ctx context.Context, nodeID string, node storage.Backend, objectID string, limiter *throttle) {
+	// A copy of a deleted object is left over on a node that missed the
+	// delete, unless the same content is still a chunk of another object. A
+	// shard belongs to whatever its chunk belongs to. Claiming the removal
+	// keeps an upload of the same content from counting on the copy.
+	chunkID, dataShards, parityShards, _, isShard := storage.ParseShardID(objectID)
+	if !isShard {
+		chunkID = objectID
+	}
+	references := s.metadataStore.ChunkReferences(chunkID)
+	if references == 0 && s.metadataStore.IsDeleted(chunkID) && s.metadataStore.StartChunkRemoval(chunkID) {
+		s.logger.Info("removing replica of deleted object", "object_id", objectID, "node_id", nodeID)
+		err := node.Delete(objectID)
+		s.metadataStore.FinishChunkRemoval(chunkID)
+		if err != nil {
+			s.logger.Error("failed to remove replica of deleted object", "object_id", objectID, "node_id", nodeID, "error", err)
+			s.count(func(stats *Stats) { stats.Errors++ })
+			return
+		}
+		s.count(func(stats *Stats) { stats.Deleted++ })
+		return
+	}
+
+	size, err := verifyReplica(ctx, node, objectID, limiter)
+	s.count(func(stats *Stats) {
+		stats.Objects++
+		stats.Bytes += size
+	})
+
+	corrupt := errors.Is(err, storage.ErrChecksumMismatch)
+	if err != nil && !corrupt {
+		s.logger.Error("failed to scrub replica", "object_id", objectID, "node_id", nodeID, "error", err)
+		s.count(func(stats *Stats) { stats.Errors++ })
+		return
+	}
+
+	if corrupt {
+		s.count(func(stats *Stats) { stats.Corrupt++ })
+		if err := s.storageManager.QuarantineReplica(nodeID, objectID); err != nil {
+			s.logger.Error("failed to quarantine replica", "object_id", objectID, "node_id", nodeID, "error", err)
+			s.count(func(stats *Stats) { stats.Errors++ })
+			return
+		}
+	}
+
+	// Chunks of larger objects have no metadata of their own
+	meta, err := s.metadataStore.Get(chunkID)
+	if err != nil && references == 0 {
+		// Could also be an upload whose metadata is not saved yet, so only report it
+		s.logger.Warn("replica has no metadata", "object_id", objectID, "node_id", nodeID)
+		s.count(func(stats *Stats) { stats.Orphaned++ })
+	}
+
+	targetNodes := s.storageManager.GetTargetNodes(objectID)
+	if !slices.Contains(targetNodes, nodeID) {
+		s.logger.Info("replica is not on a target node", "object_id", objectID, "node_id", nodeID)
+		s.count(func(stats *Stats) { stats.Misplaced++ })
+	}
+
+	// Every replica of an object is visited once per pass, so only the first
+	// target holding a copy checks the placement, unless this copy was just
+	// quarantined or sits outside the targets and may be the only one left
+	if !corrupt && slices.Contains(targetNodes, nodeID) && s.firstHolder(objectID, targetNodes) != nodeID {
+		return
+	}
+
+	if isShard {
+		s.repairShards(objectID, chunkID, dataShards, parityShards)
+		return
+	}
+
+	repaired := false
+	for _, targetNodeID := range targetNodes {
+		targetNode, exists := s.storageManager.Node(targetNodeID)
+		if !exists || targetNode.Exists(objectID) {
+			continue
+		}
+
+		if err := s.storageManager.ReplicateObject(objectID, targetNodeID); err != nil {
+			s.logger.Error("failed to repair replica", "object_id", objectID, "node_id", targetNodeID, "error", err)
+			s.count(func(stats *Stats) { stats.Errors++ })
+			continue
+		}
+		repaired = true
+		s.count(func(stats *Stats) { stats.Repaired++ })
+	}
+
+	if repaired && meta != nil {
+		meta.Replicas = s.storageManager.CheckReplicas(objectID)
+		if err := s.metadataStore.Save(meta); err != nil {
+			s.logger.Error("failed to update metadata after repair", "object_id", objectID, "error", err)
+		}
+	}
+}
+
+// repairShards restores the lost or quarantined shards of an erasure-coded chunk
+func (s *Scrubber) repairShards(shardID, chunkID string, dataShards, parityShards int) {
+	restored, err := s.storageManager.RepairShards(chunkID, dataShards, parityShards)
+	if err != nil {
+		s.logger.Error("failed to repair shards", "object_id", shardID, "chunk_id", chunkID, "error", err)
+		s.count(func(stats *Stats) { stats.Errors++ })
+	}
+	if restored > 0 {
+		s.count(func(stats *Stats) { stats.Repaired += int64(restored) })
+	}
+}
+
+// firstHolder returns the first target node that has a copy of the object
+func (s *Scrubber) firstHolder(objectID string, targetNodes []string) string {
+	for _, targetNodeID := range targetNodes {
+		if target, exists := s.storageManager.Node(targetNodeID); exists && target.Exists(objectID) {
+			return targetNodeID
+		}
+	}
+	return ""
+}
+
+// verifyReplica rehashes a replica or shard and returns the number of bytes read
+func verifyReplica(ctx context.Context, node storage.Backend, objectID string, limiter *throttle) (int64, error) {
+	reader, err := node.Retrieve(objectID)
+	if err != nil {
+		return 0, err
+	}
+	defer reader.Close()
+
+	return storage.VerifyContent(objectID, &throttledReader{ctx: ctx, reader: reader, throttle: limiter})
+}
+
+// count updates the pass statistics
+func (s *Scrubber) count(update func(stats *Stats)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	update(&s.progress.Stats)
+}
+
+// saveProgress persists the scrubber state so an interrupted pass can resume
+func (s *Scrubber) saveProgress() {
+	s.mu.Lock()
+	data, err := json.MarshalIndent(s.progress, "", "  ")
+	s.mu.Unlock()
+	if err != nil {
+		s.logger.Error("failed to marshal scrubber state", "error", err)
+		return
+	}
+
+	// Write to a temp file and rename so a crash never leaves a truncated state file
+	tmpPath := s.config.StatePath + ".tmp"
+	if err := os.MkdirAll(filepath.Dir(s.config.StatePath), 0755); err != nil {
+		s.logger.Error("failed to create scrubber state directory", "error", err)
+		return
+	}
+	if err := os.WriteFile(tmpPath, data, 0644); err != nil {
+		s.logger.Error("failed to write scrubber state", "error", err)
+		return
+	}
+	if err := os.Rename(tmpPath, s.config.StatePath); err != nil {
+		s.logger.Error("failed to write scrubber state", "error", err)
+	}
+}
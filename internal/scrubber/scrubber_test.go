@@ -0,0 +1,171 @@
+package scrubber
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/caskos/caskos/internal/hashring"
+	"github.com/caskos/caskos/internal/metadata"
+	"github.com/caskos/caskos/internal/storage"
+)
+
+// newTestCluster creates a three-node manager with replication 2 over
+// in-memory backends and stores the given objects
+func newTestCluster(t *testing.T, contents []string) (*storage.Manager, *metadata.Store, string, []string) {
+	t.Helper()
+
+	tmpDir := t.TempDir()
+	metaStore, err := metadata.NewStore(filepath.Join(tmpDir, "metadata"))
+	if err != nil {
+		t.Fatalf("failed to create metadata store: %v", err)
+	}
+
+	ring := hashring.NewHashRing(3)
+	logger := slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelError}))
+	manager := storage.NewManager(ring, 2, logger)
+	for i := 1; i <= 3; i++ {
+		nodeID := fmt.Sprintf("node%d", i)
+		ring.AddNode(nodeID)
+		manager.AddNode(nodeID, storage.NewMemoryBackend())
+	}
+
+	objectIDs := make([]string, 0, len(contents))
+	for _, content := range contents {
+		objectID := storage.GenerateObjectID([]byte(content))
+		replicas, err := manager.StoreObject(context.Background(), objectID, strings.NewReader(content), int64(len(content)))
+		if err != nil {
+			t.Fatalf("failed to store object: %v", err)
+		}
+		metaStore.Save(&metadata.ObjectMetadata{
+			ID:        objectID,
+			Size:      int64(len(content)),
+			CreatedAt: time.Now(),
+			Replicas:  replicas,
+		})
+		objectIDs = append(objectIDs, objectID)
+	}
+
+	return manager, metaStore, tmpDir, objectIDs
+}
+
+func TestScrubber_RepairsMissingAndCorruptReplicas(t *testing.T) {
+	manager, metaStore, tmpDir, objectIDs := newTestCluster(t, []string{"first object", "second object"})
+	logger := slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelError}))
+
+	// Corrupt one replica of the first object and delete one of the second
+	corruptID, missingID := objectIDs[0], objectIDs[1]
+	corruptNode, _ := manager.Node(manager.GetTargetNodes(corruptID)[1])
+	corruptNode.Store(corruptID, strings.NewReader("bit rot"))
+
+	missingNode, _ := manager.Node(manager.GetTargetNodes(missingID)[0])
+	missingNode.Delete(missingID)
+
+	scrub, err := New(manager, metaStore, Config{StatePath: filepath.Join(tmpDir, "scrubber.json")}, logger)
+	if err != nil {
+		t.Fatalf("failed to create scrubber: %v", err)
+	}
+	if err := scrub.ScrubOnce(context.Background()); err != nil {
+		t.Fatalf("scrub pass failed: %v", err)
+	}
+
+	stats := scrub.Progress().Stats
+	if stats.Corrupt != 1 {
+		t.Errorf("expected 1 corrupt replica, got %d", stats.Corrupt)
+	}
+	if stats.Repaired != 2 {
+		t.Errorf("expected 2 repaired replicas, got %d", stats.Repaired)
+	}
+
+	for _, objectID := range objectIDs {
+		for _, nodeID := range manager.GetTargetNodes(objectID) {
+			node, _ := manager.Node(nodeID)
+			if !node.Exists(objectID) {
+				t.Errorf("expected %s on %s after scrub", objectID, nodeID)
+			}
+		}
+	}
+
+	reader, err := corruptNode.Retrieve(corruptID)
+	if err != nil {
+		t.Fatalf("failed to retrieve repaired replica: %v", err)
+	}
+	defer reader.Close()
+	data, _ := io.ReadAll(reader)
+	if string(data) != "first object" {
+		t.Errorf("expected repaired replica to hold the original data, got %q", string(data))
+	}
+
+	if scrub.Progress().LastCompletedAt.IsZero() {
+		t.Error("expected completed pass to be recorded")
+	}
+
+	// A second pass counts only what it found itself, every replica intact
+	if err := scrub.ScrubOnce(context.Background()); err != nil {
+		t.Fatalf("second scrub pass failed: %v", err)
+	}
+	var replicas int64
+	for _, objectID := range objectIDs {
+		replicas += int64(len(manager.GetTargetNodes(objectID)))
+	}
+	progress := scrub.Progress()
+	if progress.Stats.Objects != replicas || progress.Stats.Corrupt != 0 || progress.Stats.Repaired != 0 {
+		t.Errorf("expected the second pass to scan %d replicas and find nothing, got %+v", replicas, progress.Stats)
+	}
+	if progress.Total.Objects != stats.Objects+replicas || progress.Total.Corrupt != 1 || progress.Total.Repaired != 2 {
+		t.Errorf("expected totals over both passes, got %+v", progress.Total)
+	}
+}
+
+func TestScrubber_ResumesFromSavedProgress(t *testing.T) {
+	contents := make([]string, 0, 20)
+	for i := 0; i < 20; i++ {
+		contents = append(contents, fmt.Sprintf("object number %d", i))
+	}
+	manager, metaStore, tmpDir, _ := newTestCluster(t, contents)
+	logger := slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelError}))
+
+	// Pretend a previous pass finished node1 and stopped halfway through node2
+	node2, _ := manager.Node("node2")
+	var node2Objects []string
+	node2.List("", func(objectID string) error {
+		node2Objects = append(node2Objects, objectID)
+		return nil
+	})
+	node3, _ := manager.Node("node3")
+	node3Count := 0
+	node3.List("", func(objectID string) error {
+		node3Count++
+		return nil
+	})
+
+	half := len(node2Objects) / 2
+	statePath := filepath.Join(tmpDir, "scrubber.json")
+	data, _ := json.Marshal(Progress{
+		PassStartedAt:  time.Now(),
+		CompletedNodes: []string{"node1"},
+		CurrentNode:    "node2",
+		LastObjectID:   node2Objects[half-1],
+	})
+	os.WriteFile(statePath, data, 0644)
+
+	scrub, err := New(manager, metaStore, Config{StatePath: statePath}, logger)
+	if err != nil {
+		t.Fatalf("failed to create scrubber: %v", err)
+	}
+	if err := scrub.ScrubOnce(context.Background()); err != nil {
+		t.Fatalf("scrub pass failed: %v", err)
+	}
+
+	expected := int64(len(node2Objects) - half + node3Count)
+	if scanned := scrub.Progress().Stats.Objects; scanned != expected {
+		t.Errorf("expected resumed pass to scan %d objects, got %d", expected, scanned)
+	}
+}
@@ -0,0 +1,60 @@
+package scrubber
+
+import (
+	"context"
+	"io"
+	"time"
+)
+
+// throttle limits the average read rate of a scrub pass
+type throttle struct {
+	bytesPerSecond int64
+	start          time.Time
+	bytes          int64
+}
+
+// newThrottle creates a throttle; a rate of 0 or less disables it
+func newThrottle(bytesPerSecond int64) *throttle {
+	return &throttle{
+		bytesPerSecond: bytesPerSecond,
+		start:          time.Now(),
+	}
+}
+
+// wait records n bytes read and sleeps until the average rate is back under the limit
+func (t *throttle) wait(ctx context.Context, n int) error {
+	if t.bytesPerSecond <= 0 {
+		return nil
+	}
+
+	t.bytes += int64(n)
+	due := t.start.Add(time.Duration(float64(t.bytes) / float64(t.bytesPerSecond) * float64(time.Second)))
+	delay := time.Until(due)
+	if delay <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// throttledReader applies a throttle to every read
+type throttledReader struct {
+	ctx      context.Context
+	reader   io.Reader
+	throttle *throttle
+}
+
+func (r *throttledReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	if waitErr := r.throttle.wait(r.ctx, n); waitErr != nil {
+		return n, waitErr
+	}
+	return n, err
+}
@@ -0,0 +1,103 @@
+package storage
+
+import (
+	"errors"
+	"io"
+	"time"
+)
+
+// ErrObjectNotFound is returned for an object a backend does not hold
+var ErrObjectNotFound = errors.New("object not found")
+
+// ErrInvalidObjectID is returned for an ID that is neither an object ID nor a
+// shard ID
+var ErrInvalidObjectID = errors.New("invalid object ID")
+
+// Backend stores the objects of one storage node. Node keeps them in a local
+// directory; MemoryBackend keeps them in memory for tests, and FaultyBackend
+// wraps another backend to inject failures. The manager, rebalancing and
+// self-healing only use backends through this interface.
+type Backend interface {
+	// Store writes an object, replacing any existing copy atomically
+	Store(objectID string, data io.Reader) error
+
+	// Retrieve opens an object for reading, ranges included
+	Retrieve(objectID string) (Object, error)
+
+	// Exists reports whether the backend holds an object
+	Exists(objectID string) bool
+
+	// Delete removes an object; removing a missing object is not an error
+	Delete(objectID string) error
+
+	// Stat returns the sizes and modification time of an object
+	Stat(objectID string) (ObjectInfo, error)
+
+	// List calls fn for every object in ascending ID order, skipping IDs up
+	// to and including after so long scans can resume where they left off
+	List(after string, fn func(objectID string) error) error
+
+	// CreatePending starts writing an object whose ID is only known once
+	// its content has been hashed, as uploads are
+	CreatePending() (PendingWrite, error)
+
+	// Quarantine moves a corrupt object aside so it is no longer served
+	Quarantine(objectID string) error
+}
+
+// Object is an object opened on a backend
+type Object interface {
+	io.ReadSeekCloser
+
+	// Size returns the logical size of the object
+	Size() int64
+
+	// ModTime returns when the object was stored
+	ModTime() time.Time
+}
+
+// ObjectInfo describes an object held by a backend
+type ObjectInfo struct {
+	Size       int64 // Logical size of the content
+	StoredSize int64 // Size as stored, after compression and encryption
+	ModTime    time.Time
+}
+
+// PendingWrite is an object being written to a backend. It is not visible
+// until it is committed under its ID.
+type PendingWrite interface {
+	io.Writer
+
+	// Commit makes the object durable and visible under objectID
+	Commit(objectID string) error
+
+	// Abort discards the object
+	Abort() error
+}
+
+// compressingBackend is implemented by backends that can compress the
+// objects they store
+type compressingBackend interface {
+	SetCompression(codec Codec)
+	Compression() Codec
+}
+
+// encryptingBackend is implemented by backends that can encrypt the objects
+// they store
+type encryptingBackend interface {
+	SetKeyring(keyring *Keyring)
+	keyRewrapper
+}
+
+// keyRewrapper is implemented by backends that can wrap the data keys of
+// their objects with the active master key, such as Node and the nodeapi
+// client, whose node process reloads its own key file first
+type keyRewrapper interface {
+	RewrapKeys() (int, error)
+}
+
+// remoteBackend is implemented by backends that reach a node in another
+// process, such as the nodeapi client
+type remoteBackend interface {
+	URL() string
+}
@@ -0,0 +1,168 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/caskos/caskos/internal/hashring"
+)
+
+// newMemoryCluster creates a manager with replication 2 over in-memory
+// backends, each wrapped so faults can be injected
+func newMemoryCluster(count int) (*Manager, map[string]*FaultyBackend, map[string]*MemoryBackend) {
+	ring := hashring.NewHashRing(50)
+	logger := slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelError}))
+	manager := NewManager(ring, 2, logger)
+
+	faulty := make(map[string]*FaultyBackend)
+	memory := make(map[string]*MemoryBackend)
+	for i := 1; i <= count; i++ {
+		nodeID := fmt.Sprintf("node%d", i)
+		memory[nodeID] = NewMemoryBackend()
+		faulty[nodeID] = NewFaultyBackend(memory[nodeID])
+		ring.AddNode(nodeID)
+		manager.AddNode(nodeID, faulty[nodeID])
+	}
+	return manager, faulty, memory
+}
+
+func TestMemoryBackend(t *testing.T) {
+	backend := NewMemoryBackend()
+
+	objectIDs := []string{"ff001234567890", "aa001234567890", "ab001234567890"}
+	for _, objectID := range objectIDs {
+		if err := backend.Store(objectID, strings.NewReader(objectID)); err != nil {
+			t.Fatalf("failed to store object: %v", err)
+		}
+	}
+
+	var listed []string
+	backend.List("aa001234567890", func(objectID string) error {
+		listed = append(listed, objectID)
+		return nil
+	})
+	if strings.Join(listed, ",") != "ab001234567890,ff001234567890" {
+		t.Errorf("expected the objects after aa00 in order, got %v", listed)
+	}
+
+	info, err := backend.Stat("ab001234567890")
+	if err != nil || info.Size != 14 || info.StoredSize != 14 {
+		t.Errorf("expected 14 bytes, got %+v (%v)", info, err)
+	}
+
+	backend.Delete("ab001234567890")
+	if _, err := backend.Retrieve("ab001234567890"); !errors.Is(err, ErrObjectNotFound) {
+		t.Errorf("expected ErrObjectNotFound after delete, got %v", err)
+	}
+
+	// The manager works the same over memory as over disk
+	manager, _, _ := newMemoryCluster(3)
+	manager.SetChunkSize(64 << 10)
+	testData := randomData(300 << 10)
+	result, err := manager.PutObject(context.Background(), bytes.NewReader(testData), "", "")
+	if err != nil {
+		t.Fatalf("failed to put object: %v", err)
+	}
+	if len(result.Chunks) < 2 {
+		t.Errorf("expected several chunks, got %d", len(result.Chunks))
+	}
+
+	reader, err := manager.OpenChunks(result.ObjectID, result.Chunks)
+	if err != nil {
+		t.Fatalf("failed to open object: %v", err)
+	}
+	retrieved, err := io.ReadAll(reader)
+	reader.Close()
+	if err != nil || !bytes.Equal(retrieved, testData) {
+		t.Fatalf("retrieved content does not match (%v)", err)
+	}
+}
+
+func TestFaultyBackend(t *testing.T) {
+	manager, faulty, memory := newMemoryCluster(3)
+	repairs := make(chan string, 4)
+	manager.SetRepairHandler(func(objectID string) {
+		repairs <- objectID
+	})
+
+	testData := "data on faulty nodes"
+	objectID := GenerateObjectID([]byte(testData))
+	if _, err := manager.StoreObject(context.Background(), objectID, strings.NewReader(testData), int64(len(testData))); err != nil {
+		t.Fatalf("failed to store object: %v", err)
+	}
+	targets := manager.GetTargetNodes(objectID)
+
+	// Reads fail over from a node that is down
+	faulty[targets[0]].SetDown(true)
+	if replicas := manager.CheckReplicas(objectID); len(replicas) != 1 {
+		t.Errorf("expected one reachable replica, got %v", replicas)
+	}
+	reader, err := manager.RetrieveObject(objectID)
+	if err != nil {
+		t.Fatalf("failed to retrieve object with a node down: %v", err)
+	}
+	retrieved, _ := io.ReadAll(reader)
+	reader.Close()
+	if string(retrieved) != testData {
+		t.Errorf("expected %q, got %q", testData, retrieved)
+	}
+	faulty[targets[0]].Heal()
+
+	// A corrupt replica is quarantined and scheduled for repair
+	faulty[targets[0]].SetCorrupt(true)
+	reader, err = manager.OpenObject(objectID)
+	if err != nil {
+		t.Fatalf("failed to open object: %v", err)
+	}
+	_, err = io.ReadAll(reader)
+	reader.Close()
+	if !errors.Is(err, ErrChecksumMismatch) {
+		t.Errorf("expected ErrChecksumMismatch from the corrupt replica, got %v", err)
+	}
+	if memory[targets[0]].Quarantined(objectID) != 1 {
+		t.Error("expected the corrupt replica to be quarantined")
+	}
+	select {
+	case repaired := <-repairs:
+		if repaired != objectID {
+			t.Errorf("expected a repair of %s, got %s", objectID, repaired)
+		}
+	case <-time.After(time.Second):
+		t.Error("expected a repair to be scheduled")
+	}
+	faulty[targets[0]].Heal()
+
+	// A write that fails on one node still reaches the others
+	manager.SetWriteConsistency(ConsistencyOne)
+	other := "written while a node fails"
+	otherID := GenerateObjectID([]byte(other))
+	failing := manager.GetTargetNodes(otherID)[0]
+	faulty[failing].Fail(OpStore, errors.New("disk full"))
+	replicas, err := manager.StoreObject(context.Background(), otherID, strings.NewReader(other), int64(len(other)))
+	if err != nil || len(replicas) != 1 || replicas[0] == failing {
+		t.Errorf("expected one replica off the failing node, got %v (%v)", replicas, err)
+	}
+	if memory[failing].Exists(otherID) {
+		t.Error("expected the failing node to hold nothing")
+	}
+	faulty[failing].Heal()
+
+	// A stalled node is dropped from writes
+	manager.SetNodeTimeout(20 * time.Millisecond)
+	slow := "written while a node stalls"
+	slowID := GenerateObjectID([]byte(slow))
+	stalled := manager.GetTargetNodes(slowID)[0]
+	faulty[stalled].SetDelay(100 * time.Millisecond)
+	replicas, err = manager.StoreObject(context.Background(), slowID, strings.NewReader(slow), int64(len(slow)))
+	if err != nil || len(replicas) != 1 || replicas[0] == stalled {
+		t.Errorf("expected one replica off the stalled node, got %v (%v)", replicas, err)
+	}
+}
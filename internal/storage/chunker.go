@@ -0,0 +1,122 @@
+package storage
+
+import (
+	"io"
+	"math/bits"
+)
+
+// DefaultChunkSize is the average size of the chunks objects are split into
+const DefaultChunkSize = 1 << 20
+
+// gearTable maps each byte to a random value for the rolling hash. It
+// decides where chunks are cut, so changing it stops new writes from
+// deduplicating against chunks already stored.
+var gearTable = func() [256]uint64 {
+	var table [256]uint64
+	state := uint64(0x6361736b6f73) // splitmix64 seeded with "caskos"
+	for i := range table {
+		state += 0x9e3779b97f4a7c15
+		z := state
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		table[i] = z ^ (z >> 31)
+	}
+	return table
+}()
+
+// Chunk is a piece of an object's content, stored under the hash of its
+// content as an object of its own, or as the shards of an erasure code
+type Chunk struct {
+	ID           string
+	Size         int64
+	DataShards   int // Zero if the chunk is replicated
+	ParityShards int
+}
+
+// ErasureCoded reports whether the chunk is stored as shards
+func (c Chunk) ErasureCoded() bool {
+	return c.DataShards > 0
+}
+
+// Chunker splits a stream into content-defined chunks. A chunk ends where a
+// rolling hash of the last 64 bytes matches a mask, so boundaries depend on
+// the content around them rather than on offsets: inserting or removing
+// bytes changes only the chunks around the edit, and the rest of the stream
+// splits into the same chunks as before. Chunks are between a quarter of
+// and four times the average size.
+type Chunker struct {
+	reader     io.Reader
+	buf        []byte
+	start, end int
+	eof        bool
+	minSize    int
+	maxSize    int
+	mask       uint64
+}
+
+// NewChunker creates a chunker reading from reader that cuts chunks of
+// about avgSize bytes
+func NewChunker(reader io.Reader, avgSize int) *Chunker {
+	if avgSize < 64 {
+		avgSize = 64
+	}
+
+	// The gear hash shifts left, so its high bits depend on the most bytes
+	maskBits := bits.Len(uint(avgSize)) - 1
+	return &Chunker{
+		reader:  reader,
+		buf:     make([]byte, avgSize*4),
+		minSize: avgSize / 4,
+		maxSize: avgSize * 4,
+		mask:    ^uint64(0) << (64 - maskBits),
+	}
+}
+
+// Next returns the next chunk, or io.EOF after the last one. The chunk is
+// only valid until the next call.
+func (c *Chunker) Next() ([]byte, error) {
+	if err := c.fill(); err != nil {
+		return nil, err
+	}
+	if c.start == c.end {
+		return nil, io.EOF
+	}
+
+	n := c.end - c.start
+	cut := n
+	if n > c.minSize {
+		data := c.buf[c.start:c.end]
+		cut = min(n, c.maxSize)
+		var hash uint64
+		for i := c.minSize; i < cut; i++ {
+			hash = hash<<1 + gearTable[data[i]]
+			if hash&c.mask == 0 {
+				cut = i + 1
+				break
+			}
+		}
+	}
+
+	chunk := c.buf[c.start : c.start+cut]
+	c.start += cut
+	return chunk, nil
+}
+
+// fill reads until the buffer holds a maximum-sized chunk or the stream ends
+func (c *Chunker) fill() error {
+	if c.eof || c.end-c.start >= c.maxSize {
+		return nil
+	}
+
+	copy(c.buf, c.buf[c.start:c.end])
+	c.end -= c.start
+	c.start = 0
+
+	n, err := io.ReadFull(c.reader, c.buf[c.end:])
+	c.end += n
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		c.eof = true
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,73 @@
+package storage
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+func TestChunker_SplitsWithinBounds(t *testing.T) {
+	data := randomData(1 << 20)
+	chunker := NewChunker(bytes.NewReader(data), 16<<10)
+
+	var reassembled []byte
+	var sizes []int
+	for {
+		chunk, err := chunker.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("failed to read chunk: %v", err)
+		}
+		reassembled = append(reassembled, chunk...)
+		sizes = append(sizes, len(chunk))
+	}
+
+	if !bytes.Equal(reassembled, data) {
+		t.Fatal("chunks do not reassemble into the input")
+	}
+	for i, size := range sizes {
+		if size > 64<<10 || (size < 4<<10 && i != len(sizes)-1) {
+			t.Errorf("chunk %d has size %d outside the bounds", i, size)
+		}
+	}
+	if len(sizes) < 16 || len(sizes) > 128 {
+		t.Errorf("expected about 64 chunks, got %d", len(sizes))
+	}
+}
+
+func TestChunker_BoundariesFollowContent(t *testing.T) {
+	data := randomData(512 << 10)
+	shifted := append([]byte("a prefix that shifts every offset"), data...)
+
+	chunks := func(data []byte) map[string]bool {
+		ids := make(map[string]bool)
+		chunker := NewChunker(bytes.NewReader(data), 8<<10)
+		for {
+			chunk, err := chunker.Next()
+			if err != nil {
+				return ids
+			}
+			ids[GenerateObjectID(chunk)] = true
+		}
+	}
+
+	original := chunks(data)
+	shared := 0
+	for id := range chunks(shifted) {
+		if original[id] {
+			shared++
+		}
+	}
+	if shared < len(original)-2 {
+		t.Errorf("expected all but the first chunks to survive the shift, %d of %d did", shared, len(original))
+	}
+}
+
+func TestChunker_Empty(t *testing.T) {
+	chunker := NewChunker(bytes.NewReader(nil), DefaultChunkSize)
+	if _, err := chunker.Next(); err != io.EOF {
+		t.Errorf("expected io.EOF, got %v", err)
+	}
+}
@@ -0,0 +1,286 @@
+package storage
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// Codec is the compression a node applies to the files it stores
+type Codec byte
+
+// Codecs recorded in the header of an object file
+const (
+	CodecNone Codec = iota // Stored as is
+	CodecGzip              // Compressed with gzip
+)
+
+// objectMagic starts the header of an object file that is compressed or
+// encrypted. Files without it hold the object's content as is, as every file
+// did before compression; content that happens to start with it is given a
+// header too, so it is not mistaken for one.
+const objectMagic = "\x89CASKOS\n"
+
+// objectHeaderSize is the size of an object file header: the magic, the
+// codec with encryptedFlag if the file is encrypted, and the logical size of
+// the content
+const objectHeaderSize = len(objectMagic) + 1 + 8
+
+// compressionSampleSize is how much of an object is buffered to decide
+// whether it is worth compressing
+const compressionSampleSize = 64 << 10
+
+// ParseCodec parses a codec name: "none" or "gzip"
+func ParseCodec(name string) (Codec, error) {
+	switch strings.ToLower(strings.TrimSpace(name)) {
+	case "", "none":
+		return CodecNone, nil
+	case "gzip":
+		return CodecGzip, nil
+	default:
+		return CodecNone, fmt.Errorf("unknown compression %q (want none or gzip)", name)
+	}
+}
+
+// String returns the name of the codec
+func (c Codec) String() string {
+	switch c {
+	case CodecNone:
+		return "none"
+	case CodecGzip:
+		return "gzip"
+	default:
+		return fmt.Sprintf("codec(%d)", byte(c))
+	}
+}
+
+// compressible reports whether compressing the start of an object saves at
+// least an eighth of its size. Content that is already compressed, such as
+// images or archives, is stored as is instead.
+func compressible(sample []byte) bool {
+	var compressed countingWriter
+	writer, _ := gzip.NewWriterLevel(&compressed, gzip.BestSpeed)
+	writer.Write(sample)
+	writer.Close()
+	return compressed.n*8 < int64(len(sample))*7
+}
+
+// countingWriter counts the bytes written to it
+type countingWriter struct {
+	n int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.n += int64(len(p))
+	return len(p), nil
+}
+
+// encodeObjectHeader builds the header of an object file
+func encodeObjectHeader(codec Codec, encrypted bool, size int64) []byte {
+	flags := byte(codec)
+	if encrypted {
+		flags |= encryptedFlag
+	}
+
+	header := make([]byte, 0, objectHeaderSize)
+	header = append(header, objectMagic...)
+	header = append(header, flags)
+	return binary.BigEndian.AppendUint64(header, uint64(size))
+}
+
+// ObjectFile is an object's file opened on a node. Reads return the object's
+// content: an encrypted file is decrypted and a compressed file decompressed
+// as it is read, and seeking backwards in a compressed file restarts
+// decompression from its start. Content that fails to decrypt or decompress
+// is reported as ErrChecksumMismatch.
+type ObjectFile struct {
+	file      *os.File
+	codec     Codec
+	encrypted bool
+	data      io.ReaderAt // Stored content after the header, decrypted
+	dataSize  int64
+	size      int64 // Logical size of the content
+	physical  int64 // Size of the file
+	modTime   time.Time
+	pos       int64
+	decoder   *gzip.Reader // Nil until a compressed file is read
+	decoded   int64        // Position of the decoder in the content
+}
+
+// openObjectFile opens an object file and reads its header, if any. dataKeys
+// is called for the keys an encrypted file may be sealed with; of several,
+// the first that decrypts the file's first segment is used.
+func openObjectFile(path string, dataKeys func() ([][]byte, error)) (*ObjectFile, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to stat object file: %w", err)
+	}
+
+	f := &ObjectFile{
+		file:     file,
+		codec:    CodecNone,
+		data:     file,
+		dataSize: info.Size(),
+		size:     info.Size(),
+		physical: info.Size(),
+		modTime:  info.ModTime(),
+	}
+
+	header := make([]byte, objectHeaderSize)
+	if _, err := io.ReadFull(file, header); err != nil || !bytes.HasPrefix(header, []byte(objectMagic)) {
+		return f, nil
+	}
+
+	flags := header[len(objectMagic)]
+	f.codec = Codec(flags &^ encryptedFlag)
+	f.encrypted = flags&encryptedFlag != 0
+	f.size = int64(binary.BigEndian.Uint64(header[len(objectMagic)+1:]))
+	f.dataSize = info.Size() - int64(objectHeaderSize)
+	f.data = io.NewSectionReader(file, int64(objectHeaderSize), f.dataSize)
+	if f.codec != CodecNone && f.codec != CodecGzip {
+		file.Close()
+		return nil, fmt.Errorf("object file has unknown codec %d", byte(f.codec))
+	}
+
+	if f.encrypted {
+		keys, err := dataKeys()
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+		var decrypter *decryptingReader
+		for i, key := range keys {
+			decrypter, err = newDecryptingReader(f.data, f.dataSize, key)
+			if err != nil || i == len(keys)-1 || decrypter.decrypt(0) == nil {
+				break
+			}
+		}
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+		f.data, f.dataSize = decrypter, decrypter.size
+	}
+	return f, nil
+}
+
+// Size returns the logical size of the object
+func (f *ObjectFile) Size() int64 {
+	return f.size
+}
+
+// PhysicalSize returns the size of the object's file on disk
+func (f *ObjectFile) PhysicalSize() int64 {
+	return f.physical
+}
+
+// Codec returns the codec the object is stored with
+func (f *ObjectFile) Codec() Codec {
+	return f.codec
+}
+
+// Encrypted reports whether the object's file is encrypted
+func (f *ObjectFile) Encrypted() bool {
+	return f.encrypted
+}
+
+// ModTime returns the modification time of the object's file
+func (f *ObjectFile) ModTime() time.Time {
+	return f.modTime
+}
+
+func (f *ObjectFile) Read(p []byte) (int, error) {
+	if f.pos >= f.size {
+		return 0, io.EOF
+	}
+	p = p[:min(int64(len(p)), f.size-f.pos)]
+
+	if f.codec == CodecNone {
+		// A file shorter than its header says ends early, which readers
+		// verifying the content treat as corruption
+		n, err := f.data.ReadAt(p, f.pos)
+		f.pos += int64(n)
+		if err == io.EOF && n > 0 {
+			err = nil
+		}
+		return n, err
+	}
+
+	if err := f.seekDecoder(); err != nil {
+		return 0, err
+	}
+	n, err := f.decoder.Read(p)
+	f.pos += int64(n)
+	f.decoded += int64(n)
+	if err == io.EOF {
+		if f.pos < f.size {
+			return n, fmt.Errorf("%w: compressed content ends early", ErrChecksumMismatch)
+		}
+		err = nil
+	}
+	if err != nil {
+		return n, fmt.Errorf("%w: %v", ErrChecksumMismatch, err)
+	}
+	return n, nil
+}
+
+// seekDecoder moves the decoder of a compressed file to the read position
+func (f *ObjectFile) seekDecoder() error {
+	if f.decoder == nil || f.decoded > f.pos {
+		var err error
+		stream := io.NewSectionReader(f.data, 0, f.dataSize)
+		if f.decoder == nil {
+			f.decoder, err = gzip.NewReader(stream)
+		} else {
+			err = f.decoder.Reset(stream)
+		}
+		if err != nil {
+			return fmt.Errorf("%w: %v", ErrChecksumMismatch, err)
+		}
+		f.decoded = 0
+	}
+
+	if f.decoded < f.pos {
+		skipped, err := io.CopyN(io.Discard, f.decoder, f.pos-f.decoded)
+		f.decoded += skipped
+		if err != nil {
+			return fmt.Errorf("%w: %v", ErrChecksumMismatch, err)
+		}
+	}
+	return nil
+}
+
+func (f *ObjectFile) Seek(offset int64, whence int) (int64, error) {
+	var pos int64
+	switch whence {
+	case io.SeekStart:
+		pos = offset
+	case io.SeekCurrent:
+		pos = f.pos + offset
+	case io.SeekEnd:
+		pos = f.size + offset
+	default:
+		return f.pos, fmt.Errorf("invalid whence %d", whence)
+	}
+	if pos < 0 {
+		return f.pos, fmt.Errorf("negative position")
+	}
+
+	f.pos = pos
+	return pos, nil
+}
+
+// Close closes the file
+func (f *ObjectFile) Close() error {
+	return f.file.Close()
+}
@@ -0,0 +1,101 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestNode_Compression(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "storage-test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	node, err := NewNode("test-node", tmpDir)
+	if err != nil {
+		t.Fatalf("failed to create node: %v", err)
+	}
+	node.SetCompression(CodecGzip)
+
+	var logs strings.Builder
+	for i := 0; logs.Len() < 300<<10; i++ {
+		fmt.Fprintf(&logs, `{"level":"info","msg":"request served","request":%d,"status":200}`+"\n", i)
+	}
+	content := logs.String()
+	objectID := GenerateObjectID([]byte(content))
+	if err := node.Store(objectID, strings.NewReader(content)); err != nil {
+		t.Fatalf("failed to store object: %v", err)
+	}
+
+	info, err := node.Stat(objectID)
+	if err != nil {
+		t.Fatalf("failed to stat object: %v", err)
+	}
+	if info.Size != int64(len(content)) || info.StoredSize > info.Size/4 {
+		t.Errorf("expected %d bytes compressed to under a quarter, got %d on disk", info.Size, info.StoredSize)
+	}
+
+	reader, err := node.Retrieve(objectID)
+	if err != nil {
+		t.Fatalf("failed to retrieve object: %v", err)
+	}
+	retrieved, err := io.ReadAll(reader)
+	reader.Close()
+	if err != nil || string(retrieved) != content {
+		t.Fatalf("retrieved content does not match (%v)", err)
+	}
+
+	// Ranges are served from compressed files too, seeking either way
+	file, err := node.Open(objectID)
+	if err != nil {
+		t.Fatalf("failed to open object: %v", err)
+	}
+	part := make([]byte, 100)
+	for _, offset := range []int64{200000, 1000, 250000} {
+		file.Seek(offset, io.SeekStart)
+		if _, err := io.ReadFull(file, part); err != nil || string(part) != content[offset:offset+100] {
+			t.Errorf("range at %d does not match (%v)", offset, err)
+		}
+	}
+	file.Close()
+
+	// Content that does not compress is stored as is
+	random := randomData(100 << 10)
+	randomID := GenerateObjectID(random)
+	node.Store(randomID, bytes.NewReader(random))
+	if info, _ := node.Stat(randomID); info.Size != info.StoredSize {
+		t.Errorf("expected incompressible content to be stored as is, got %d bytes on disk for %d", info.StoredSize, info.Size)
+	}
+
+	// Content that looks like a header is not mistaken for one
+	node.SetCompression(CodecNone)
+	lookalike := objectMagic + "\x01 but not compressed"
+	lookalikeID := GenerateObjectID([]byte(lookalike))
+	node.Store(lookalikeID, strings.NewReader(lookalike))
+	reader, _ = node.Retrieve(lookalikeID)
+	retrieved, err = io.ReadAll(reader)
+	reader.Close()
+	if err != nil || string(retrieved) != lookalike {
+		t.Errorf("expected the lookalike content back, got %q (%v)", retrieved, err)
+	}
+
+	// Damaged compressed data reads as a checksum mismatch
+	path := objectFile(node, objectID)
+	data, _ := os.ReadFile(path)
+	for i := objectHeaderSize + 100; i < objectHeaderSize+200; i++ {
+		data[i] ^= 0xff
+	}
+	os.WriteFile(path, data, 0644)
+	reader, _ = node.Retrieve(objectID)
+	_, err = io.ReadAll(reader)
+	reader.Close()
+	if !errors.Is(err, ErrChecksumMismatch) {
+		t.Errorf("expected ErrChecksumMismatch for damaged data, got %v", err)
+	}
+}
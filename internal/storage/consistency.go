@@ -0,0 +1,70 @@
+package storage
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Consistency is the number of replicas a write must reach before it succeeds
+type Consistency string
+
+// Write consistency levels
+const (
+	ConsistencyOne    Consistency = "one"    // At least one replica
+	ConsistencyQuorum Consistency = "quorum" // A majority of the replication factor
+	ConsistencyAll    Consistency = "all"    // Every replica
+)
+
+// DefaultConsistency is the write consistency used when none is configured
+const DefaultConsistency = ConsistencyQuorum
+
+// ParseConsistency parses a consistency level name, ignoring case
+func ParseConsistency(name string) (Consistency, error) {
+	switch c := Consistency(strings.ToLower(strings.TrimSpace(name))); c {
+	case ConsistencyOne, ConsistencyQuorum, ConsistencyAll:
+		return c, nil
+	default:
+		return "", fmt.Errorf("unknown consistency level %q (want one, quorum or all)", name)
+	}
+}
+
+// Required returns the number of replicas a write needs for a replication factor
+func (c Consistency) Required(replication int) int {
+	switch c {
+	case ConsistencyOne:
+		return 1
+	case ConsistencyAll:
+		return replication
+	default:
+		return replication/2 + 1
+	}
+}
+
+// RequiredShards returns the number of shards a write of an erasure-coded
+// chunk needs. Every level needs the data shards, since fewer cannot be
+// decoded; quorum adds a majority of the parity shards and all adds every one.
+func (c Consistency) RequiredShards(dataShards, parityShards int) int {
+	switch c {
+	case ConsistencyOne:
+		return dataShards
+	case ConsistencyAll:
+		return dataShards + parityShards
+	default:
+		return dataShards + (parityShards+1)/2
+	}
+}
+
+// QuorumError is returned when a write reached fewer replicas than its
+// consistency level requires. Replicas that were written are left in place,
+// so retrying the same content completes them.
+type QuorumError struct {
+	Consistency Consistency
+	Required    int
+	Written     []string
+}
+
+// Error implements the error interface
+func (e *QuorumError) Error() string {
+	return fmt.Sprintf("write quorum not met: %d of %d required replicas written (consistency %s)",
+		len(e.Written), e.Required, e.Consistency)
+}
@@ -0,0 +1,32 @@
+package storage
+
+import "testing"
+
+func TestConsistency_Required(t *testing.T) {
+	tests := []struct {
+		consistency Consistency
+		replication int
+		want        int
+	}{
+		{ConsistencyOne, 3, 1},
+		{ConsistencyQuorum, 2, 2},
+		{ConsistencyQuorum, 3, 2},
+		{ConsistencyQuorum, 5, 3},
+		{ConsistencyAll, 3, 3},
+	}
+
+	for _, tt := range tests {
+		if got := tt.consistency.Required(tt.replication); got != tt.want {
+			t.Errorf("%s with replication %d: expected %d, got %d", tt.consistency, tt.replication, tt.want, got)
+		}
+	}
+}
+
+func TestParseConsistency(t *testing.T) {
+	if c, err := ParseConsistency("QUORUM"); err != nil || c != ConsistencyQuorum {
+		t.Errorf("expected quorum, got %q (%v)", c, err)
+	}
+	if _, err := ParseConsistency("most"); err == nil {
+		t.Error("expected an unknown level to be rejected")
+	}
+}
@@ -0,0 +1,8 @@
+//go:build !linux && !darwin
+
+package storage
+
+// diskFree cannot determine free space on this platform
+func diskFree(path string) int64 {
+	return -1
+}
@@ -0,0 +1,321 @@
+package storage
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+// encryptedFlag marks the codec byte of an object file header whose content
+// is encrypted
+const encryptedFlag = 0x80
+
+// keyDir is the directory inside a node that holds the wrapped data keys of
+// encrypted objects, in the same ab/cd/ layout as the objects
+const keyDir = ".keys"
+
+// encryptionSegmentSize is the amount of content sealed together. Each
+// segment carries its own authentication tag, so ranges are decrypted
+// without reading the whole file.
+const encryptionSegmentSize = 64 << 10
+
+// dataKeySize is the size of the AES-256 keys objects are encrypted with
+const dataKeySize = 32
+
+// ErrUnknownKey is returned when a data key was wrapped with a master key
+// that is not in the key file
+var ErrUnknownKey = errors.New("master key not found in key file")
+
+// Keyring holds the master keys that wrap the data keys of encrypted
+// objects. New data keys are wrapped with the active key; the others are
+// kept so that keys wrapped before a rotation can still be unwrapped.
+type Keyring struct {
+	path   string
+	mu     sync.RWMutex
+	active string
+	keys   map[string]cipher.AEAD
+}
+
+// keyFile is the JSON layout of a key file: base64-encoded 32-byte keys by
+// ID, and the ID of the key new data keys are wrapped with
+type keyFile struct {
+	Active string            `json:"active"`
+	Keys   map[string]string `json:"keys"`
+}
+
+// LoadKeyring reads the master keys from a key file
+func LoadKeyring(path string) (*Keyring, error) {
+	k := &Keyring{path: path}
+	if err := k.Reload(); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// Reload reads the key file again, e.g. after a new key was added and made
+// active ahead of a rotation
+func (k *Keyring) Reload() error {
+	data, err := os.ReadFile(k.path)
+	if err != nil {
+		return fmt.Errorf("failed to read key file: %w", err)
+	}
+
+	var file keyFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return fmt.Errorf("failed to unmarshal key file: %w", err)
+	}
+	if _, exists := file.Keys[file.Active]; !exists {
+		return fmt.Errorf("active key %q is not in the key file", file.Active)
+	}
+
+	keys := make(map[string]cipher.AEAD, len(file.Keys))
+	for id, encoded := range file.Keys {
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil || len(key) != dataKeySize {
+			return fmt.Errorf("key %q is not a base64-encoded %d-byte key", id, dataKeySize)
+		}
+		if len(id) > 255 {
+			return fmt.Errorf("key ID %q is longer than 255 bytes", id)
+		}
+		if keys[id], err = newGCM(key); err != nil {
+			return err
+		}
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.active = file.Active
+	k.keys = keys
+	return nil
+}
+
+// Active returns the ID of the key new data keys are wrapped with
+func (k *Keyring) Active() string {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return k.active
+}
+
+// wrappedKey is a data key encrypted with a master key, as stored next to
+// an object. The object ID is authenticated with it, so a key file cannot
+// be moved to another object.
+type wrappedKey struct {
+	KeyID string `json:"key_id"`
+	Key   []byte `json:"key"` // Nonce followed by the sealed data key
+
+	// Previous is the key of the copy an object replaces while the new copy
+	// is being committed, for reading whichever copy a crash leaves
+	Previous *wrappedKey `json:"previous,omitempty"`
+}
+
+// wrap encrypts a data key for objectID with the active master key
+func (k *Keyring) wrap(objectID string, dataKey []byte) (*wrappedKey, error) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	aead := k.keys[k.active]
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	return &wrappedKey{KeyID: k.active, Key: aead.Seal(nonce, nonce, dataKey, []byte(objectID))}, nil
+}
+
+// unwrap decrypts the data key of objectID
+func (k *Keyring) unwrap(objectID string, wrapped *wrappedKey) ([]byte, error) {
+	k.mu.RLock()
+	aead, exists := k.keys[wrapped.KeyID]
+	k.mu.RUnlock()
+	if !exists {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownKey, wrapped.KeyID)
+	}
+
+	if len(wrapped.Key) < aead.NonceSize() {
+		return nil, fmt.Errorf("wrapped key of %s is too short", objectID)
+	}
+	nonce, sealed := wrapped.Key[:aead.NonceSize()], wrapped.Key[aead.NonceSize():]
+	dataKey, err := aead.Open(nil, nonce, sealed, []byte(objectID))
+	if err != nil {
+		return nil, fmt.Errorf("failed to unwrap key of %s: %w", objectID, err)
+	}
+	return dataKey, nil
+}
+
+// rewrap wraps the data key of objectID again with the active master key
+func (k *Keyring) rewrap(objectID string, wrapped *wrappedKey) (*wrappedKey, error) {
+	dataKey, err := k.unwrap(objectID, wrapped)
+	if err != nil {
+		return nil, err
+	}
+	return k.wrap(objectID, dataKey)
+}
+
+// newDataKey generates a random key for a new object
+func newDataKey() ([]byte, error) {
+	key := make([]byte, dataKeySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, fmt.Errorf("failed to generate data key: %w", err)
+	}
+	return key, nil
+}
+
+// newGCM creates an AES-GCM cipher
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cipher: %w", err)
+	}
+	return cipher.NewGCM(block)
+}
+
+// segmentNonce returns the nonce of a segment: its index and whether it is
+// the last one. Every object has its own key, so nonces never repeat under
+// one key, and a file cut at a segment boundary fails to authenticate
+// because its new last segment was not sealed as the last.
+func segmentNonce(index int64, last bool) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce, uint64(index))
+	if last {
+		nonce[8] = 1
+	}
+	return nonce
+}
+
+// encryptingWriter seals content in segments as it is written. A full
+// segment is held until more content arrives, since only Close knows which
+// segment is the last.
+type encryptingWriter struct {
+	writer io.Writer
+	aead   cipher.AEAD
+	buf    []byte
+	index  int64
+	sealed []byte
+}
+
+// newEncryptingWriter creates a writer that encrypts with dataKey into writer
+func newEncryptingWriter(writer io.Writer, dataKey []byte) (*encryptingWriter, error) {
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	return &encryptingWriter{
+		writer: writer,
+		aead:   aead,
+		buf:    make([]byte, 0, encryptionSegmentSize),
+	}, nil
+}
+
+func (w *encryptingWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		if len(w.buf) == encryptionSegmentSize {
+			if err := w.seal(false); err != nil {
+				return written, err
+			}
+		}
+		n := copy(w.buf[len(w.buf):encryptionSegmentSize], p)
+		w.buf = w.buf[:len(w.buf)+n]
+		p = p[n:]
+		written += n
+	}
+	return written, nil
+}
+
+// Close seals the last segment; it does not close the underlying writer
+func (w *encryptingWriter) Close() error {
+	return w.seal(true)
+}
+
+// seal encrypts and writes the buffered segment
+func (w *encryptingWriter) seal(last bool) error {
+	w.sealed = w.aead.Seal(w.sealed[:0], segmentNonce(w.index, last), w.buf, nil)
+	w.index++
+	w.buf = w.buf[:0]
+	_, err := w.writer.Write(w.sealed)
+	return err
+}
+
+// decryptingReader gives random access to the content of an encrypted file,
+// decrypting the segments a read covers. Segments that fail to
+// authenticate are reported as ErrChecksumMismatch.
+type decryptingReader struct {
+	reader   io.ReaderAt
+	aead     cipher.AEAD
+	segments int64
+	size     int64 // Size of the decrypted content
+	cached   int64 // Index of the segment in plain, or -1
+	sealed   []byte
+	plain    []byte
+}
+
+// newDecryptingReader decrypts the sealed segments making up the first
+// sealedSize bytes of reader
+func newDecryptingReader(reader io.ReaderAt, sealedSize int64, dataKey []byte) (*decryptingReader, error) {
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	sealedSegment := int64(encryptionSegmentSize + aead.Overhead())
+	segments := (sealedSize + sealedSegment - 1) / sealedSegment
+	if segments == 0 || sealedSize-(segments-1)*sealedSegment < int64(aead.Overhead()) {
+		return nil, fmt.Errorf("%w: encrypted content is truncated", ErrChecksumMismatch)
+	}
+	return &decryptingReader{
+		reader:   reader,
+		aead:     aead,
+		segments: segments,
+		size:     sealedSize - segments*int64(aead.Overhead()),
+		cached:   -1,
+	}, nil
+}
+
+func (r *decryptingReader) ReadAt(p []byte, off int64) (int, error) {
+	read := 0
+	for read < len(p) {
+		if off >= r.size {
+			return read, io.EOF
+		}
+
+		index := off / encryptionSegmentSize
+		if err := r.decrypt(index); err != nil {
+			return read, err
+		}
+		n := copy(p[read:], r.plain[off-index*encryptionSegmentSize:])
+		read += n
+		off += int64(n)
+	}
+	return read, nil
+}
+
+// decrypt reads and decrypts a segment unless it is the one already decrypted
+func (r *decryptingReader) decrypt(index int64) error {
+	if r.cached == index {
+		return nil
+	}
+
+	sealedSegment := int64(encryptionSegmentSize + r.aead.Overhead())
+	start := index * sealedSegment
+	length := min(sealedSegment, r.size+r.segments*int64(r.aead.Overhead())-start)
+	r.sealed = append(r.sealed[:0], make([]byte, length)...)
+	if _, err := r.reader.ReadAt(r.sealed, start); err != nil {
+		return err
+	}
+
+	plain, err := r.aead.Open(r.plain[:0], segmentNonce(index, index == r.segments-1), r.sealed, nil)
+	if err != nil {
+		r.cached = -1
+		return fmt.Errorf("%w: segment %d failed to decrypt", ErrChecksumMismatch, index)
+	}
+	r.plain = plain
+	r.cached = index
+	return nil
+}
@@ -0,0 +1,361 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeKeyFile writes a key file with the given keys, each filled with one byte
+func writeKeyFile(t *testing.T, path, active string, keys map[string]byte) {
+	t.Helper()
+	file := keyFile{Active: active, Keys: make(map[string]string)}
+	for id, fill := range keys {
+		file.Keys[id] = base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{fill}, dataKeySize))
+	}
+	data, _ := json.Marshal(file)
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatalf("failed to write key file: %v", err)
+	}
+}
+
+func TestNode_Encryption(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "storage-test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	keyPath := filepath.Join(tmpDir, "keys.json")
+	writeKeyFile(t, keyPath, "k1", map[string]byte{"k1": 1})
+	keyring, err := LoadKeyring(keyPath)
+	if err != nil {
+		t.Fatalf("failed to load keyring: %v", err)
+	}
+
+	node, err := NewNode("test-node", filepath.Join(tmpDir, "node"))
+	if err != nil {
+		t.Fatalf("failed to create node: %v", err)
+	}
+	node.SetKeyring(keyring)
+	node.SetCompression(CodecGzip)
+
+	// Several segments, compressible so both layers apply
+	content := strings.Repeat("the quick brown fox jumps over the lazy dog\n", 5000)
+	objectID := GenerateObjectID([]byte(content))
+	if err := node.Store(objectID, strings.NewReader(content)); err != nil {
+		t.Fatalf("failed to store object: %v", err)
+	}
+	random := randomData(200 << 10)
+	randomID := GenerateObjectID(random)
+	if err := node.Store(randomID, bytes.NewReader(random)); err != nil {
+		t.Fatalf("failed to store object: %v", err)
+	}
+
+	raw, _ := os.ReadFile(objectFile(node, randomID))
+	if bytes.Contains(raw, random[1000:1100]) {
+		t.Error("expected no plaintext in the object file")
+	}
+
+	for id, want := range map[string][]byte{objectID: []byte(content), randomID: random} {
+		reader, err := node.Retrieve(id)
+		if err != nil {
+			t.Fatalf("failed to retrieve object: %v", err)
+		}
+		retrieved, err := io.ReadAll(reader)
+		reader.Close()
+		if err != nil || !bytes.Equal(retrieved, want) {
+			t.Fatalf("retrieved content does not match (%v)", err)
+		}
+	}
+
+	// Ranges across segment boundaries, seeking either way
+	file, err := node.Open(randomID)
+	if err != nil {
+		t.Fatalf("failed to open object: %v", err)
+	}
+	if !file.Encrypted() {
+		t.Error("expected the object file to be encrypted")
+	}
+	part := make([]byte, 300)
+	for _, offset := range []int64{150000, encryptionSegmentSize - 100, 10} {
+		file.Seek(offset, io.SeekStart)
+		if _, err := io.ReadFull(file, part); err != nil || !bytes.Equal(part, random[offset:offset+300]) {
+			t.Errorf("range at %d does not match (%v)", offset, err)
+		}
+	}
+	file.Close()
+
+	// Rotate to a new master key, then drop the old one
+	writeKeyFile(t, keyPath, "k2", map[string]byte{"k1": 1, "k2": 2})
+	if err := keyring.Reload(); err != nil {
+		t.Fatalf("failed to reload keyring: %v", err)
+	}
+	rewrapped, err := node.RewrapKeys()
+	if err != nil || rewrapped != 2 {
+		t.Fatalf("expected 2 keys rewrapped, got %d (%v)", rewrapped, err)
+	}
+	if rewrapped, _ := node.RewrapKeys(); rewrapped != 0 {
+		t.Errorf("expected no keys left to rewrap, got %d", rewrapped)
+	}
+	writeKeyFile(t, keyPath, "k2", map[string]byte{"k2": 2})
+	keyring.Reload()
+	reader, err := node.Retrieve(randomID)
+	if err != nil {
+		t.Fatalf("failed to retrieve object after rotation: %v", err)
+	}
+	retrieved, err := io.ReadAll(reader)
+	reader.Close()
+	if err != nil || !bytes.Equal(retrieved, random) {
+		t.Fatalf("content does not match after rotation (%v)", err)
+	}
+
+	// Tampered and truncated files read as a checksum mismatch
+	path := objectFile(node, randomID)
+	raw, _ = os.ReadFile(path)
+	tampered := bytes.Clone(raw)
+	tampered[len(tampered)/2] ^= 0xff
+	os.WriteFile(path, tampered, 0644)
+	reader, _ = node.Retrieve(randomID)
+	_, err = io.ReadAll(reader)
+	reader.Close()
+	if !errors.Is(err, ErrChecksumMismatch) {
+		t.Errorf("expected ErrChecksumMismatch for tampered data, got %v", err)
+	}
+
+	sealedSegment := encryptionSegmentSize + 16
+	os.WriteFile(path, raw[:objectHeaderSize+2*sealedSegment], 0644)
+	reader, err = node.Retrieve(randomID)
+	if err == nil {
+		_, err = io.ReadAll(reader)
+		reader.Close()
+	}
+	if !errors.Is(err, ErrChecksumMismatch) {
+		t.Errorf("expected ErrChecksumMismatch for a file cut at a segment boundary, got %v", err)
+	}
+
+	// Storing the object again replaces the damaged copy and its key
+	if err := node.Store(randomID, bytes.NewReader(random)); err != nil {
+		t.Fatalf("failed to store object again: %v", err)
+	}
+	if retrieved, err := node.Retrieve(randomID); err != nil {
+		t.Errorf("failed to retrieve replaced object: %v", err)
+	} else {
+		data, err := io.ReadAll(retrieved)
+		retrieved.Close()
+		if err != nil || !bytes.Equal(data, random) {
+			t.Errorf("replaced content does not match (%v)", err)
+		}
+	}
+
+	// A crash while a copy is replaced leaves either copy readable
+	var oldKey, newKey wrappedKey
+	oldObject, _ := os.ReadFile(path)
+	data, _ := os.ReadFile(objectKeyFile(node, randomID))
+	json.Unmarshal(data, &oldKey)
+	if err := node.Store(randomID, bytes.NewReader(random)); err != nil {
+		t.Fatalf("failed to store object again: %v", err)
+	}
+	newObject, _ := os.ReadFile(path)
+	data, _ = os.ReadFile(objectKeyFile(node, randomID))
+	json.Unmarshal(data, &newKey)
+	if newKey.Previous != nil {
+		t.Error("expected the previous key to be dropped after the commit")
+	}
+	newKey.Previous = &oldKey
+	data, _ = json.Marshal(newKey)
+	os.WriteFile(objectKeyFile(node, randomID), data, 0600)
+	for name, object := range map[string][]byte{"replaced": oldObject, "new": newObject} {
+		os.WriteFile(path, object, 0644)
+		reader, err := node.Retrieve(randomID)
+		if err != nil {
+			t.Fatalf("failed to retrieve %s copy: %v", name, err)
+		}
+		retrieved, err := io.ReadAll(reader)
+		reader.Close()
+		if err != nil || !bytes.Equal(retrieved, random) {
+			t.Errorf("%s copy does not match (%v)", name, err)
+		}
+	}
+
+	// A plain copy replacing an encrypted one leaves no key behind
+	node.SetKeyring(nil)
+	if err := node.Store(randomID, bytes.NewReader(random)); err != nil {
+		t.Fatalf("failed to store plain object: %v", err)
+	}
+	node.SetKeyring(keyring)
+	if _, err := os.Stat(objectKeyFile(node, randomID)); !os.IsNotExist(err) {
+		t.Errorf("expected the stale key to be removed, got %v", err)
+	}
+	if file, err := node.Open(randomID); err != nil || file.Encrypted() {
+		t.Errorf("expected a plain object, got %v", err)
+	} else {
+		file.Close()
+	}
+
+	// Without its key an object cannot be read, but that is not corruption
+	os.Remove(objectKeyFile(node, objectID))
+	if _, err := node.Retrieve(objectID); err == nil || errors.Is(err, ErrChecksumMismatch) {
+		t.Errorf("expected a plain error for a missing key, got %v", err)
+	}
+
+	// Deleting an object removes its key
+	node.Delete(randomID)
+	if _, err := os.Stat(objectKeyFile(node, randomID)); !os.IsNotExist(err) {
+		t.Errorf("expected the key to be deleted, got %v", err)
+	}
+}
+
+func TestLoadKeyring(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "storage-test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	path := filepath.Join(tmpDir, "keys.json")
+	if _, err := LoadKeyring(path); err == nil {
+		t.Error("expected a missing key file to fail")
+	}
+
+	writeKeyFile(t, path, "missing", map[string]byte{"k1": 1})
+	if _, err := LoadKeyring(path); err == nil {
+		t.Error("expected an active key not in the file to fail")
+	}
+
+	os.WriteFile(path, []byte(`{"active":"k1","keys":{"k1":"c2hvcnQ="}}`), 0600)
+	if _, err := LoadKeyring(path); err == nil {
+		t.Error("expected a short key to fail")
+	}
+}
+
+func TestKeyring_Seal(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "storage-test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	keyPath := filepath.Join(tmpDir, "keys.json")
+	writeKeyFile(t, keyPath, "k1", map[string]byte{"k1": 1})
+	keyring, err := LoadKeyring(keyPath)
+	if err != nil {
+		t.Fatalf("failed to load keyring: %v", err)
+	}
+
+	record := []byte(`{"content_type":"text/plain"}`)
+	sealed, err := keyring.Seal("a.json", record)
+	if err != nil {
+		t.Fatalf("failed to seal record: %v", err)
+	}
+	if bytes.Contains(sealed, []byte("text/plain")) || keyring.NeedsSealing(sealed) {
+		t.Error("expected the record to be sealed with the active key")
+	}
+	if plain, err := keyring.Unseal("a.json", sealed); err != nil || !bytes.Equal(plain, record) {
+		t.Errorf("unsealed record does not match (%v)", err)
+	}
+	if _, err := keyring.Unseal("b.json", sealed); !errors.Is(err, ErrChecksumMismatch) {
+		t.Errorf("expected ErrChecksumMismatch for another label, got %v", err)
+	}
+	var none *Keyring
+	if _, err := none.Unseal("a.json", sealed); err == nil {
+		t.Error("expected a sealed record to fail without a keyring")
+	}
+
+	// Plain records read as they are and need sealing, as do records sealed
+	// before a rotation
+	if plain, err := keyring.Unseal("a.json", record); err != nil || !bytes.Equal(plain, record) || !keyring.NeedsSealing(record) {
+		t.Errorf("expected a plain record to read as it is (%v)", err)
+	}
+	writeKeyFile(t, keyPath, "k2", map[string]byte{"k1": 1, "k2": 2})
+	keyring.Reload()
+	if !keyring.NeedsSealing(sealed) {
+		t.Error("expected a record sealed with the old key to need sealing")
+	}
+	if plain, err := keyring.Unseal("a.json", sealed); err != nil || !bytes.Equal(plain, record) {
+		t.Errorf("expected the old key to unseal the record (%v)", err)
+	}
+}
+
+func TestSealedFile(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "storage-test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	keyPath := filepath.Join(tmpDir, "keys.json")
+	writeKeyFile(t, keyPath, "k1", map[string]byte{"k1": 1})
+	keyring, err := LoadKeyring(keyPath)
+	if err != nil {
+		t.Fatalf("failed to load keyring: %v", err)
+	}
+
+	// Parts at unaligned offsets, out of order and across segments
+	content := randomData(3*encryptionSegmentSize + 1000)
+	cuts := []int{0, 70000, 131072, 150000, len(content)}
+	for _, k := range []*Keyring{keyring, nil} {
+		path := filepath.Join(tmpDir, "staged")
+		file, _ := os.Create(path)
+		sealed, err := k.NewSealedFile(file, "upload/data")
+		if err != nil {
+			t.Fatalf("failed to create sealed file: %v", err)
+		}
+		for i := len(cuts) - 2; i >= 0; i-- {
+			if _, err := sealed.WriteAt(content[cuts[i]:cuts[i+1]], int64(cuts[i])); err != nil {
+				t.Fatalf("failed to write part %d: %v", i, err)
+			}
+		}
+		sealed.Close()
+
+		raw, _ := os.ReadFile(path)
+		if encrypted := !bytes.Contains(raw, content[1000:1100]); encrypted != (k != nil) {
+			t.Errorf("expected the file to be encrypted: %v", k != nil)
+		}
+		file, _ = os.Open(path)
+		sealed, err = keyring.OpenSealedFile(file, "upload/data")
+		if err != nil {
+			t.Fatalf("failed to open sealed file: %v", err)
+		}
+		read, err := io.ReadAll(io.NewSectionReader(sealed, 0, int64(len(content))))
+		sealed.Close()
+		if err != nil || !bytes.Equal(read, content) {
+			t.Errorf("read content does not match (%v)", err)
+		}
+	}
+
+	// A file read under another label, or tampered with, fails to decrypt,
+	// and so does a segment never written
+	path := filepath.Join(tmpDir, "tampered")
+	file, _ := os.Create(path)
+	sealed, _ := keyring.NewSealedFile(file, "upload/data")
+	sealed.WriteAt(content[:100], 0)
+	sealed.WriteAt(content[:100], 2*encryptionSegmentSize)
+	sealed.Close()
+	file, _ = os.Open(path)
+	if _, err := keyring.OpenSealedFile(file, "upload/other"); !errors.Is(err, ErrChecksumMismatch) {
+		t.Errorf("expected ErrChecksumMismatch for another label, got %v", err)
+	}
+	file.Close()
+	file, _ = os.Open(path)
+	sealed, _ = keyring.OpenSealedFile(file, "upload/data")
+	if _, err := sealed.ReadAt(make([]byte, 10), encryptionSegmentSize); !errors.Is(err, ErrChecksumMismatch) {
+		t.Errorf("expected ErrChecksumMismatch for a segment never written, got %v", err)
+	}
+	sealed.Close()
+	raw, _ := os.ReadFile(path)
+	raw[len(raw)-10] ^= 0xff
+	os.WriteFile(path, raw, 0644)
+	file, _ = os.Open(path)
+	sealed, _ = keyring.OpenSealedFile(file, "upload/data")
+	if _, err := sealed.ReadAt(make([]byte, 10), 2*encryptionSegmentSize); !errors.Is(err, ErrChecksumMismatch) {
+		t.Errorf("expected ErrChecksumMismatch for tampered data, got %v", err)
+	}
+	sealed.Close()
+}
@@ -0,0 +1,517 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Durability is how the chunks of an object are protected against node
+// loss: by full replicas on the replication factor's number of nodes, or by
+// Reed-Solomon erasure coding into data and parity shards on distinct nodes.
+// Erasure coding with k data and m parity shards survives the loss of any m
+// nodes at an overhead of (k+m)/k instead of the replication factor.
+type Durability string
+
+// DurabilityReplicated stores full replicas of every chunk
+const DurabilityReplicated Durability = "replicated"
+
+// ParseDurability parses a durability policy: "replicated", or "ec:K+M" for
+// erasure coding into K data and M parity shards
+func ParseDurability(name string) (Durability, error) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	if name == string(DurabilityReplicated) {
+		return DurabilityReplicated, nil
+	}
+
+	spec, ok := strings.CutPrefix(name, "ec:")
+	dataPart, parityPart, found := strings.Cut(spec, "+")
+	dataShards, dataErr := strconv.Atoi(dataPart)
+	parityShards, parityErr := strconv.Atoi(parityPart)
+	if !ok || !found || dataErr != nil || parityErr != nil ||
+		dataShards < 1 || parityShards < 1 || dataShards+parityShards > 256 {
+		return "", fmt.Errorf("unknown durability %q (want replicated or ec:K+M)", name)
+	}
+	return ErasureCoding(dataShards, parityShards), nil
+}
+
+// ErasureCoding returns the durability policy of a Reed-Solomon code
+func ErasureCoding(dataShards, parityShards int) Durability {
+	return Durability(fmt.Sprintf("ec:%d+%d", dataShards, parityShards))
+}
+
+// Shards returns the data and parity shard counts of an erasure coding
+// policy, or zeros for replication
+func (d Durability) Shards() (dataShards, parityShards int) {
+	spec, ok := strings.CutPrefix(string(d), "ec:")
+	if !ok {
+		return 0, 0
+	}
+	dataPart, parityPart, _ := strings.Cut(spec, "+")
+	dataShards, _ = strconv.Atoi(dataPart)
+	parityShards, _ = strconv.Atoi(parityPart)
+	return dataShards, parityShards
+}
+
+// shardHeaderSize is the size of the header in front of a shard's data: the
+// size of the whole chunk and the SHA-256 of the shard's data, so a shard can
+// be verified, and a chunk rebuilt, without the metadata store
+const shardHeaderSize = 8 + sha256.Size
+
+// ShardID returns the ID a shard of an erasure-coded chunk is stored under.
+// It names the chunk and the code, so the shard's placement can be derived
+// from the ID alone.
+func ShardID(chunkID string, dataShards, parityShards, index int) string {
+	return fmt.Sprintf("%s.ec%d-%d.%d", chunkID, dataShards, parityShards, index)
+}
+
+// ParseShardID splits a shard ID into the chunk ID, the shard counts and the
+// index of the shard. It reports false for an ID that is not a shard.
+func ParseShardID(id string) (chunkID string, dataShards, parityShards, index int, ok bool) {
+	parts := strings.Split(id, ".")
+	if len(parts) != 3 || !IsValidObjectID(parts[0]) {
+		return "", 0, 0, 0, false
+	}
+	code, found := strings.CutPrefix(parts[1], "ec")
+	dataPart, parityPart, cut := strings.Cut(code, "-")
+	var err1, err2, err3 error
+	dataShards, err1 = strconv.Atoi(dataPart)
+	parityShards, err2 = strconv.Atoi(parityPart)
+	index, err3 = strconv.Atoi(parts[2])
+	if !found || !cut || err1 != nil || err2 != nil || err3 != nil ||
+		dataShards < 1 || parityShards < 1 || index < 0 || index >= dataShards+parityShards {
+		return "", 0, 0, 0, false
+	}
+	return parts[0], dataShards, parityShards, index, true
+}
+
+// contentVerifier checks written content against the ID it is stored under.
+// An object's ID is the SHA-256 of its content; a shard carries the hash of
+// its data in its header.
+type contentVerifier struct {
+	objectID string
+	shard    bool
+	header   []byte
+	hasher   hash.Hash
+}
+
+// newContentVerifier creates a verifier for the content of objectID
+func newContentVerifier(objectID string) *contentVerifier {
+	_, _, _, _, shard := ParseShardID(objectID)
+	return &contentVerifier{objectID: objectID, shard: shard, hasher: sha256.New()}
+}
+
+func (v *contentVerifier) Write(p []byte) (int, error) {
+	n := len(p)
+	if v.shard && len(v.header) < shardHeaderSize {
+		take := min(shardHeaderSize-len(v.header), len(p))
+		v.header = append(v.header, p[:take]...)
+		p = p[take:]
+	}
+	v.hasher.Write(p)
+	return n, nil
+}
+
+// valid reports whether the content written matches
+func (v *contentVerifier) valid() bool {
+	sum := v.hasher.Sum(nil)
+	if v.shard {
+		return len(v.header) == shardHeaderSize && bytes.Equal(v.header[8:], sum)
+	}
+	return hex.EncodeToString(sum) == v.objectID
+}
+
+// VerifyContent reads stored content to the end and checks it against the
+// object or shard ID it is stored under. It returns the number of bytes read
+// and ErrChecksumMismatch if the content is corrupt.
+func VerifyContent(objectID string, reader io.Reader) (int64, error) {
+	verifier := newContentVerifier(objectID)
+	size, err := io.Copy(verifier, reader)
+	if err != nil {
+		return size, err
+	}
+	if !verifier.valid() {
+		return size, ErrChecksumMismatch
+	}
+	return size, nil
+}
+
+// shardTargets returns the nodes the shards of a chunk are placed on, one
+// per shard in shard order. If the ring has fewer nodes than shards, as when
+// nodes left after the chunk was written, nodes hold several shards rather
+// than none. New chunks are never written that way; see putShards.
+func (m *Manager) shardTargets(chunkID string, total int) []string {
+	nodeIDs := m.hashRing.GetNodes(chunkID, total)
+	if len(nodeIDs) == 0 {
+		return nil
+	}
+	targets := make([]string, total)
+	for i := range targets {
+		targets[i] = nodeIDs[i%len(nodeIDs)]
+	}
+	return targets
+}
+
+// putShards erasure-codes a chunk and writes each shard to its node,
+// skipping shards that are already stored. The shard of a node that is down
+// goes to a stand-in node with a hint, as replicas do. It returns the nodes
+// holding a shard afterwards.
+func (m *Manager) putShards(ctx context.Context, chunk Chunk, data []byte, durability Durability, consistency Consistency) (Chunk, []string, error) {
+	dataShards, parityShards := durability.Shards()
+	chunk.DataShards, chunk.ParityShards = dataShards, parityShards
+	total := dataShards + parityShards
+	m.mu.RLock()
+	if nodeCount := m.hashRing.NodeCount(); nodeCount < total {
+		// Shards sharing a node would be lost together
+		m.mu.RUnlock()
+		return chunk, nil, fmt.Errorf("durability %s needs %d storage nodes, found %d", durability, total, nodeCount)
+	}
+	targets := m.shardTargets(chunk.ID, total)
+	_, standIns := m.handoffNodes(chunk.ID, targets)
+	writeNodes := m.shardWriteNodes(targets, standIns)
+	writeTargets := make([][]writeTarget, total)
+	for i, nodeID := range writeNodes {
+		if nodeID != "" {
+			writeTargets[i] = m.writeTargets([]string{nodeID})
+		}
+	}
+	m.mu.RUnlock()
+
+	rs, err := NewReedSolomon(dataShards, parityShards)
+	if err != nil {
+		return chunk, nil, err
+	}
+	shards := rs.Split(data)
+	if err := rs.Encode(shards); err != nil {
+		return chunk, nil, err
+	}
+
+	// Shards go to different nodes, so they are written concurrently
+	stored := make([]bool, total)
+	var wg sync.WaitGroup
+	for i, nodeID := range writeNodes {
+		if nodeID == "" {
+			continue // Left to repair
+		}
+		shardID := ShardID(chunk.ID, dataShards, parityShards, i)
+		if len(writeTargets[i]) > 0 && writeTargets[i][0].node.Exists(shardID) {
+			stored[i] = true
+			continue
+		}
+
+		wg.Add(1)
+		go func(i int, nodeID, shardID string) {
+			defer wg.Done()
+			streams, _, _, err := m.fanOut(ctx, bytes.NewReader(encodeShard(chunk.Size, shards[i])), writeTargets[i])
+			var written []string
+			if err == nil {
+				written, err = m.commitStreams(ctx, shardID, streams)
+			}
+			if err != nil {
+				m.logger.Error("failed to store shard", "shard_id", shardID, "node_id", nodeID, "error", err)
+				return
+			}
+			m.recordHints(shardID, written, standIns)
+			stored[i] = true
+		}(i, nodeID, shardID)
+	}
+	wg.Wait()
+	if ctx.Err() != nil {
+		return chunk, nil, ctx.Err()
+	}
+
+	var holders []string
+	written := 0
+	for i, ok := range stored {
+		if ok {
+			written++
+			holders = append(holders, writeNodes[i])
+		}
+	}
+	holders = uniqueSorted(holders)
+
+	required := consistency.RequiredShards(dataShards, parityShards)
+	if written < required {
+		m.logger.Warn("write quorum not met",
+			"consistency", consistency,
+			"required", required,
+			"written", written,
+			"chunk_id", chunk.ID)
+		return chunk, nil, &QuorumError{Consistency: consistency, Required: required, Written: holders}
+	}
+	if written < total {
+		m.logger.Warn("write quorum met with missing shards, scheduling repair",
+			"chunk_id", chunk.ID,
+			"written", written,
+			"shards", total)
+		m.ScheduleRepair(ShardID(chunk.ID, dataShards, parityShards, 0))
+	}
+	return chunk, holders, nil
+}
+
+// shardWriteNodes returns the node each shard is written to: its target, or
+// for a target that is down, a stand-in from handoffNodes writing for it.
+// It is empty for a shard whose target is down without a stand-in. The
+// caller must hold the lock.
+func (m *Manager) shardWriteNodes(targets []string, standIns map[string]string) []string {
+	byOwner := make(map[string][]string, len(standIns))
+	for standIn, owner := range standIns {
+		byOwner[owner] = append(byOwner[owner], standIn)
+	}
+
+	writeNodes := make([]string, len(targets))
+	for i, nodeID := range targets {
+		if !m.nodeDown(nodeID) {
+			writeNodes[i] = nodeID
+			continue
+		}
+		if spare := byOwner[nodeID]; len(spare) > 0 {
+			writeNodes[i] = spare[0]
+			byOwner[nodeID] = spare[1:]
+		}
+	}
+	return writeNodes
+}
+
+// encodeShard prepends the shard header to a shard's data
+func encodeShard(chunkSize int64, data []byte) []byte {
+	buf := make([]byte, shardHeaderSize, shardHeaderSize+len(data))
+	binary.BigEndian.PutUint64(buf, uint64(chunkSize))
+	sum := sha256.Sum256(data)
+	copy(buf[8:], sum[:])
+	return append(buf, data...)
+}
+
+// readShard reads a shard from the first of sources holding an intact copy.
+// A corrupt copy is quarantined and the next one is tried. It returns nil if
+// no intact copy was found.
+func (m *Manager) readShard(shardID string, sources []sourceNode) (data []byte, chunkSize int64) {
+	for _, source := range sources {
+		nodeID, node := source.nodeID, source.node
+		if !node.Exists(shardID) {
+			continue
+		}
+
+		reader, err := node.Retrieve(shardID)
+		if err != nil {
+			continue
+		}
+		content, err := io.ReadAll(reader)
+		reader.Close()
+		if err != nil && !errors.Is(err, ErrChecksumMismatch) {
+			m.logger.Warn("failed to read shard", "shard_id", shardID, "node_id", nodeID, "error", err)
+			continue
+		}
+
+		sum := sha256.Sum256(content[min(len(content), shardHeaderSize):])
+		if err != nil || len(content) < shardHeaderSize || !bytes.Equal(content[8:shardHeaderSize], sum[:]) {
+			m.logger.Error("replica failed checksum verification", "object_id", shardID, "node_id", nodeID)
+			if err := node.Quarantine(shardID); err != nil {
+				m.logger.Error("failed to quarantine replica", "object_id", shardID, "node_id", nodeID, "error", err)
+			}
+			continue
+		}
+		return content[shardHeaderSize:], int64(binary.BigEndian.Uint64(content))
+	}
+	return nil, 0
+}
+
+// shardSources looks up the nodes each shard of a chunk can be read from,
+// in shard order, so the shards can be read without holding the lock. The
+// caller must hold the lock.
+func (m *Manager) shardSources(chunkID string, dataShards, parityShards int) [][]sourceNode {
+	sources := make([][]sourceNode, dataShards+parityShards)
+	for i := range sources {
+		sources[i] = m.availableSources(ShardID(chunkID, dataShards, parityShards, i))
+	}
+	return sources
+}
+
+// readShards reads the shards of a chunk from the nodes shardSources found,
+// preferring data shards, until enough are found to decode it. Shards that
+// could not be read are nil.
+func (m *Manager) readShards(chunkID string, dataShards, parityShards int, sources [][]sourceNode) ([][]byte, int64, error) {
+	shards := make([][]byte, dataShards+parityShards)
+	found := 0
+	var chunkSize int64
+	for i := range shards {
+		if found == dataShards {
+			break
+		}
+		data, size := m.readShard(ShardID(chunkID, dataShards, parityShards, i), sources[i])
+		if data == nil {
+			continue
+		}
+		shards[i] = data
+		chunkSize = size
+		found++
+	}
+	if found < dataShards {
+		return nil, 0, fmt.Errorf("chunk %s: %w: %d of %d shards readable", chunkID, ErrTooFewShards, found, dataShards)
+	}
+	return shards, chunkSize, nil
+}
+
+// readErasureChunk decodes an erasure-coded chunk from its shards and
+// verifies the result against the chunk ID. Lost or corrupt shards are
+// scheduled for rebuilding.
+func (m *Manager) readErasureChunk(chunk Chunk) ([]byte, error) {
+	m.mu.RLock()
+	sources := m.shardSources(chunk.ID, chunk.DataShards, chunk.ParityShards)
+	m.mu.RUnlock()
+
+	shards, _, err := m.readShards(chunk.ID, chunk.DataShards, chunk.ParityShards, sources)
+	if err != nil {
+		return nil, err
+	}
+
+	rs, err := NewReedSolomon(chunk.DataShards, chunk.ParityShards)
+	if err != nil {
+		return nil, err
+	}
+	degraded := false
+	for _, shard := range shards[:chunk.DataShards] {
+		if shard == nil {
+			degraded = true
+		}
+	}
+	if err := rs.Reconstruct(shards); err != nil {
+		return nil, err
+	}
+	data, err := rs.Join(shards, int(chunk.Size))
+	if err != nil {
+		return nil, err
+	}
+	if GenerateObjectID(data) != chunk.ID {
+		return nil, fmt.Errorf("chunk %s: %w", chunk.ID, ErrChecksumMismatch)
+	}
+
+	if degraded {
+		m.logger.Warn("read chunk from parity shards", "chunk_id", chunk.ID)
+		m.ScheduleRepair(ShardID(chunk.ID, chunk.DataShards, chunk.ParityShards, 0))
+	}
+	return data, nil
+}
+
+// RepairShards restores the shards of an erasure-coded chunk on the nodes
+// the ring assigns to them. A shard that still has a copy elsewhere is
+// copied; shards with no intact copy left are rebuilt from the others. It
+// returns the number of shards restored. With fewer nodes than shards, as
+// after nodes leave, shards are restored onto nodes holding another shard of
+// the chunk, and a warning is logged since such a node takes both down with
+// it. The nodes are looked up under the lock, which is released while
+// shards are copied.
+func (m *Manager) RepairShards(chunkID string, dataShards, parityShards int) (int, error) {
+	total := dataShards + parityShards
+	m.mu.RLock()
+	nodeCount := m.hashRing.NodeCount()
+	targets := m.shardTargets(chunkID, total)
+	targetNodes := make([]Backend, len(targets))
+	for i, nodeID := range targets {
+		targetNodes[i], _ = m.availableNode(nodeID)
+	}
+	sources := m.shardSources(chunkID, dataShards, parityShards)
+	m.mu.RUnlock()
+
+	if len(targets) == 0 {
+		return 0, fmt.Errorf("no storage nodes available")
+	}
+	if nodeCount < total {
+		m.logger.Warn("too few nodes to keep shards apart",
+			"chunk_id", chunkID,
+			"nodes", nodeCount,
+			"shards", total)
+	}
+
+	var missing []int
+	restored := 0
+	for i, target := range targetNodes {
+		shardID := ShardID(chunkID, dataShards, parityShards, i)
+		if target == nil || target.Exists(shardID) {
+			continue
+		}
+
+		copied := false
+		for _, source := range sources[i] {
+			if source.nodeID == targets[i] || !source.node.Exists(shardID) {
+				continue
+			}
+			if err := m.copyReplica(shardID, source.nodeID, source.node, target); err == nil {
+				copied = true
+				break
+			}
+		}
+		if copied {
+			restored++
+			continue
+		}
+		missing = append(missing, i)
+	}
+	if len(missing) == 0 {
+		return restored, nil
+	}
+
+	shards, chunkSize, err := m.readShards(chunkID, dataShards, parityShards, sources)
+	if err != nil {
+		return restored, err
+	}
+	rs, err := NewReedSolomon(dataShards, parityShards)
+	if err != nil {
+		return restored, err
+	}
+	for _, i := range missing {
+		shards[i] = nil
+	}
+	if err := rs.Reconstruct(shards); err != nil {
+		return restored, err
+	}
+
+	var lastErr error
+	for _, i := range missing {
+		shardID := ShardID(chunkID, dataShards, parityShards, i)
+		if err := targetNodes[i].Store(shardID, bytes.NewReader(encodeShard(chunkSize, shards[i]))); err != nil {
+			m.logger.Error("failed to rebuild shard", "shard_id", shardID, "node_id", targets[i], "error", err)
+			lastErr = err
+			continue
+		}
+		restored++
+		m.logger.Info("rebuilt shard", "shard_id", shardID, "node_id", targets[i])
+	}
+	return restored, lastErr
+}
+
+// shardHolders returns the nodes holding a shard of an erasure-coded chunk
+func (m *Manager) shardHolders(chunk Chunk) []string {
+	var holders []string
+	for i := 0; i < chunk.DataShards+chunk.ParityShards; i++ {
+		shardID := ShardID(chunk.ID, chunk.DataShards, chunk.ParityShards, i)
+		for nodeID, node := range m.nodes {
+			if !m.nodeDown(nodeID) && node.Exists(shardID) {
+				holders = append(holders, nodeID)
+			}
+		}
+	}
+	return uniqueSorted(holders)
+}
+
+// uniqueSorted sorts node IDs and removes duplicates
+func uniqueSorted(nodeIDs []string) []string {
+	sort.Strings(nodeIDs)
+	unique := nodeIDs[:0]
+	for i, nodeID := range nodeIDs {
+		if i == 0 || nodeID != nodeIDs[i-1] {
+			unique = append(unique, nodeID)
+		}
+	}
+	return unique
+}
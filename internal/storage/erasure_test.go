@@ -0,0 +1,179 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/caskos/caskos/internal/hashring"
+	"log/slog"
+)
+
+func TestParseDurability(t *testing.T) {
+	if d, err := ParseDurability("EC:4+2"); err != nil || d != ErasureCoding(4, 2) {
+		t.Errorf("expected ec:4+2, got %q (%v)", d, err)
+	}
+	if dataShards, parityShards := ErasureCoding(4, 2).Shards(); dataShards != 4 || parityShards != 2 {
+		t.Errorf("expected 4+2 shards, got %d+%d", dataShards, parityShards)
+	}
+	for _, name := range []string{"ec:4", "ec:0+2", "ec:4+0", "mirrored"} {
+		if _, err := ParseDurability(name); err == nil {
+			t.Errorf("expected %q to be rejected", name)
+		}
+	}
+
+	chunkID := GenerateObjectID([]byte("chunk"))
+	id, dataShards, parityShards, index, ok := ParseShardID(ShardID(chunkID, 4, 2, 5))
+	if !ok || id != chunkID || dataShards != 4 || parityShards != 2 || index != 5 {
+		t.Errorf("shard ID does not round-trip: %s %d+%d #%d", id, dataShards, parityShards, index)
+	}
+	if _, _, _, _, ok := ParseShardID(chunkID); ok {
+		t.Error("expected an object ID not to parse as a shard")
+	}
+}
+
+func TestManager_ErasureCoding(t *testing.T) {
+	tmpDir, _ := os.MkdirTemp("", "storage-erasure")
+	defer os.RemoveAll(tmpDir)
+
+	ring := hashring.NewHashRing(50)
+	logger := slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelError}))
+	manager := NewManager(ring, 3, logger)
+	manager.SetChunkSize(64 << 10)
+	nodes := make(map[string]*Node)
+	for i := 1; i <= 6; i++ {
+		nodeID := fmt.Sprintf("node%d", i)
+		node, _ := NewNode(nodeID, filepath.Join(tmpDir, nodeID))
+		ring.AddNode(nodeID)
+		manager.AddNode(nodeID, node)
+		nodes[nodeID] = node
+	}
+
+	testData := randomData(300 << 10)
+	result, err := manager.PutObject(context.Background(), bytes.NewReader(testData), "", ErasureCoding(4, 2))
+	if err != nil {
+		t.Fatalf("failed to put object: %v", err)
+	}
+	if result.Durability != ErasureCoding(4, 2) {
+		t.Errorf("expected durability ec:4+2, got %q", result.Durability)
+	}
+
+	// Every shard is stored once, and the shards span all the nodes
+	stored := 0
+	for _, node := range nodes {
+		node.List("", func(string) error {
+			stored++
+			return nil
+		})
+	}
+	if stored != 6*len(result.Chunks) {
+		t.Errorf("expected %d shard files, found %d", 6*len(result.Chunks), stored)
+	}
+	chunk := result.Chunks[0]
+	if !chunk.ErasureCoded() {
+		t.Fatal("expected chunks to be erasure-coded")
+	}
+	if holders := manager.CheckChunkReplicas(result.Chunks); len(holders) != 6 {
+		t.Errorf("expected shards on 6 nodes, got %v", holders)
+	}
+
+	// Lose two shards of the first chunk, a data and a parity shard
+	lost := []int{1, 5}
+	for _, i := range lost {
+		shardID := ShardID(chunk.ID, 4, 2, i)
+		for _, node := range nodes {
+			node.Delete(shardID)
+		}
+	}
+
+	reader, err := manager.OpenChunks(result.ObjectID, result.Chunks)
+	if err != nil {
+		t.Fatalf("failed to open degraded object: %v", err)
+	}
+	retrieved, err := io.ReadAll(reader)
+	reader.Close()
+	if err != nil || !bytes.Equal(retrieved, testData) {
+		t.Fatalf("degraded read does not match (%v)", err)
+	}
+
+	restored, err := manager.RepairShards(chunk.ID, 4, 2)
+	if err != nil || restored != len(lost) {
+		t.Fatalf("expected %d shards rebuilt, got %d (%v)", len(lost), restored, err)
+	}
+	for _, i := range lost {
+		shardID := ShardID(chunk.ID, 4, 2, i)
+		node := nodes[manager.GetTargetNodes(shardID)[0]]
+		reader, err := node.Retrieve(shardID)
+		if err != nil {
+			t.Fatalf("rebuilt shard %d is missing: %v", i, err)
+		}
+		_, err = VerifyContent(shardID, reader)
+		reader.Close()
+		if err != nil {
+			t.Errorf("rebuilt shard %d does not verify: %v", i, err)
+		}
+	}
+
+	// Beyond the parity shards the chunk cannot be read
+	for i := 0; i < 3; i++ {
+		shardID := ShardID(chunk.ID, 4, 2, i)
+		for _, node := range nodes {
+			node.Delete(shardID)
+		}
+	}
+	if _, err := manager.OpenChunks(result.ObjectID, result.Chunks); err == nil {
+		t.Error("expected an object missing three of six shards to fail to open")
+	}
+
+	// Erasure coding needs a node per shard
+	if _, err := manager.PutObject(context.Background(), bytes.NewReader(testData), "", ErasureCoding(6, 2)); err == nil {
+		t.Error("expected ec:6+2 to be rejected on 6 nodes")
+	}
+}
+
+func TestManager_ShardsNeedDistinctNodes(t *testing.T) {
+	manager, _, memory := newMemoryCluster(3)
+	testData := []byte("coded before a node left")
+	result, err := manager.PutObject(context.Background(), bytes.NewReader(testData), "", ErasureCoding(2, 1))
+	if err != nil {
+		t.Fatalf("failed to store object: %v", err)
+	}
+	chunk := result.Chunks[0]
+
+	// With a node gone, new shards are not doubled up on the others
+	lost := manager.GetTargetNodes(ShardID(chunk.ID, 2, 1, 2))[0]
+	if err := manager.RemoveNode(lost, true); err != nil {
+		t.Fatalf("failed to remove node: %v", err)
+	}
+	content := []byte("coded after a node left")
+	later := Chunk{ID: GenerateObjectID(content), Size: int64(len(content))}
+	if _, _, err := manager.putShards(context.Background(), later, content, ErasureCoding(2, 1), ConsistencyOne); err == nil {
+		t.Error("expected shards to be rejected with fewer nodes than shards")
+	}
+	for i := range 3 {
+		for nodeID, node := range memory {
+			if node.Exists(ShardID(later.ID, 2, 1, i)) {
+				t.Errorf("expected no shard %d on %s", i, nodeID)
+			}
+		}
+	}
+
+	// Chunks written before are still repaired, onto a node holding another shard
+	restored, err := manager.RepairShards(chunk.ID, 2, 1)
+	if err != nil || restored != 1 {
+		t.Fatalf("expected 1 shard rebuilt, got %d (%v)", restored, err)
+	}
+	reader, err := manager.OpenChunks(result.ObjectID, result.Chunks)
+	if err != nil {
+		t.Fatalf("failed to open object: %v", err)
+	}
+	retrieved, err := io.ReadAll(reader)
+	reader.Close()
+	if err != nil || !bytes.Equal(retrieved, testData) {
+		t.Errorf("object does not match after repair (%v)", err)
+	}
+}
@@ -0,0 +1,211 @@
+package storage
+
+import (
+	"errors"
+	"io"
+	"sync"
+	"time"
+)
+
+// ErrBackendDown is returned by a FaultyBackend that was taken down
+var ErrBackendDown = errors.New("storage backend is down")
+
+// Operation names a group of backend calls faults can be injected into
+type Operation string
+
+// Operations of a FaultyBackend
+const (
+	OpStore      Operation = "store" // Store, and pending writes and commits
+	OpRetrieve   Operation = "retrieve"
+	OpExists     Operation = "exists"
+	OpDelete     Operation = "delete"
+	OpStat       Operation = "stat"
+	OpList       Operation = "list"
+	OpQuarantine Operation = "quarantine"
+)
+
+// FaultyBackend wraps a backend and injects failures, so tests can check how
+// the manager and self-healing cope with nodes that fail, stall, go down or
+// return corrupt data. A backend with no faults set passes every call through.
+type FaultyBackend struct {
+	backend Backend
+	mu      sync.RWMutex
+	faults  map[Operation]error
+	down    bool
+	delay   time.Duration
+	corrupt bool
+}
+
+// NewFaultyBackend wraps a backend with no faults set
+func NewFaultyBackend(backend Backend) *FaultyBackend {
+	return &FaultyBackend{
+		backend: backend,
+		faults:  make(map[Operation]error),
+	}
+}
+
+// Fail makes an operation fail with err; a nil err clears the fault
+func (f *FaultyBackend) Fail(op Operation, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err == nil {
+		delete(f.faults, op)
+		return
+	}
+	f.faults[op] = err
+}
+
+// SetDown takes the backend down or brings it back. A backend that is down
+// fails every operation with ErrBackendDown and reports no objects.
+func (f *FaultyBackend) SetDown(down bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.down = down
+}
+
+// SetDelay makes every operation, and every write to a pending object, wait
+// before it runs, like a slow or stalled disk
+func (f *FaultyBackend) SetDelay(delay time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.delay = delay
+}
+
+// SetCorrupt makes retrieved objects return damaged content, as if their
+// data had rotted on disk
+func (f *FaultyBackend) SetCorrupt(corrupt bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.corrupt = corrupt
+}
+
+// Heal clears every fault
+func (f *FaultyBackend) Heal() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.faults = make(map[Operation]error)
+	f.down = false
+	f.delay = 0
+	f.corrupt = false
+}
+
+// fault waits out the delay and returns the error op should fail with, if any
+func (f *FaultyBackend) fault(op Operation) error {
+	f.mu.RLock()
+	delay, down, err := f.delay, f.down, f.faults[op]
+	f.mu.RUnlock()
+
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+	if down {
+		return ErrBackendDown
+	}
+	return err
+}
+
+func (f *FaultyBackend) Store(objectID string, data io.Reader) error {
+	if err := f.fault(OpStore); err != nil {
+		return err
+	}
+	return f.backend.Store(objectID, data)
+}
+
+func (f *FaultyBackend) Retrieve(objectID string) (Object, error) {
+	if err := f.fault(OpRetrieve); err != nil {
+		return nil, err
+	}
+	object, err := f.backend.Retrieve(objectID)
+	if err != nil {
+		return nil, err
+	}
+
+	f.mu.RLock()
+	corrupt := f.corrupt
+	f.mu.RUnlock()
+	if corrupt {
+		return &corruptObject{Object: object}, nil
+	}
+	return object, nil
+}
+
+func (f *FaultyBackend) Exists(objectID string) bool {
+	if err := f.fault(OpExists); err != nil {
+		return false
+	}
+	return f.backend.Exists(objectID)
+}
+
+func (f *FaultyBackend) Delete(objectID string) error {
+	if err := f.fault(OpDelete); err != nil {
+		return err
+	}
+	return f.backend.Delete(objectID)
+}
+
+func (f *FaultyBackend) Stat(objectID string) (ObjectInfo, error) {
+	if err := f.fault(OpStat); err != nil {
+		return ObjectInfo{}, err
+	}
+	return f.backend.Stat(objectID)
+}
+
+func (f *FaultyBackend) List(after string, fn func(objectID string) error) error {
+	if err := f.fault(OpList); err != nil {
+		return err
+	}
+	return f.backend.List(after, fn)
+}
+
+func (f *FaultyBackend) CreatePending() (PendingWrite, error) {
+	if err := f.fault(OpStore); err != nil {
+		return nil, err
+	}
+	pending, err := f.backend.CreatePending()
+	if err != nil {
+		return nil, err
+	}
+	return &faultyPending{PendingWrite: pending, backend: f}, nil
+}
+
+func (f *FaultyBackend) Quarantine(objectID string) error {
+	if err := f.fault(OpQuarantine); err != nil {
+		return err
+	}
+	return f.backend.Quarantine(objectID)
+}
+
+// faultyPending checks for store faults on every write and on commit, so a
+// backend can fail in the middle of a write
+type faultyPending struct {
+	PendingWrite
+	backend *FaultyBackend
+}
+
+func (p *faultyPending) Write(data []byte) (int, error) {
+	if err := p.backend.fault(OpStore); err != nil {
+		return 0, err
+	}
+	return p.PendingWrite.Write(data)
+}
+
+func (p *faultyPending) Commit(objectID string) error {
+	if err := p.backend.fault(OpStore); err != nil {
+		p.PendingWrite.Abort()
+		return err
+	}
+	return p.PendingWrite.Commit(objectID)
+}
+
+// corruptObject flips the bits of every byte read from an object
+type corruptObject struct {
+	Object
+}
+
+func (o *corruptObject) Read(p []byte) (int, error) {
+	n, err := o.Object.Read(p)
+	for i := range p[:n] {
+		p[i] ^= 0xff
+	}
+	return n, err
+}
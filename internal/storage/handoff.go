@@ -0,0 +1,253 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"time"
+)
+
+// Hint records a replica written to a stand-in node because the node the
+// ring places it on was down. Once the owner is back, the replica is copied
+// to it and the stand-in's temporary copy is removed.
+type Hint struct {
+	ObjectID  string    `json:"object_id"`
+	Owner     string    `json:"owner"`  // Node the replica belongs on
+	Holder    string    `json:"holder"` // Node holding the temporary copy
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// hintKey identifies the hint for one replica of an object
+func hintKey(objectID, owner string) string {
+	return owner + "/" + objectID
+}
+
+// EnableHintDir makes the manager persist hints in dir, one file per hint
+// under a directory per owner, and loads the hints left by a previous run so
+// they are still replayed
+func (m *Manager) EnableHintDir(dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create hint directory: %w", err)
+	}
+
+	paths, err := filepath.Glob(filepath.Join(dir, "*", "*"))
+	if err != nil {
+		return fmt.Errorf("failed to list hints: %w", err)
+	}
+
+	m.hintMu.Lock()
+	defer m.hintMu.Unlock()
+	for _, path := range paths {
+		if filepath.Ext(path) == ".tmp" {
+			os.Remove(path)
+			continue
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("failed to read hint: %w", err)
+		}
+		var hint Hint
+		if err := json.Unmarshal(data, &hint); err != nil {
+			return fmt.Errorf("failed to unmarshal hint %s: %w", path, err)
+		}
+		m.hints[hintKey(hint.ObjectID, hint.Owner)] = hint
+	}
+	m.hintDir = dir
+	return nil
+}
+
+// Hints returns the hints waiting to be replayed, oldest first
+func (m *Manager) Hints() []Hint {
+	m.hintMu.Lock()
+	defer m.hintMu.Unlock()
+
+	hints := make([]Hint, 0, len(m.hints))
+	for _, hint := range m.hints {
+		hints = append(hints, hint)
+	}
+	sort.Slice(hints, func(i, j int) bool {
+		if !hints[i].CreatedAt.Equal(hints[j].CreatedAt) {
+			return hints[i].CreatedAt.Before(hints[j].CreatedAt)
+		}
+		return hintKey(hints[i].ObjectID, hints[i].Owner) < hintKey(hints[j].ObjectID, hints[j].Owner)
+	})
+	return hints
+}
+
+// handoffNodes returns the nodes to write an object to: its targets that are
+// not down, plus a stand-in for each target that is. A stand-in is the next
+// node on the ring that is neither a target nor down. The returned map gives
+// the owner each stand-in writes for. The caller must hold the lock.
+func (m *Manager) handoffNodes(objectID string, targetNodes []string) ([]string, map[string]string) {
+	writeNodes := make([]string, 0, len(targetNodes))
+	var down []string
+	for _, nodeID := range targetNodes {
+		if m.nodeDown(nodeID) {
+			down = append(down, nodeID)
+		} else {
+			writeNodes = append(writeNodes, nodeID)
+		}
+	}
+	if len(down) == 0 {
+		return writeNodes, nil
+	}
+
+	standIns := make(map[string]string, len(down))
+	for _, nodeID := range m.hashRing.GetNodes(objectID, m.hashRing.NodeCount()) {
+		if len(standIns) == len(down) {
+			break
+		}
+		if _, exists := m.availableNode(nodeID); !exists || slices.Contains(targetNodes, nodeID) {
+			continue
+		}
+		standIns[nodeID] = down[len(standIns)]
+		writeNodes = append(writeNodes, nodeID)
+	}
+	for _, owner := range down[len(standIns):] {
+		m.logger.Warn("no stand-in node for down target", "object_id", objectID, "node_id", owner)
+	}
+	return writeNodes, standIns
+}
+
+// recordHints records a hint for every stand-in among the nodes an object
+// was written to
+func (m *Manager) recordHints(objectID string, written []string, standIns map[string]string) {
+	for _, holder := range written {
+		owner, ok := standIns[holder]
+		if !ok {
+			continue
+		}
+
+		hint := Hint{ObjectID: objectID, Owner: owner, Holder: holder, CreatedAt: time.Now()}
+		if err := m.addHint(hint); err != nil {
+			m.logger.Error("failed to record hint", "object_id", objectID, "node_id", owner, "holder", holder, "error", err)
+			continue
+		}
+		m.logger.Warn("wrote hinted replica for down node", "object_id", objectID, "node_id", owner, "holder", holder)
+	}
+}
+
+// addHint records a hint, replacing any earlier hint for the same replica
+func (m *Manager) addHint(hint Hint) error {
+	m.hintMu.Lock()
+	defer m.hintMu.Unlock()
+
+	m.hints[hintKey(hint.ObjectID, hint.Owner)] = hint
+	if m.hintDir == "" {
+		return nil
+	}
+
+	data, err := json.Marshal(hint)
+	if err != nil {
+		return fmt.Errorf("failed to marshal hint: %w", err)
+	}
+	path := filepath.Join(m.hintDir, hint.Owner, hint.ObjectID)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("failed to create hint directory: %w", err)
+	}
+	tmpPath := path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0644); err != nil {
+		return fmt.Errorf("failed to write hint: %w", err)
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		return fmt.Errorf("failed to write hint: %w", err)
+	}
+	return nil
+}
+
+// removeHint forgets a hint, unless it was replaced by a newer one since
+func (m *Manager) removeHint(hint Hint) {
+	m.hintMu.Lock()
+	defer m.hintMu.Unlock()
+
+	key := hintKey(hint.ObjectID, hint.Owner)
+	if current, exists := m.hints[key]; !exists || current.Holder != hint.Holder || !current.CreatedAt.Equal(hint.CreatedAt) {
+		return
+	}
+	delete(m.hints, key)
+	if m.hintDir != "" {
+		if err := os.Remove(filepath.Join(m.hintDir, hint.Owner, hint.ObjectID)); err != nil && !os.IsNotExist(err) {
+			m.logger.Error("failed to remove hint", "object_id", hint.ObjectID, "node_id", hint.Owner, "error", err)
+		}
+	}
+}
+
+// dropHints forgets the hints owned or held by a node that left the cluster.
+// Their replicas are restored by repair instead.
+func (m *Manager) dropHints(nodeID string) {
+	for _, hint := range m.Hints() {
+		if hint.Owner == nodeID || hint.Holder == nodeID {
+			m.removeHint(hint)
+		}
+	}
+}
+
+// ReplayHints copies hinted replicas to their owners once the owners are no
+// longer down, then removes the stand-ins' temporary copies. It returns the
+// number of hints replayed; hints that fail stay for the next call.
+func (m *Manager) ReplayHints(ctx context.Context) int {
+	m.hintReplay.Lock()
+	defer m.hintReplay.Unlock()
+
+	replayed := 0
+	for _, hint := range m.Hints() {
+		if ctx.Err() != nil {
+			break
+		}
+		if m.nodeDown(hint.Owner) {
+			continue
+		}
+		if err := m.replayHint(hint); err != nil {
+			m.logger.Warn("failed to replay hint", "object_id", hint.ObjectID, "node_id", hint.Owner, "holder", hint.Holder, "error", err)
+			continue
+		}
+		m.removeHint(hint)
+		replayed++
+	}
+	if replayed > 0 {
+		m.logger.Info("replayed hints", "count", replayed)
+	}
+	return replayed
+}
+
+// replayHint restores one hinted replica on its owner
+func (m *Manager) replayHint(hint Hint) error {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	owner, ownerExists := m.nodes[hint.Owner]
+	holder, holderExists := m.availableNode(hint.Holder)
+	if !ownerExists {
+		// The owner left; the copy stays until repair or rebalancing moves it
+		return nil
+	}
+	if !holderExists {
+		if _, exists := m.nodes[hint.Holder]; exists {
+			return fmt.Errorf("holder is down: %s", hint.Holder)
+		}
+		return nil
+	}
+	if !holder.Exists(hint.ObjectID) {
+		// Deleted since, or lost with the holder's disk
+		return nil
+	}
+
+	if !owner.Exists(hint.ObjectID) {
+		if err := m.copyReplica(hint.ObjectID, hint.Holder, holder, owner); err != nil {
+			return err
+		}
+		m.logger.Info("replayed hinted replica", "object_id", hint.ObjectID, "node_id", hint.Owner, "holder", hint.Holder)
+	}
+
+	// The ring may have changed since, making the stand-in a target itself
+	if !slices.Contains(m.targetNodes(hint.ObjectID), hint.Holder) {
+		if err := holder.Delete(hint.ObjectID); err != nil {
+			return fmt.Errorf("failed to remove hinted copy: %w", err)
+		}
+	}
+	return nil
+}
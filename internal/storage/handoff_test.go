@@ -0,0 +1,158 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestManager_HintedHandoff(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "storage-test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	manager, faulty, memory := newMemoryCluster(4)
+	manager.SetHealthConfig(HealthConfig{DownAfter: 1})
+	if err := manager.EnableHintDir(tmpDir); err != nil {
+		t.Fatalf("failed to enable hint directory: %v", err)
+	}
+	ctx := context.Background()
+
+	testData := "written while its owner is down"
+	objectID := GenerateObjectID([]byte(testData))
+	targets := manager.GetTargetNodes(objectID)
+	owner := targets[0]
+	faulty[owner].SetDown(true)
+	manager.ProbeNodes(ctx)
+
+	// The owner's replica goes to a stand-in, so the write keeps full replication
+	replicas, err := manager.StoreObject(ctx, objectID, strings.NewReader(testData), int64(len(testData)))
+	if err != nil {
+		t.Fatalf("failed to store object with a node down: %v", err)
+	}
+	if len(replicas) != 2 || slices.Contains(replicas, owner) {
+		t.Fatalf("expected two replicas off the down node, got %v", replicas)
+	}
+	hints := manager.Hints()
+	if len(hints) != 1 || hints[0].ObjectID != objectID || hints[0].Owner != owner || slices.Contains(targets, hints[0].Holder) {
+		t.Fatalf("expected a hint for %s held outside the targets, got %+v", owner, hints)
+	}
+	holder := hints[0].Holder
+	if !memory[holder].Exists(objectID) {
+		t.Error("expected the stand-in to hold the hinted copy")
+	}
+
+	// Chunks written by uploads are handed off too
+	content := randomData(10 << 10)
+	result, err := manager.PutObject(ctx, bytes.NewReader(content), "", "")
+	if err != nil {
+		t.Fatalf("failed to put object with a node down: %v", err)
+	}
+	hinted := slices.Contains(manager.GetTargetNodes(result.ObjectID), owner)
+	if hinted != (len(manager.Hints()) == 2) {
+		t.Errorf("expected a hint only if the upload targets the down node, got %+v", manager.Hints())
+	}
+
+	// Hints survive a restart
+	restarted, _, _ := newMemoryCluster(4)
+	if err := restarted.EnableHintDir(tmpDir); err != nil {
+		t.Fatalf("failed to load hints: %v", err)
+	}
+	if len(restarted.Hints()) != len(manager.Hints()) {
+		t.Errorf("expected %d hints after a restart, got %d", len(manager.Hints()), len(restarted.Hints()))
+	}
+
+	// Nothing is replayed while the owner is down
+	if replayed := manager.ReplayHints(ctx); replayed != 0 {
+		t.Errorf("expected no replay while the owner is down, got %d", replayed)
+	}
+
+	// Once the owner is back, the replica moves to it
+	faulty[owner].Heal()
+	manager.ProbeNodes(ctx)
+	pending := len(manager.Hints())
+	if replayed := manager.ReplayHints(ctx); replayed != pending {
+		t.Errorf("expected %d hints to be replayed, got %d", pending, replayed)
+	}
+	if !memory[owner].Exists(objectID) {
+		t.Error("expected the owner to hold the replica after the replay")
+	}
+	if memory[holder].Exists(objectID) {
+		t.Error("expected the hinted copy to be removed after the replay")
+	}
+	if len(manager.Hints()) != 0 {
+		t.Errorf("expected no hints left, got %+v", manager.Hints())
+	}
+	if entries, _ := os.ReadDir(tmpDir + "/" + owner); len(entries) != 0 {
+		t.Errorf("expected no hint files left, got %d", len(entries))
+	}
+
+	reader, err := manager.OpenChunks(result.ObjectID, result.Chunks)
+	if err != nil {
+		t.Fatalf("failed to open object: %v", err)
+	}
+	retrieved, err := io.ReadAll(reader)
+	reader.Close()
+	if err != nil || !bytes.Equal(retrieved, content) {
+		t.Errorf("retrieved content does not match after the replay (%v)", err)
+	}
+}
+
+func TestManager_ShardHandoff(t *testing.T) {
+	manager, faulty, memory := newMemoryCluster(6)
+	manager.SetHealthConfig(HealthConfig{DownAfter: 1})
+	ctx := context.Background()
+
+	// A single chunk, so its ID is the object's
+	content := randomData(10 << 10)
+	chunkID := GenerateObjectID(content)
+	shardID := ShardID(chunkID, 2, 1, 0)
+	owner := manager.GetTargetNodes(shardID)[0]
+	faulty[owner].SetDown(true)
+	manager.ProbeNodes(ctx)
+
+	// The down node's shard goes to a stand-in, so the stripe stays whole
+	result, err := manager.PutObject(ctx, bytes.NewReader(content), "", ErasureCoding(2, 1))
+	if err != nil {
+		t.Fatalf("failed to put object with a node down: %v", err)
+	}
+	hints := manager.Hints()
+	if len(hints) != 1 || hints[0].ObjectID != shardID || hints[0].Owner != owner {
+		t.Fatalf("expected a hint for shard 0 on %s, got %+v", owner, hints)
+	}
+	holder := hints[0].Holder
+	if !memory[holder].Exists(shardID) {
+		t.Error("expected the stand-in to hold the hinted shard")
+	}
+	for i := 1; i < 3; i++ {
+		if slices.Contains(manager.GetTargetNodes(ShardID(chunkID, 2, 1, i)), holder) {
+			t.Errorf("expected the stand-in to hold no other shard of the stripe, but it is the target of shard %d", i)
+		}
+	}
+
+	// Once the owner is back, the shard moves to it
+	faulty[owner].Heal()
+	manager.ProbeNodes(ctx)
+	if replayed := manager.ReplayHints(ctx); replayed != 1 {
+		t.Errorf("expected the hint to be replayed, got %d", replayed)
+	}
+	if !memory[owner].Exists(shardID) || memory[holder].Exists(shardID) {
+		t.Error("expected the shard to move from the stand-in to its owner")
+	}
+
+	reader, err := manager.OpenChunks(result.ObjectID, result.Chunks)
+	if err != nil {
+		t.Fatalf("failed to open object: %v", err)
+	}
+	retrieved, err := io.ReadAll(reader)
+	reader.Close()
+	if err != nil || !bytes.Equal(retrieved, content) {
+		t.Errorf("retrieved content does not match after the replay (%v)", err)
+	}
+}
@@ -0,0 +1,289 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Health states of a node, see Manager.NodeHealth
+const (
+	HealthUp      = "up"      // Probes succeed quickly and the disk has room
+	HealthSuspect = "suspect" // Probes failed, were slow or found the disk nearly full; still used
+	HealthDown    = "down"    // Probes keep failing; skipped by reads and writes until one succeeds
+)
+
+// Defaults for HealthConfig fields left at zero
+const (
+	DefaultProbeInterval = 10 * time.Second
+	DefaultProbeTimeout  = 5 * time.Second
+	DefaultDownAfter     = 3
+	DefaultSlowProbe     = time.Second
+)
+
+// probeObjectID is the object a backend without a probe of its own is
+// asked about. No content hashes to it, so it is never stored.
+const probeObjectID = "0000000000000000000000000000000000000000000000000000000000000000"
+
+// errProbeTimeout is the error of a probe that did not finish in time
+var errProbeTimeout = errors.New("probe timed out")
+
+// HealthConfig controls how nodes are probed and when they count as suspect
+// or down
+type HealthConfig struct {
+	Interval     time.Duration // Pause between probes of every node
+	Timeout      time.Duration // A probe taking longer fails
+	DownAfter    int           // Consecutive failed probes before a node is down
+	SlowProbe    time.Duration // A probe taking longer makes the node suspect
+	MinFreeBytes int64         // Less free space makes the node suspect; 0 disables the check
+}
+
+// withDefaults returns the config with zero fields set to their defaults
+func (c HealthConfig) withDefaults() HealthConfig {
+	if c.Interval <= 0 {
+		c.Interval = DefaultProbeInterval
+	}
+	if c.Timeout <= 0 {
+		c.Timeout = DefaultProbeTimeout
+	}
+	if c.DownAfter <= 0 {
+		c.DownAfter = DefaultDownAfter
+	}
+	if c.SlowProbe <= 0 {
+		c.SlowProbe = DefaultSlowProbe
+	}
+	return c
+}
+
+// ProbeResult is what a backend reports about itself when probed
+type ProbeResult struct {
+	FreeBytes int64 `json:"free_bytes"` // Space left for objects; -1 if unknown
+}
+
+// prober is implemented by backends that can check their own health, such
+// as a node writing a file to its disk
+type prober interface {
+	Probe() (ProbeResult, error)
+}
+
+// ProbeBackend checks that a backend works. Backends without a probe of
+// their own are asked about an object that never exists, which fails if the
+// backend cannot be reached.
+func ProbeBackend(backend Backend) (ProbeResult, error) {
+	if backend, ok := backend.(prober); ok {
+		return backend.Probe()
+	}
+	if _, err := backend.Stat(probeObjectID); err != nil && !errors.Is(err, ErrObjectNotFound) {
+		return ProbeResult{}, err
+	}
+	return ProbeResult{FreeBytes: -1}, nil
+}
+
+// Probe checks that the node's disk is writable, by writing and syncing a
+// small file next to its pending objects, and reports its free space
+func (n *Node) Probe() (ProbeResult, error) {
+	dir := filepath.Join(n.BasePath, pendingDir)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return ProbeResult{}, fmt.Errorf("failed to create pending directory: %w", err)
+	}
+
+	file, err := os.CreateTemp(dir, "probe-*")
+	if err != nil {
+		return ProbeResult{}, fmt.Errorf("failed to create probe file: %w", err)
+	}
+	defer os.Remove(file.Name())
+
+	_, err = file.Write(make([]byte, 4096))
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return ProbeResult{}, fmt.Errorf("failed to write probe file: %w", err)
+	}
+
+	return ProbeResult{FreeBytes: diskFree(n.BasePath)}, nil
+}
+
+// NodeHealth is the health of a node as of its last probe
+type NodeHealth struct {
+	State     string    `json:"state"`
+	CheckedAt time.Time `json:"checked_at"` // Zero until the first probe
+	LatencyMs float64   `json:"latency_ms"`
+	FreeBytes int64     `json:"free_bytes"` // -1 if unknown
+	Failures  int       `json:"failures"`   // Consecutive failed probes
+	Reason    string    `json:"reason,omitempty"`
+}
+
+// SetHealthConfig sets how nodes are probed. It takes effect with the next
+// round of probes.
+func (m *Manager) SetHealthConfig(config HealthConfig) {
+	m.healthMu.Lock()
+	defer m.healthMu.Unlock()
+	m.healthConfig = config.withDefaults()
+}
+
+// RunHealthChecks probes every node at the configured interval until the
+// context is cancelled. After each round, hints for nodes that are no longer
+// down are replayed.
+func (m *Manager) RunHealthChecks(ctx context.Context) {
+	for {
+		m.ProbeNodes(ctx)
+		m.ReplayHints(ctx)
+
+		m.healthMu.RLock()
+		interval := m.healthConfig.Interval
+		m.healthMu.RUnlock()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+// ProbeNodes probes every node once, concurrently, and updates their health
+func (m *Manager) ProbeNodes(ctx context.Context) {
+	m.mu.RLock()
+	nodes := maps.Clone(m.nodes)
+	m.mu.RUnlock()
+
+	m.healthMu.RLock()
+	config := m.healthConfig
+	m.healthMu.RUnlock()
+
+	var wg sync.WaitGroup
+	for nodeID, node := range nodes {
+		wg.Add(1)
+		go func(nodeID string, node Backend) {
+			defer wg.Done()
+			start := time.Now()
+			result, err := probeWithTimeout(ctx, node, config.Timeout)
+			if ctx.Err() != nil {
+				return
+			}
+			m.recordProbe(nodeID, config, result, time.Since(start), err)
+		}(nodeID, node)
+	}
+	wg.Wait()
+}
+
+// probeWithTimeout probes a backend, giving up after timeout. A probe that
+// hangs, as on a stuck disk, is left to finish on its own.
+func probeWithTimeout(ctx context.Context, backend Backend, timeout time.Duration) (ProbeResult, error) {
+	type outcome struct {
+		result ProbeResult
+		err    error
+	}
+	done := make(chan outcome, 1)
+	go func() {
+		result, err := ProbeBackend(backend)
+		done <- outcome{result, err}
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case o := <-done:
+		return o.result, o.err
+	case <-timer.C:
+		return ProbeResult{}, errProbeTimeout
+	case <-ctx.Done():
+		return ProbeResult{}, ctx.Err()
+	}
+}
+
+// recordProbe updates the health of a node with the outcome of a probe and
+// logs state changes
+func (m *Manager) recordProbe(nodeID string, config HealthConfig, result ProbeResult, latency time.Duration, err error) {
+	m.healthMu.Lock()
+	defer m.healthMu.Unlock()
+
+	previous, known := m.health[nodeID]
+	if !known {
+		previous = NodeHealth{State: HealthUp, FreeBytes: -1}
+	}
+	health := NodeHealth{
+		State:     HealthUp,
+		CheckedAt: time.Now(),
+		LatencyMs: float64(latency.Microseconds()) / 1000,
+		FreeBytes: result.FreeBytes,
+	}
+
+	switch {
+	case err != nil:
+		health.Failures = previous.Failures + 1
+		health.FreeBytes = previous.FreeBytes
+		health.Reason = err.Error()
+		health.State = HealthSuspect
+		if health.Failures >= config.DownAfter {
+			health.State = HealthDown
+		}
+	case latency > config.SlowProbe:
+		health.State = HealthSuspect
+		health.Reason = fmt.Sprintf("probe took %s", latency.Round(time.Millisecond))
+	case config.MinFreeBytes > 0 && result.FreeBytes >= 0 && result.FreeBytes < config.MinFreeBytes:
+		health.State = HealthSuspect
+		health.Reason = fmt.Sprintf("%d bytes free", result.FreeBytes)
+	}
+	m.health[nodeID] = health
+
+	if health.State != previous.State {
+		log := m.logger.Warn
+		if health.State == HealthUp {
+			log = m.logger.Info
+		}
+		log("node health changed", "node_id", nodeID, "from", previous.State, "to", health.State, "reason", health.Reason)
+	}
+}
+
+// NodeHealth returns the health of every node. Nodes that were not probed
+// yet are up.
+func (m *Manager) NodeHealth() map[string]NodeHealth {
+	nodeIDs := m.NodeIDs()
+
+	m.healthMu.RLock()
+	defer m.healthMu.RUnlock()
+
+	health := make(map[string]NodeHealth, len(nodeIDs))
+	for _, nodeID := range nodeIDs {
+		nodeHealth, known := m.health[nodeID]
+		if !known {
+			nodeHealth = NodeHealth{State: HealthUp, FreeBytes: -1}
+		}
+		health[nodeID] = nodeHealth
+	}
+	return health
+}
+
+// nodeDown reports whether a node's probes keep failing
+func (m *Manager) nodeDown(nodeID string) bool {
+	m.healthMu.RLock()
+	defer m.healthMu.RUnlock()
+	return m.health[nodeID].State == HealthDown
+}
+
+// availableNode returns a node's backend unless the node is unknown or down;
+// the caller must hold the lock
+func (m *Manager) availableNode(nodeID string) (Backend, bool) {
+	node, exists := m.nodes[nodeID]
+	if !exists || m.nodeDown(nodeID) {
+		return nil, false
+	}
+	return node, true
+}
+
+// forgetHealth drops the health of a node that left the cluster
+func (m *Manager) forgetHealth(nodeID string) {
+	m.healthMu.Lock()
+	defer m.healthMu.Unlock()
+	delete(m.health, nodeID)
+}
@@ -0,0 +1,120 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"os"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNode_Probe(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "storage-test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	node, err := NewNode("test-node", tmpDir)
+	if err != nil {
+		t.Fatalf("failed to create node: %v", err)
+	}
+
+	result, err := node.Probe()
+	if err != nil {
+		t.Fatalf("failed to probe node: %v", err)
+	}
+	if runtime.GOOS == "linux" && result.FreeBytes <= 0 {
+		t.Errorf("expected free space to be reported, got %d", result.FreeBytes)
+	}
+
+	// The probe file does not linger as a pending object
+	entries, _ := os.ReadDir(tmpDir + "/" + pendingDir)
+	if len(entries) != 0 {
+		t.Errorf("expected no pending files after a probe, got %d", len(entries))
+	}
+}
+
+func TestManager_NodeHealth(t *testing.T) {
+	manager, faulty, _ := newMemoryCluster(3)
+	manager.SetHealthConfig(HealthConfig{
+		Timeout:   50 * time.Millisecond,
+		SlowProbe: 20 * time.Millisecond,
+		DownAfter: 2,
+	})
+	ctx := context.Background()
+
+	manager.ProbeNodes(ctx)
+	for nodeID, health := range manager.NodeHealth() {
+		if health.State != HealthUp || health.CheckedAt.IsZero() {
+			t.Errorf("expected %s to be up after a probe, got %+v", nodeID, health)
+		}
+	}
+
+	testData := "data on a node that goes down"
+	objectID := GenerateObjectID([]byte(testData))
+	if _, err := manager.StoreObject(ctx, objectID, strings.NewReader(testData), int64(len(testData))); err != nil {
+		t.Fatalf("failed to store object: %v", err)
+	}
+	failing := manager.GetTargetNodes(objectID)[0]
+
+	// One failed probe makes a node suspect, further ones take it down
+	faulty[failing].SetDown(true)
+	manager.ProbeNodes(ctx)
+	if health := manager.NodeHealth()[failing]; health.State != HealthSuspect || health.Failures != 1 {
+		t.Errorf("expected %s to be suspect after one failed probe, got %+v", failing, health)
+	}
+	manager.ProbeNodes(ctx)
+	if health := manager.NodeHealth()[failing]; health.State != HealthDown || !strings.Contains(health.Reason, ErrBackendDown.Error()) {
+		t.Errorf("expected %s to be down after two failed probes, got %+v", failing, health)
+	}
+
+	// A down node is skipped even if it could answer, until a probe succeeds
+	faulty[failing].Heal()
+	faulty[failing].Fail(OpExists, errors.New("must not be called"))
+	faulty[failing].Fail(OpStore, errors.New("must not be called"))
+	if replicas := manager.CheckReplicas(objectID); len(replicas) != 1 || replicas[0] == failing {
+		t.Errorf("expected only the replica off the down node, got %v", replicas)
+	}
+	reader, err := manager.RetrieveObject(objectID)
+	if err != nil {
+		t.Fatalf("failed to retrieve object with a node down: %v", err)
+	}
+	reader.Close()
+
+	manager.SetWriteConsistency(ConsistencyOne)
+	other := "written while a node is down"
+	otherID := GenerateObjectID([]byte(other))
+	replicas, err := manager.StoreObject(ctx, otherID, strings.NewReader(other), int64(len(other)))
+	if err != nil {
+		t.Fatalf("failed to store object with a node down: %v", err)
+	}
+	for _, nodeID := range replicas {
+		if nodeID == failing {
+			t.Errorf("expected no replica on the down node, got %v", replicas)
+		}
+	}
+	if err := manager.ReplicateObject(otherID, failing); err == nil {
+		t.Error("expected replication to a down node to fail")
+	}
+
+	faulty[failing].Heal()
+	manager.ProbeNodes(ctx)
+	if health := manager.NodeHealth()[failing]; health.State != HealthUp || health.Failures != 0 {
+		t.Errorf("expected %s to recover after a successful probe, got %+v", failing, health)
+	}
+
+	// Slow probes make a node suspect, and probes that hang fail
+	faulty[failing].SetDelay(30 * time.Millisecond)
+	manager.ProbeNodes(ctx)
+	if health := manager.NodeHealth()[failing]; health.State != HealthSuspect || health.Failures != 0 {
+		t.Errorf("expected %s to be suspect after a slow probe, got %+v", failing, health)
+	}
+	faulty[failing].SetDelay(200 * time.Millisecond)
+	manager.ProbeNodes(ctx)
+	if health := manager.NodeHealth()[failing]; health.Failures != 1 || health.Reason != errProbeTimeout.Error() {
+		t.Errorf("expected %s to fail a probe that hangs, got %+v", failing, health)
+	}
+}
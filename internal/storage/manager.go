@@ -1,21 +1,67 @@
 package storage
 
 import (
+	"bytes"
+	"context"
 	"crypto/sha256"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
+	"maps"
+	"slices"
+	"sort"
 	"sync"
+	"time"
 )
 
+// DefaultNodeTimeout is how long a write waits on a single node, per chunk
+// and for the final commit, before dropping it as a straggler
+const DefaultNodeTimeout = 30 * time.Second
+
+// ErrNodeTimeout is returned for a node that did not finish its part of a
+// write within the node timeout
+var ErrNodeTimeout = errors.New("storage node timed out")
+
 // Manager coordinates storage across multiple nodes with replication
 type Manager struct {
 	mu          sync.RWMutex
-	nodes       map[string]*Node
+	nodes       map[string]Backend
 	hashRing    HashRingInterface
 	replication int
+	consistency Consistency
+	nodeTimeout time.Duration
+	chunkSize   int
+	durability  Durability
+	compression Codec
+	keyring     *Keyring
 	logger      *slog.Logger
+
+	repairMu      sync.RWMutex
+	repairHandler func(objectID string)
+	chunkReserver ChunkReserver
+	tombstones    TombstoneChecker
+
+	healthMu     sync.RWMutex
+	health       map[string]NodeHealth
+	healthConfig HealthConfig
+
+	hintMu     sync.Mutex
+	hints      map[string]Hint // By hintKey
+	hintDir    string
+	hintReplay sync.Mutex
+
+	rebalanceRun sync.Mutex
+	rebalanceMu  sync.Mutex
+	rebalance    RebalanceProgress
+
+	draining       map[string]bool
+	weights        map[string]float64
+	labels         map[string]map[string]string
+	removed        []string
+	membershipPath string
+	virtualNodes   int
 }
 
 // HashRingInterface defines the interface for hash ring operations
@@ -23,88 +69,789 @@ type HashRingInterface interface {
 	GetNodes(key string, count int) []string
 	ListNodes() []string
 	NodeCount() int
+	AddNode(nodeID string)
+	AddLabeledNode(nodeID string, weight float64, labels map[string]string)
+	SetWeight(nodeID string, weight float64) bool
+	SetLabels(nodeID string, labels map[string]string) bool
+	RemoveNode(nodeID string)
+	Shares(count int) map[string]float64
 }
 
 // NewManager creates a new storage manager
 func NewManager(hashRing HashRingInterface, replication int, logger *slog.Logger) *Manager {
 	return &Manager{
-		nodes:       make(map[string]*Node),
-		hashRing:    hashRing,
-		replication: replication,
-		logger:      logger,
+		nodes:        make(map[string]Backend),
+		hashRing:     hashRing,
+		replication:  replication,
+		consistency:  DefaultConsistency,
+		nodeTimeout:  DefaultNodeTimeout,
+		chunkSize:    DefaultChunkSize,
+		durability:   DurabilityReplicated,
+		logger:       logger,
+		draining:     make(map[string]bool),
+		weights:      make(map[string]float64),
+		labels:       make(map[string]map[string]string),
+		health:       make(map[string]NodeHealth),
+		healthConfig: HealthConfig{}.withDefaults(),
+		hints:        make(map[string]Hint),
 	}
 }
 
 // AddNode adds a storage node to the manager
-func (m *Manager) AddNode(nodeID string, node *Node) {
+func (m *Manager) AddNode(nodeID string, backend Backend) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.nodes[nodeID] = backend
+	m.applyKeyring(backend)
+}
+
+// SetWriteConsistency sets the consistency level writes use when the caller
+// does not ask for one
+func (m *Manager) SetWriteConsistency(consistency Consistency) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.consistency = consistency
+}
+
+// SetNodeTimeout sets how long a write waits on a single node before
+// dropping it; zero waits indefinitely
+func (m *Manager) SetNodeTimeout(timeout time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.nodeTimeout = timeout
+}
+
+// SetChunkSize sets the average size of the chunks PutObject splits objects
+// into. Changing it stops new writes from deduplicating against chunks that
+// were cut at the old size.
+func (m *Manager) SetChunkSize(size int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.chunkSize = size
+}
+
+// SetCompression sets the codec of nodes that are added without one
+func (m *Manager) SetCompression(codec Codec) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
-	m.nodes[nodeID] = node
+	m.compression = codec
 }
 
-// StoreObject stores an object with replication
-func (m *Manager) StoreObject(objectID string, data io.Reader, size int64) ([]string, error) {
+// Compression returns the codec of nodes that are added without one
+func (m *Manager) Compression() Codec {
 	m.mu.RLock()
 	defer m.mu.RUnlock()
+	return m.compression
+}
+
+// SetKeyring sets the master keys every node encrypts new objects under,
+// including nodes added later
+func (m *Manager) SetKeyring(keyring *Keyring) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.keyring = keyring
+	for _, backend := range m.nodes {
+		m.applyKeyring(backend)
+	}
+}
+
+// Keyring returns the master keys nodes encrypt new objects under, or nil
+func (m *Manager) Keyring() *Keyring {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.keyring
+}
+
+// applyKeyring gives a node being added the manager's keyring, if it can
+// encrypt. The caller must hold m.mu.
+func (m *Manager) applyKeyring(backend Backend) {
+	if node, ok := backend.(encryptingBackend); ok && m.keyring != nil {
+		node.SetKeyring(m.keyring)
+	}
+}
+
+// RotateKeys reloads the key file and wraps the data keys on every node with
+// its active master key. Nodes in other processes reload their own key file,
+// which must make the same key active. Once it succeeds, master keys that are
+// no longer active can be removed from the key files. It returns the number
+// of keys rewrapped per node.
+func (m *Manager) RotateKeys() (map[string]int, error) {
+	keyring := m.Keyring()
+	if keyring == nil {
+		return nil, fmt.Errorf("encryption is not enabled")
+	}
+	if err := keyring.Reload(); err != nil {
+		return nil, err
+	}
+
+	m.mu.RLock()
+	nodes := maps.Clone(m.nodes)
+	m.mu.RUnlock()
+
+	rewrapped := make(map[string]int, len(nodes))
+	for nodeID, backend := range nodes {
+		node, ok := backend.(keyRewrapper)
+		if !ok {
+			continue
+		}
+		count, err := node.RewrapKeys()
+		rewrapped[nodeID] = count
+		if err != nil {
+			return rewrapped, fmt.Errorf("node %s: %w", nodeID, err)
+		}
+	}
 
-	// Get nodes for this object using consistent hashing
+	m.logger.Info("master key rotated", "active_key", keyring.Active(), "rewrapped", rewrapped)
+	return rewrapped, nil
+}
+
+// SetDurability sets the durability policy writes use when the caller does
+// not ask for one
+func (m *Manager) SetDurability(durability Durability) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.durability = durability
+}
+
+// SetRepairHandler sets the function used to re-replicate objects that lost a
+// replica, for example after a corrupted copy was quarantined
+func (m *Manager) SetRepairHandler(handler func(objectID string)) {
+	m.repairMu.Lock()
+	defer m.repairMu.Unlock()
+	m.repairHandler = handler
+}
+
+// ChunkReserver keeps chunks from being removed from the nodes while a write
+// that uses them is in progress. PutObject reserves every chunk before it
+// checks whether the nodes already hold it, and the object's own ID once it
+// is known, so the object is not deleted before the caller records it.
+type ChunkReserver interface {
+	ReserveChunk(chunkID string)
+	ReleaseChunk(chunkID string)
+}
+
+// SetChunkReserver sets where PutObject reserves chunks. The reservations of
+// a successful write are held until the caller releases them with
+// ReleasePut, once it has recorded the object.
+func (m *Manager) SetChunkReserver(reserver ChunkReserver) {
+	m.repairMu.Lock()
+	defer m.repairMu.Unlock()
+	m.chunkReserver = reserver
+}
+
+// TombstoneChecker reports objects that were deleted and whose content no
+// other object still uses, so that moving copies around does not bring them
+// back
+type TombstoneChecker interface {
+	IsTombstoned(objectID string) bool
+}
+
+// SetTombstoneChecker sets where rebalancing looks up deleted objects. Without
+// one, every object found on the nodes is moved.
+func (m *Manager) SetTombstoneChecker(checker TombstoneChecker) {
+	m.repairMu.Lock()
+	defer m.repairMu.Unlock()
+	m.tombstones = checker
+}
+
+// tombstoned reports whether an object or shard was deleted; a shard is
+// deleted with its chunk
+func (m *Manager) tombstoned(objectID string) bool {
+	m.repairMu.RLock()
+	checker := m.tombstones
+	m.repairMu.RUnlock()
+
+	if checker == nil {
+		return false
+	}
+	if chunkID, _, _, _, ok := ParseShardID(objectID); ok {
+		objectID = chunkID
+	}
+	return checker.IsTombstoned(objectID)
+}
+
+// ReleasePut drops the reservations PutObject took for a successful write
+func (m *Manager) ReleasePut(result *PutResult) {
+	m.releaseChunks(append([]Chunk{{ID: result.ObjectID}}, result.Chunks...))
+}
+
+// releaseChunks drops reservations taken on the given chunks
+func (m *Manager) releaseChunks(chunks []Chunk) {
+	m.repairMu.RLock()
+	reserver := m.chunkReserver
+	m.repairMu.RUnlock()
+
+	if reserver == nil {
+		return
+	}
+	for _, chunk := range chunks {
+		reserver.ReleaseChunk(chunk.ID)
+	}
+}
+
+// ScheduleRepair asks for an object to be re-replicated in the background
+func (m *Manager) ScheduleRepair(objectID string) {
+	m.repairMu.RLock()
+	handler := m.repairHandler
+	m.repairMu.RUnlock()
+
+	if handler == nil {
+		m.logger.Warn("no repair handler set, object left under-replicated", "object_id", objectID)
+		return
+	}
+
+	go handler(objectID)
+}
+
+// PutResult describes an object written by PutObject
+type PutResult struct {
+	ObjectID    string
+	Size        int64
+	Chunks      []Chunk     // Chunks the object was split into, in order
+	Replicas    []string    // Nodes holding the least replicated chunk, or its shards
+	Durability  Durability  // Durability policy the chunks were stored with
+	Consistency Consistency // Consistency level the write was held to
+	Required    int         // Replicas or shards the consistency level required
+}
+
+// StoreObject stores an object with replication. The data is streamed to all
+// target nodes in parallel rather than buffered in memory. It fails with a
+// *QuorumError if fewer replicas than the default write consistency requires
+// were written; target nodes that failed or timed out after the quorum was
+// met are handed off to background repair. The replica of a target that is
+// down goes to a stand-in node with a hint, see ReplayHints. Data that does
+// not hash to objectID, or is not size bytes long unless size is negative,
+// is discarded and fails with an error.
+func (m *Manager) StoreObject(ctx context.Context, objectID string, data io.Reader, size int64) ([]string, error) {
+	// Get nodes for this object using consistent hashing. The lock is only
+	// held to pick them, not while the data streams.
+	m.mu.RLock()
 	targetNodes := m.hashRing.GetNodes(objectID, m.replication)
+	writeNodes, standIns := m.handoffNodes(objectID, targetNodes)
+	targets := m.writeTargets(writeNodes)
+	consistency := m.consistency
+	m.mu.RUnlock()
+
 	if len(targetNodes) == 0 {
 		return nil, fmt.Errorf("no storage nodes available")
 	}
 
-	// Read data into memory for replication (for small to medium files)
-	// For large files, we'd want to stream to multiple nodes, but for simplicity
-	// we'll read into memory first
-	dataBytes, err := io.ReadAll(data)
+	streams, hash, written, err := m.fanOut(ctx, data, targets)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case size >= 0 && written != size:
+		err = fmt.Errorf("failed to store object %s: expected %d bytes, got %d", objectID, size, written)
+	case hash != objectID:
+		err = fmt.Errorf("failed to store object %s: %w", objectID, ErrChecksumMismatch)
+	}
 	if err != nil {
-		return nil, fmt.Errorf("failed to read object data: %w", err)
+		for _, stream := range streams {
+			stream.pending.Abort()
+		}
+		return nil, err
 	}
 
-	replicatedNodes := make([]string, 0, len(targetNodes))
-	var lastErr error
+	replicatedNodes, err := m.commitStreams(ctx, objectID, streams)
+	if err != nil {
+		return nil, err
+	}
+	m.recordHints(objectID, replicatedNodes, standIns)
+
+	if err := m.checkQuorum(objectID, consistency, targetNodes, replicatedNodes); err != nil {
+		return nil, err
+	}
 
-	// Store on multiple nodes
+	return replicatedNodes, nil
+}
+
+// PutObject streams an object whose ID is not known in advance. The data is
+// split into content-defined chunks while it is hashed, and each chunk is
+// stored as an object of its own on the nodes the hash ring assigns to it.
+// Nodes that already hold a chunk are not written again, so content shared
+// between objects, or between versions of a file, is stored once. An object
+// that fits in one chunk is stored under its own ID. Memory use does not
+// depend on object size.
+//
+// With an erasure coding durability each chunk is instead encoded into data
+// and parity shards, stored on distinct nodes. An empty durability uses the
+// manager's default.
+//
+// The write succeeds once every chunk has as many replicas or shards as
+// consistency requires; an empty consistency uses the manager's default.
+// Otherwise it fails with a *QuorumError. Canceling ctx aborts the write.
+// With a chunk reserver set, a successful write stays reserved until it is
+// released with ReleasePut; see SetChunkReserver.
+func (m *Manager) PutObject(ctx context.Context, data io.Reader, consistency Consistency, durability Durability) (result *PutResult, err error) {
+	m.mu.RLock()
+	if consistency == "" {
+		consistency = m.consistency
+	}
+	if durability == "" {
+		durability = m.durability
+	}
+	nodeCount := m.hashRing.NodeCount()
+	chunkSize := m.chunkSize
+	m.mu.RUnlock()
+
+	if nodeCount == 0 {
+		return nil, fmt.Errorf("no storage nodes available")
+	}
+	dataShards, parityShards := durability.Shards()
+	if dataShards > 0 && nodeCount < dataShards+parityShards {
+		return nil, fmt.Errorf("durability %s needs %d storage nodes, found %d", durability, dataShards+parityShards, nodeCount)
+	}
+	required := consistency.Required(m.replication)
+	if dataShards > 0 {
+		required = consistency.RequiredShards(dataShards, parityShards)
+	}
+
+	m.repairMu.RLock()
+	reserver := m.chunkReserver
+	m.repairMu.RUnlock()
+
+	// Chunks stay reserved until the caller records them, unless the write fails
+	var reserved []Chunk
+	defer func() {
+		if err != nil {
+			m.releaseChunks(reserved)
+		}
+	}()
+
+	hasher := sha256.New()
+	chunker := NewChunker(io.TeeReader(data, hasher), chunkSize)
+	var chunks []Chunk
+	var replicas []string
+	var size int64
+	for {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		content, err := chunker.Next()
+		if err == io.EOF {
+			if len(chunks) > 0 {
+				break
+			}
+			content = nil // An empty object is a single empty chunk
+		} else if err != nil {
+			return nil, fmt.Errorf("failed to read object data: %w", err)
+		}
+
+		chunk := Chunk{ID: GenerateObjectID(content), Size: int64(len(content))}
+		if reserver != nil {
+			reserver.ReserveChunk(chunk.ID)
+			reserved = append(reserved, chunk)
+		}
+
+		var chunkReplicas []string
+		if dataShards > 0 {
+			chunk, chunkReplicas, err = m.putShards(ctx, chunk, content, durability, consistency)
+		} else {
+			chunkReplicas, err = m.putChunk(ctx, chunk, content, consistency)
+		}
+		if err != nil {
+			return nil, err
+		}
+		chunks = append(chunks, chunk)
+		size += chunk.Size
+		if replicas == nil || len(chunkReplicas) < len(replicas) {
+			replicas = chunkReplicas
+		}
+	}
+
+	objectID := hex.EncodeToString(hasher.Sum(nil))
+	if reserver != nil {
+		reserver.ReserveChunk(objectID)
+	}
+
+	return &PutResult{
+		ObjectID:    objectID,
+		Size:        size,
+		Chunks:      chunks,
+		Replicas:    replicas,
+		Durability:  durability,
+		Consistency: consistency,
+		Required:    required,
+	}, nil
+}
+
+// putChunk stores a chunk on its target nodes, skipping those that already
+// hold it, and returns the nodes that hold it afterwards
+func (m *Manager) putChunk(ctx context.Context, chunk Chunk, data []byte, consistency Consistency) ([]string, error) {
+	m.mu.RLock()
+	targetNodes := m.hashRing.GetNodes(chunk.ID, m.replication)
+	available := m.writeTargets(targetNodes)
+	m.mu.RUnlock()
+
+	var holders, missing []string
+	for _, target := range available {
+		if target.node.Exists(chunk.ID) {
+			holders = append(holders, target.nodeID)
+		}
+	}
 	for _, nodeID := range targetNodes {
+		if !slices.Contains(holders, nodeID) {
+			missing = append(missing, nodeID)
+		}
+	}
+
+	if len(missing) > 0 {
+		m.mu.RLock()
+		writeNodes, standIns := m.handoffNodes(chunk.ID, missing)
+		targets := m.writeTargets(writeNodes)
+		m.mu.RUnlock()
+
+		streams, _, _, err := m.fanOut(ctx, bytes.NewReader(data), targets)
+		if err == nil {
+			var written []string
+			written, err = m.commitStreams(ctx, chunk.ID, streams)
+			m.recordHints(chunk.ID, written, standIns)
+			holders = append(holders, written...)
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if err != nil && len(holders) == 0 {
+			return nil, err
+		}
+		if err != nil {
+			m.logger.Error("failed to store chunk on missing nodes", "chunk_id", chunk.ID, "nodes", missing, "error", err)
+		}
+	}
+
+	if err := m.checkQuorum(chunk.ID, consistency, targetNodes, holders); err != nil {
+		return nil, err
+	}
+	return holders, nil
+}
+
+// checkQuorum returns a *QuorumError if a write reached fewer replicas than
+// its consistency level requires. If the quorum was met but some targets
+// were not written, the object is handed off to background repair.
+func (m *Manager) checkQuorum(objectID string, consistency Consistency, targetNodes, replicatedNodes []string) error {
+	required := consistency.Required(m.replication)
+	if len(replicatedNodes) < required {
+		m.logger.Warn("write quorum not met",
+			"consistency", consistency,
+			"required", required,
+			"written", len(replicatedNodes),
+			"nodes", replicatedNodes)
+		return &QuorumError{
+			Consistency: consistency,
+			Required:    required,
+			Written:     replicatedNodes,
+		}
+	}
+
+	if len(replicatedNodes) < len(targetNodes) {
+		m.logger.Warn("write quorum met with missing replicas, scheduling repair",
+			"object_id", objectID,
+			"written", replicatedNodes,
+			"targets", targetNodes)
+		m.ScheduleRepair(objectID)
+	}
+	return nil
+}
+
+// streamChunkSize is the size of the buffers used to fan data out to nodes
+const streamChunkSize = 256 << 10
+
+// writeTarget is a node a write streams to. Targets are looked up under the
+// lock, so the data can be streamed without holding it.
+type writeTarget struct {
+	nodeID string
+	node   Backend
+}
+
+// writeTargets looks up the nodes a write goes to, leaving out those that
+// are unknown or down. The caller must hold the lock.
+func (m *Manager) writeTargets(nodeIDs []string) []writeTarget {
+	targets := make([]writeTarget, 0, len(nodeIDs))
+	for _, nodeID := range nodeIDs {
 		node, exists := m.nodes[nodeID]
 		if !exists {
 			m.logger.Warn("node not found in manager", "node_id", nodeID)
 			continue
 		}
+		if m.nodeDown(nodeID) {
+			m.logger.Warn("skipping down node for write", "node_id", nodeID)
+			continue
+		}
+		targets = append(targets, writeTarget{nodeID: nodeID, node: node})
+	}
+	return targets
+}
+
+// replicaStream is one node's share of a fan-out write
+type replicaStream struct {
+	nodeID  string
+	pending PendingWrite
+	chunks  chan []byte
+	done    chan error
+	dropped bool
+}
+
+// fanOut copies data to pending objects on the given targets concurrently
+// while hashing it, and returns the ID and size of the data. Each node is fed
+// by its own goroutine through a small buffered channel, so a slow node only
+// holds a few chunks in memory. A node that does not accept a chunk or
+// finish its write within the node timeout is dropped as a straggler, and so
+// is a node that fails; fanOut only returns an error if none of them
+// succeeded, or if ctx is canceled.
+func (m *Manager) fanOut(ctx context.Context, data io.Reader, targets []writeTarget) ([]*replicaStream, string, int64, error) {
+	streams := make([]*replicaStream, 0, len(targets))
+	for _, target := range targets {
+		pending, err := target.node.CreatePending()
+		if err != nil {
+			m.logger.Error("failed to store object on node", "node_id", target.nodeID, "error", err)
+			continue
+		}
+
+		stream := &replicaStream{
+			nodeID:  target.nodeID,
+			pending: pending,
+			chunks:  make(chan []byte, 4),
+			done:    make(chan error, 1),
+		}
+		go stream.run()
+		streams = append(streams, stream)
+	}
+
+	if len(streams) == 0 {
+		return nil, "", 0, fmt.Errorf("failed to store object on any node")
+	}
+
+	hasher := sha256.New()
+	var size int64
+	var readErr error
+	for {
+		// Every chunk gets a fresh buffer since it is shared by all streams
+		buf := make([]byte, streamChunkSize)
+		n, err := io.ReadFull(data, buf)
+		if n > 0 {
+			hasher.Write(buf[:n])
+			size += int64(n)
+			for _, stream := range streams {
+				if stream.dropped {
+					continue
+				}
+				if err := m.sendChunk(ctx, stream, buf[:n]); err != nil {
+					if ctx.Err() != nil {
+						for _, stream := range streams {
+							if !stream.dropped {
+								stream.drop()
+							}
+						}
+						return nil, "", 0, ctx.Err()
+					}
+					m.logger.Warn("dropping slow node from write", "node_id", stream.nodeID, "error", err)
+					stream.drop()
+				}
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			readErr = err
+			break
+		}
+	}
 
-		// Create a new reader from the bytes for each node
-		reader := io.NopCloser(io.NewSectionReader(
-			&byteReader{data: dataBytes}, 0, int64(len(dataBytes)),
-		))
+	for _, stream := range streams {
+		if !stream.dropped {
+			close(stream.chunks)
+		}
+	}
 
-		if err := node.Store(objectID, reader); err != nil {
-			m.logger.Error("failed to store object on node", "node_id", nodeID, "error", err)
+	written := make([]*replicaStream, 0, len(streams))
+	var lastErr error
+	for i, stream := range streams {
+		if stream.dropped {
+			lastErr = ErrNodeTimeout
+			continue
+		}
+
+		err := m.awaitStream(ctx, stream)
+		if ctx.Err() != nil {
+			for _, stream := range written {
+				stream.pending.Abort()
+			}
+			for _, stream := range streams[i:] {
+				if !stream.dropped {
+					go stream.abortWhenDone()
+				}
+			}
+			return nil, "", 0, ctx.Err()
+		}
+		if err == nil {
+			err = readErr
+		}
+		if err != nil {
+			if err == ErrNodeTimeout {
+				stream.dropped = true
+				go stream.abortWhenDone()
+			} else {
+				stream.pending.Abort()
+			}
+			if err != readErr {
+				m.logger.Error("failed to store object on node", "node_id", stream.nodeID, "error", err)
+			}
 			lastErr = err
 			continue
 		}
+		written = append(written, stream)
+	}
 
-		replicatedNodes = append(replicatedNodes, nodeID)
-		m.logger.Info("stored object on node", "object_id", objectID, "node_id", nodeID)
+	if readErr != nil {
+		return nil, "", 0, fmt.Errorf("failed to read object data: %w", readErr)
 	}
+	if len(written) == 0 {
+		return nil, "", 0, fmt.Errorf("failed to store object on any node: %w", lastErr)
+	}
+
+	return written, hex.EncodeToString(hasher.Sum(nil)), size, nil
+}
 
+// sendChunk hands a chunk to a stream, giving up after the node timeout
+func (m *Manager) sendChunk(ctx context.Context, stream *replicaStream, chunk []byte) error {
+	timeout, stop := m.nodeTimer()
+	defer stop()
+
+	select {
+	case stream.chunks <- chunk:
+		return nil
+	case <-timeout:
+		return ErrNodeTimeout
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// awaitStream waits for a stream to finish writing, giving up after the node timeout
+func (m *Manager) awaitStream(ctx context.Context, stream *replicaStream) error {
+	timeout, stop := m.nodeTimer()
+	defer stop()
+
+	select {
+	case err := <-stream.done:
+		return err
+	case <-timeout:
+		return ErrNodeTimeout
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// nodeTimer returns a channel that fires after the node timeout, or never if
+// no timeout is set, and a function that releases the timer. Writes stream
+// without holding the lock, so it takes the lock to read the timeout.
+func (m *Manager) nodeTimer() (<-chan time.Time, func()) {
+	m.mu.RLock()
+	nodeTimeout := m.nodeTimeout
+	m.mu.RUnlock()
+
+	if nodeTimeout <= 0 {
+		return nil, func() {}
+	}
+	timer := time.NewTimer(nodeTimeout)
+	return timer.C, func() { timer.Stop() }
+}
+
+// run writes the chunks it receives to the pending object. After a write
+// error it keeps draining the channel so the producer never blocks on it.
+func (s *replicaStream) run() {
+	var err error
+	for chunk := range s.chunks {
+		if err != nil {
+			continue
+		}
+		_, err = s.pending.Write(chunk)
+	}
+	s.done <- err
+}
+
+// drop stops feeding a stream that is being abandoned. Its write may still be
+// blocked on the node, so the pending object is aborted once it returns.
+func (s *replicaStream) drop() {
+	s.dropped = true
+	close(s.chunks)
+	go s.abortWhenDone()
+}
+
+// abortWhenDone waits for the stream's writer to exit and discards its pending object
+func (s *replicaStream) abortWhenDone() {
+	<-s.done
+	s.pending.Abort()
+}
+
+// commitStreams commits the pending objects of successful streams under
+// objectID in parallel. A node whose commit does not finish within the node
+// timeout is left out of the result; its commit may still complete later.
+func (m *Manager) commitStreams(ctx context.Context, objectID string, streams []*replicaStream) ([]string, error) {
+	results := make([]chan error, len(streams))
+	for i, stream := range streams {
+		results[i] = make(chan error, 1)
+		go func(stream *replicaStream, result chan<- error) {
+			result <- stream.pending.Commit(objectID)
+		}(stream, results[i])
+	}
+
+	replicatedNodes := make([]string, 0, len(streams))
+	var lastErr error
+	for i, stream := range streams {
+		timeout, stop := m.nodeTimer()
+		var err error
+		select {
+		case err = <-results[i]:
+		case <-timeout:
+			err = ErrNodeTimeout
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+		stop()
+
+		if err != nil {
+			m.logger.Error("failed to store object on node", "node_id", stream.nodeID, "error", err)
+			lastErr = err
+			continue
+		}
+
+		replicatedNodes = append(replicatedNodes, stream.nodeID)
+		m.logger.Info("stored object on node", "object_id", objectID, "node_id", stream.nodeID)
+	}
+
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
 	if len(replicatedNodes) == 0 {
+		if lastErr == nil {
+			return nil, fmt.Errorf("no target nodes available for object: %s", objectID)
+		}
 		return nil, fmt.Errorf("failed to store object on any node: %w", lastErr)
 	}
 
 	return replicatedNodes, nil
 }
 
-// RetrieveObject retrieves an object from any available replica
+// RetrieveObject retrieves an object from any available replica. The nodes
+// the ring assigns to the object are tried first, followed by every other
+// node, so objects that have not been rebalanced after a ring change are
+// still found on their old owners.
+//
+// The returned reader verifies the content against the object ID as it
+// streams: if a replica is corrupt, reading it to the end fails with
+// ErrChecksumMismatch and the replica is quarantined and scheduled for
+// re-replication, so the next read fails over to another replica.
 func (m *Manager) RetrieveObject(objectID string) (io.ReadCloser, error) {
 	m.mu.RLock()
 	defer m.mu.RUnlock()
 
-	// Get nodes that should have this object
-	targetNodes := m.hashRing.GetNodes(objectID, m.replication)
-
 	// Try each node until we find one with the object
-	for _, nodeID := range targetNodes {
-		node, exists := m.nodes[nodeID]
+	for _, nodeID := range m.sourceNodes(objectID) {
+		node, exists := m.availableNode(nodeID)
 		if !exists {
 			continue
 		}
@@ -116,40 +863,301 @@ func (m *Manager) RetrieveObject(objectID string) (io.ReadCloser, error) {
 		reader, err := node.Retrieve(objectID)
 		if err == nil {
 			m.logger.Info("retrieved object from node", "object_id", objectID, "node_id", nodeID)
-			return reader, nil
+			return newVerifyingReader(reader, objectID, func() {
+				m.quarantineReplica(nodeID, node, objectID)
+			}), nil
 		}
 	}
 
 	return nil, fmt.Errorf("object not found on any available node: %s", objectID)
 }
 
-// ReplicateObject replicates an object to a specific node (for self-healing)
-func (m *Manager) ReplicateObject(objectID string, targetNodeID string) error {
+// OpenObject opens an object for random access on the first available
+// replica, trying nodes in the same order as RetrieveObject. Reading it from
+// start to end verifies the content; a corrupt replica is quarantined and
+// scheduled for re-replication.
+func (m *Manager) OpenObject(objectID string) (*ObjectReader, error) {
+	file, onMismatch, err := m.openReplica(objectID)
+	if err != nil {
+		return nil, err
+	}
+
+	return newObjectReader(file, objectID, onMismatch), nil
+}
+
+// OpenChunks opens an object stored as chunks for random access. Each chunk
+// is read from its first available replica once the read reaches it, and is
+// verified like a whole object in OpenObject when it is read from start to
+// end. An erasure-coded chunk is decoded from its shards, rebuilding lost
+// data shards from parity. It fails up front if any chunk has no replica,
+// or too few shards, left.
+func (m *Manager) OpenChunks(objectID string, chunks []Chunk) (*ObjectReader, error) {
 	m.mu.RLock()
 	defer m.mu.RUnlock()
 
-	// First, find the object on any existing node
-	sourceReader, err := m.RetrieveObject(objectID)
+	for _, chunk := range chunks {
+		if chunk.ErasureCoded() {
+			if shards := m.countShards(chunk); shards < chunk.DataShards {
+				return nil, fmt.Errorf("chunk %s of object %s has %d of %d shards needed", chunk.ID, objectID, shards, chunk.DataShards)
+			}
+		} else if !m.hasReplica(chunk.ID) {
+			return nil, fmt.Errorf("chunk %s of object %s not found on any available node", chunk.ID, objectID)
+		}
+	}
+
+	return newChunkedReader(chunks, m.openChunk), nil
+}
+
+// openChunk opens the content of a chunk for reading
+func (m *Manager) openChunk(chunk Chunk) (io.ReadSeekCloser, func(), error) {
+	if !chunk.ErasureCoded() {
+		file, onMismatch, err := m.openReplica(chunk.ID)
+		if err != nil {
+			return nil, nil, err
+		}
+		return file, onMismatch, nil
+	}
+
+	data, err := m.readErasureChunk(chunk)
 	if err != nil {
-		return fmt.Errorf("failed to retrieve object for replication: %w", err)
+		return nil, nil, err
+	}
+	return nopCloser{bytes.NewReader(data)}, nil, nil
+}
+
+// nopCloser adds a Close method that does nothing to an in-memory reader
+type nopCloser struct {
+	io.ReadSeeker
+}
+
+func (nopCloser) Close() error {
+	return nil
+}
+
+// openReplica opens the first available replica of an object and returns
+// a function that quarantines it
+func (m *Manager) openReplica(objectID string) (Object, func(), error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	for _, nodeID := range m.sourceNodes(objectID) {
+		node, exists := m.availableNode(nodeID)
+		if !exists || !node.Exists(objectID) {
+			continue
+		}
+
+		file, err := node.Retrieve(objectID)
+		if err != nil {
+			continue
+		}
+
+		m.logger.Info("opened object on node", "object_id", objectID, "node_id", nodeID)
+		return file, func() { m.quarantineReplica(nodeID, node, objectID) }, nil
+	}
+
+	return nil, nil, fmt.Errorf("object not found on any available node: %s", objectID)
+}
+
+// countShards returns how many shards of an erasure-coded chunk are stored
+func (m *Manager) countShards(chunk Chunk) int {
+	count := 0
+	for i := 0; i < chunk.DataShards+chunk.ParityShards; i++ {
+		if m.hasReplica(ShardID(chunk.ID, chunk.DataShards, chunk.ParityShards, i)) {
+			count++
+		}
+	}
+	return count
+}
+
+// hasReplica reports whether any node holds a replica of an object
+func (m *Manager) hasReplica(objectID string) bool {
+	for nodeID, node := range m.nodes {
+		if !m.nodeDown(nodeID) && node.Exists(objectID) {
+			return true
+		}
 	}
-	defer sourceReader.Close()
+	return false
+}
 
-	// Get the target node
+// ReplicateObject replicates an object to a specific node (for self-healing).
+// The copy is verified against the object ID before it is committed; a
+// corrupt source replica is quarantined and the next one is tried. The
+// nodes are looked up under the lock, which is released during the copy.
+func (m *Manager) ReplicateObject(objectID string, targetNodeID string) error {
+	m.mu.RLock()
 	targetNode, exists := m.nodes[targetNodeID]
+	sources := m.availableSources(objectID)
+	m.mu.RUnlock()
+
 	if !exists {
 		return fmt.Errorf("target node not found: %s", targetNodeID)
 	}
+	if m.nodeDown(targetNodeID) {
+		return fmt.Errorf("target node is down: %s", targetNodeID)
+	}
+
+	lastErr := fmt.Errorf("object not found on any available node: %s", objectID)
+	for _, source := range sources {
+		if source.nodeID == targetNodeID || !source.node.Exists(objectID) {
+			continue
+		}
+
+		if err := m.copyReplica(objectID, source.nodeID, source.node, targetNode); err != nil {
+			m.logger.Warn("failed to copy replica", "object_id", objectID, "source_node", source.nodeID, "error", err)
+			lastErr = err
+			continue
+		}
+
+		m.logger.Info("replicated object to node", "object_id", objectID, "node_id", targetNodeID)
+		return nil
+	}
 
-	// Store on target node
-	if err := targetNode.Store(objectID, sourceReader); err != nil {
+	return fmt.Errorf("failed to retrieve object for replication: %w", lastErr)
+}
+
+// sourceNodes returns every node ID in the order replicas of an object should
+// be read from: the ring's targets first, then all other nodes, since copies
+// can still sit on nodes that no longer own the object
+func (m *Manager) sourceNodes(objectID string) []string {
+	nodeIDs := m.targetNodes(objectID)
+	seen := make(map[string]bool, len(nodeIDs))
+	for _, nodeID := range nodeIDs {
+		seen[nodeID] = true
+	}
+
+	others := make([]string, 0, len(m.nodes))
+	for nodeID := range m.nodes {
+		if !seen[nodeID] {
+			others = append(others, nodeID)
+		}
+	}
+	sort.Strings(others)
+
+	return append(nodeIDs, others...)
+}
+
+// sourceNode is a node an object or shard can be read from. Sources are
+// looked up under the lock, so the data can be copied without holding it.
+type sourceNode struct {
+	nodeID string
+	node   Backend
+}
+
+// availableSources returns the nodes that are up in the order sourceNodes
+// gives. The caller must hold the lock.
+func (m *Manager) availableSources(objectID string) []sourceNode {
+	var sources []sourceNode
+	for _, nodeID := range m.sourceNodes(objectID) {
+		if node, exists := m.availableNode(nodeID); exists {
+			sources = append(sources, sourceNode{nodeID: nodeID, node: node})
+		}
+	}
+	return sources
+}
+
+// copyReplica copies an object or shard from source to target, committing it
+// only if the copied content matches its ID
+func (m *Manager) copyReplica(objectID, sourceID string, source, target Backend) error {
+	reader, err := source.Retrieve(objectID)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	pending, err := target.CreatePending()
+	if err != nil {
+		return err
+	}
+
+	verifier := newContentVerifier(objectID)
+	_, err = io.Copy(io.MultiWriter(pending, verifier), reader)
+	if err != nil && !errors.Is(err, ErrChecksumMismatch) {
+		pending.Abort()
+		return fmt.Errorf("failed to copy object data: %w", err)
+	}
+
+	if err != nil || !verifier.valid() {
+		pending.Abort()
+		m.quarantineReplica(sourceID, source, objectID)
+		return ErrChecksumMismatch
+	}
+
+	if err := pending.Commit(objectID); err != nil {
 		return fmt.Errorf("failed to replicate object to node: %w", err)
 	}
 
-	m.logger.Info("replicated object to node", "object_id", objectID, "node_id", targetNodeID)
 	return nil
 }
 
+// QuarantineReplica moves a corrupt replica of an object aside on the given
+// node. Unlike the quarantine performed during reads it does not schedule a
+// repair, so callers that restore replicas themselves do not repair twice.
+func (m *Manager) QuarantineReplica(nodeID string, objectID string) error {
+	m.mu.RLock()
+	node, exists := m.nodes[nodeID]
+	m.mu.RUnlock()
+	if !exists {
+		return fmt.Errorf("node not found: %s", nodeID)
+	}
+
+	m.logger.Error("replica failed checksum verification", "object_id", objectID, "node_id", nodeID)
+	if err := node.Quarantine(objectID); err != nil {
+		return err
+	}
+
+	m.logger.Warn("quarantined corrupt replica", "object_id", objectID, "node_id", nodeID)
+	return nil
+}
+
+// quarantineReplica moves a corrupt replica aside and schedules the object for re-replication
+func (m *Manager) quarantineReplica(nodeID string, node Backend, objectID string) {
+	m.logger.Error("replica failed checksum verification", "object_id", objectID, "node_id", nodeID)
+
+	if err := node.Quarantine(objectID); err != nil {
+		m.logger.Error("failed to quarantine replica", "object_id", objectID, "node_id", nodeID, "error", err)
+	} else {
+		m.logger.Warn("quarantined corrupt replica", "object_id", objectID, "node_id", nodeID)
+	}
+
+	m.ScheduleRepair(objectID)
+}
+
+// DeleteObject removes an object from every node that holds a replica and
+// returns the nodes it was removed from. It keeps going when a node fails, so
+// as many copies as possible are removed; the error reports the last failure.
+func (m *Manager) DeleteObject(objectID string) ([]string, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	deletedNodes := make([]string, 0, m.replication)
+	var lastErr error
+	for nodeID, node := range m.nodes {
+		if m.nodeDown(nodeID) {
+			m.logger.Warn("skipping down node for delete", "object_id", objectID, "node_id", nodeID)
+			continue
+		}
+		if !node.Exists(objectID) {
+			continue
+		}
+
+		if err := node.Delete(objectID); err != nil {
+			m.logger.Error("failed to delete object from node", "object_id", objectID, "node_id", nodeID, "error", err)
+			lastErr = err
+			continue
+		}
+
+		deletedNodes = append(deletedNodes, nodeID)
+		m.logger.Info("deleted object from node", "object_id", objectID, "node_id", nodeID)
+	}
+	sort.Strings(deletedNodes)
+
+	if lastErr != nil {
+		return deletedNodes, fmt.Errorf("failed to delete object from all nodes: %w", lastErr)
+	}
+
+	return deletedNodes, nil
+}
+
 // CheckReplicas checks which nodes have replicas of an object
 func (m *Manager) CheckReplicas(objectID string) []string {
 	m.mu.RLock()
@@ -157,7 +1165,7 @@ func (m *Manager) CheckReplicas(objectID string) []string {
 
 	availableNodes := make([]string, 0)
 	for nodeID, node := range m.nodes {
-		if node.Exists(objectID) {
+		if !m.nodeDown(nodeID) && node.Exists(objectID) {
 			availableNodes = append(availableNodes, nodeID)
 		}
 	}
@@ -165,10 +1173,84 @@ func (m *Manager) CheckReplicas(objectID string) []string {
 	return availableNodes
 }
 
-// GetTargetNodes returns the nodes that should store an object according to the hash ring
+// CheckChunkReplicas returns the nodes holding the least replicated of the
+// given chunks, which is how many node failures the whole object survives.
+// For an erasure-coded chunk these are the nodes holding one of its shards.
+func (m *Manager) CheckChunkReplicas(chunks []Chunk) []string {
+	var replicas []string
+	for i, chunk := range chunks {
+		var holders []string
+		if chunk.ErasureCoded() {
+			m.mu.RLock()
+			holders = m.shardHolders(chunk)
+			m.mu.RUnlock()
+		} else {
+			holders = m.CheckReplicas(chunk.ID)
+		}
+		if i == 0 || len(holders) < len(replicas) {
+			replicas = holders
+		}
+	}
+	return replicas
+}
+
+// DeleteChunk removes a chunk, or every shard of an erasure-coded chunk,
+// from all nodes and returns the nodes it was removed from
+func (m *Manager) DeleteChunk(chunk Chunk) ([]string, error) {
+	if !chunk.ErasureCoded() {
+		return m.DeleteObject(chunk.ID)
+	}
+
+	var deletedNodes []string
+	var lastErr error
+	for i := 0; i < chunk.DataShards+chunk.ParityShards; i++ {
+		nodeIDs, err := m.DeleteObject(ShardID(chunk.ID, chunk.DataShards, chunk.ParityShards, i))
+		if err != nil {
+			lastErr = err
+		}
+		deletedNodes = append(deletedNodes, nodeIDs...)
+	}
+	return uniqueSorted(deletedNodes), lastErr
+}
+
+// NodeIDs returns the IDs of all nodes known to the manager in sorted order
+func (m *Manager) NodeIDs() []string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	nodeIDs := make([]string, 0, len(m.nodes))
+	for nodeID := range m.nodes {
+		nodeIDs = append(nodeIDs, nodeID)
+	}
+	sort.Strings(nodeIDs)
+	return nodeIDs
+}
+
+// Node returns the backend of the storage node with the given ID
+func (m *Manager) Node(nodeID string) (Backend, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	node, exists := m.nodes[nodeID]
+	return node, exists
+}
+
+// GetTargetNodes returns the nodes that should store an object according to
+// the hash ring. A shard of an erasure-coded chunk has a single target, the
+// node its index picks among the chunk's nodes.
 func (m *Manager) GetTargetNodes(objectID string) []string {
 	m.mu.RLock()
 	defer m.mu.RUnlock()
+	return m.targetNodes(objectID)
+}
+
+// targetNodes returns the placement of an object or shard
+func (m *Manager) targetNodes(objectID string) []string {
+	if chunkID, dataShards, parityShards, index, ok := ParseShardID(objectID); ok {
+		if targets := m.shardTargets(chunkID, dataShards+parityShards); len(targets) > 0 {
+			return targets[index : index+1]
+		}
+		return nil
+	}
 	return m.hashRing.GetNodes(objectID, m.replication)
 }
 
@@ -178,21 +1260,16 @@ func GenerateObjectID(data []byte) string {
 	return hex.EncodeToString(hash[:])
 }
 
-// byteReader implements io.ReaderAt for byte slices
-type byteReader struct {
-	data []byte
-}
-
-func (br *byteReader) ReadAt(p []byte, off int64) (n int, err error) {
-	if off < 0 {
-		return 0, fmt.Errorf("negative offset")
+// IsValidObjectID reports whether id has the form of an object ID: a
+// lowercase hex-encoded SHA-256 hash
+func IsValidObjectID(id string) bool {
+	if len(id) != sha256.Size*2 {
+		return false
 	}
-	if off >= int64(len(br.data)) {
-		return 0, io.EOF
-	}
-	n = copy(p, br.data[off:])
-	if n < len(p) {
-		err = io.EOF
+	for _, c := range id {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
 	}
-	return n, err
+	return true
 }
@@ -1,10 +1,16 @@
 package storage
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"io"
+	"math/rand"
 	"os"
+	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/caskos/caskos/internal/hashring"
 	"log/slog"
@@ -37,7 +43,7 @@ func TestManager_StoreAndRetrieve(t *testing.T) {
 
 	// Store object
 	reader := strings.NewReader(testData)
-	replicatedNodes, err := manager.StoreObject(objectID, reader, int64(len(testData)))
+	replicatedNodes, err := manager.StoreObject(context.Background(), objectID, reader, int64(len(testData)))
 	if err != nil {
 		t.Fatalf("failed to store object: %v", err)
 	}
@@ -109,7 +115,7 @@ func TestManager_CheckReplicas(t *testing.T) {
 	objectID := GenerateObjectID([]byte(testData))
 
 	reader := strings.NewReader(testData)
-	_, err := manager.StoreObject(objectID, reader, int64(len(testData)))
+	_, err := manager.StoreObject(context.Background(), objectID, reader, int64(len(testData)))
 	if err != nil {
 		t.Fatalf("failed to store object: %v", err)
 	}
@@ -120,3 +126,524 @@ func TestManager_CheckReplicas(t *testing.T) {
 	}
 }
 
+func TestManager_StoreObjectVerifiesContent(t *testing.T) {
+	manager, _, memory := newMemoryCluster(3)
+	ctx := context.Background()
+
+	testData := "content that must match its ID"
+	objectID := GenerateObjectID([]byte(testData))
+
+	if _, err := manager.StoreObject(ctx, objectID, strings.NewReader("something else"), -1); !errors.Is(err, ErrChecksumMismatch) {
+		t.Errorf("expected ErrChecksumMismatch for other content, got %v", err)
+	}
+	if _, err := manager.StoreObject(ctx, objectID, strings.NewReader(testData), int64(len(testData))+1); err == nil {
+		t.Error("expected an error for a size that does not match")
+	}
+	for nodeID, node := range memory {
+		if node.Exists(objectID) {
+			t.Errorf("expected nothing stored on %s", nodeID)
+		}
+	}
+
+	// A negative size is not checked
+	if _, err := manager.StoreObject(ctx, objectID, strings.NewReader(testData), -1); err != nil {
+		t.Errorf("failed to store object of unknown size: %v", err)
+	}
+}
+
+
+func TestManager_PutObject(t *testing.T) {
+	tmpDir, _ := os.MkdirTemp("", "storage-put")
+	defer os.RemoveAll(tmpDir)
+
+	ring := hashring.NewHashRing(3)
+	logger := slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelError}))
+	manager := NewManager(ring, 2, logger)
+
+	nodes := make([]*Node, 0, 3)
+	for _, nodeID := range []string{"node1", "node2", "node3"} {
+		node, _ := NewNode(nodeID, filepath.Join(tmpDir, nodeID))
+		ring.AddNode(nodeID)
+		manager.AddNode(nodeID, node)
+		nodes = append(nodes, node)
+	}
+
+	// Random data split into several chunks, each larger than a single
+	// fan-out buffer so it spans several writes
+	manager.SetChunkSize(256 << 10)
+	testData := randomData(2 << 20)
+
+	result, err := manager.PutObject(context.Background(), bytes.NewReader(testData), "", "")
+	if err != nil {
+		t.Fatalf("failed to put object: %v", err)
+	}
+
+	if result.ObjectID != GenerateObjectID(testData) {
+		t.Errorf("expected content hash as object ID, got %s", result.ObjectID)
+	}
+	if result.Size != int64(len(testData)) {
+		t.Errorf("size mismatch: expected %d, got %d", len(testData), result.Size)
+	}
+	if len(result.Replicas) != 2 {
+		t.Errorf("expected 2 replicas, got %v", result.Replicas)
+	}
+	if len(result.Chunks) < 2 {
+		t.Fatalf("expected several chunks, got %d", len(result.Chunks))
+	}
+
+	// Chunks must be on the nodes the ring assigns to them
+	for _, chunk := range result.Chunks {
+		for _, nodeID := range manager.GetTargetNodes(chunk.ID) {
+			if !manager.nodes[nodeID].Exists(chunk.ID) {
+				t.Errorf("expected chunk %s on target node %s", chunk.ID, nodeID)
+			}
+		}
+	}
+
+	// No staged copies should be left behind
+	for _, node := range nodes {
+		entries, _ := os.ReadDir(filepath.Join(node.BasePath, pendingDir))
+		if len(entries) != 0 {
+			t.Errorf("expected no pending files on %s, found %d", node.ID, len(entries))
+		}
+	}
+
+	reader, err := manager.OpenChunks(result.ObjectID, result.Chunks)
+	if err != nil {
+		t.Fatalf("failed to open object: %v", err)
+	}
+	defer reader.Close()
+
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatalf("failed to read object: %v", err)
+	}
+	if !bytes.Equal(data, testData) {
+		t.Error("retrieved data does not match stored data")
+	}
+
+	// A range spanning a chunk boundary is read from both chunks
+	boundary := result.Chunks[0].Size
+	reader.Seek(boundary-10, io.SeekStart)
+	part := make([]byte, 20)
+	if _, err := io.ReadFull(reader, part); err != nil || !bytes.Equal(part, testData[boundary-10:boundary+10]) {
+		t.Errorf("range across chunks does not match (%v)", err)
+	}
+}
+
+func TestManager_PutObjectDeduplicatesChunks(t *testing.T) {
+	tmpDir, _ := os.MkdirTemp("", "storage-dedup")
+	defer os.RemoveAll(tmpDir)
+
+	ring := hashring.NewHashRing(3)
+	logger := slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelError}))
+	manager := NewManager(ring, 1, logger)
+	manager.SetChunkSize(64 << 10)
+
+	node, _ := NewNode("node1", filepath.Join(tmpDir, "node1"))
+	ring.AddNode("node1")
+	manager.AddNode("node1", node)
+
+	original := randomData(1 << 20)
+	first, err := manager.PutObject(context.Background(), bytes.NewReader(original), "", "")
+	if err != nil {
+		t.Fatalf("failed to put object: %v", err)
+	}
+
+	// Insert a few bytes in the middle, as an edited file would
+	edited := append(append(append([]byte{}, original[:500000]...), "inserted"...), original[500000:]...)
+	second, err := manager.PutObject(context.Background(), bytes.NewReader(edited), "", "")
+	if err != nil {
+		t.Fatalf("failed to put edited object: %v", err)
+	}
+
+	known := make(map[string]bool)
+	for _, chunk := range first.Chunks {
+		known[chunk.ID] = true
+	}
+	var shared int64
+	for _, chunk := range second.Chunks {
+		if known[chunk.ID] {
+			shared += chunk.Size
+		}
+	}
+	if shared < int64(len(original))*3/4 {
+		t.Errorf("expected most of the edited object to reuse chunks, shared %d of %d bytes", shared, len(edited))
+	}
+
+	// Shared chunks are stored once
+	unique := make(map[string]bool)
+	for _, chunk := range append(first.Chunks, second.Chunks...) {
+		unique[chunk.ID] = true
+	}
+	stored := 0
+	node.List("", func(string) error {
+		stored++
+		return nil
+	})
+	if stored != len(unique) {
+		t.Errorf("expected %d chunk files, found %d", len(unique), stored)
+	}
+}
+
+// randomData returns reproducible data that does not repeat
+func randomData(size int) []byte {
+	data := make([]byte, size)
+	rand.New(rand.NewSource(1)).Read(data)
+	return data
+}
+
+func TestManager_CorruptReplicaIsQuarantined(t *testing.T) {
+	tmpDir, _ := os.MkdirTemp("", "storage-verify")
+	defer os.RemoveAll(tmpDir)
+
+	ring := hashring.NewHashRing(3)
+	logger := slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelError}))
+	manager := NewManager(ring, 2, logger)
+
+	for _, nodeID := range []string{"node1", "node2"} {
+		node, _ := NewNode(nodeID, filepath.Join(tmpDir, nodeID))
+		ring.AddNode(nodeID)
+		manager.AddNode(nodeID, node)
+	}
+
+	repairs := make(chan string, 1)
+	manager.SetRepairHandler(func(objectID string) {
+		repairs <- objectID
+	})
+
+	testData := "data that will rot on disk"
+	objectID := GenerateObjectID([]byte(testData))
+	if _, err := manager.StoreObject(context.Background(), objectID, strings.NewReader(testData), int64(len(testData))); err != nil {
+		t.Fatalf("failed to store object: %v", err)
+	}
+
+	// Flip the content of the replica that is read first
+	badNode := manager.nodes[manager.GetTargetNodes(objectID)[0]].(*Node)
+	if err := os.WriteFile(objectFile(badNode, objectID), []byte("data that has rotted on disk"), 0644); err != nil {
+		t.Fatalf("failed to corrupt replica: %v", err)
+	}
+
+	reader, err := manager.RetrieveObject(objectID)
+	if err != nil {
+		t.Fatalf("failed to retrieve object: %v", err)
+	}
+	_, err = io.ReadAll(reader)
+	reader.Close()
+	if err != ErrChecksumMismatch {
+		t.Fatalf("expected checksum mismatch, got %v", err)
+	}
+
+	if badNode.Exists(objectID) {
+		t.Error("expected corrupt replica to be removed from the object tree")
+	}
+	entries, _ := os.ReadDir(filepath.Join(badNode.BasePath, quarantineDir))
+	if len(entries) != 1 {
+		t.Errorf("expected 1 quarantined file, found %d", len(entries))
+	}
+
+	if repaired := <-repairs; repaired != objectID {
+		t.Errorf("expected repair of %s, got %s", objectID, repaired)
+	}
+
+	// The next read fails over to the healthy replica
+	reader, err = manager.RetrieveObject(objectID)
+	if err != nil {
+		t.Fatalf("failed to retrieve object after quarantine: %v", err)
+	}
+	defer reader.Close()
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatalf("failed to read healthy replica: %v", err)
+	}
+	if string(data) != testData {
+		t.Errorf("data mismatch: expected %q, got %q", testData, string(data))
+	}
+
+	// Re-replication restores the quarantined copy
+	if err := manager.ReplicateObject(objectID, badNode.ID); err != nil {
+		t.Fatalf("failed to replicate object: %v", err)
+	}
+	if !badNode.Exists(objectID) {
+		t.Error("expected replica to be restored")
+	}
+}
+
+// blockingReader returns some data and then blocks until its channel is closed
+type blockingReader struct {
+	sent    bool
+	release chan struct{}
+}
+
+func (r *blockingReader) Read(p []byte) (int, error) {
+	if !r.sent {
+		r.sent = true
+		return copy(p, "partial upload"), nil
+	}
+	<-r.release
+	return 0, io.EOF
+}
+
+func TestManager_PutObjectCanceled(t *testing.T) {
+	tmpDir, _ := os.MkdirTemp("", "storage-cancel")
+	defer os.RemoveAll(tmpDir)
+
+	ring := hashring.NewHashRing(3)
+	logger := slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelError}))
+	manager := NewManager(ring, 2, logger)
+
+	nodes := make([]*Node, 0, 2)
+	for _, nodeID := range []string{"node1", "node2"} {
+		node, _ := NewNode(nodeID, filepath.Join(tmpDir, nodeID))
+		ring.AddNode(nodeID)
+		manager.AddNode(nodeID, node)
+		nodes = append(nodes, node)
+	}
+
+	// The reader stalls mid-upload until after the write was canceled, like
+	// a client that stopped sending
+	reader := &blockingReader{release: make(chan struct{})}
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		cancel()
+		close(reader.release)
+	}()
+
+	if _, err := manager.PutObject(ctx, reader, "", ""); err != context.Canceled {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+
+	// Staged data is discarded
+	deadline := time.Now().Add(5 * time.Second)
+	for _, node := range nodes {
+		for {
+			entries, _ := os.ReadDir(filepath.Join(node.BasePath, pendingDir))
+			if len(entries) == 0 {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("expected no pending files on %s, found %d", node.ID, len(entries))
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+}
+
+func TestManager_StreamingWriteDoesNotBlockMembership(t *testing.T) {
+	manager, _, _ := newMemoryCluster(3)
+
+	// Uploads stall mid-stream like slow clients
+	readers := []*blockingReader{{release: make(chan struct{})}, {release: make(chan struct{})}}
+	done := make(chan error, 2)
+	go func() {
+		_, err := manager.StoreObject(context.Background(), GenerateObjectID([]byte("partial upload")), readers[0], int64(len("partial upload")))
+		done <- err
+	}()
+	go func() {
+		_, err := manager.PutObject(context.Background(), readers[1], "", "")
+		done <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	added := make(chan struct{})
+	go func() {
+		manager.AddNode("node4", NewMemoryBackend())
+		close(added)
+	}()
+	select {
+	case <-added:
+	case <-time.After(time.Second):
+		t.Fatal("expected a node to be added while uploads are streaming")
+	}
+
+	for _, reader := range readers {
+		close(reader.release)
+	}
+	for range readers {
+		if err := <-done; err != nil {
+			t.Errorf("failed to finish upload: %v", err)
+		}
+	}
+}
+
+func TestManager_RepairDoesNotBlockMembership(t *testing.T) {
+	manager, faulty, memory := newMemoryCluster(3)
+
+	replicated, err := manager.PutObject(context.Background(), bytes.NewReader([]byte("replicated")), "", "")
+	if err != nil {
+		t.Fatalf("failed to store object: %v", err)
+	}
+	coded, err := manager.PutObject(context.Background(), bytes.NewReader([]byte("erasure coded")), "", ErasureCoding(2, 1))
+	if err != nil {
+		t.Fatalf("failed to store object: %v", err)
+	}
+	shardID := ShardID(coded.Chunks[0].ID, 2, 1, 0)
+
+	// Lost copies are restored onto a slow node
+	repairs := map[string]func() error{
+		replicated.ObjectID: func() error {
+			return manager.ReplicateObject(replicated.ObjectID, manager.GetTargetNodes(replicated.ObjectID)[0])
+		},
+		shardID: func() error {
+			_, err := manager.RepairShards(coded.Chunks[0].ID, 2, 1)
+			return err
+		},
+	}
+	for objectID, repair := range repairs {
+		target := manager.GetTargetNodes(objectID)[0]
+		memory[target].Delete(objectID)
+		faulty[target].SetDelay(200 * time.Millisecond)
+
+		done := make(chan error, 1)
+		go func() {
+			done <- repair()
+		}()
+		time.Sleep(50 * time.Millisecond)
+
+		added := make(chan struct{})
+		go func() {
+			manager.AddNode(target, faulty[target])
+			close(added)
+		}()
+		select {
+		case <-added:
+		case <-time.After(100 * time.Millisecond):
+			t.Errorf("expected a node to be added while %s is copied", objectID)
+		}
+
+		if err := <-done; err != nil {
+			t.Errorf("failed to restore %s: %v", objectID, err)
+		}
+		faulty[target].Heal()
+		if !memory[target].Exists(objectID) {
+			t.Errorf("expected %s to be restored", objectID)
+		}
+	}
+}
+
+func TestManager_SlowNodeIsDropped(t *testing.T) {
+	ring := hashring.NewHashRing(3)
+	logger := slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelError}))
+	manager := NewManager(ring, 2, logger)
+	manager.SetNodeTimeout(20 * time.Millisecond)
+
+	// A stream whose writer never reads stands in for a stalled disk
+	stream := &replicaStream{nodeID: "slow", chunks: make(chan []byte), done: make(chan error, 1)}
+	if err := manager.sendChunk(context.Background(), stream, []byte("chunk")); err != ErrNodeTimeout {
+		t.Errorf("expected ErrNodeTimeout sending to a stalled node, got %v", err)
+	}
+	if err := manager.awaitStream(context.Background(), stream); err != ErrNodeTimeout {
+		t.Errorf("expected ErrNodeTimeout waiting on a stalled node, got %v", err)
+	}
+}
+
+func TestManager_MissedReplicaIsRepaired(t *testing.T) {
+	tmpDir, _ := os.MkdirTemp("", "storage-straggler")
+	defer os.RemoveAll(tmpDir)
+
+	ring := hashring.NewHashRing(3)
+	logger := slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelError}))
+	manager := NewManager(ring, 2, logger)
+	manager.SetWriteConsistency(ConsistencyOne)
+
+	for _, nodeID := range []string{"node1", "node2"} {
+		node, _ := NewNode(nodeID, filepath.Join(tmpDir, nodeID))
+		ring.AddNode(nodeID)
+		manager.AddNode(nodeID, node)
+	}
+
+	repairs := make(chan string, 1)
+	manager.SetRepairHandler(func(objectID string) {
+		repairs <- objectID
+	})
+
+	// node2 cannot take writes
+	node2 := manager.nodes["node2"].(*Node)
+	os.RemoveAll(node2.BasePath)
+	os.WriteFile(node2.BasePath, []byte("not a directory"), 0644)
+
+	testData := "written while a node is down"
+	objectID := GenerateObjectID([]byte(testData))
+	replicas, err := manager.StoreObject(context.Background(), objectID, strings.NewReader(testData), int64(len(testData)))
+	if err != nil {
+		t.Fatalf("expected the write to meet consistency one, got %v", err)
+	}
+	if len(replicas) != 1 || replicas[0] != "node1" {
+		t.Errorf("expected a single replica on node1, got %v", replicas)
+	}
+
+	select {
+	case repaired := <-repairs:
+		if repaired != objectID {
+			t.Errorf("expected repair of %s, got %s", objectID, repaired)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("expected the missed replica to be handed off to repair")
+	}
+
+	// At the default quorum the same write fails
+	manager.SetWriteConsistency(ConsistencyQuorum)
+	_, err = manager.StoreObject(context.Background(), objectID, strings.NewReader(testData), int64(len(testData)))
+	var quorumErr *QuorumError
+	if !errors.As(err, &quorumErr) {
+		t.Errorf("expected a quorum error, got %v", err)
+	}
+}
+
+func TestManager_OpenObjectVerifiesFullReads(t *testing.T) {
+	tmpDir, _ := os.MkdirTemp("", "storage-open")
+	defer os.RemoveAll(tmpDir)
+
+	ring := hashring.NewHashRing(3)
+	logger := slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelError}))
+	manager := NewManager(ring, 1, logger)
+
+	node, _ := NewNode("node1", filepath.Join(tmpDir, "node1"))
+	ring.AddNode("node1")
+	manager.AddNode("node1", node)
+
+	testData := "object served with ranges"
+	objectID := GenerateObjectID([]byte(testData))
+	if _, err := manager.StoreObject(context.Background(), objectID, strings.NewReader(testData), int64(len(testData))); err != nil {
+		t.Fatalf("failed to store object: %v", err)
+	}
+
+	reader, err := manager.OpenObject(objectID)
+	if err != nil {
+		t.Fatalf("failed to open object: %v", err)
+	}
+	if reader.Size() != int64(len(testData)) {
+		t.Errorf("expected size %d, got %d", len(testData), reader.Size())
+	}
+
+	// A range in the middle is served as is
+	reader.Seek(7, io.SeekStart)
+	part := make([]byte, 6)
+	if _, err := io.ReadFull(reader, part); err != nil || string(part) != "served" {
+		t.Errorf("expected \"served\", got %q (%v)", part, err)
+	}
+
+	// Reading from the start to the end verifies the content
+	reader.Seek(0, io.SeekStart)
+	data, err := io.ReadAll(reader)
+	reader.Close()
+	if err != nil || string(data) != testData {
+		t.Errorf("expected verified full read, got %q (%v)", data, err)
+	}
+
+	// A corrupt replica fails the full read before its last bytes are returned
+	os.WriteFile(objectFile(node, objectID), []byte("object served with rangez"), 0644)
+	reader, err = manager.OpenObject(objectID)
+	if err != nil {
+		t.Fatalf("failed to open object: %v", err)
+	}
+	data, err = io.ReadAll(reader)
+	reader.Close()
+	if err != ErrChecksumMismatch {
+		t.Errorf("expected checksum mismatch, got %v", err)
+	}
+	if len(data) == len(testData) {
+		t.Error("expected the corrupt body to be cut short")
+	}
+}
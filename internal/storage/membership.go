@@ -0,0 +1,398 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"slices"
+	"sort"
+)
+
+// Node states reported by Manager.Nodes
+const (
+	NodeActive   = "active"   // In the ring and receiving new objects
+	NodeDraining = "draining" // Out of the ring while its objects move to other nodes
+	NodeDrained  = "drained"  // Out of the ring and empty, ready to be removed
+)
+
+// DefaultWeight is the weight of a node whose weight was never set. A node's
+// share of the objects is proportional to its weight.
+const DefaultWeight = 1.0
+
+// MaxWeight is the largest weight a node can have. The number of virtual
+// nodes grows with the weight, so it must stay bounded.
+const MaxWeight = 100.0
+
+// ValidWeight reports whether a node weight is positive and at most MaxWeight
+func ValidWeight(weight float64) bool {
+	return weight > 0 && weight <= MaxWeight
+}
+
+// errNodeWalkStopped stops a node walk early
+var errNodeWalkStopped = errors.New("walk stopped")
+
+// NodeRecord describes a storage node in the persisted membership
+type NodeRecord struct {
+	ID          string            `json:"id"`
+	Path        string            `json:"path"`
+	URL         string            `json:"url,omitempty"` // Set for remote nodes, which have no local path
+	State       string            `json:"state"`
+	Weight      float64           `json:"weight"`
+	Labels      map[string]string `json:"labels,omitempty"`      // Failure domains, see hashring.LabelZone
+	Compression string            `json:"compression,omitempty"` // Codec of new objects, see ParseCodec; empty in older files
+}
+
+// Membership is the persisted list of storage nodes. Nodes added or removed
+// at runtime are recorded here so the cluster comes back the same way after a
+// restart.
+type Membership struct {
+	VirtualNodes int          `json:"virtual_nodes"`
+	Nodes        []NodeRecord `json:"nodes"`
+	Removed      []string     `json:"removed,omitempty"`
+}
+
+// LoadMembership reads a membership file; it returns nil if the file does not exist
+func LoadMembership(path string) (*Membership, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to read membership file: %w", err)
+	}
+
+	var membership Membership
+	if err := json.Unmarshal(data, &membership); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal membership: %w", err)
+	}
+
+	// Files written before weights existed have none
+	for i := range membership.Nodes {
+		if membership.Nodes[i].Weight <= 0 {
+			membership.Nodes[i].Weight = DefaultWeight
+		}
+	}
+	return &membership, nil
+}
+
+// EnableMembershipFile makes the manager record node membership changes in
+// path and writes the current membership to it
+func (m *Manager) EnableMembershipFile(path string, virtualNodes int, removed []string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.membershipPath = path
+	m.virtualNodes = virtualNodes
+	m.removed = slices.Clone(removed)
+	return m.saveMembership()
+}
+
+// RestoreNode adds a node recorded in a membership file. Active nodes join
+// the hash ring with their weight and labels; other nodes are marked draining, so that an
+// interrupted drain can be resumed with DrainNode.
+func (m *Manager) RestoreNode(record NodeRecord, backend Backend) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.nodes[record.ID] = backend
+	m.applyKeyring(backend)
+	m.weights[record.ID] = record.Weight
+	m.labels[record.ID] = maps.Clone(record.Labels)
+	if record.State == NodeActive {
+		m.hashRing.AddLabeledNode(record.ID, record.Weight, record.Labels)
+	} else {
+		m.draining[record.ID] = true
+	}
+}
+
+// Nodes returns the membership records of all nodes in sorted order
+func (m *Manager) Nodes() []NodeRecord {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.nodeRecords()
+}
+
+// JoinNode adds a new node with the given weight and failure domain labels to
+// the manager and the hash ring. Objects whose placement now includes the node
+// are not moved by JoinNode; run a rebalance filtered with PlacedOn to move
+// them.
+func (m *Manager) JoinNode(nodeID string, backend Backend, weight float64, labels map[string]string) error {
+	if !ValidWeight(weight) {
+		return fmt.Errorf("invalid node weight: %v", weight)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, exists := m.nodes[nodeID]; exists {
+		return fmt.Errorf("node already exists: %s", nodeID)
+	}
+
+	m.nodes[nodeID] = backend
+	m.applyKeyring(backend)
+	m.weights[nodeID] = weight
+	m.labels[nodeID] = maps.Clone(labels)
+	m.hashRing.AddLabeledNode(nodeID, weight, labels)
+	m.removed = slices.DeleteFunc(m.removed, func(id string) bool { return id == nodeID })
+	m.logger.Info("node joined", "node_id", nodeID, "weight", weight, "labels", labels)
+
+	return m.saveMembership()
+}
+
+// SetNodeWeight changes the weight of an active node. Only objects on the
+// virtual nodes that were added or removed change placement; run a rebalance
+// filtered with HeldOrPlacedOn to move them.
+func (m *Manager) SetNodeWeight(nodeID string, weight float64) error {
+	if !ValidWeight(weight) {
+		return fmt.Errorf("invalid node weight: %v", weight)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, exists := m.nodes[nodeID]; !exists {
+		return fmt.Errorf("node not found: %s", nodeID)
+	}
+	if m.draining[nodeID] {
+		return fmt.Errorf("node %s is not in the ring", nodeID)
+	}
+
+	m.weights[nodeID] = weight
+	m.hashRing.SetWeight(nodeID, weight)
+	m.logger.Info("node weight changed", "node_id", nodeID, "weight", weight)
+
+	return m.saveMembership()
+}
+
+// SetNodeCompression changes the codec a node compresses new objects with.
+// Objects already stored keep theirs, so nothing needs to move.
+func (m *Manager) SetNodeCompression(nodeID string, codec Codec) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	backend, exists := m.nodes[nodeID]
+	if !exists {
+		return fmt.Errorf("node not found: %s", nodeID)
+	}
+	node, ok := backend.(compressingBackend)
+	if !ok {
+		return fmt.Errorf("node %s does not support compression", nodeID)
+	}
+
+	node.SetCompression(codec)
+	m.logger.Info("node compression changed", "node_id", nodeID, "compression", codec.String())
+
+	return m.saveMembership()
+}
+
+// SetNodeLabels replaces the failure domain labels of a node. Labels decide
+// how replicas spread over the whole ring, so any object may change
+// placement; run an unfiltered rebalance to move them.
+func (m *Manager) SetNodeLabels(nodeID string, labels map[string]string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, exists := m.nodes[nodeID]; !exists {
+		return fmt.Errorf("node not found: %s", nodeID)
+	}
+
+	m.labels[nodeID] = maps.Clone(labels)
+	if !m.draining[nodeID] {
+		m.hashRing.SetLabels(nodeID, labels)
+	}
+	m.logger.Info("node labels changed", "node_id", nodeID, "labels", labels)
+
+	return m.saveMembership()
+}
+
+// KeyspaceShares returns the expected fraction of objects each node in the
+// ring stores, given the node weights and the replication factor
+func (m *Manager) KeyspaceShares() map[string]float64 {
+	return m.hashRing.Shares(m.replication)
+}
+
+// DrainNode takes a node out of the hash ring and moves its objects to their
+// new owners. The node stays readable while it drains, so no object becomes
+// unavailable. DrainNode blocks until the objects have been moved.
+func (m *Manager) DrainNode(ctx context.Context, nodeID string) error {
+	if err := m.StartDrain(nodeID); err != nil {
+		return err
+	}
+	return m.MoveDrainedObjects(ctx, nodeID)
+}
+
+// StartDrain takes a node out of the hash ring, so it receives no new
+// objects. It fails without changing anything if the node is unknown or the
+// ring would be left with too few nodes for the replication factor.
+func (m *Manager) StartDrain(nodeID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, exists := m.nodes[nodeID]; !exists {
+		return fmt.Errorf("node not found: %s", nodeID)
+	}
+	if m.draining[nodeID] {
+		return nil
+	}
+	if m.hashRing.NodeCount() <= m.replication {
+		return fmt.Errorf("cannot drain %s: the ring needs at least %d other nodes", nodeID, m.replication)
+	}
+
+	m.draining[nodeID] = true
+	m.hashRing.RemoveNode(nodeID)
+	m.logger.Info("draining node", "node_id", nodeID)
+	return m.saveMembership()
+}
+
+// MoveDrainedObjects moves the objects of a node taken out of the ring by
+// StartDrain to their new owners, and blocks until they have been moved
+func (m *Manager) MoveDrainedObjects(ctx context.Context, nodeID string) error {
+	m.mu.RLock()
+	node, exists := m.nodes[nodeID]
+	draining := m.draining[nodeID]
+	m.mu.RUnlock()
+	if !exists {
+		return fmt.Errorf("node not found: %s", nodeID)
+	}
+	if !draining {
+		return fmt.Errorf("node %s is not draining", nodeID)
+	}
+
+	if err := m.Rebalance(ctx, RebalanceOptions{Filter: node.Exists}); err != nil {
+		return fmt.Errorf("failed to drain node: %w", err)
+	}
+
+	if !nodeEmpty(node) {
+		return fmt.Errorf("node %s still holds objects after drain", nodeID)
+	}
+
+	m.logger.Info("node drained", "node_id", nodeID)
+	return nil
+}
+
+// RemoveNode removes a node from the manager and the hash ring. Unless force
+// is set, the node must have been drained first so no objects are lost.
+func (m *Manager) RemoveNode(nodeID string, force bool) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	node, exists := m.nodes[nodeID]
+	if !exists {
+		return fmt.Errorf("node not found: %s", nodeID)
+	}
+	if !force && m.nodeState(nodeID, node) != NodeDrained {
+		return fmt.Errorf("node %s must be drained before it is removed", nodeID)
+	}
+
+	delete(m.nodes, nodeID)
+	m.forgetHealth(nodeID)
+	m.dropHints(nodeID)
+	delete(m.draining, nodeID)
+	delete(m.weights, nodeID)
+	delete(m.labels, nodeID)
+	m.hashRing.RemoveNode(nodeID)
+	m.removed = append(m.removed, nodeID)
+	m.logger.Info("node removed", "node_id", nodeID, "forced", force)
+
+	return m.saveMembership()
+}
+
+// PlacedOn returns a rebalance filter selecting the objects the hash ring
+// places on the given node, i.e. the objects that move to a node that joined
+func (m *Manager) PlacedOn(nodeID string) func(objectID string) bool {
+	return func(objectID string) bool {
+		return slices.Contains(m.GetTargetNodes(objectID), nodeID)
+	}
+}
+
+// HeldOrPlacedOn returns a rebalance filter selecting the objects a node holds
+// or the hash ring places on it. A weight change only moves keys to or from
+// the node itself, so these are the objects it can affect.
+func (m *Manager) HeldOrPlacedOn(nodeID string) func(objectID string) bool {
+	placedOn := m.PlacedOn(nodeID)
+	return func(objectID string) bool {
+		if node, exists := m.Node(nodeID); exists && node.Exists(objectID) {
+			return true
+		}
+		return placedOn(objectID)
+	}
+}
+
+// nodeRecords builds the membership records; the caller must hold the lock
+func (m *Manager) nodeRecords() []NodeRecord {
+	records := make([]NodeRecord, 0, len(m.nodes))
+	for nodeID, backend := range m.nodes {
+		weight, ok := m.weights[nodeID]
+		if !ok {
+			weight = DefaultWeight
+		}
+		record := NodeRecord{
+			ID:     nodeID,
+			State:  m.nodeState(nodeID, backend),
+			Weight: weight,
+			Labels: maps.Clone(m.labels[nodeID]),
+		}
+		if node, ok := backend.(*Node); ok {
+			record.Path = node.BasePath
+		}
+		if node, ok := backend.(remoteBackend); ok {
+			record.URL = node.URL()
+		}
+		if node, ok := backend.(compressingBackend); ok {
+			record.Compression = node.Compression().String()
+		}
+		records = append(records, record)
+	}
+	sort.Slice(records, func(i, j int) bool { return records[i].ID < records[j].ID })
+	return records
+}
+
+// nodeState returns the state of a node; the caller must hold the lock
+func (m *Manager) nodeState(nodeID string, node Backend) string {
+	if !m.draining[nodeID] {
+		return NodeActive
+	}
+	if nodeEmpty(node) {
+		return NodeDrained
+	}
+	return NodeDraining
+}
+
+// saveMembership writes the membership file if one is enabled; the caller must hold the lock
+func (m *Manager) saveMembership() error {
+	if m.membershipPath == "" {
+		return nil
+	}
+
+	membership := Membership{
+		VirtualNodes: m.virtualNodes,
+		Nodes:        m.nodeRecords(),
+		Removed:      m.removed,
+	}
+	data, err := json.MarshalIndent(membership, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal membership: %w", err)
+	}
+
+	tmpPath := m.membershipPath + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0644); err != nil {
+		return fmt.Errorf("failed to write membership file: %w", err)
+	}
+	if err := os.Rename(tmpPath, m.membershipPath); err != nil {
+		return fmt.Errorf("failed to write membership file: %w", err)
+	}
+	return nil
+}
+
+// nodeEmpty reports whether a node holds no objects
+func nodeEmpty(node Backend) bool {
+	empty := true
+	node.List("", func(objectID string) error {
+		empty = false
+		return errNodeWalkStopped
+	})
+	return empty
+}
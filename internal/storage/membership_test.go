@@ -0,0 +1,207 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/caskos/caskos/internal/hashring"
+)
+
+func TestManager_JoinDrainAndRemoveNode(t *testing.T) {
+	tmpDir, _ := os.MkdirTemp("", "storage-membership")
+	defer os.RemoveAll(tmpDir)
+
+	ring := hashring.NewHashRing(10)
+	logger := slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelError}))
+	manager := NewManager(ring, 2, logger)
+
+	membershipPath := filepath.Join(tmpDir, "nodes.json")
+	if err := manager.EnableMembershipFile(membershipPath, 10, nil); err != nil {
+		t.Fatalf("failed to enable membership file: %v", err)
+	}
+
+	for _, nodeID := range []string{"node1", "node2", "node3"} {
+		node, _ := NewNode(nodeID, filepath.Join(tmpDir, nodeID))
+		if err := manager.JoinNode(node.ID, node, DefaultWeight, nil); err != nil {
+			t.Fatalf("failed to join node: %v", err)
+		}
+	}
+
+	objectIDs := make([]string, 0, 30)
+	for i := 0; i < 30; i++ {
+		data := fmt.Sprintf("membership object %d", i)
+		objectID := GenerateObjectID([]byte(data))
+		if _, err := manager.StoreObject(context.Background(), objectID, strings.NewReader(data), int64(len(data))); err != nil {
+			t.Fatalf("failed to store object: %v", err)
+		}
+		objectIDs = append(objectIDs, objectID)
+	}
+
+	// A node that still holds objects cannot be removed without draining
+	if err := manager.RemoveNode("node2", false); err == nil {
+		t.Fatal("expected removing an undrained node to fail")
+	}
+
+	if err := manager.DrainNode(context.Background(), "node2"); err != nil {
+		t.Fatalf("failed to drain node: %v", err)
+	}
+	for _, record := range manager.Nodes() {
+		if record.ID == "node2" && record.State != NodeDrained {
+			t.Errorf("expected node2 to be drained, got %s", record.State)
+		}
+	}
+
+	if err := manager.RemoveNode("node2", false); err != nil {
+		t.Fatalf("failed to remove drained node: %v", err)
+	}
+	if ring.NodeCount() != 2 {
+		t.Errorf("expected 2 nodes in ring, got %d", ring.NodeCount())
+	}
+
+	// Every object still has its full replica count on the remaining nodes
+	for _, objectID := range objectIDs {
+		if replicas := manager.CheckReplicas(objectID); len(replicas) != 2 {
+			t.Errorf("object %s: expected 2 replicas after drain, found %v", objectID, replicas)
+		}
+	}
+
+	// The membership file reflects the change
+	membership, err := LoadMembership(membershipPath)
+	if err != nil {
+		t.Fatalf("failed to load membership: %v", err)
+	}
+	if len(membership.Nodes) != 2 || len(membership.Removed) != 1 || membership.Removed[0] != "node2" {
+		t.Errorf("unexpected membership: %+v", membership)
+	}
+
+	// The ring must keep enough nodes for the replication factor
+	if err := manager.DrainNode(context.Background(), "node1"); err == nil {
+		t.Error("expected draining below the replication factor to fail")
+	}
+}
+
+func TestManager_SetNodeWeight(t *testing.T) {
+	tmpDir, _ := os.MkdirTemp("", "storage-weight")
+	defer os.RemoveAll(tmpDir)
+
+	ring := hashring.NewHashRing(50)
+	logger := slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelError}))
+	manager := NewManager(ring, 1, logger)
+
+	membershipPath := filepath.Join(tmpDir, "nodes.json")
+	if err := manager.EnableMembershipFile(membershipPath, 50, nil); err != nil {
+		t.Fatalf("failed to enable membership file: %v", err)
+	}
+
+	for _, nodeID := range []string{"node1", "node2", "node3"} {
+		node, _ := NewNode(nodeID, filepath.Join(tmpDir, nodeID))
+		if err := manager.JoinNode(node.ID, node, DefaultWeight, nil); err != nil {
+			t.Fatalf("failed to join node: %v", err)
+		}
+	}
+
+	objectIDs := make([]string, 0, 60)
+	for i := 0; i < 60; i++ {
+		data := fmt.Sprintf("weighted object %d", i)
+		objectID := GenerateObjectID([]byte(data))
+		if _, err := manager.StoreObject(context.Background(), objectID, strings.NewReader(data), int64(len(data))); err != nil {
+			t.Fatalf("failed to store object: %v", err)
+		}
+		objectIDs = append(objectIDs, objectID)
+	}
+
+	sharesBefore := manager.KeyspaceShares()
+	if err := manager.SetNodeWeight("node3", 3); err != nil {
+		t.Fatalf("failed to set weight: %v", err)
+	}
+	for _, weight := range []float64{0, MaxWeight + 1, math.NaN(), math.Inf(1)} {
+		if err := manager.SetNodeWeight("node3", weight); err == nil {
+			t.Errorf("expected weight %v to be rejected", weight)
+		}
+	}
+	if err := manager.JoinNode("node4", NewMemoryBackend(), MaxWeight*2, nil); err == nil {
+		t.Error("expected a node joining with too large a weight to be rejected")
+	}
+
+	sharesAfter := manager.KeyspaceShares()
+	if sharesAfter["node3"] <= sharesBefore["node3"] {
+		t.Errorf("expected node3's share to grow, got %f -> %f", sharesBefore["node3"], sharesAfter["node3"])
+	}
+
+	if err := manager.Rebalance(context.Background(), RebalanceOptions{Filter: manager.HeldOrPlacedOn("node3")}); err != nil {
+		t.Fatalf("rebalance failed: %v", err)
+	}
+
+	// Every object is back on exactly the nodes the reweighted ring picks
+	for _, objectID := range objectIDs {
+		targets := manager.GetTargetNodes(objectID)
+		replicas := manager.CheckReplicas(objectID)
+		if len(replicas) != 1 || replicas[0] != targets[0] {
+			t.Errorf("object %s: expected it on %v, found %v", objectID, targets, replicas)
+		}
+	}
+
+	// The weight survives a restart
+	membership, err := LoadMembership(membershipPath)
+	if err != nil {
+		t.Fatalf("failed to load membership: %v", err)
+	}
+	for _, record := range membership.Nodes {
+		if record.ID == "node3" && record.Weight != 3 {
+			t.Errorf("expected node3 weight 3 in membership file, got %f", record.Weight)
+		}
+	}
+}
+
+func TestManager_ReplicasSpanFailureDomains(t *testing.T) {
+	tmpDir, _ := os.MkdirTemp("", "storage-domains")
+	defer os.RemoveAll(tmpDir)
+
+	ring := hashring.NewHashRing(20)
+	logger := slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelError}))
+	manager := NewManager(ring, 2, logger)
+
+	zones := map[string]string{"node1": "a", "node2": "a", "node3": "b", "node4": "b"}
+	for _, nodeID := range []string{"node1", "node2", "node3", "node4"} {
+		node, _ := NewNode(nodeID, filepath.Join(tmpDir, nodeID))
+		if err := manager.JoinNode(node.ID, node, DefaultWeight, map[string]string{hashring.LabelZone: zones[nodeID]}); err != nil {
+			t.Fatalf("failed to join node: %v", err)
+		}
+	}
+
+	objectIDs := make([]string, 0, 40)
+	for i := 0; i < 40; i++ {
+		data := fmt.Sprintf("domain object %d", i)
+		objectID := GenerateObjectID([]byte(data))
+		replicas, err := manager.StoreObject(context.Background(), objectID, strings.NewReader(data), int64(len(data)))
+		if err != nil {
+			t.Fatalf("failed to store object: %v", err)
+		}
+		if len(replicas) != 2 || zones[replicas[0]] == zones[replicas[1]] {
+			t.Errorf("object %s: replicas %v are not in distinct zones", objectID, replicas)
+		}
+		objectIDs = append(objectIDs, objectID)
+	}
+
+	// Moving node2 to its own zone changes placement; a rebalance follows it
+	zones["node2"] = "c"
+	if err := manager.SetNodeLabels("node2", map[string]string{hashring.LabelZone: "c"}); err != nil {
+		t.Fatalf("failed to set labels: %v", err)
+	}
+	if err := manager.Rebalance(context.Background(), RebalanceOptions{}); err != nil {
+		t.Fatalf("rebalance failed: %v", err)
+	}
+
+	for _, objectID := range objectIDs {
+		replicas := manager.CheckReplicas(objectID)
+		if len(replicas) != 2 || zones[replicas[0]] == zones[replicas[1]] {
+			t.Errorf("object %s: replicas %v are not in distinct zones after relabeling", objectID, replicas)
+		}
+	}
+}
@@ -0,0 +1,171 @@
+package storage
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+)
+
+// MemoryBackend keeps objects in memory. It lets tests run a whole cluster
+// without touching the disk; everything is lost when the process exits.
+type MemoryBackend struct {
+	mu          sync.RWMutex
+	objects     map[string]memoryObject
+	quarantined map[string]int // Number of copies quarantined per object
+}
+
+// memoryObject is an object held by a MemoryBackend
+type memoryObject struct {
+	data    []byte
+	modTime time.Time
+}
+
+// NewMemoryBackend creates an empty in-memory backend
+func NewMemoryBackend() *MemoryBackend {
+	return &MemoryBackend{
+		objects:     make(map[string]memoryObject),
+		quarantined: make(map[string]int),
+	}
+}
+
+// Store keeps a copy of the object's data
+func (b *MemoryBackend) Store(objectID string, data io.Reader) error {
+	content, err := io.ReadAll(data)
+	if err != nil {
+		return fmt.Errorf("failed to write object data: %w", err)
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.objects[objectID] = memoryObject{data: content, modTime: time.Now()}
+	return nil
+}
+
+// Retrieve opens an object for reading
+func (b *MemoryBackend) Retrieve(objectID string) (Object, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	object, exists := b.objects[objectID]
+	if !exists {
+		return nil, fmt.Errorf("%w: %s", ErrObjectNotFound, objectID)
+	}
+
+	// Stored data is never modified in place, so readers can share it
+	return &memoryReader{Reader: bytes.NewReader(object.data), modTime: object.modTime}, nil
+}
+
+// Exists checks if an object is held in memory
+func (b *MemoryBackend) Exists(objectID string) bool {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	_, exists := b.objects[objectID]
+	return exists
+}
+
+// Delete removes an object
+func (b *MemoryBackend) Delete(objectID string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.objects, objectID)
+	return nil
+}
+
+// Stat returns the size and modification time of an object. Objects are kept
+// as is, so both sizes are the same.
+func (b *MemoryBackend) Stat(objectID string) (ObjectInfo, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	object, exists := b.objects[objectID]
+	if !exists {
+		return ObjectInfo{}, fmt.Errorf("%w: %s", ErrObjectNotFound, objectID)
+	}
+	size := int64(len(object.data))
+	return ObjectInfo{Size: size, StoredSize: size, ModTime: object.modTime}, nil
+}
+
+// List calls fn for every object in ascending ID order after the given ID.
+// The IDs are collected first, so fn may read from or write to the backend.
+func (b *MemoryBackend) List(after string, fn func(objectID string) error) error {
+	b.mu.RLock()
+	objectIDs := make([]string, 0, len(b.objects))
+	for objectID := range b.objects {
+		if objectID > after {
+			objectIDs = append(objectIDs, objectID)
+		}
+	}
+	b.mu.RUnlock()
+	sort.Strings(objectIDs)
+
+	for _, objectID := range objectIDs {
+		if err := fn(objectID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CreatePending starts writing a new object into a buffer
+func (b *MemoryBackend) CreatePending() (PendingWrite, error) {
+	return &memoryPending{backend: b}, nil
+}
+
+// Quarantine drops a corrupt object, counting it so tests can check that
+// corruption was noticed
+func (b *MemoryBackend) Quarantine(objectID string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if _, exists := b.objects[objectID]; !exists {
+		return fmt.Errorf("%w: %s", ErrObjectNotFound, objectID)
+	}
+	delete(b.objects, objectID)
+	b.quarantined[objectID]++
+	return nil
+}
+
+// Quarantined returns how many copies of an object were quarantined
+func (b *MemoryBackend) Quarantined(objectID string) int {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.quarantined[objectID]
+}
+
+// memoryReader reads an object held by a MemoryBackend
+type memoryReader struct {
+	*bytes.Reader
+	modTime time.Time
+}
+
+func (r *memoryReader) ModTime() time.Time {
+	return r.modTime
+}
+
+func (r *memoryReader) Close() error {
+	return nil
+}
+
+// memoryPending buffers an object being written to a MemoryBackend
+type memoryPending struct {
+	backend *MemoryBackend
+	buf     bytes.Buffer
+}
+
+func (p *memoryPending) Write(data []byte) (int, error) {
+	return p.buf.Write(data)
+}
+
+// Commit stores the buffered object under objectID
+func (p *memoryPending) Commit(objectID string) error {
+	return p.backend.Store(objectID, &p.buf)
+}
+
+// Abort discards the buffered object
+func (p *memoryPending) Abort() error {
+	p.buf.Reset()
+	return nil
+}
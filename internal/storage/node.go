@@ -1,18 +1,34 @@
 package storage
 
 import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
+	"regexp"
 	"sync"
+	"time"
 )
 
-// Node represents a storage node (a directory on disk)
+// pendingDir is the directory inside a node that holds objects still being written.
+// Objects only appear in the ab/cd/ tree once they are complete and on disk.
+const pendingDir = ".pending"
+
+// quarantineDir is the directory inside a node that holds replicas found to be corrupt
+const quarantineDir = ".quarantine"
+
+// Node represents a storage node (a directory on disk). It is the Backend
+// servers run with.
 type Node struct {
-	ID       string
-	BasePath string
-	mu       sync.RWMutex
+	ID          string
+	BasePath    string
+	mu          sync.RWMutex
+	compression Codec
+	keyring     *Keyring
 }
 
 // NewNode creates a new storage node
@@ -21,53 +37,120 @@ func NewNode(id, basePath string) (*Node, error) {
 		return nil, fmt.Errorf("failed to create storage node directory: %w", err)
 	}
 
-	return &Node{
+	node := &Node{
 		ID:       id,
 		BasePath: basePath,
-	}, nil
+	}
+
+	if _, err := node.Recover(); err != nil {
+		return nil, err
+	}
+
+	return node, nil
 }
 
-// Store writes object data to the storage node
-func (n *Node) Store(objectID string, data io.Reader) error {
+// SetCompression sets the codec new objects are compressed with. Objects
+// that do not compress well are stored as is; objects already stored keep
+// their codec.
+func (n *Node) SetCompression(codec Codec) {
 	n.mu.Lock()
 	defer n.mu.Unlock()
+	n.compression = codec
+}
 
-	// Create object directory structure: basePath/objectID[0:2]/objectID[2:4]/objectID
-	dir1 := objectID[0:2]
-	dir2 := objectID[2:4]
-	objectDir := filepath.Join(n.BasePath, dir1, dir2)
-	if err := os.MkdirAll(objectDir, 0755); err != nil {
-		return fmt.Errorf("failed to create object directory: %w", err)
+// Compression returns the codec new objects are compressed with
+func (n *Node) Compression() Codec {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	return n.compression
+}
+
+// SetKeyring sets the master keys objects are encrypted under. Once set, new
+// objects are encrypted with a key of their own, stored wrapped by the
+// keyring's active key; objects already stored are left as they are.
+func (n *Node) SetKeyring(keyring *Keyring) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.keyring = keyring
+}
+
+// Keyring returns the master keys objects are encrypted under, or nil if the
+// node does not encrypt
+func (n *Node) Keyring() *Keyring {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	return n.keyring
+}
+
+// Recover removes temporary files left behind by writes that never completed,
+// for example because the process crashed. It returns the number of files removed.
+// Recover must not run concurrently with writes to the node.
+func (n *Node) Recover() (int, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	dir := filepath.Join(n.BasePath, pendingDir)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, fmt.Errorf("failed to read pending directory: %w", err)
+	}
+
+	removed := 0
+	for _, entry := range entries {
+		if err := os.RemoveAll(filepath.Join(dir, entry.Name())); err != nil {
+			return removed, fmt.Errorf("failed to remove pending file: %w", err)
+		}
+		removed++
 	}
 
-	objectPath := filepath.Join(objectDir, objectID)
-	file, err := os.Create(objectPath)
+	return removed, nil
+}
+
+// Store writes object data to the storage node. The data is written to a
+// temporary file and fsynced before being renamed into place, so a crash or
+// failed copy never leaves a partial object at the final path.
+func (n *Node) Store(objectID string, data io.Reader) error {
+	pending, err := n.CreatePending()
 	if err != nil {
-		return fmt.Errorf("failed to create object file: %w", err)
+		return err
 	}
-	defer file.Close()
 
-	if _, err := io.Copy(file, data); err != nil {
-		os.Remove(objectPath) // Clean up on error
+	if _, err := io.Copy(pending, data); err != nil {
+		pending.Abort() // Clean up on error
 		return fmt.Errorf("failed to write object data: %w", err)
 	}
 
-	return nil
+	return pending.Commit(objectID)
+}
+
+// Retrieve reads object data from the storage node, decompressing it if needed
+func (n *Node) Retrieve(objectID string) (Object, error) {
+	file, err := n.Open(objectID)
+	if err != nil {
+		return nil, err
+	}
+	return file, nil
 }
 
-// Retrieve reads object data from the storage node
-func (n *Node) Retrieve(objectID string) (io.ReadCloser, error) {
+// Open opens an object for random access, e.g. to serve ranges
+func (n *Node) Open(objectID string) (*ObjectFile, error) {
+	path, err := n.objectPath(objectID)
+	if err != nil {
+		return nil, err
+	}
+
 	n.mu.RLock()
 	defer n.mu.RUnlock()
 
-	dir1 := objectID[0:2]
-	dir2 := objectID[2:4]
-	objectPath := filepath.Join(n.BasePath, dir1, dir2, objectID)
-
-	file, err := os.Open(objectPath)
+	file, err := openObjectFile(path, func() ([][]byte, error) {
+		return n.readDataKeys(objectID)
+	})
 	if err != nil {
 		if os.IsNotExist(err) {
-			return nil, fmt.Errorf("object not found: %s", objectID)
+			return nil, fmt.Errorf("%w: %s", ErrObjectNotFound, objectID)
 		}
 		return nil, fmt.Errorf("failed to open object file: %w", err)
 	}
@@ -77,49 +160,593 @@ func (n *Node) Retrieve(objectID string) (io.ReadCloser, error) {
 
 // Exists checks if an object exists on this node
 func (n *Node) Exists(objectID string) bool {
+	path, err := n.objectPath(objectID)
+	if err != nil {
+		return false
+	}
+
 	n.mu.RLock()
 	defer n.mu.RUnlock()
 
-	dir1 := objectID[0:2]
-	dir2 := objectID[2:4]
-	objectPath := filepath.Join(n.BasePath, dir1, dir2, objectID)
-
-	_, err := os.Stat(objectPath)
+	_, err = os.Stat(path)
 	return err == nil
 }
 
 // Delete removes an object from the storage node
 func (n *Node) Delete(objectID string) error {
+	path, err := n.objectPath(objectID)
+	if err != nil {
+		return err
+	}
+	keyPath, _ := n.keyPath(objectID)
+
 	n.mu.Lock()
 	defer n.mu.Unlock()
 
-	dir1 := objectID[0:2]
-	dir2 := objectID[2:4]
-	objectPath := filepath.Join(n.BasePath, dir1, dir2, objectID)
-
-	if err := os.Remove(objectPath); err != nil && !os.IsNotExist(err) {
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
 		return fmt.Errorf("failed to delete object: %w", err)
 	}
+	if err := os.Remove(keyPath); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to delete object key: %w", err)
+	}
 
 	return nil
 }
 
-// GetSize returns the size of an object in bytes
-func (n *Node) GetSize(objectID string) (int64, error) {
-	n.mu.RLock()
-	defer n.mu.RUnlock()
+// Stat returns the logical size of an object, the size of its file, which is
+// smaller if the object is compressed, and the file's modification time
+func (n *Node) Stat(objectID string) (ObjectInfo, error) {
+	file, err := n.Open(objectID)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	defer file.Close()
+
+	return ObjectInfo{Size: file.Size(), StoredSize: file.PhysicalSize(), ModTime: file.ModTime()}, nil
+}
+
+// Quarantine moves an object out of the object tree into the node's quarantine
+// directory, so it is no longer served but can still be inspected
+func (n *Node) Quarantine(objectID string) error {
+	path, err := n.objectPath(objectID)
+	if err != nil {
+		return err
+	}
+	keyPath, _ := n.keyPath(objectID)
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	dir := filepath.Join(n.BasePath, quarantineDir)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create quarantine directory: %w", err)
+	}
+
+	// Timestamp the file so repeated corruption of one object keeps every copy
+	target := filepath.Join(dir, fmt.Sprintf("%s.%d", objectID, time.Now().UnixNano()))
+	if err := os.Rename(path, target); err != nil {
+		if os.IsNotExist(err) {
+			return fmt.Errorf("%w: %s", ErrObjectNotFound, objectID)
+		}
+		return fmt.Errorf("failed to quarantine object: %w", err)
+	}
+
+	// The key goes along, so an encrypted copy can still be inspected
+	if err := os.Rename(keyPath, target+".key"); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to quarantine object key: %w", err)
+	}
+
+	return nil
+}
+
+// List calls fn for every object on the node in ascending ID order. If after
+// is not empty, objects with IDs up to and including it are skipped, which lets
+// long-running scans resume where they left off. List does not hold the node
+// lock while fn runs, so fn may read from the node.
+func (n *Node) List(after string, fn func(objectID string) error) error {
+	if after != "" && !validStoredID(after) {
+		return fmt.Errorf("%w: %q", ErrInvalidObjectID, after)
+	}
+
+	level1, err := objectDirNames(n.BasePath)
+	if err != nil {
+		return fmt.Errorf("failed to list node directory: %w", err)
+	}
+
+	for _, dir1 := range level1 {
+		if after != "" && dir1 < after[0:2] {
+			continue
+		}
+
+		level2, err := objectDirNames(filepath.Join(n.BasePath, dir1))
+		if err != nil {
+			return fmt.Errorf("failed to list object directory: %w", err)
+		}
+
+		for _, dir2 := range level2 {
+			if after != "" && dir1+dir2 < after[0:4] {
+				continue
+			}
+
+			entries, err := os.ReadDir(filepath.Join(n.BasePath, dir1, dir2))
+			if err != nil {
+				if os.IsNotExist(err) {
+					continue
+				}
+				return fmt.Errorf("failed to list object directory: %w", err)
+			}
 
-	dir1 := objectID[0:2]
-	dir2 := objectID[2:4]
-	objectPath := filepath.Join(n.BasePath, dir1, dir2, objectID)
+			for _, entry := range entries {
+				objectID := entry.Name()
+				if entry.IsDir() || objectID <= after {
+					continue
+				}
+				if err := fn(objectID); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	return nil
+}
 
-	info, err := os.Stat(objectPath)
+// objectDirNames returns the sorted names of the two-character fan-out
+// directories in dir, skipping internal directories such as .pending
+func objectDirNames(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
 	if err != nil {
 		if os.IsNotExist(err) {
-			return 0, fmt.Errorf("object not found: %s", objectID)
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	names := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		if entry.IsDir() && len(entry.Name()) == 2 && entry.Name()[0] != '.' {
+			names = append(names, entry.Name())
 		}
-		return 0, fmt.Errorf("failed to stat object: %w", err)
+	}
+	return names, nil
+}
+
+// storedIDPattern matches the IDs a node stores under: the hex digits of an
+// object ID, at least the four objects are placed by, and the suffix of a
+// shard ID if any
+var storedIDPattern = regexp.MustCompile(`^[0-9a-f]{4,64}(\.ec[0-9]+-[0-9]+\.[0-9]+)?$`)
+
+// validStoredID reports whether a node can store an object under id. Only such
+// IDs are turned into paths, so none leaves BasePath.
+func validStoredID(id string) bool {
+	return storedIDPattern.MatchString(id)
+}
+
+// objectPath returns the path of an object: basePath/objectID[0:2]/objectID[2:4]/objectID
+func (n *Node) objectPath(objectID string) (string, error) {
+	if !validStoredID(objectID) {
+		return "", fmt.Errorf("%w: %q", ErrInvalidObjectID, objectID)
+	}
+	return filepath.Join(n.BasePath, objectID[0:2], objectID[2:4], objectID), nil
+}
+
+// keyPath returns the path of the wrapped data key of an encrypted object:
+// basePath/.keys/objectID[0:2]/objectID[2:4]/objectID
+func (n *Node) keyPath(objectID string) (string, error) {
+	if !validStoredID(objectID) {
+		return "", fmt.Errorf("%w: %q", ErrInvalidObjectID, objectID)
+	}
+	return filepath.Join(n.BasePath, keyDir, objectID[0:2], objectID[2:4], objectID), nil
+}
+
+// readDataKeys reads and unwraps the data key of an encrypted object,
+// followed by the key of the copy it replaces while a commit is in progress.
+// A key that is missing or wrapped by an unknown master key is an error, not
+// corruption, so readers move on to another replica without quarantining
+// this one. The caller must hold the node lock.
+func (n *Node) readDataKeys(objectID string) ([][]byte, error) {
+	if n.keyring == nil {
+		return nil, fmt.Errorf("object %s is encrypted but the node has no key file", objectID)
+	}
+
+	wrapped, err := n.readWrappedKey(objectID)
+	if err != nil {
+		return nil, err
+	}
+	key, err := n.keyring.unwrap(objectID, wrapped)
+	if err != nil {
+		return nil, err
+	}
+	keys := [][]byte{key}
+	if wrapped.Previous != nil {
+		if previous, err := n.keyring.unwrap(objectID, wrapped.Previous); err == nil {
+			keys = append(keys, previous)
+		}
+	}
+	return keys, nil
+}
+
+// readWrappedKey reads the key file of an object. The caller must hold the
+// node lock.
+func (n *Node) readWrappedKey(objectID string) (*wrappedKey, error) {
+	keyPath, err := n.keyPath(objectID)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(keyPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read object key: %w", err)
+	}
+	var wrapped wrappedKey
+	if err := json.Unmarshal(data, &wrapped); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal object key: %w", err)
+	}
+	return &wrapped, nil
+}
+
+// writeWrappedKey durably replaces the key file of an object, through a
+// temporary file renamed into place. The caller must hold the node lock.
+func (n *Node) writeWrappedKey(objectID string, wrapped *wrappedKey) error {
+	keyPath, err := n.keyPath(objectID)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(wrapped)
+	if err != nil {
+		return fmt.Errorf("failed to marshal object key: %w", err)
 	}
 
-	return info.Size(), nil
+	file, err := os.CreateTemp(filepath.Join(n.BasePath, pendingDir), "key-*")
+	if err != nil {
+		return fmt.Errorf("failed to create pending key file: %w", err)
+	}
+	if _, err := file.Write(data); err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(file.Name())
+		return fmt.Errorf("failed to write pending key file: %w", err)
+	}
+
+	keyParent := filepath.Dir(keyPath)
+	if err := mkdirAllSynced(keyParent, n.BasePath); err != nil {
+		os.Remove(file.Name())
+		return fmt.Errorf("failed to create key directory: %w", err)
+	}
+	if err := os.Rename(file.Name(), keyPath); err != nil {
+		os.Remove(file.Name())
+		return fmt.Errorf("failed to commit object key: %w", err)
+	}
+	return syncDir(keyParent)
+}
+
+// RewrapKeys wraps the data keys of the node's encrypted objects with the
+// keyring's active master key, after a new key was made active. Only the
+// small key files are rewritten; the objects themselves are not touched. It
+// returns the number of keys rewrapped.
+func (n *Node) RewrapKeys() (int, error) {
+	keyring := n.Keyring()
+	if keyring == nil {
+		return 0, fmt.Errorf("node %s does not encrypt objects", n.ID)
+	}
+	active := keyring.Active()
+
+	root := filepath.Join(n.BasePath, keyDir)
+	rewrapped := 0
+	err := filepath.WalkDir(root, func(path string, entry os.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if entry.IsDir() {
+			return nil
+		}
+
+		changed, err := n.rewrapKey(keyring, entry.Name(), active)
+		if err != nil {
+			return err
+		}
+		if changed {
+			rewrapped++
+		}
+		return nil
+	})
+	if err != nil {
+		return rewrapped, fmt.Errorf("failed to rewrap keys: %w", err)
+	}
+
+	return rewrapped, nil
+}
+
+// rewrapKey wraps the data keys in the key file of one object with the
+// active master key, unless they already are
+func (n *Node) rewrapKey(keyring *Keyring, objectID, active string) (bool, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	wrapped, err := n.readWrappedKey(objectID)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return false, nil // Deleted meanwhile
+		}
+		return false, err
+	}
+	if wrapped.KeyID == active && (wrapped.Previous == nil || wrapped.Previous.KeyID == active) {
+		return false, nil
+	}
+
+	rewrapped, err := keyring.rewrap(objectID, wrapped)
+	if err != nil {
+		return false, err
+	}
+	if wrapped.Previous != nil {
+		if rewrapped.Previous, err = keyring.rewrap(objectID, wrapped.Previous); err != nil {
+			return false, err
+		}
+	}
+	if err := n.writeWrappedKey(objectID, rewrapped); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// PendingObject is an object being written to a node whose ID is not known yet.
+// It lives in a temporary file until it is committed under its final ID. The
+// start of the content is held back until it shows whether the object is
+// worth compressing with the node's codec. On a node with a keyring the
+// content is encrypted after it is compressed.
+type PendingObject struct {
+	node      *Node
+	file      *os.File
+	size      int64
+	codec     Codec     // Node's codec until the object's is chosen
+	sample    []byte    // Content held back until the codec is chosen
+	writer    io.Writer // Nil until the codec is chosen
+	gzip      *gzip.Writer
+	header    bool
+	keyring   *Keyring
+	dataKey   []byte // Nil unless the object is encrypted
+	encrypter *encryptingWriter
+}
+
+// CreatePending starts writing a new object to a temporary file on the node
+func (n *Node) CreatePending() (PendingWrite, error) {
+	dir := filepath.Join(n.BasePath, pendingDir)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create pending directory: %w", err)
+	}
+
+	file, err := os.CreateTemp(dir, "object-*")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create pending file: %w", err)
+	}
+
+	pending := &PendingObject{node: n, file: file, codec: n.Compression(), keyring: n.Keyring()}
+	if pending.keyring != nil {
+		if pending.dataKey, err = newDataKey(); err != nil {
+			pending.Abort()
+			return nil, err
+		}
+	}
+	return pending, nil
+}
+
+// Write appends data to the pending object
+func (p *PendingObject) Write(data []byte) (int, error) {
+	if p.writer == nil {
+		p.sample = append(p.sample, data...)
+		p.size += int64(len(data))
+		if len(p.sample) < p.sampleSize() {
+			return len(data), nil
+		}
+		return len(data), p.start()
+	}
+
+	written, err := p.writer.Write(data)
+	p.size += int64(written)
+	return written, err
+}
+
+// Size returns the number of bytes written so far
+func (p *PendingObject) Size() int64 {
+	return p.size
+}
+
+// sampleSize returns how much content is needed to choose the codec
+func (p *PendingObject) sampleSize() int {
+	if p.codec == CodecNone {
+		return len(objectMagic)
+	}
+	return compressionSampleSize
+}
+
+// start chooses the object's codec from the content held back, writes the
+// header, if the file needs one, and then the content
+func (p *PendingObject) start() error {
+	if p.codec != CodecNone && !compressible(p.sample) {
+		p.codec = CodecNone
+	}
+
+	// The header's size field is filled in by Commit
+	encrypted := p.dataKey != nil
+	p.header = p.codec != CodecNone || encrypted || bytes.HasPrefix(p.sample, []byte(objectMagic))
+	if p.header {
+		if _, err := p.file.Write(encodeObjectHeader(p.codec, encrypted, 0)); err != nil {
+			return err
+		}
+	}
+
+	p.writer = p.file
+	if encrypted {
+		var err error
+		if p.encrypter, err = newEncryptingWriter(p.file, p.dataKey); err != nil {
+			return err
+		}
+		p.writer = p.encrypter
+	}
+	if p.codec == CodecGzip {
+		p.gzip = gzip.NewWriter(p.writer)
+		p.writer = p.gzip
+	}
+
+	_, err := p.writer.Write(p.sample)
+	p.sample = nil
+	return err
+}
+
+// finish writes what is left of the content and the header's size field
+func (p *PendingObject) finish() error {
+	if p.writer == nil {
+		if err := p.start(); err != nil {
+			return err
+		}
+	}
+	if p.gzip != nil {
+		if err := p.gzip.Close(); err != nil {
+			return err
+		}
+	}
+	if p.encrypter != nil {
+		if err := p.encrypter.Close(); err != nil {
+			return err
+		}
+	}
+	if p.header {
+		if _, err := p.file.WriteAt(encodeObjectHeader(p.codec, p.dataKey != nil, p.size), 0); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Commit makes the pending object durable and moves it into place under
+// objectID. The file is fsynced before the rename and the directory after it,
+// so once Commit returns the object survives a crash. An existing copy of the
+// object is replaced atomically. The key of an encrypted object is committed
+// just before it, under the same lock, so readers never see one without the
+// other; the key of the copy it replaces stays in the key file until the new
+// copy is in place, so whichever copy a crash leaves can be read. A plain
+// copy is moved into place before the key of an encrypted copy is removed.
+func (p *PendingObject) Commit(objectID string) error {
+	n := p.node
+	objectPath, err := n.objectPath(objectID)
+	if err != nil {
+		p.Abort()
+		return err
+	}
+	keyPath, _ := n.keyPath(objectID)
+
+	if err := p.finish(); err != nil {
+		p.Abort()
+		return fmt.Errorf("failed to write pending file: %w", err)
+	}
+	if err := p.file.Sync(); err != nil {
+		p.Abort()
+		return fmt.Errorf("failed to sync pending file: %w", err)
+	}
+	if err := p.file.Close(); err != nil {
+		os.Remove(p.file.Name())
+		return fmt.Errorf("failed to close pending file: %w", err)
+	}
+
+	var wrapped *wrappedKey
+	if p.dataKey != nil {
+		if wrapped, err = p.keyring.wrap(objectID, p.dataKey); err != nil {
+			os.Remove(p.file.Name())
+			return err
+		}
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	objectDir := filepath.Dir(objectPath)
+	if err := mkdirAllSynced(objectDir, n.BasePath); err != nil {
+		os.Remove(p.file.Name())
+		return fmt.Errorf("failed to create object directory: %w", err)
+	}
+
+	if wrapped != nil {
+		previous, err := n.readWrappedKey(objectID)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			os.Remove(p.file.Name())
+			return err
+		}
+		if previous != nil {
+			wrapped.Previous = &wrappedKey{KeyID: previous.KeyID, Key: previous.Key}
+		}
+		if err := n.writeWrappedKey(objectID, wrapped); err != nil {
+			os.Remove(p.file.Name())
+			return err
+		}
+	}
+
+	if err := os.Rename(p.file.Name(), objectPath); err != nil {
+		os.Remove(p.file.Name())
+		return fmt.Errorf("failed to commit object: %w", err)
+	}
+
+	if err := syncDir(objectDir); err != nil {
+		return fmt.Errorf("failed to sync object directory: %w", err)
+	}
+
+	switch {
+	case wrapped == nil:
+		// The object replaced an encrypted copy of itself
+		if err := os.Remove(keyPath); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove object key: %w", err)
+		}
+	case wrapped.Previous != nil:
+		// A previous key left behind is only tried if the new one fails
+		wrapped.Previous = nil
+		if err := n.writeWrappedKey(objectID, wrapped); err != nil {
+			return fmt.Errorf("failed to remove previous object key: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// Abort discards the pending object
+func (p *PendingObject) Abort() error {
+	p.file.Close()
+	if err := os.Remove(p.file.Name()); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove pending file: %w", err)
+	}
+	return nil
+}
+
+// mkdirAllSynced creates dir and any missing parents below root, fsyncing the
+// parent of every directory it creates so the new entries are durable
+func mkdirAllSynced(dir, root string) error {
+	if _, err := os.Stat(dir); err == nil {
+		return nil
+	}
+
+	parent := filepath.Dir(dir)
+	if parent != root && parent != dir {
+		if err := mkdirAllSynced(parent, root); err != nil {
+			return err
+		}
+	}
+
+	if err := os.Mkdir(dir, 0755); err != nil && !os.IsExist(err) {
+		return err
+	}
+	return syncDir(parent)
+}
+
+// syncDir fsyncs a directory so that entries created or renamed in it are durable
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
 }
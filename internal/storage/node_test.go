@@ -1,6 +1,7 @@
 package storage
 
 import (
+	"errors"
 	"io"
 	"os"
 	"path/filepath"
@@ -52,7 +53,7 @@ func TestNode_StoreAndRetrieve(t *testing.T) {
 	}
 }
 
-func TestNode_GetSize(t *testing.T) {
+func TestNode_Stat(t *testing.T) {
 	tmpDir, err := os.MkdirTemp("", "storage-test")
 	if err != nil {
 		t.Fatalf("failed to create temp dir: %v", err)
@@ -72,10 +73,11 @@ func TestNode_GetSize(t *testing.T) {
 		t.Fatalf("failed to store object: %v", err)
 	}
 
-	size, err := node.GetSize(objectID)
+	info, err := node.Stat(objectID)
 	if err != nil {
-		t.Fatalf("failed to get size: %v", err)
+		t.Fatalf("failed to stat object: %v", err)
 	}
+	size := info.Size
 
 	expectedSize := int64(len(testData))
 	if size != expectedSize {
@@ -112,6 +114,52 @@ func TestNode_Delete(t *testing.T) {
 	}
 }
 
+func TestNode_InvalidIDs(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "storage-test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	node, err := NewNode("test-node", filepath.Join(tmpDir, "node"))
+	if err != nil {
+		t.Fatalf("failed to create node: %v", err)
+	}
+	victim := filepath.Join(tmpDir, "victim")
+	if err := os.WriteFile(victim, []byte("outside the node"), 0644); err != nil {
+		t.Fatalf("failed to write file: %v", err)
+	}
+
+	// An ID with a path in it must not reach files outside the node
+	for _, objectID := range []string{"../../../victim", "../victim", "ab/../../victim", "", "a", "abc"} {
+		if _, err := node.Open(objectID); !errors.Is(err, ErrInvalidObjectID) {
+			t.Errorf("expected ErrInvalidObjectID opening %q, got %v", objectID, err)
+		}
+		if err := node.Quarantine(objectID); !errors.Is(err, ErrInvalidObjectID) {
+			t.Errorf("expected ErrInvalidObjectID quarantining %q, got %v", objectID, err)
+		}
+		if err := node.Delete(objectID); !errors.Is(err, ErrInvalidObjectID) {
+			t.Errorf("expected ErrInvalidObjectID deleting %q, got %v", objectID, err)
+		}
+		if err := node.Store(objectID, strings.NewReader("x")); !errors.Is(err, ErrInvalidObjectID) {
+			t.Errorf("expected ErrInvalidObjectID storing %q, got %v", objectID, err)
+		}
+		if node.Exists(objectID) {
+			t.Errorf("expected %q not to exist", objectID)
+		}
+	}
+	// A cursor too short to place an object by is refused too
+	for _, after := range []string{"a", "abc", "../x"} {
+		if err := node.List(after, func(string) error { return nil }); !errors.Is(err, ErrInvalidObjectID) {
+			t.Errorf("expected ErrInvalidObjectID listing after %q, got %v", after, err)
+		}
+	}
+
+	if data, err := os.ReadFile(victim); err != nil || string(data) != "outside the node" {
+		t.Errorf("expected the file outside the node to be untouched, got %q (%v)", data, err)
+	}
+}
+
 func TestNode_DirectoryStructure(t *testing.T) {
 	tmpDir, err := os.MkdirTemp("", "storage-test")
 	if err != nil {
@@ -139,3 +187,191 @@ func TestNode_DirectoryStructure(t *testing.T) {
 	}
 }
 
+
+func TestNode_PendingObject(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "storage-test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	node, err := NewNode("test-node", tmpDir)
+	if err != nil {
+		t.Fatalf("failed to create node: %v", err)
+	}
+
+	objectID := "abcdef1234567890abcdef1234567890"
+	testData := "Pending object data"
+
+	pending, err := node.CreatePending()
+	if err != nil {
+		t.Fatalf("failed to create pending object: %v", err)
+	}
+	if _, err := pending.Write([]byte(testData)); err != nil {
+		t.Fatalf("failed to write pending object: %v", err)
+	}
+
+	// Pending objects are not visible until committed
+	if node.Exists(objectID) {
+		t.Error("expected pending object to not exist before commit")
+	}
+
+	if err := pending.Commit(objectID); err != nil {
+		t.Fatalf("failed to commit pending object: %v", err)
+	}
+
+	info, err := node.Stat(objectID)
+	if err != nil {
+		t.Fatalf("failed to stat object: %v", err)
+	}
+	size := info.Size
+	if size != int64(len(testData)) {
+		t.Errorf("size mismatch: expected %d, got %d", len(testData), size)
+	}
+
+	// Aborted objects leave nothing behind
+	aborted, err := node.CreatePending()
+	if err != nil {
+		t.Fatalf("failed to create pending object: %v", err)
+	}
+	aborted.Write([]byte("discarded"))
+	if err := aborted.Abort(); err != nil {
+		t.Fatalf("failed to abort pending object: %v", err)
+	}
+
+	entries, _ := os.ReadDir(filepath.Join(tmpDir, pendingDir))
+	if len(entries) != 0 {
+		t.Errorf("expected no pending files after abort, found %d", len(entries))
+	}
+}
+
+// failingReader returns some data and then an error, like a dropped connection
+type failingReader struct {
+	sent bool
+}
+
+func (r *failingReader) Read(p []byte) (int, error) {
+	if !r.sent {
+		r.sent = true
+		return copy(p, "partial data"), nil
+	}
+	return 0, io.ErrUnexpectedEOF
+}
+
+func TestNode_StoreIsAtomic(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "storage-test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	node, err := NewNode("test-node", tmpDir)
+	if err != nil {
+		t.Fatalf("failed to create node: %v", err)
+	}
+
+	objectID := "abcdef1234567890abcdef1234567890"
+
+	// A failed copy must not leave a truncated object behind
+	if err := node.Store(objectID, &failingReader{}); err == nil {
+		t.Fatal("expected store to fail")
+	}
+	if node.Exists(objectID) {
+		t.Error("expected no object after failed store")
+	}
+
+	entries, _ := os.ReadDir(filepath.Join(tmpDir, pendingDir))
+	if len(entries) != 0 {
+		t.Errorf("expected no pending files after failed store, found %d", len(entries))
+	}
+}
+
+func TestNode_RecoverSweepsPendingFiles(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "storage-test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	node, err := NewNode("test-node", tmpDir)
+	if err != nil {
+		t.Fatalf("failed to create node: %v", err)
+	}
+
+	// Simulate a crash in the middle of a write
+	pending, err := node.CreatePending()
+	if err != nil {
+		t.Fatalf("failed to create pending object: %v", err)
+	}
+	pending.Write([]byte("half-written"))
+	pending.(*PendingObject).file.Close()
+
+	// Reopening the node runs the recovery pass
+	if _, err := NewNode("test-node", tmpDir); err != nil {
+		t.Fatalf("failed to reopen node: %v", err)
+	}
+
+	entries, _ := os.ReadDir(filepath.Join(tmpDir, pendingDir))
+	if len(entries) != 0 {
+		t.Errorf("expected recovery to remove pending files, found %d", len(entries))
+	}
+}
+
+func TestNode_List(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "storage-test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	node, err := NewNode("test-node", tmpDir)
+	if err != nil {
+		t.Fatalf("failed to create node: %v", err)
+	}
+
+	objectIDs := []string{
+		"aa001234567890", "aa011234567890", "ab001234567890", "ff001234567890",
+	}
+	for _, objectID := range objectIDs {
+		if err := node.Store(objectID, strings.NewReader(objectID)); err != nil {
+			t.Fatalf("failed to store object: %v", err)
+		}
+	}
+
+	// Internal directories must not show up as objects
+	pending, _ := node.CreatePending()
+	defer pending.Abort()
+
+	var walked []string
+	if err := node.List("", func(objectID string) error {
+		walked = append(walked, objectID)
+		return nil
+	}); err != nil {
+		t.Fatalf("failed to walk node: %v", err)
+	}
+	if strings.Join(walked, ",") != strings.Join(objectIDs, ",") {
+		t.Errorf("expected %v, got %v", objectIDs, walked)
+	}
+
+	// Resuming skips everything up to and including the given ID
+	walked = nil
+	node.List(objectIDs[1], func(objectID string) error {
+		walked = append(walked, objectID)
+		return nil
+	})
+	if strings.Join(walked, ",") != strings.Join(objectIDs[2:], ",") {
+		t.Errorf("expected %v, got %v", objectIDs[2:], walked)
+	}
+}
+
+// objectFile returns the path of an object on a node
+func objectFile(node *Node, objectID string) string {
+	path, _ := node.objectPath(objectID)
+	return path
+}
+
+// objectKeyFile returns the path of an object's key on a node
+func objectKeyFile(node *Node, objectID string) string {
+	path, _ := node.keyPath(objectID)
+	return path
+}
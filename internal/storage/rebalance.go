@@ -0,0 +1,207 @@
+package storage
+
+import (
+	"context"
+	"slices"
+	"sync"
+	"time"
+)
+
+// defaultRebalanceConcurrency is the number of objects moved at once when not configured
+const defaultRebalanceConcurrency = 4
+
+// RebalanceOptions controls a rebalance run
+type RebalanceOptions struct {
+	// Concurrency bounds how many objects are moved at the same time
+	Concurrency int
+	// Filter limits the run to objects it returns true for, typically the
+	// key ranges that moved in a ring change. A nil filter checks every object.
+	Filter func(objectID string) bool
+}
+
+// RebalanceProgress reports the state of the current or last rebalance run
+type RebalanceProgress struct {
+	Running    bool      `json:"running"`
+	StartedAt  time.Time `json:"started_at,omitempty"`
+	FinishedAt time.Time `json:"finished_at,omitempty"`
+	Scanned    int64     `json:"scanned"`
+	Moved      int64     `json:"moved"`
+	Copied     int64     `json:"copied"`
+	Removed    int64     `json:"removed"`
+	Failed     int64     `json:"failed"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// Rebalance moves objects onto the nodes the hash ring currently assigns to
+// them. Each object is first copied to every target that lacks it; surplus
+// copies on nodes outside the placement are deleted only once all targets are
+// confirmed to hold the object, so an interrupted run never loses data.
+// Runs are serialized: a rebalance started while another is running waits
+// for it to finish.
+func (m *Manager) Rebalance(ctx context.Context, opts RebalanceOptions) error {
+	concurrency := opts.Concurrency
+	if concurrency <= 0 {
+		concurrency = defaultRebalanceConcurrency
+	}
+
+	m.rebalanceRun.Lock()
+	defer m.rebalanceRun.Unlock()
+
+	m.rebalanceMu.Lock()
+	m.rebalance = RebalanceProgress{Running: true, StartedAt: time.Now()}
+	m.rebalanceMu.Unlock()
+	m.logger.Info("starting rebalance", "concurrency", concurrency)
+
+	objectIDs := make(chan string)
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for objectID := range objectIDs {
+				m.rebalanceObject(objectID)
+			}
+		}()
+	}
+
+	var walkErr error
+	for _, nodeID := range m.NodeIDs() {
+		node, exists := m.Node(nodeID)
+		if !exists {
+			continue
+		}
+
+		walkErr = node.List("", func(objectID string) error {
+			if opts.Filter != nil && !opts.Filter(objectID) {
+				return nil
+			}
+
+			// Every holder of an object sees it, so only the first one in
+			// node order hands it to the workers
+			if holders := m.CheckReplicas(objectID); len(holders) > 0 && slices.Min(holders) != nodeID {
+				return nil
+			}
+
+			m.updateRebalance(func(p *RebalanceProgress) { p.Scanned++ })
+			select {
+			case objectIDs <- objectID:
+				return nil
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		})
+		if walkErr != nil {
+			break
+		}
+	}
+
+	close(objectIDs)
+	wg.Wait()
+
+	m.rebalanceMu.Lock()
+	m.rebalance.Running = false
+	m.rebalance.FinishedAt = time.Now()
+	if walkErr != nil {
+		m.rebalance.Error = walkErr.Error()
+	}
+	progress := m.rebalance
+	m.rebalanceMu.Unlock()
+
+	m.logger.Info("rebalance finished",
+		"scanned", progress.Scanned,
+		"moved", progress.Moved,
+		"copied", progress.Copied,
+		"removed", progress.Removed,
+		"failed", progress.Failed,
+		"error", progress.Error)
+	return walkErr
+}
+
+// RebalanceProgress returns the progress of the current or last rebalance run
+func (m *Manager) RebalanceProgress() RebalanceProgress {
+	m.rebalanceMu.Lock()
+	defer m.rebalanceMu.Unlock()
+	return m.rebalance
+}
+
+// rebalanceObject brings one object in line with its ring placement.
+// Deleted objects are left where they are for the delete or the scrubber to
+// remove, and copies made while the object was being deleted are removed
+// again rather than kept in place of the old ones.
+func (m *Manager) rebalanceObject(objectID string) {
+	if m.tombstoned(objectID) {
+		return
+	}
+	targetNodes := m.GetTargetNodes(objectID)
+	holders := m.CheckReplicas(objectID)
+
+	changed := false
+	var copied []string
+	for _, targetNodeID := range targetNodes {
+		if slices.Contains(holders, targetNodeID) {
+			continue
+		}
+
+		if err := m.ReplicateObject(objectID, targetNodeID); err != nil {
+			m.logger.Error("failed to move object to new owner", "object_id", objectID, "node_id", targetNodeID, "error", err)
+			m.updateRebalance(func(p *RebalanceProgress) { p.Failed++ })
+			return
+		}
+		changed = true
+		copied = append(copied, targetNodeID)
+		m.updateRebalance(func(p *RebalanceProgress) { p.Copied++ })
+	}
+
+	// A delete that ran during the copy may have missed the new copies
+	if m.tombstoned(objectID) {
+		for _, nodeID := range copied {
+			if node, exists := m.Node(nodeID); exists {
+				if err := node.Delete(objectID); err != nil {
+					m.logger.Error("failed to remove copy of deleted object", "object_id", objectID, "node_id", nodeID, "error", err)
+				}
+			}
+		}
+		m.logger.Info("object deleted while rebalancing", "object_id", objectID)
+		return
+	}
+
+	// Confirm the new copies before removing any old ones
+	for _, targetNodeID := range targetNodes {
+		node, exists := m.Node(targetNodeID)
+		if !exists || !node.Exists(objectID) {
+			m.logger.Warn("object missing from new owner, keeping old copies", "object_id", objectID, "node_id", targetNodeID)
+			m.updateRebalance(func(p *RebalanceProgress) { p.Failed++ })
+			return
+		}
+	}
+
+	for _, nodeID := range holders {
+		if slices.Contains(targetNodes, nodeID) {
+			continue
+		}
+
+		node, exists := m.Node(nodeID)
+		if !exists {
+			continue
+		}
+		if err := node.Delete(objectID); err != nil {
+			m.logger.Error("failed to remove surplus copy", "object_id", objectID, "node_id", nodeID, "error", err)
+			m.updateRebalance(func(p *RebalanceProgress) { p.Failed++ })
+			continue
+		}
+		changed = true
+		m.updateRebalance(func(p *RebalanceProgress) { p.Removed++ })
+	}
+
+	if changed {
+		m.updateRebalance(func(p *RebalanceProgress) { p.Moved++ })
+		m.logger.Info("rebalanced object", "object_id", objectID, "nodes", targetNodes)
+	}
+}
+
+// updateRebalance applies a change to the rebalance progress
+func (m *Manager) updateRebalance(update func(p *RebalanceProgress)) {
+	m.rebalanceMu.Lock()
+	defer m.rebalanceMu.Unlock()
+	update(&m.rebalance)
+}
@@ -0,0 +1,142 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/caskos/caskos/internal/hashring"
+)
+
+func TestManager_RebalanceAfterNodeJoins(t *testing.T) {
+	tmpDir, _ := os.MkdirTemp("", "storage-rebalance")
+	defer os.RemoveAll(tmpDir)
+
+	ring := hashring.NewHashRing(10)
+	logger := slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelError}))
+	manager := NewManager(ring, 2, logger)
+
+	addNode := func(nodeID string) {
+		node, _ := NewNode(nodeID, filepath.Join(tmpDir, nodeID))
+		ring.AddNode(nodeID)
+		manager.AddNode(nodeID, node)
+	}
+	addNode("node1")
+	addNode("node2")
+	addNode("node3")
+
+	objectIDs := make([]string, 0, 50)
+	for i := 0; i < 50; i++ {
+		data := fmt.Sprintf("rebalanced object %d", i)
+		objectID := GenerateObjectID([]byte(data))
+		if _, err := manager.StoreObject(context.Background(), objectID, strings.NewReader(data), int64(len(data))); err != nil {
+			t.Fatalf("failed to store object: %v", err)
+		}
+		objectIDs = append(objectIDs, objectID)
+	}
+
+	before := ring.Clone()
+	addNode("node4")
+	ranges := hashring.MovedRanges(before, ring, 2)
+
+	// Objects are still readable from their old owners before the rebalance
+	for _, objectID := range objectIDs {
+		reader, err := manager.RetrieveObject(objectID)
+		if err != nil {
+			t.Fatalf("failed to retrieve %s before rebalance: %v", objectID, err)
+		}
+		reader.Close()
+	}
+
+	err := manager.Rebalance(context.Background(), RebalanceOptions{
+		Concurrency: 2,
+		Filter: func(objectID string) bool {
+			return hashring.ContainsKey(ranges, objectID)
+		},
+	})
+	if err != nil {
+		t.Fatalf("rebalance failed: %v", err)
+	}
+
+	// Every object now lives exactly on its targets
+	for _, objectID := range objectIDs {
+		targets := manager.GetTargetNodes(objectID)
+		holders := manager.CheckReplicas(objectID)
+		if len(holders) != len(targets) {
+			t.Errorf("object %s: expected replicas on %v, found on %v", objectID, targets, holders)
+		}
+		for _, nodeID := range targets {
+			if !manager.nodes[nodeID].Exists(objectID) {
+				t.Errorf("object %s missing from target %s", objectID, nodeID)
+			}
+		}
+	}
+
+	progress := manager.RebalanceProgress()
+	if progress.Running || progress.Moved == 0 || progress.Failed != 0 {
+		t.Errorf("unexpected rebalance progress: %+v", progress)
+	}
+	if progress.Copied != progress.Removed {
+		t.Errorf("expected every copy to replace a surplus replica, copied %d removed %d", progress.Copied, progress.Removed)
+	}
+}
+
+// tombstoneFunc adapts a function to a TombstoneChecker
+type tombstoneFunc func(objectID string) bool
+
+func (f tombstoneFunc) IsTombstoned(objectID string) bool {
+	return f(objectID)
+}
+
+func TestManager_RebalanceSkipsDeletedObjects(t *testing.T) {
+	manager, _, _ := newMemoryCluster(3)
+
+	holders := make(map[string][]string)
+	for i := 0; i < 20; i++ {
+		data := fmt.Sprintf("deleted object %d", i)
+		objectID := GenerateObjectID([]byte(data))
+		if _, err := manager.StoreObject(context.Background(), objectID, strings.NewReader(data), int64(len(data))); err != nil {
+			t.Fatalf("failed to store object: %v", err)
+		}
+		holders[objectID] = slices.Sorted(slices.Values(manager.CheckReplicas(objectID)))
+	}
+
+	// Half the objects were deleted before the rebalance, the others while
+	// it copies them
+	var mu sync.Mutex
+	lookups := make(map[string]int)
+	manager.SetTombstoneChecker(tombstoneFunc(func(objectID string) bool {
+		mu.Lock()
+		defer mu.Unlock()
+		lookups[objectID]++
+		return objectID < "8" || lookups[objectID] > 1
+	}))
+
+	manager.hashRing.AddNode("node4")
+	manager.AddNode("node4", NewMemoryBackend())
+	if err := manager.Rebalance(context.Background(), RebalanceOptions{}); err != nil {
+		t.Fatalf("rebalance failed: %v", err)
+	}
+
+	moved := 0
+	for objectID, before := range holders {
+		if !slices.Equal(slices.Sorted(slices.Values(manager.GetTargetNodes(objectID))), before) {
+			moved++
+		}
+		if after := slices.Sorted(slices.Values(manager.CheckReplicas(objectID))); !slices.Equal(after, before) {
+			t.Errorf("object %s: expected copies to stay on %v, found on %v", objectID, before, after)
+		}
+	}
+	if moved == 0 {
+		t.Fatal("expected the new node to take over some objects")
+	}
+	if progress := manager.RebalanceProgress(); progress.Moved != 0 || progress.Removed != 0 {
+		t.Errorf("expected no deleted object to be moved: %+v", progress)
+	}
+}
@@ -0,0 +1,263 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrTooFewShards is returned when fewer shards than the data shard count
+// are left to reconstruct from
+var ErrTooFewShards = errors.New("too few shards to reconstruct")
+
+// gfExp and gfLog are the exponent and logarithm tables of GF(2^8) with the
+// polynomial x^8 + x^4 + x^3 + x^2 + 1 (0x11d). gfExp is doubled in length
+// so products of logarithms need no reduction.
+var gfExp, gfLog = func() ([510]byte, [256]byte) {
+	var exp [510]byte
+	var log [256]byte
+	x := 1
+	for i := 0; i < 255; i++ {
+		exp[i] = byte(x)
+		exp[i+255] = byte(x)
+		log[x] = byte(i)
+		x <<= 1
+		if x&0x100 != 0 {
+			x ^= 0x11d
+		}
+	}
+	return exp, log
+}()
+
+// gfMul multiplies two elements of GF(2^8)
+func gfMul(a, b byte) byte {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return gfExp[int(gfLog[a])+int(gfLog[b])]
+}
+
+// gfInv returns the multiplicative inverse of a non-zero element
+func gfInv(a byte) byte {
+	return gfExp[255-int(gfLog[a])]
+}
+
+// gfPow raises a to the power n
+func gfPow(a byte, n int) byte {
+	if n == 0 {
+		return 1
+	}
+	if a == 0 {
+		return 0
+	}
+	return gfExp[(int(gfLog[a])*n)%255]
+}
+
+// ReedSolomon is a systematic Reed-Solomon code over GF(2^8). Data is split
+// into DataShards equal shards and ParityShards parity shards are computed
+// from them; the data can be rebuilt from any DataShards of the shards.
+type ReedSolomon struct {
+	DataShards   int
+	ParityShards int
+	matrix       [][]byte // Encoding matrix; its top rows are the identity
+}
+
+// NewReedSolomon creates a code with the given number of data and parity shards
+func NewReedSolomon(dataShards, parityShards int) (*ReedSolomon, error) {
+	if dataShards < 1 || parityShards < 1 || dataShards+parityShards > 256 {
+		return nil, fmt.Errorf("invalid shard counts %d+%d", dataShards, parityShards)
+	}
+
+	// Any square submatrix of a Vandermonde matrix is invertible. Multiplying
+	// by the inverse of its top square keeps that property and makes the
+	// code systematic, so data shards are stored as they are.
+	total := dataShards + parityShards
+	vandermonde := make([][]byte, total)
+	for r := range vandermonde {
+		vandermonde[r] = make([]byte, dataShards)
+		for c := range vandermonde[r] {
+			vandermonde[r][c] = gfPow(byte(r), c)
+		}
+	}
+	top, err := invertMatrix(vandermonde[:dataShards])
+	if err != nil {
+		return nil, err
+	}
+
+	return &ReedSolomon{
+		DataShards:   dataShards,
+		ParityShards: parityShards,
+		matrix:       multiplyMatrix(vandermonde, top),
+	}, nil
+}
+
+// Split divides data into data shards of equal size, padding the last with
+// zeros, and allocates the parity shards. Call Encode to fill them.
+func (rs *ReedSolomon) Split(data []byte) [][]byte {
+	shardSize := (len(data) + rs.DataShards - 1) / rs.DataShards
+	buf := make([]byte, shardSize*(rs.DataShards+rs.ParityShards))
+	copy(buf, data)
+
+	shards := make([][]byte, rs.DataShards+rs.ParityShards)
+	for i := range shards {
+		shards[i] = buf[i*shardSize : (i+1)*shardSize : (i+1)*shardSize]
+	}
+	return shards
+}
+
+// Encode computes the parity shards from the data shards
+func (rs *ReedSolomon) Encode(shards [][]byte) error {
+	if len(shards) != rs.DataShards+rs.ParityShards {
+		return fmt.Errorf("expected %d shards, got %d", rs.DataShards+rs.ParityShards, len(shards))
+	}
+	for i := rs.DataShards; i < len(shards); i++ {
+		rs.encodeRow(rs.matrix[i], shards[:rs.DataShards], shards[i])
+	}
+	return nil
+}
+
+// Reconstruct fills in the missing (nil) shards from those present. It fails
+// with ErrTooFewShards if fewer than DataShards are present.
+func (rs *ReedSolomon) Reconstruct(shards [][]byte) error {
+	if len(shards) != rs.DataShards+rs.ParityShards {
+		return fmt.Errorf("expected %d shards, got %d", rs.DataShards+rs.ParityShards, len(shards))
+	}
+
+	present := make([]int, 0, rs.DataShards)
+	shardSize := 0
+	for i, shard := range shards {
+		if shard != nil && len(present) < rs.DataShards {
+			present = append(present, i)
+			shardSize = len(shard)
+		}
+	}
+	if len(present) < rs.DataShards {
+		return ErrTooFewShards
+	}
+
+	// The rows of the present shards map the data to them, so their inverse
+	// maps them back to the data
+	rows := make([][]byte, len(present))
+	inputs := make([][]byte, len(present))
+	for i, index := range present {
+		rows[i] = rs.matrix[index]
+		inputs[i] = shards[index]
+		if len(shards[index]) != shardSize {
+			return fmt.Errorf("shard %d has size %d, expected %d", index, len(shards[index]), shardSize)
+		}
+	}
+	decode, err := invertMatrix(rows)
+	if err != nil {
+		return err
+	}
+
+	for i := 0; i < rs.DataShards; i++ {
+		if shards[i] == nil {
+			shards[i] = make([]byte, shardSize)
+			rs.encodeRow(decode[i], inputs, shards[i])
+		}
+	}
+	for i := rs.DataShards; i < len(shards); i++ {
+		if shards[i] == nil {
+			shards[i] = make([]byte, shardSize)
+			rs.encodeRow(rs.matrix[i], shards[:rs.DataShards], shards[i])
+		}
+	}
+	return nil
+}
+
+// Join concatenates the data shards and cuts the padding off at size
+func (rs *ReedSolomon) Join(shards [][]byte, size int) ([]byte, error) {
+	data := make([]byte, 0, size)
+	for _, shard := range shards[:rs.DataShards] {
+		if shard == nil {
+			return nil, ErrTooFewShards
+		}
+		data = append(data, shard...)
+	}
+	if len(data) < size {
+		return nil, fmt.Errorf("shards hold %d bytes, expected %d", len(data), size)
+	}
+	return data[:size], nil
+}
+
+// encodeRow sets out to the combination of inputs given by the coefficients of row
+func (rs *ReedSolomon) encodeRow(row []byte, inputs [][]byte, out []byte) {
+	clear(out)
+	for c, input := range inputs {
+		coefficient := row[c]
+		if coefficient == 0 {
+			continue
+		}
+		if coefficient == 1 {
+			for j, b := range input {
+				out[j] ^= b
+			}
+			continue
+		}
+		var table [256]byte
+		for b := 1; b < 256; b++ {
+			table[b] = gfMul(coefficient, byte(b))
+		}
+		for j, b := range input {
+			out[j] ^= table[b]
+		}
+	}
+}
+
+// multiplyMatrix returns the product of a and b
+func multiplyMatrix(a, b [][]byte) [][]byte {
+	result := make([][]byte, len(a))
+	for r := range a {
+		result[r] = make([]byte, len(b[0]))
+		for c := range result[r] {
+			var sum byte
+			for i := range b {
+				sum ^= gfMul(a[r][i], b[i][c])
+			}
+			result[r][c] = sum
+		}
+	}
+	return result
+}
+
+// invertMatrix returns the inverse of a square matrix by Gauss-Jordan elimination
+func invertMatrix(matrix [][]byte) ([][]byte, error) {
+	n := len(matrix)
+	work := make([][]byte, n)
+	for r := range matrix {
+		work[r] = make([]byte, 2*n)
+		copy(work[r], matrix[r])
+		work[r][n+r] = 1
+	}
+
+	for col := 0; col < n; col++ {
+		pivot := col
+		for pivot < n && work[pivot][col] == 0 {
+			pivot++
+		}
+		if pivot == n {
+			return nil, errors.New("matrix is singular")
+		}
+		work[col], work[pivot] = work[pivot], work[col]
+
+		scale := gfInv(work[col][col])
+		for c := range work[col] {
+			work[col][c] = gfMul(work[col][c], scale)
+		}
+		for r := 0; r < n; r++ {
+			if r == col || work[r][col] == 0 {
+				continue
+			}
+			factor := work[r][col]
+			for c := range work[r] {
+				work[r][c] ^= gfMul(factor, work[col][c])
+			}
+		}
+	}
+
+	inverse := make([][]byte, n)
+	for r := range work {
+		inverse[r] = work[r][n:]
+	}
+	return inverse, nil
+}
@@ -0,0 +1,50 @@
+package storage
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestReedSolomon_ReconstructsFromAnyDataShards(t *testing.T) {
+	rs, err := NewReedSolomon(4, 2)
+	if err != nil {
+		t.Fatalf("failed to create code: %v", err)
+	}
+
+	data := randomData(10007)
+	shards := rs.Split(data)
+	if err := rs.Encode(shards); err != nil {
+		t.Fatalf("failed to encode: %v", err)
+	}
+
+	// Every way of losing two of the six shards
+	for a := 0; a < 6; a++ {
+		for b := a + 1; b < 6; b++ {
+			damaged := make([][]byte, len(shards))
+			for i, shard := range shards {
+				if i != a && i != b {
+					damaged[i] = append([]byte(nil), shard...)
+				}
+			}
+
+			if err := rs.Reconstruct(damaged); err != nil {
+				t.Fatalf("failed to reconstruct without shards %d and %d: %v", a, b, err)
+			}
+			for i := range shards {
+				if !bytes.Equal(damaged[i], shards[i]) {
+					t.Errorf("shard %d differs after losing %d and %d", i, a, b)
+				}
+			}
+			joined, err := rs.Join(damaged, len(data))
+			if err != nil || !bytes.Equal(joined, data) {
+				t.Errorf("joined data differs after losing %d and %d (%v)", a, b, err)
+			}
+		}
+	}
+
+	// Three lost shards are one too many
+	shards[0], shards[3], shards[5] = nil, nil, nil
+	if err := rs.Reconstruct(shards); err != ErrTooFewShards {
+		t.Errorf("expected ErrTooFewShards, got %v", err)
+	}
+}
@@ -0,0 +1,314 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"sync"
+)
+
+// sealedRecordMagic starts a record sealed by Keyring.Seal. Plain records
+// are JSON documents, which never start with it.
+const sealedRecordMagic = "\x89CASKREC\n"
+
+// sealedFileMagic starts the header of a file created by NewSealedFile
+const sealedFileMagic = "\x89CASKSTG\n"
+
+// sealedSlotSize is the space a segment of a sealed file takes: its nonce,
+// its content and its authentication tag
+const sealedSlotSize = 12 + encryptionSegmentSize + 16
+
+// Seal encrypts a small record, such as a metadata file, with the active
+// master key. label names the record and is authenticated with it, so a
+// sealed record cannot be passed off as another. A nil keyring returns the
+// record as it is.
+func (k *Keyring) Seal(label string, plaintext []byte) ([]byte, error) {
+	if k == nil {
+		return plaintext, nil
+	}
+
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	aead := k.keys[k.active]
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	sealed := make([]byte, 0, len(sealedRecordMagic)+1+len(k.active)+len(nonce)+len(plaintext)+aead.Overhead())
+	sealed = append(sealed, sealedRecordMagic...)
+	sealed = append(sealed, byte(len(k.active)))
+	sealed = append(sealed, k.active...)
+	sealed = append(sealed, nonce...)
+	return aead.Seal(sealed, nonce, plaintext, []byte(label)), nil
+}
+
+// Unseal decrypts a record sealed by Seal. Records that are not sealed, such
+// as those written before encryption was enabled, are returned as they are.
+// A sealed record that fails to authenticate is reported as
+// ErrChecksumMismatch.
+func (k *Keyring) Unseal(label string, data []byte) ([]byte, error) {
+	if !bytes.HasPrefix(data, []byte(sealedRecordMagic)) {
+		return data, nil
+	}
+	if k == nil {
+		return nil, fmt.Errorf("record %s is encrypted but no key file is loaded", label)
+	}
+
+	keyID, rest, ok := splitSealedRecord(data)
+	if !ok {
+		return nil, fmt.Errorf("%w: record %s is truncated", ErrChecksumMismatch, label)
+	}
+	k.mu.RLock()
+	aead, exists := k.keys[keyID]
+	k.mu.RUnlock()
+	if !exists {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownKey, keyID)
+	}
+	if len(rest) < aead.NonceSize() {
+		return nil, fmt.Errorf("%w: record %s is truncated", ErrChecksumMismatch, label)
+	}
+
+	plaintext, err := aead.Open(nil, rest[:aead.NonceSize()], rest[aead.NonceSize():], []byte(label))
+	if err != nil {
+		return nil, fmt.Errorf("%w: record %s failed to decrypt", ErrChecksumMismatch, label)
+	}
+	return plaintext, nil
+}
+
+// NeedsSealing reports whether a record is plain or sealed with a master key
+// other than the active one, so that rotation seals it again
+func (k *Keyring) NeedsSealing(data []byte) bool {
+	keyID, _, ok := splitSealedRecord(data)
+	return !ok || keyID != k.Active()
+}
+
+// splitSealedRecord returns the ID of the master key a record is sealed
+// with, and the nonce and sealed content that follow it
+func splitSealedRecord(data []byte) (string, []byte, bool) {
+	rest, ok := bytes.CutPrefix(data, []byte(sealedRecordMagic))
+	if !ok || len(rest) == 0 || len(rest) < 1+int(rest[0]) {
+		return "", nil, false
+	}
+	return string(rest[1 : 1+rest[0]]), rest[1+rest[0]:], true
+}
+
+// SealedFile is a local file encrypted in segments that can be written and
+// read at any offset, for uploads staged before they are stored. The file
+// has its own data key, sealed with the master key in its header. Each
+// segment sits in a slot of its own and is sealed with a fresh nonce
+// whenever it is written, authenticated with its index and the file's label.
+// Segments are sealed whole, so the content reads as zeros up to the end of
+// its last segment, and a slot never written reads as zeros while its
+// segment is only partly written, but fails to decrypt when read.
+//
+// A file created without a keyring, or staged before sealed files existed,
+// is read and written as it is. A SealedFile may be used concurrently.
+type SealedFile struct {
+	mu     sync.Mutex
+	file   *os.File
+	aead   cipher.AEAD // Nil if the file is plain
+	label  string
+	offset int64 // Start of the content, after the header
+	cached int64 // Index of the segment in plain, or -1
+	plain  []byte
+	sealed []byte
+}
+
+// NewSealedFile writes the header of a new sealed file to file, which must
+// be empty and open for reading and writing, with a new data key. A nil
+// keyring gives a plain file. The SealedFile closes file when it is closed.
+func (k *Keyring) NewSealedFile(file *os.File, label string) (*SealedFile, error) {
+	header := binary.BigEndian.AppendUint32([]byte(sealedFileMagic), 0)
+	f := &SealedFile{file: file, label: label, cached: -1}
+	if k != nil {
+		dataKey, err := newDataKey()
+		if err != nil {
+			return nil, err
+		}
+		if f.aead, err = newGCM(dataKey); err != nil {
+			return nil, err
+		}
+		sealedKey, err := k.Seal(label, dataKey)
+		if err != nil {
+			return nil, err
+		}
+		header = binary.BigEndian.AppendUint32(header[:len(sealedFileMagic)], uint32(len(sealedKey)))
+		header = append(header, sealedKey...)
+	}
+
+	if _, err := file.WriteAt(header, 0); err != nil {
+		return nil, fmt.Errorf("failed to write sealed file header: %w", err)
+	}
+	f.offset = int64(len(header))
+	return f, nil
+}
+
+// OpenSealedFile reads the header of a file created by NewSealedFile, open
+// for reading and possibly writing. The SealedFile closes file when it is
+// closed.
+func (k *Keyring) OpenSealedFile(file *os.File, label string) (*SealedFile, error) {
+	f := &SealedFile{file: file, label: label, cached: -1}
+	header := make([]byte, len(sealedFileMagic)+4)
+	if _, err := file.ReadAt(header, 0); err != nil || !bytes.HasPrefix(header, []byte(sealedFileMagic)) {
+		return f, nil // Staged before sealed files existed
+	}
+	keySize := binary.BigEndian.Uint32(header[len(sealedFileMagic):])
+	f.offset = int64(len(header)) + int64(keySize)
+	if keySize == 0 {
+		return f, nil
+	}
+	if k == nil {
+		return nil, fmt.Errorf("file %s is encrypted but no key file is loaded", label)
+	}
+
+	sealedKey := make([]byte, keySize)
+	if _, err := file.ReadAt(sealedKey, int64(len(header))); err != nil {
+		return nil, fmt.Errorf("%w: header of %s is truncated", ErrChecksumMismatch, label)
+	}
+	dataKey, err := k.Unseal(label, sealedKey)
+	if err != nil {
+		return nil, err
+	}
+	if f.aead, err = newGCM(dataKey); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// WriteAt writes content at an offset, sealing every segment it touches
+// again
+func (f *SealedFile) WriteAt(p []byte, off int64) (int, error) {
+	if f.aead == nil {
+		return f.file.WriteAt(p, f.offset+off)
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	written := 0
+	for written < len(p) {
+		index := off / encryptionSegmentSize
+		start := off - index*encryptionSegmentSize
+		n := min(int64(len(p)-written), encryptionSegmentSize-start)
+
+		if start > 0 || n < encryptionSegmentSize {
+			if err := f.open(index, true); err != nil {
+				return written, err
+			}
+		} else {
+			f.plain = slices.Grow(f.plain[:0], encryptionSegmentSize)[:encryptionSegmentSize]
+		}
+		copy(f.plain[start:], p[written:written+int(n)])
+		if err := f.seal(index); err != nil {
+			return written, err
+		}
+		written += int(n)
+		off += n
+	}
+	return written, nil
+}
+
+// ReadAt reads content from an offset. Past the last segment written it
+// returns io.EOF.
+func (f *SealedFile) ReadAt(p []byte, off int64) (int, error) {
+	if f.aead == nil {
+		return f.file.ReadAt(p, f.offset+off)
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	read := 0
+	for read < len(p) {
+		index := off / encryptionSegmentSize
+		if err := f.open(index, false); err != nil {
+			return read, err
+		}
+		n := copy(p[read:], f.plain[off-index*encryptionSegmentSize:])
+		read += n
+		off += int64(n)
+	}
+	return read, nil
+}
+
+// open reads and decrypts a segment into plain, unless it is there already.
+// With fill, a slot never written gives a segment of zeros; without it, a
+// slot past the end of the file is io.EOF and any other is an error.
+func (f *SealedFile) open(index int64, fill bool) error {
+	if f.cached == index {
+		return nil
+	}
+	f.cached = -1
+
+	f.sealed = slices.Grow(f.sealed[:0], sealedSlotSize)[:sealedSlotSize]
+	n, err := f.file.ReadAt(f.sealed, f.offset+index*sealedSlotSize)
+	switch {
+	case n == 0 && err == io.EOF:
+		if !fill {
+			return io.EOF
+		}
+		f.zero()
+		return nil
+	case n < sealedSlotSize && err != io.EOF:
+		return fmt.Errorf("failed to read %s: %w", f.label, err)
+	case n < sealedSlotSize:
+		return fmt.Errorf("%w: segment %d of %s is truncated", ErrChecksumMismatch, index, f.label)
+	}
+
+	if fill && !slices.ContainsFunc(f.sealed, func(b byte) bool { return b != 0 }) {
+		f.zero()
+		return nil
+	}
+	nonceSize := f.aead.NonceSize()
+	plain, err := f.aead.Open(f.plain[:0], f.sealed[:nonceSize], f.sealed[nonceSize:], f.segmentData(index))
+	if err != nil {
+		return fmt.Errorf("%w: segment %d of %s failed to decrypt", ErrChecksumMismatch, index, f.label)
+	}
+	f.plain = plain
+	f.cached = index
+	return nil
+}
+
+// zero fills plain with a segment of zeros
+func (f *SealedFile) zero() {
+	f.plain = slices.Grow(f.plain[:0], encryptionSegmentSize)[:encryptionSegmentSize]
+	clear(f.plain)
+}
+
+// seal encrypts the segment in plain with a fresh nonce and writes it to
+// its slot
+func (f *SealedFile) seal(index int64) error {
+	f.cached = -1
+	nonce := make([]byte, f.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	f.sealed = f.aead.Seal(append(f.sealed[:0], nonce...), nonce, f.plain, f.segmentData(index))
+	if _, err := f.file.WriteAt(f.sealed, f.offset+index*sealedSlotSize); err != nil {
+		return fmt.Errorf("failed to write %s: %w", f.label, err)
+	}
+	f.cached = index
+	return nil
+}
+
+// segmentData returns the data authenticated with a segment: the file's
+// label and the segment's index
+func (f *SealedFile) segmentData(index int64) []byte {
+	return binary.BigEndian.AppendUint64([]byte(f.label), uint64(index))
+}
+
+// Sync commits the file to stable storage
+func (f *SealedFile) Sync() error {
+	return f.file.Sync()
+}
+
+// Close closes the file
+func (f *SealedFile) Close() error {
+	return f.file.Close()
+}
@@ -0,0 +1,239 @@
+package storage
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"io"
+	"sort"
+	"time"
+)
+
+// ErrChecksumMismatch is returned when the content of a replica does not hash to its object ID
+var ErrChecksumMismatch = errors.New("object content does not match its ID")
+
+// verifyingReader hashes an object while it is read and checks the result
+// against the object ID once the underlying reader reaches EOF
+type verifyingReader struct {
+	io.ReadCloser
+	objectID   string
+	hasher     hash.Hash
+	onMismatch func()
+	err        error
+}
+
+// newVerifyingReader wraps reader so that reading it to the end verifies its
+// content. onMismatch is called once if the content turns out to be corrupt.
+func newVerifyingReader(reader io.ReadCloser, objectID string, onMismatch func()) *verifyingReader {
+	return &verifyingReader{
+		ReadCloser: reader,
+		objectID:   objectID,
+		hasher:     sha256.New(),
+		onMismatch: onMismatch,
+	}
+}
+
+func (r *verifyingReader) Read(p []byte) (int, error) {
+	if r.err != nil {
+		return 0, r.err
+	}
+
+	n, err := r.ReadCloser.Read(p)
+	r.hasher.Write(p[:n])
+	if errors.Is(err, ErrChecksumMismatch) {
+		// The replica failed to decompress
+		r.err = err
+		if r.onMismatch != nil {
+			r.onMismatch()
+		}
+		return n, r.err
+	}
+	if err == io.EOF {
+		if hex.EncodeToString(r.hasher.Sum(nil)) != r.objectID {
+			r.err = ErrChecksumMismatch
+			if r.onMismatch != nil {
+				r.onMismatch()
+			}
+			return n, r.err
+		}
+		r.err = io.EOF
+	}
+
+	return n, err
+}
+
+// ObjectReader gives random access to an object, as needed to serve HTTP
+// ranges. The object is read from a single replica file or, if it was split
+// into chunks, from one replica file per chunk, each opened once the read
+// reaches it. Content is verified whenever a chunk is read sequentially from
+// its start to its end: the final read of a corrupt replica fails with
+// ErrChecksumMismatch instead of returning its last bytes. Ranges that do
+// not cover a whole chunk cannot be verified and are left to the scrubber.
+type ObjectReader struct {
+	segments []*segment
+	size     int64
+	modTime  time.Time
+	pos      int64
+	open     func(chunk Chunk) (io.ReadSeekCloser, func(), error)
+	err      error
+}
+
+// segment is the part of an object held in one replica file or decoded
+// from one chunk's shards
+type segment struct {
+	chunk      Chunk
+	offset     int64 // Position of the first byte in the object
+	size       int64
+	file       io.ReadSeekCloser
+	filePos    int64
+	hasher     hash.Hash
+	hashed     int64 // Bytes from the start fed to the hasher
+	verified   bool
+	onMismatch func()
+}
+
+// newObjectReader wraps an open replica file. onMismatch is called once if
+// the content turns out to be corrupt.
+func newObjectReader(file Object, objectID string, onMismatch func()) *ObjectReader {
+	return &ObjectReader{
+		segments: []*segment{{
+			chunk:      Chunk{ID: objectID, Size: file.Size()},
+			size:       file.Size(),
+			file:       file,
+			hasher:     sha256.New(),
+			onMismatch: onMismatch,
+		}},
+		size:    file.Size(),
+		modTime: file.ModTime(),
+	}
+}
+
+// newChunkedReader reads an object made of chunks. open returns the content
+// of a chunk and a function to call if it turns out to be corrupt.
+func newChunkedReader(chunks []Chunk, open func(chunk Chunk) (io.ReadSeekCloser, func(), error)) *ObjectReader {
+	r := &ObjectReader{
+		segments: make([]*segment, 0, len(chunks)),
+		open:     open,
+	}
+	for _, chunk := range chunks {
+		r.segments = append(r.segments, &segment{
+			chunk:  chunk,
+			offset: r.size,
+			size:   chunk.Size,
+			hasher: sha256.New(),
+		})
+		r.size += chunk.Size
+	}
+	return r
+}
+
+// Size returns the size of the object in bytes
+func (r *ObjectReader) Size() int64 {
+	return r.size
+}
+
+// ModTime returns the modification time of the replica file, or the zero
+// time for a chunked object
+func (r *ObjectReader) ModTime() time.Time {
+	return r.modTime
+}
+
+func (r *ObjectReader) Read(p []byte) (int, error) {
+	if r.err != nil {
+		return 0, r.err
+	}
+	if r.pos >= r.size {
+		return 0, io.EOF
+	}
+
+	seg := r.segments[sort.Search(len(r.segments), func(i int) bool {
+		return r.segments[i].offset+r.segments[i].size > r.pos
+	})]
+	if seg.file == nil {
+		file, onMismatch, err := r.open(seg.chunk)
+		if err != nil {
+			r.err = err
+			return 0, err
+		}
+		seg.file, seg.onMismatch = file, onMismatch
+	}
+
+	offset := r.pos - seg.offset
+	if seg.filePos != offset {
+		if _, err := seg.file.Seek(offset, io.SeekStart); err != nil {
+			return 0, err
+		}
+		seg.filePos = offset
+	}
+
+	n, err := seg.file.Read(p[:min(int64(len(p)), seg.size-offset)])
+	seg.filePos += int64(n)
+	if errors.Is(err, ErrChecksumMismatch) {
+		// The replica failed to decompress
+		r.err = err
+		if seg.onMismatch != nil {
+			seg.onMismatch()
+		}
+		return 0, r.err
+	}
+	if offset == seg.hashed {
+		seg.hasher.Write(p[:n])
+		seg.hashed += int64(n)
+	}
+	r.pos += int64(n)
+
+	// Check before handing out the last bytes, so a client reading the
+	// whole object never receives a complete corrupt body. A file shorter
+	// than the chunk it holds is corrupt too.
+	truncated := n == 0 && err == io.EOF
+	if truncated || (n > 0 && seg.hashed == seg.size && !seg.verified) {
+		if truncated || hex.EncodeToString(seg.hasher.Sum(nil)) != seg.chunk.ID {
+			r.err = ErrChecksumMismatch
+			if seg.onMismatch != nil {
+				seg.onMismatch()
+			}
+			return 0, r.err
+		}
+		seg.verified = true
+	}
+
+	if err == io.EOF {
+		err = nil
+	}
+	return n, err
+}
+
+func (r *ObjectReader) Seek(offset int64, whence int) (int64, error) {
+	var pos int64
+	switch whence {
+	case io.SeekStart:
+		pos = offset
+	case io.SeekCurrent:
+		pos = r.pos + offset
+	case io.SeekEnd:
+		pos = r.size + offset
+	default:
+		return r.pos, errors.New("invalid whence")
+	}
+	if pos < 0 {
+		return r.pos, errors.New("negative position")
+	}
+
+	r.pos = pos
+	return pos, nil
+}
+
+// Close closes every replica file opened by the reader
+func (r *ObjectReader) Close() error {
+	var firstErr error
+	for _, seg := range r.segments {
+		if seg.file == nil {
+			continue
+		}
+		if err := seg.file.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
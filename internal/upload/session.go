@@ -0,0 +1,594 @@
+package upload
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/caskos/caskos/internal/storage"
+)
+
+// DefaultTTL is how long a session may go without receiving data before it
+// is garbage-collected
+const DefaultTTL = 24 * time.Hour
+
+// Errors returned by session operations
+var (
+	ErrSessionNotFound  = errors.New("upload session not found")
+	ErrOutOfRange       = errors.New("part extends past the declared upload size")
+	ErrIncomplete       = errors.New("upload is missing data")
+	ErrFinished         = errors.New("upload is already finished")
+	ErrChecksumMismatch = errors.New("part does not match its checksum")
+	ErrOffsetMismatch   = errors.New("part does not start at the upload offset")
+)
+
+// Config controls where sessions are kept and when they expire
+type Config struct {
+	Dir     string           // Directory holding one subdirectory per session
+	TTL     time.Duration    // Idle time after which a session is discarded
+	Keyring *storage.Keyring // Seals session files and staged data; nil leaves them plain
+}
+
+// Range is a half-open byte range [Start, End)
+type Range struct {
+	Start int64 `json:"start"`
+	End   int64 `json:"end"`
+}
+
+// Session is a resumable upload. Parts may arrive in any order and be sent
+// again; Received records which bytes have been durably written.
+type Session struct {
+	ID          string            `json:"id"`
+	Size        int64             `json:"size"`
+	ContentType string            `json:"content_type"`
+	Metadata    map[string]string `json:"metadata,omitempty"`
+	CreatedAt   time.Time         `json:"created_at"`
+	ExpiresAt   time.Time         `json:"expires_at"`
+	Received    []Range           `json:"received"`
+	ObjectID    string            `json:"object_id,omitempty"` // Set once the upload is stored
+}
+
+// ReceivedBytes returns how many bytes of the upload have been received
+func (s *Session) ReceivedBytes() int64 {
+	var total int64
+	for _, r := range s.Received {
+		total += r.End - r.Start
+	}
+	return total
+}
+
+// Complete reports whether every byte of the upload has been received
+func (s *Session) Complete() bool {
+	return s.ReceivedBytes() == s.Size
+}
+
+// Offset returns how many bytes have been received from the start of the
+// upload without a gap
+func (s *Session) Offset() int64 {
+	if len(s.Received) == 0 || s.Received[0].Start != 0 {
+		return 0
+	}
+	return s.Received[0].End
+}
+
+// ResumeOffset returns the offset a client sending the upload in order
+// resumes from. An upload that holds all its data but is not stored yet
+// reports its last byte as missing, so the client sends it again and
+// storing the upload is retried then.
+func (s *Session) ResumeOffset() int64 {
+	offset := s.Offset()
+	if s.Complete() && s.ObjectID == "" && offset > 0 {
+		return offset - 1
+	}
+	return offset
+}
+
+// addRange records a received range, merging it with overlapping and
+// adjacent ranges
+func (s *Session) addRange(r Range) {
+	ranges := append(s.Received, r)
+	sort.Slice(ranges, func(i, j int) bool { return ranges[i].Start < ranges[j].Start })
+
+	merged := ranges[:1]
+	for _, next := range ranges[1:] {
+		last := &merged[len(merged)-1]
+		if next.Start <= last.End {
+			last.End = max(last.End, next.End)
+			continue
+		}
+		merged = append(merged, next)
+	}
+	s.Received = merged
+}
+
+// Checksum is the expected digest of a part. The part is hashed as it is
+// received and discarded if the digest does not match.
+type Checksum struct {
+	Hash hash.Hash
+	Sum  []byte
+}
+
+// Sessions stores resumable uploads on local disk. Each session is a
+// directory holding session.json and a sparse data file that parts are
+// written into at their offsets. With a keyring both are sealed.
+type Sessions struct {
+	mu        sync.Mutex
+	config    Config
+	logger    *slog.Logger
+	appending map[string]bool      // Sessions an AppendPart is writing to
+	files     map[string]*dataFile // Data files open for writing or reading
+}
+
+// dataFile is the data file of a session, shared by everything writing to
+// or reading it, so writes to the same segment of a sealed file never race
+type dataFile struct {
+	*storage.SealedFile
+	users int
+}
+
+// New creates the session directory
+func New(config Config, logger *slog.Logger) (*Sessions, error) {
+	if config.TTL <= 0 {
+		config.TTL = DefaultTTL
+	}
+	if err := os.MkdirAll(config.Dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create upload directory: %w", err)
+	}
+
+	return &Sessions{
+		config:    config,
+		logger:    logger,
+		appending: make(map[string]bool),
+		files:     make(map[string]*dataFile),
+	}, nil
+}
+
+// Create starts a session for an upload of the given size. metadata holds
+// client-supplied values kept with the session and may be nil.
+func (s *Sessions) Create(size int64, contentType string, metadata map[string]string) (*Session, error) {
+	if size < 0 {
+		return nil, fmt.Errorf("upload size must not be negative")
+	}
+
+	id, err := newSessionID()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	session := &Session{
+		ID:          id,
+		Size:        size,
+		ContentType: contentType,
+		Metadata:    metadata,
+		CreatedAt:   now,
+		ExpiresAt:   now.Add(s.config.TTL),
+		Received:    []Range{},
+	}
+
+	dir := s.sessionDir(id)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create session directory: %w", err)
+	}
+	file, err := os.Create(filepath.Join(dir, "data"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create session data file: %w", err)
+	}
+	sealed, err := s.config.Keyring.NewSealedFile(file, id+"/data")
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to create session data file: %w", err)
+	}
+	sealed.Close()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.save(session); err != nil {
+		return nil, err
+	}
+
+	return session, nil
+}
+
+// Get reads a session
+func (s *Sessions) Get(id string) (*Session, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.load(id)
+}
+
+// WritePart writes data at offset and records the bytes received. length is
+// the size of the part if known, or -1; a part known to extend past the
+// upload is refused before anything is written. If the data stream fails
+// part way, the bytes that arrived are still recorded, so the client can
+// resume from the end of the received ranges.
+//
+// With a checksum, the part is staged in a file of its own and copied into
+// the data file only if it arrives whole and matches, so a part that fails
+// the check leaves the data received before untouched.
+func (s *Sessions) WritePart(id string, offset, length int64, data io.Reader, checksum *Checksum) (*Session, error) {
+	session, err := s.Get(id)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkPart(session, offset, length); err != nil {
+		return nil, err
+	}
+	return s.writePart(session, offset, data, checksum)
+}
+
+// AppendPart writes a part like WritePart, for clients that send an upload
+// in order. The part must start at the session's ResumeOffset, checked under
+// the lock, and only one appended part is written to a session at a time; a
+// part arriving meanwhile fails with ErrOffsetMismatch. Once the upload is
+// complete, finish is called to store it before another part is accepted.
+func (s *Sessions) AppendPart(id string, offset, length int64, data io.Reader, checksum *Checksum, finish func(*Session) (*Session, error)) (*Session, error) {
+	s.mu.Lock()
+	session, err := s.load(id)
+	if err == nil {
+		err = checkPart(session, offset, length)
+	}
+	if err == nil && (s.appending[id] || offset != session.ResumeOffset()) {
+		err = ErrOffsetMismatch
+	}
+	if err != nil {
+		s.mu.Unlock()
+		return nil, err
+	}
+	s.appending[id] = true
+	s.mu.Unlock()
+
+	defer func() {
+		s.mu.Lock()
+		delete(s.appending, id)
+		s.mu.Unlock()
+	}()
+	session, err = s.writePart(session, offset, data, checksum)
+	if err != nil || !session.Complete() || session.ObjectID != "" {
+		return session, err
+	}
+	return finish(session)
+}
+
+// checkPart checks that a part of the given length fits a session that
+// still accepts data
+func checkPart(session *Session, offset, length int64) error {
+	if session.ObjectID != "" {
+		return ErrFinished
+	}
+	if offset < 0 || offset > session.Size || (length >= 0 && length > session.Size-offset) {
+		return ErrOutOfRange
+	}
+	return nil
+}
+
+// writePart writes a checked part to the data file and records it
+func (s *Sessions) writePart(session *Session, offset int64, data io.Reader, checksum *Checksum) (*Session, error) {
+	id := session.ID
+	s.mu.Lock()
+	file, err := s.openData(id)
+	s.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	defer s.closeData(id)
+
+	var n int64
+	var copyErr error
+	if checksum == nil {
+		n, copyErr = receive(io.NewOffsetWriter(file, offset), data, session.Size-offset)
+	} else {
+		n, copyErr = s.receiveChecked(id, io.NewOffsetWriter(file, offset), data, session.Size-offset, checksum)
+	}
+	if err := file.Sync(); err != nil {
+		return nil, fmt.Errorf("failed to sync session data file: %w", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// The session may have been completed or aborted meanwhile
+	session, err = s.load(id)
+	if err != nil {
+		return nil, err
+	}
+	if n > 0 {
+		session.addRange(Range{Start: offset, End: offset + n})
+	}
+	session.ExpiresAt = time.Now().Add(s.config.TTL)
+	if err := s.save(session); err != nil {
+		return nil, err
+	}
+
+	if copyErr != nil {
+		if errors.Is(copyErr, ErrOutOfRange) || errors.Is(copyErr, ErrChecksumMismatch) {
+			return session, copyErr
+		}
+		return session, fmt.Errorf("failed to receive part: %w", copyErr)
+	}
+	return session, nil
+}
+
+// receive copies a part of at most limit bytes and fails if it is longer
+func receive(w io.Writer, data io.Reader, limit int64) (int64, error) {
+	n, err := io.Copy(w, io.LimitReader(data, limit))
+	if err == nil {
+		var extra [1]byte
+		if m, _ := data.Read(extra[:]); m > 0 {
+			err = ErrOutOfRange
+		}
+	}
+	return n, err
+}
+
+// receiveChecked stages a part in a temporary file of the session and
+// copies it to w only once it arrived whole and matches its checksum
+func (s *Sessions) receiveChecked(id string, w io.Writer, data io.Reader, limit int64, checksum *Checksum) (int64, error) {
+	file, err := os.CreateTemp(s.sessionDir(id), "part-*")
+	if err != nil {
+		return 0, fmt.Errorf("failed to create part file: %w", err)
+	}
+	defer os.Remove(file.Name())
+	staged, err := s.config.Keyring.NewSealedFile(file, id+"/"+filepath.Base(file.Name()))
+	if err != nil {
+		file.Close()
+		return 0, fmt.Errorf("failed to create part file: %w", err)
+	}
+	defer staged.Close()
+
+	n, err := receive(io.MultiWriter(io.NewOffsetWriter(staged, 0), checksum.Hash), data, limit)
+	if err != nil {
+		return 0, err
+	}
+	if !bytes.Equal(checksum.Hash.Sum(nil), checksum.Sum) {
+		return 0, ErrChecksumMismatch
+	}
+	return io.Copy(w, io.NewSectionReader(staged, 0, n))
+}
+
+// Open returns the assembled data of a complete session
+func (s *Sessions) Open(id string) (io.ReadCloser, *Session, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	session, err := s.load(id)
+	if err != nil {
+		return nil, nil, err
+	}
+	if session.ObjectID != "" {
+		return nil, session, ErrFinished
+	}
+	if !session.Complete() {
+		return nil, session, ErrIncomplete
+	}
+
+	file, err := s.openData(id)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &dataReader{io.NewSectionReader(file, 0, session.Size), func() { s.closeData(id) }}, session, nil
+}
+
+// dataReader reads the data of a complete session
+type dataReader struct {
+	*io.SectionReader
+	release func()
+}
+
+// Close releases the data file
+func (r *dataReader) Close() error {
+	r.release()
+	return nil
+}
+
+// openData opens the data file of a session, or shares it if it is open
+// already. The caller must hold the lock, and release the file with
+// closeData.
+func (s *Sessions) openData(id string) (*storage.SealedFile, error) {
+	if file, ok := s.files[id]; ok {
+		file.users++
+		return file.SealedFile, nil
+	}
+
+	file, err := os.OpenFile(filepath.Join(s.sessionDir(id), "data"), os.O_RDWR, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open session data file: %w", err)
+	}
+	sealed, err := s.config.Keyring.OpenSealedFile(file, id+"/data")
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to open session data file: %w", err)
+	}
+	s.files[id] = &dataFile{SealedFile: sealed, users: 1}
+	return sealed, nil
+}
+
+// closeData releases a data file opened by openData, closing it once
+// nothing uses it
+func (s *Sessions) closeData(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	file := s.files[id]
+	if file.users--; file.users == 0 {
+		delete(s.files, id)
+		file.Close()
+	}
+}
+
+// Finish records the object a complete upload was stored as and discards
+// its data. The session is kept until it expires, so clients can still look
+// up the result.
+func (s *Sessions) Finish(id, objectID string) (*Session, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	session, err := s.load(id)
+	if err != nil {
+		return nil, err
+	}
+	if !session.Complete() {
+		return nil, ErrIncomplete
+	}
+
+	session.ObjectID = objectID
+	session.ExpiresAt = time.Now().Add(s.config.TTL)
+	if err := s.save(session); err != nil {
+		return nil, err
+	}
+	if err := os.Remove(filepath.Join(s.sessionDir(id), "data")); err != nil && !os.IsNotExist(err) {
+		s.logger.Warn("failed to remove finished upload data", "session_id", id, "error", err)
+	}
+	return session, nil
+}
+
+// Remove discards a session and its data
+func (s *Sessions) Remove(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, err := s.load(id); err != nil {
+		return err
+	}
+	if err := os.RemoveAll(s.sessionDir(id)); err != nil {
+		return fmt.Errorf("failed to remove session: %w", err)
+	}
+	return nil
+}
+
+// Run removes expired sessions periodically until the context is cancelled
+func (s *Sessions) Run(ctx context.Context) {
+	interval := max(s.config.TTL/4, time.Second)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+
+		if _, err := s.Expire(time.Now()); err != nil {
+			s.logger.Error("failed to expire upload sessions", "error", err)
+		}
+	}
+}
+
+// Expire removes the sessions that expired before now and returns how many
+// were removed
+func (s *Sessions) Expire(now time.Time) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entries, err := os.ReadDir(s.config.Dir)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read upload directory: %w", err)
+	}
+
+	removed := 0
+	for _, entry := range entries {
+		if !entry.IsDir() || !validSessionID(entry.Name()) {
+			continue
+		}
+
+		session, err := s.load(entry.Name())
+		if errors.Is(err, ErrSessionNotFound) {
+			// Left behind by a crash while the session was created
+			info, infoErr := entry.Info()
+			if infoErr != nil || now.Sub(info.ModTime()) < s.config.TTL {
+				continue
+			}
+		} else if err != nil {
+			s.logger.Warn("skipping unreadable upload session", "session_id", entry.Name(), "error", err)
+			continue
+		} else if now.Before(session.ExpiresAt) {
+			continue
+		}
+
+		if err := os.RemoveAll(s.sessionDir(entry.Name())); err != nil {
+			return removed, fmt.Errorf("failed to remove session: %w", err)
+		}
+		removed++
+		s.logger.Info("expired upload session", "session_id", entry.Name())
+	}
+
+	return removed, nil
+}
+
+// load reads a session; the caller must hold the lock
+func (s *Sessions) load(id string) (*Session, error) {
+	if !validSessionID(id) {
+		return nil, ErrSessionNotFound
+	}
+
+	data, err := os.ReadFile(filepath.Join(s.sessionDir(id), "session.json"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, ErrSessionNotFound
+		}
+		return nil, fmt.Errorf("failed to read session file: %w", err)
+	}
+	if data, err = s.config.Keyring.Unseal(id+"/session.json", data); err != nil {
+		return nil, fmt.Errorf("failed to unseal session: %w", err)
+	}
+
+	var session Session
+	if err := json.Unmarshal(data, &session); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal session: %w", err)
+	}
+	return &session, nil
+}
+
+// save atomically writes a session; the caller must hold the lock
+func (s *Sessions) save(session *Session) error {
+	data, err := json.MarshalIndent(session, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal session: %w", err)
+	}
+	if data, err = s.config.Keyring.Seal(session.ID+"/session.json", data); err != nil {
+		return fmt.Errorf("failed to seal session: %w", err)
+	}
+
+	path := filepath.Join(s.sessionDir(session.ID), "session.json")
+	if err := os.WriteFile(path+".tmp", data, 0644); err != nil {
+		return fmt.Errorf("failed to write session file: %w", err)
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return fmt.Errorf("failed to write session file: %w", err)
+	}
+	return nil
+}
+
+// sessionDir returns the directory of a session
+func (s *Sessions) sessionDir(id string) string {
+	return filepath.Join(s.config.Dir, id)
+}
+
+// newSessionID returns a random session ID
+func newSessionID() (string, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", fmt.Errorf("failed to generate session ID: %w", err)
+	}
+	return hex.EncodeToString(b[:]), nil
+}
+
+// validSessionID reports whether id has the form of a session ID, so it is
+// safe to use in a path
+func validSessionID(id string) bool {
+	if len(id) != 32 {
+		return false
+	}
+	_, err := hex.DecodeString(id)
+	return err == nil
+}
@@ -0,0 +1,258 @@
+package upload
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"errors"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/caskos/caskos/internal/storage"
+)
+
+func newTestSessions(t *testing.T, ttl time.Duration) *Sessions {
+	t.Helper()
+
+	tmpDir, err := os.MkdirTemp("", "upload-test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(tmpDir) })
+
+	logger := slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelError}))
+	sessions, err := New(Config{Dir: tmpDir, TTL: ttl}, logger)
+	if err != nil {
+		t.Fatalf("failed to create sessions: %v", err)
+	}
+	return sessions
+}
+
+// failingReader returns its data and then an error, like a dropped connection
+type failingReader struct {
+	data io.Reader
+}
+
+func (r *failingReader) Read(p []byte) (int, error) {
+	n, err := r.data.Read(p)
+	if err == io.EOF {
+		return n, errors.New("connection reset")
+	}
+	return n, err
+}
+
+func TestSessions_PartsInAnyOrderAndResume(t *testing.T) {
+	sessions := newTestSessions(t, time.Hour)
+	content := "0123456789abcdefghij"
+
+	session, err := sessions.Create(int64(len(content)), "text/plain", nil)
+	if err != nil {
+		t.Fatalf("failed to create session: %v", err)
+	}
+
+	// The tail arrives first, then the head is cut off part way
+	if _, err := sessions.WritePart(session.ID, 15, 5, strings.NewReader(content[15:]), nil); err != nil {
+		t.Fatalf("failed to write part: %v", err)
+	}
+	session, err = sessions.WritePart(session.ID, 0, -1, &failingReader{strings.NewReader(content[:6])}, nil)
+	if err == nil {
+		t.Fatal("expected the dropped part to fail")
+	}
+	if len(session.Received) != 2 || session.Received[0] != (Range{0, 6}) || session.Received[1] != (Range{15, 20}) {
+		t.Fatalf("expected the received bytes to be kept, got %+v", session.Received)
+	}
+
+	if _, _, err := sessions.Open(session.ID); !errors.Is(err, ErrIncomplete) {
+		t.Errorf("expected ErrIncomplete, got %v", err)
+	}
+
+	// Resume from the end of the first range, overlapping the tail
+	session, err = sessions.WritePart(session.ID, 6, 11, strings.NewReader(content[6:17]), nil)
+	if err != nil {
+		t.Fatalf("failed to write part: %v", err)
+	}
+	if len(session.Received) != 1 || !session.Complete() {
+		t.Fatalf("expected one complete range, got %+v", session.Received)
+	}
+
+	if _, err := sessions.WritePart(session.ID, 18, 8, strings.NewReader("too long"), nil); !errors.Is(err, ErrOutOfRange) {
+		t.Errorf("expected ErrOutOfRange, got %v", err)
+	}
+
+	file, _, err := sessions.Open(session.ID)
+	if err != nil {
+		t.Fatalf("failed to open session: %v", err)
+	}
+	data, _ := io.ReadAll(file)
+	file.Close()
+	if string(data) != content {
+		t.Errorf("expected %q, got %q", content, data)
+	}
+}
+
+func TestSessions_ExpireIdleSessions(t *testing.T) {
+	sessions := newTestSessions(t, time.Hour)
+
+	idle, err := sessions.Create(10, "", nil)
+	if err != nil {
+		t.Fatalf("failed to create session: %v", err)
+	}
+	active, err := sessions.Create(10, "", nil)
+	if err != nil {
+		t.Fatalf("failed to create session: %v", err)
+	}
+
+	// Writing a part extends the session's life
+	later := time.Now().Add(50 * time.Minute)
+	sessions.config.TTL = 2 * time.Hour
+	if _, err := sessions.WritePart(active.ID, 0, 5, strings.NewReader("01234"), nil); err != nil {
+		t.Fatalf("failed to write part: %v", err)
+	}
+
+	removed, err := sessions.Expire(later.Add(20 * time.Minute))
+	if err != nil {
+		t.Fatalf("failed to expire sessions: %v", err)
+	}
+	if removed != 1 {
+		t.Errorf("expected one expired session, got %d", removed)
+	}
+	if _, err := sessions.Get(idle.ID); !errors.Is(err, ErrSessionNotFound) {
+		t.Errorf("expected the idle session to be gone, got %v", err)
+	}
+	if _, err := sessions.Get(active.ID); err != nil {
+		t.Errorf("expected the active session to remain, got %v", err)
+	}
+}
+
+func TestSessions_ChecksumAndFinish(t *testing.T) {
+	sessions := newTestSessions(t, time.Hour)
+
+	session, err := sessions.Create(5, "text/plain", map[string]string{"filename": "digits.txt"})
+	if err != nil {
+		t.Fatalf("failed to create session: %v", err)
+	}
+
+	// A part that does not match its checksum is not recorded
+	wrong := sha1.Sum([]byte("other"))
+	_, err = sessions.WritePart(session.ID, 0, 5, strings.NewReader("01234"), &Checksum{Hash: sha1.New(), Sum: wrong[:]})
+	if !errors.Is(err, ErrChecksumMismatch) {
+		t.Fatalf("expected ErrChecksumMismatch, got %v", err)
+	}
+	if session, _ = sessions.Get(session.ID); session.Offset() != 0 {
+		t.Fatalf("expected nothing received, got offset %d", session.Offset())
+	}
+
+	right := sha1.Sum([]byte("01234"))
+	session, err = sessions.WritePart(session.ID, 0, 5, strings.NewReader("01234"), &Checksum{Hash: sha1.New(), Sum: right[:]})
+	if err != nil {
+		t.Fatalf("failed to write part: %v", err)
+	}
+	if session.Offset() != 5 || session.Metadata["filename"] != "digits.txt" {
+		t.Fatalf("expected offset 5 and the metadata kept, got %+v", session)
+	}
+
+	// A part failing its checksum leaves the data received before intact
+	_, err = sessions.WritePart(session.ID, 0, 5, strings.NewReader("xxxxx"), &Checksum{Hash: sha1.New(), Sum: right[:]})
+	if !errors.Is(err, ErrChecksumMismatch) {
+		t.Fatalf("expected ErrChecksumMismatch, got %v", err)
+	}
+	file, _, err := sessions.Open(session.ID)
+	if err != nil {
+		t.Fatalf("failed to open session: %v", err)
+	}
+	data, _ := io.ReadAll(file)
+	file.Close()
+	if string(data) != "01234" {
+		t.Fatalf("expected the received data to be kept, got %q", data)
+	}
+	if entries, _ := os.ReadDir(sessions.sessionDir(session.ID)); len(entries) != 2 {
+		t.Errorf("expected no staged parts left, got %d files", len(entries))
+	}
+
+	// A finished session keeps its result but accepts no more data
+	if _, err := sessions.Finish(session.ID, "object"); err != nil {
+		t.Fatalf("failed to finish session: %v", err)
+	}
+	if session, _ = sessions.Get(session.ID); session.ObjectID != "object" {
+		t.Errorf("expected the object ID to be recorded, got %q", session.ObjectID)
+	}
+	if _, _, err := sessions.Open(session.ID); !errors.Is(err, ErrFinished) {
+		t.Errorf("expected ErrFinished opening a finished session, got %v", err)
+	}
+	if _, err := sessions.WritePart(session.ID, 0, 5, strings.NewReader("01234"), nil); !errors.Is(err, ErrFinished) {
+		t.Errorf("expected ErrFinished writing to a finished session, got %v", err)
+	}
+}
+
+func TestSessions_Encrypted(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "upload-test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	keyPath := filepath.Join(tmpDir, "keys.json")
+	key := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, 32))
+	os.WriteFile(keyPath, []byte(`{"active":"k1","keys":{"k1":"`+key+`"}}`), 0600)
+	keyring, err := storage.LoadKeyring(keyPath)
+	if err != nil {
+		t.Fatalf("failed to load keyring: %v", err)
+	}
+	logger := slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelError}))
+	sessions, err := New(Config{Dir: filepath.Join(tmpDir, "uploads"), TTL: time.Hour, Keyring: keyring}, logger)
+	if err != nil {
+		t.Fatalf("failed to create sessions: %v", err)
+	}
+
+	content := make([]byte, 300000)
+	rand.Read(content)
+	session, err := sessions.Create(int64(len(content)), "text/plain", map[string]string{"filename": "secret.txt"})
+	if err != nil {
+		t.Fatalf("failed to create session: %v", err)
+	}
+
+	// Parts written at once, across segments and at unaligned offsets, one
+	// of them staged for its checksum
+	cuts := []int{0, 100000, 200000, len(content)}
+	errs := make(chan error, len(cuts)-1)
+	for i := range len(cuts) - 1 {
+		go func() {
+			part := content[cuts[i]:cuts[i+1]]
+			var checksum *Checksum
+			if i == 1 {
+				sum := sha1.Sum(part)
+				checksum = &Checksum{Hash: sha1.New(), Sum: sum[:]}
+			}
+			_, err := sessions.WritePart(session.ID, int64(cuts[i]), int64(len(part)), bytes.NewReader(part), checksum)
+			errs <- err
+		}()
+	}
+	for range len(cuts) - 1 {
+		if err := <-errs; err != nil {
+			t.Fatalf("failed to write part: %v", err)
+		}
+	}
+
+	for _, name := range []string{"data", "session.json"} {
+		raw, _ := os.ReadFile(filepath.Join(sessions.sessionDir(session.ID), name))
+		if bytes.Contains(raw, content[1000:1100]) || bytes.Contains(raw, []byte("secret.txt")) {
+			t.Errorf("expected %s to be sealed", name)
+		}
+	}
+
+	file, session, err := sessions.Open(session.ID)
+	if err != nil {
+		t.Fatalf("failed to open session: %v", err)
+	}
+	data, err := io.ReadAll(file)
+	file.Close()
+	if err != nil || !bytes.Equal(data, content) || session.Metadata["filename"] != "secret.txt" {
+		t.Errorf("expected the upload to read back, got %d bytes (%v)", len(data), err)
+	}
+}
@@ -2,19 +2,28 @@ package test
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"io"
+	"math/rand"
 	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/caskos/caskos/internal/api"
 	"github.com/caskos/caskos/internal/hashring"
 	"github.com/caskos/caskos/internal/metadata"
 	"github.com/caskos/caskos/internal/storage"
+	"github.com/caskos/caskos/internal/upload"
 	"log/slog"
 )
 
@@ -130,3 +139,997 @@ func TestUploadDownloadRoundTrip(t *testing.T) {
 	}
 }
 
+
+// newTestServer creates an API server backed by three storage nodes with replication 2
+func newTestServer(t *testing.T) (*api.Server, *storage.Manager, *metadata.Store) {
+	t.Helper()
+
+	// Self-healing runs in background goroutines that may still be writing when
+	// the test ends, so clean up without failing on a non-empty directory
+	tmpDir, _ := os.MkdirTemp("", "caskos-test")
+	t.Cleanup(func() { os.RemoveAll(tmpDir) })
+
+	metaStore, err := metadata.NewStore(filepath.Join(tmpDir, "metadata"))
+	if err != nil {
+		t.Fatalf("failed to create metadata store: %v", err)
+	}
+
+	ring := hashring.NewHashRing(3)
+	logger := slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelError}))
+	storageManager := storage.NewManager(ring, 2, logger)
+	for i := 1; i <= 3; i++ {
+		nodeID := fmt.Sprintf("node%d", i)
+		node, err := storage.NewNode(nodeID, filepath.Join(tmpDir, "data", nodeID))
+		if err != nil {
+			t.Fatalf("failed to create node: %v", err)
+		}
+		ring.AddNode(nodeID)
+		storageManager.AddNode(nodeID, node)
+	}
+
+	return api.NewServer(storageManager, metaStore, logger, 2), storageManager, metaStore
+}
+
+// uploadFile uploads content through the multipart upload handler and returns the object ID
+func uploadFile(t *testing.T, server *api.Server, content string) string {
+	t.Helper()
+
+	recorder := postUpload(t, server, content, "")
+	if recorder.Code != http.StatusCreated && recorder.Code != http.StatusOK {
+		t.Fatalf("expected status 201 or 200, got %d: %s", recorder.Code, recorder.Body.String())
+	}
+
+	var response map[string]interface{}
+	if err := json.Unmarshal(recorder.Body.Bytes(), &response); err != nil {
+		t.Fatalf("failed to parse upload response: %v", err)
+	}
+	return response["id"].(string)
+}
+
+// postUpload sends content to the upload handler, with a write consistency
+// header unless consistency is empty
+func postUpload(t *testing.T, server *api.Server, content, consistency string) *httptest.ResponseRecorder {
+	t.Helper()
+
+	var requestBody bytes.Buffer
+	writer := multipart.NewWriter(&requestBody)
+	part, err := writer.CreateFormFile("file", "test.txt")
+	if err != nil {
+		t.Fatalf("failed to create form file: %v", err)
+	}
+	part.Write([]byte(content))
+	writer.Close()
+
+	req := httptest.NewRequest(http.MethodPost, "/upload", &requestBody)
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	if consistency != "" {
+		req.Header.Set(api.ConsistencyHeader, consistency)
+	}
+	recorder := httptest.NewRecorder()
+	server.UploadHandler(recorder, req)
+	return recorder
+}
+
+func TestUploadWriteConsistency(t *testing.T) {
+	server, storageManager, _ := newTestServer(t)
+
+	// Break node1 by replacing its directory with a file
+	backend, _ := storageManager.Node("node1")
+	node := backend.(*storage.Node)
+	os.RemoveAll(node.BasePath)
+	os.WriteFile(node.BasePath, []byte("not a directory"), 0644)
+
+	// Find content the ring places on the broken node
+	var content string
+	for i := 0; ; i++ {
+		content = fmt.Sprintf("consistency test %d", i)
+		targets := storageManager.GetTargetNodes(storage.GenerateObjectID([]byte(content)))
+		if slices.Contains(targets, "node1") {
+			break
+		}
+	}
+
+	// Both replicas are required, so the write fails
+	recorder := postUpload(t, server, content, "all")
+	if recorder.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected status 503, got %d: %s", recorder.Code, recorder.Body.String())
+	}
+
+	// A single replica is enough at consistency one, and the response says so
+	recorder = postUpload(t, server, content, "one")
+	if recorder.Code != http.StatusCreated {
+		t.Fatalf("expected status 201, got %d: %s", recorder.Code, recorder.Body.String())
+	}
+	var response map[string]interface{}
+	if err := json.Unmarshal(recorder.Body.Bytes(), &response); err != nil {
+		t.Fatalf("failed to parse upload response: %v", err)
+	}
+	if response["replicas_written"] != 1.0 || response["replicas_required"] != 1.0 || response["consistency"] != "one" {
+		t.Errorf("unexpected write report: %v", response)
+	}
+
+	recorder = postUpload(t, server, content, "most")
+	if recorder.Code != http.StatusBadRequest {
+		t.Errorf("expected status 400 for an unknown consistency, got %d", recorder.Code)
+	}
+}
+
+func TestDeleteObject(t *testing.T) {
+	server, storageManager, metaStore := newTestServer(t)
+	objectID := uploadFile(t, server, "content that will be deleted")
+
+	deleteReq := httptest.NewRequest(http.MethodDelete, fmt.Sprintf("/object/%s", objectID), nil)
+	deleteReq.SetPathValue("id", objectID)
+	deleteRecorder := httptest.NewRecorder()
+	server.DeleteObjectHandler(deleteRecorder, deleteReq)
+
+	if deleteRecorder.Code != http.StatusNoContent {
+		t.Fatalf("expected status 204, got %d: %s", deleteRecorder.Code, deleteRecorder.Body.String())
+	}
+
+	if replicas := storageManager.CheckReplicas(objectID); len(replicas) != 0 {
+		t.Errorf("expected no replicas after delete, found %v", replicas)
+	}
+	if metaStore.Exists(objectID) {
+		t.Error("expected metadata to be removed")
+	}
+	if !metaStore.IsDeleted(objectID) {
+		t.Error("expected a tombstone for the deleted object")
+	}
+
+	// Self-healing must not bring the object back
+	storageManager.ScheduleRepair(objectID)
+	getReq := httptest.NewRequest(http.MethodGet, fmt.Sprintf("/object/%s", objectID), nil)
+	getReq.SetPathValue("id", objectID)
+	getRecorder := httptest.NewRecorder()
+	server.GetObjectHandler(getRecorder, getReq)
+	if getRecorder.Code != http.StatusNotFound {
+		t.Errorf("expected status 404 after delete, got %d", getRecorder.Code)
+	}
+
+	// Deleting again reports the object as missing
+	deleteRecorder = httptest.NewRecorder()
+	server.DeleteObjectHandler(deleteRecorder, deleteReq)
+	if deleteRecorder.Code != http.StatusNotFound {
+		t.Errorf("expected status 404 for second delete, got %d", deleteRecorder.Code)
+	}
+
+	// Uploading the same content again restores it
+	if restoredID := uploadFile(t, server, "content that will be deleted"); restoredID != objectID {
+		t.Fatalf("expected same object ID on re-upload, got %s", restoredID)
+	}
+	if metaStore.IsDeleted(objectID) {
+		t.Error("expected re-upload to clear the tombstone")
+	}
+}
+
+// gatedBackend holds deletes until its gate is opened
+type gatedBackend struct {
+	storage.Backend
+	gate chan struct{}
+}
+
+func (b *gatedBackend) Delete(objectID string) error {
+	<-b.gate
+	return b.Backend.Delete(objectID)
+}
+
+func TestDeleteRacingUpload(t *testing.T) {
+	tmpDir, _ := os.MkdirTemp("", "caskos-test")
+	defer os.RemoveAll(tmpDir)
+	metaStore, err := metadata.NewStore(tmpDir)
+	if err != nil {
+		t.Fatalf("failed to create metadata store: %v", err)
+	}
+
+	ring := hashring.NewHashRing(3)
+	logger := slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelError}))
+	storageManager := storage.NewManager(ring, 2, logger)
+	gate := make(chan struct{})
+	for i := 1; i <= 3; i++ {
+		nodeID := fmt.Sprintf("node%d", i)
+		ring.AddNode(nodeID)
+		storageManager.AddNode(nodeID, &gatedBackend{Backend: storage.NewMemoryBackend(), gate: gate})
+	}
+	server := api.NewServer(storageManager, metaStore, logger, 2)
+
+	content := "content deleted while it is uploaded again"
+	objectID := uploadFile(t, server, content)
+
+	// The delete stalls while removing the content from the nodes
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		req := httptest.NewRequest(http.MethodDelete, "/object/"+objectID, nil)
+		req.SetPathValue("id", objectID)
+		server.DeleteObjectHandler(httptest.NewRecorder(), req)
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	// An upload of the same content must not count on the copies being removed
+	go func() {
+		defer wg.Done()
+		postUpload(t, server, content, "")
+	}()
+	time.Sleep(50 * time.Millisecond)
+	close(gate)
+	wg.Wait()
+
+	if !metaStore.Exists(objectID) {
+		t.Fatal("expected the upload after the delete to keep the object")
+	}
+	req := httptest.NewRequest(http.MethodGet, "/object/"+objectID, nil)
+	req.SetPathValue("id", objectID)
+	recorder := httptest.NewRecorder()
+	server.GetObjectHandler(recorder, req)
+	if recorder.Code != http.StatusOK || recorder.Body.String() != content {
+		t.Errorf("expected the uploaded object to survive the delete, got status %d", recorder.Code)
+	}
+}
+
+func TestChunkDeduplication(t *testing.T) {
+	server, storageManager, metaStore := newTestServer(t)
+	storageManager.SetChunkSize(16 << 10)
+
+	original := make([]byte, 512<<10)
+	rand.New(rand.NewSource(1)).Read(original)
+	edited := append(append(append([]byte{}, original[:200000]...), "a small edit"...), original[200000:]...)
+
+	originalID := uploadFile(t, server, string(original))
+	editedID := uploadFile(t, server, string(edited))
+
+	originalMeta, _ := metaStore.Get(originalID)
+	editedMeta, err := metaStore.Get(editedID)
+	if err != nil {
+		t.Fatalf("failed to get metadata: %v", err)
+	}
+	if len(editedMeta.Chunks) < 2 {
+		t.Fatalf("expected the object to be split into chunks, got %d", len(editedMeta.Chunks))
+	}
+
+	// The edited copy only adds the chunks around the edit
+	recorder := httptest.NewRecorder()
+	server.StatsHandler(recorder, httptest.NewRequest(http.MethodGet, "/admin/stats", nil))
+	var stats map[string]interface{}
+	if err := json.Unmarshal(recorder.Body.Bytes(), &stats); err != nil {
+		t.Fatalf("failed to parse stats: %v", err)
+	}
+	logical := int64(len(original) + len(edited))
+	if int64(stats["logical_bytes"].(float64)) != logical {
+		t.Errorf("expected %d logical bytes, got %v", logical, stats["logical_bytes"])
+	}
+	if physical := int64(stats["physical_bytes"].(float64)); physical > int64(len(original))*5/4 {
+		t.Errorf("expected shared chunks to be stored once, got %d physical bytes", physical)
+	}
+
+	getObject := func(objectID string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/object/"+objectID, nil)
+		req.SetPathValue("id", objectID)
+		recorder := httptest.NewRecorder()
+		server.GetObjectHandler(recorder, req)
+		return recorder
+	}
+	if recorder := getObject(editedID); recorder.Code != http.StatusOK || !bytes.Equal(recorder.Body.Bytes(), edited) {
+		t.Fatalf("expected the edited object back, got status %d", recorder.Code)
+	}
+
+	// Deleting one object keeps the chunks the other still references
+	deleteReq := httptest.NewRequest(http.MethodDelete, "/object/"+originalID, nil)
+	deleteReq.SetPathValue("id", originalID)
+	deleteRecorder := httptest.NewRecorder()
+	server.DeleteObjectHandler(deleteRecorder, deleteReq)
+	if deleteRecorder.Code != http.StatusNoContent {
+		t.Fatalf("expected status 204, got %d: %s", deleteRecorder.Code, deleteRecorder.Body.String())
+	}
+
+	shared := make(map[string]bool)
+	for _, ref := range editedMeta.Chunks {
+		shared[ref.ID] = true
+	}
+	for _, ref := range originalMeta.Chunks {
+		replicas := storageManager.CheckReplicas(ref.ID)
+		if shared[ref.ID] && len(replicas) == 0 {
+			t.Errorf("shared chunk %s was removed", ref.ID)
+		}
+		if !shared[ref.ID] && len(replicas) != 0 {
+			t.Errorf("unreferenced chunk %s was kept on %v", ref.ID, replicas)
+		}
+	}
+	if recorder := getObject(editedID); recorder.Code != http.StatusOK || !bytes.Equal(recorder.Body.Bytes(), edited) {
+		t.Errorf("expected the edited object to survive, got status %d", recorder.Code)
+	}
+	if recorder := getObject(originalID); recorder.Code != http.StatusNotFound {
+		t.Errorf("expected status 404 for the deleted object, got %d", recorder.Code)
+	}
+
+	if stats := metaStore.Stats(); stats.LogicalBytes != int64(len(edited)) || stats.Chunks != len(editedMeta.Chunks) {
+		t.Errorf("unexpected stats after delete: %+v", stats)
+	}
+}
+
+func TestErasureCodedBucket(t *testing.T) {
+	server, storageManager, metaStore := newTestServer(t)
+
+	do := func(handler http.HandlerFunc, method, target, bucket, key, body, durability string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		req.SetPathValue("bucket", bucket)
+		req.SetPathValue("key", key)
+		if durability != "" {
+			req.Header.Set(api.DurabilityHeader, durability)
+		}
+		recorder := httptest.NewRecorder()
+		handler(recorder, req)
+		return recorder
+	}
+
+	if invalid := do(server.CreateBucketHandler, http.MethodPut, "/buckets/cold", "cold", "", "", "ec:2"); invalid.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for an invalid durability, got %d", invalid.Code)
+	}
+	if created := do(server.CreateBucketHandler, http.MethodPut, "/buckets/cold", "cold", "", "", "ec:2+1"); created.Code != http.StatusCreated {
+		t.Fatalf("expected 201 creating bucket, got %d: %s", created.Code, created.Body.String())
+	}
+
+	// Keys written to the bucket take its durability
+	content := strings.Repeat("erasure coded content ", 1000)
+	if put := do(server.PutKeyHandler, http.MethodPut, "/buckets/cold/archive.txt", "cold", "archive.txt", content, ""); put.Code != http.StatusCreated {
+		t.Fatalf("expected 201 putting key, got %d: %s", put.Code, put.Body.String())
+	}
+	entry, _ := metaStore.GetKey("cold", "archive.txt")
+	meta, err := metaStore.Get(entry.ObjectID)
+	if err != nil {
+		t.Fatalf("failed to get metadata: %v", err)
+	}
+	if meta.Durability != "ec:2+1" || len(meta.Chunks) != 1 || meta.Chunks[0].DataShards != 2 {
+		t.Fatalf("expected one ec:2+1 chunk, got %q %+v", meta.Durability, meta.Chunks)
+	}
+
+	// Losing a node's shard still leaves the content readable
+	shardID := storage.ShardID(meta.Chunks[0].ID, 2, 1, 0)
+	for _, nodeID := range storageManager.GetTargetNodes(shardID) {
+		node, _ := storageManager.Node(nodeID)
+		node.Delete(shardID)
+	}
+	if get := do(server.GetKeyHandler, http.MethodGet, "/buckets/cold/archive.txt", "cold", "archive.txt", "", ""); get.Code != http.StatusOK || get.Body.String() != content {
+		t.Fatalf("expected content from the remaining shards, got %d", get.Code)
+	}
+
+	// The degraded read schedules a repair that rebuilds the lost shard
+	deadline := time.Now().Add(5 * time.Second)
+	for len(storageManager.CheckReplicas(shardID)) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("expected the lost shard to be rebuilt")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// The header overrides the bucket's policy
+	if put := do(server.PutKeyHandler, http.MethodPut, "/buckets/cold/hot.txt", "cold", "hot.txt", "replicated content", "replicated"); put.Code != http.StatusCreated {
+		t.Fatalf("expected 201 putting key, got %d: %s", put.Code, put.Body.String())
+	}
+	hotEntry, _ := metaStore.GetKey("cold", "hot.txt")
+	if hotMeta, _ := metaStore.Get(hotEntry.ObjectID); hotMeta.Durability != "replicated" || len(hotMeta.Chunks) != 0 {
+		t.Errorf("expected a replicated object, got %q %+v", hotMeta.Durability, hotMeta.Chunks)
+	}
+
+	// Deleting the key deletes the object, removing every shard
+	if deleted := do(server.DeleteKeyHandler, http.MethodDelete, "/buckets/cold/archive.txt", "cold", "archive.txt", "", ""); deleted.Code != http.StatusNoContent {
+		t.Fatalf("expected status 204, got %d: %s", deleted.Code, deleted.Body.String())
+	}
+	for i := 0; i < 3; i++ {
+		shardID := storage.ShardID(meta.Chunks[0].ID, 2, 1, i)
+		if replicas := storageManager.CheckReplicas(shardID); len(replicas) != 0 {
+			t.Errorf("shard %d was kept on %v", i, replicas)
+		}
+	}
+}
+
+func TestDeleteWithPendingShardRepair(t *testing.T) {
+	server, storageManager, metaStore := newTestServer(t)
+	storageManager.SetChunkSize(16 << 10)
+
+	bucketReq := httptest.NewRequest(http.MethodPut, "/buckets/cold", nil)
+	bucketReq.SetPathValue("bucket", "cold")
+	bucketReq.Header.Set(api.DurabilityHeader, "ec:2+1")
+	bucketRecorder := httptest.NewRecorder()
+	server.CreateBucketHandler(bucketRecorder, bucketReq)
+	if bucketRecorder.Code != http.StatusCreated {
+		t.Fatalf("expected 201 creating bucket, got %d: %s", bucketRecorder.Code, bucketRecorder.Body.String())
+	}
+
+	content := make([]byte, 256<<10)
+	rand.New(rand.NewSource(3)).Read(content)
+	putReq := httptest.NewRequest(http.MethodPut, "/buckets/cold/archive.bin", bytes.NewReader(content))
+	putReq.SetPathValue("bucket", "cold")
+	putReq.SetPathValue("key", "archive.bin")
+	putRecorder := httptest.NewRecorder()
+	server.PutKeyHandler(putRecorder, putReq)
+	if putRecorder.Code != http.StatusCreated {
+		t.Fatalf("expected 201 putting key, got %d: %s", putRecorder.Code, putRecorder.Body.String())
+	}
+	entry, _ := metaStore.GetKey("cold", "archive.bin")
+	meta, err := metaStore.Get(entry.ObjectID)
+	if err != nil {
+		t.Fatalf("failed to get metadata: %v", err)
+	}
+	if len(meta.Chunks) < 2 {
+		t.Fatalf("expected the object to be split into chunks, got %d", len(meta.Chunks))
+	}
+
+	// Keep two shards of each chunk as a node that misses the delete would
+	leftovers := make(map[string][]byte)
+	for _, chunk := range meta.Chunks {
+		for i := 0; i < 2; i++ {
+			shardID := storage.ShardID(chunk.ID, 2, 1, i)
+			nodeID := storageManager.CheckReplicas(shardID)[0]
+			node, _ := storageManager.Node(nodeID)
+			reader, err := node.Retrieve(shardID)
+			if err != nil {
+				t.Fatalf("failed to read shard: %v", err)
+			}
+			leftovers[nodeID+"/"+shardID], _ = io.ReadAll(reader)
+			reader.Close()
+		}
+	}
+
+	// Deleting the only key deletes the object
+	deleteKeyReq := httptest.NewRequest(http.MethodDelete, "/buckets/cold/archive.bin", nil)
+	deleteKeyReq.SetPathValue("bucket", "cold")
+	deleteKeyReq.SetPathValue("key", "archive.bin")
+	deleteRecorder := httptest.NewRecorder()
+	server.DeleteKeyHandler(deleteRecorder, deleteKeyReq)
+	if deleteRecorder.Code != http.StatusNoContent || !metaStore.IsDeleted(meta.ID) {
+		t.Fatalf("expected the key and its object to be deleted, got %d: %s", deleteRecorder.Code, deleteRecorder.Body.String())
+	}
+
+	for path, data := range leftovers {
+		nodeID, shardID, _ := strings.Cut(path, "/")
+		node, _ := storageManager.Node(nodeID)
+		if err := node.Store(shardID, bytes.NewReader(data)); err != nil {
+			t.Fatalf("failed to restore shard: %v", err)
+		}
+	}
+
+	// Repairs scheduled by degraded reads or writes before the delete run
+	// after it, and must not rebuild the missing shards from the leftovers
+	for _, chunk := range meta.Chunks {
+		storageManager.ScheduleRepair(storage.ShardID(chunk.ID, 2, 1, 0))
+	}
+	time.Sleep(200 * time.Millisecond)
+	for _, chunk := range meta.Chunks {
+		shardID := storage.ShardID(chunk.ID, 2, 1, 2)
+		if replicas := storageManager.CheckReplicas(shardID); len(replicas) != 0 {
+			t.Errorf("shard %s was rebuilt on %v", shardID, replicas)
+		}
+	}
+}
+
+func TestAdminNodeMembership(t *testing.T) {
+	server, storageManager, _ := newTestServer(t)
+
+	objectIDs := make([]string, 0, 10)
+	for i := 0; i < 10; i++ {
+		objectIDs = append(objectIDs, uploadFile(t, server, fmt.Sprintf("admin test object %d", i)))
+	}
+
+	// Add a fourth node at runtime
+	nodeDir, _ := os.MkdirTemp("", "caskos-node4")
+	defer os.RemoveAll(nodeDir)
+	heavy := fmt.Sprintf(`{"id": "node4", "path": %q, "weight": 1000}`, nodeDir)
+	heavyRecorder := httptest.NewRecorder()
+	server.AddNodeHandler(heavyRecorder, httptest.NewRequest(http.MethodPost, "/admin/nodes", bytes.NewBufferString(heavy)))
+	if heavyRecorder.Code != http.StatusBadRequest {
+		t.Errorf("expected status 400 for a weight above the limit, got %d", heavyRecorder.Code)
+	}
+	body := fmt.Sprintf(`{"id": "node4", "path": %q}`, nodeDir)
+	addReq := httptest.NewRequest(http.MethodPost, "/admin/nodes", bytes.NewBufferString(body))
+	addRecorder := httptest.NewRecorder()
+	server.AddNodeHandler(addRecorder, addReq)
+	if addRecorder.Code != http.StatusCreated {
+		t.Fatalf("expected status 201, got %d: %s", addRecorder.Code, addRecorder.Body.String())
+	}
+
+	waitForRebalance(t, storageManager)
+
+	// Drain node1
+	drainReq := httptest.NewRequest(http.MethodPost, "/admin/nodes/node1/drain", nil)
+	drainReq.SetPathValue("id", "node1")
+	drainRecorder := httptest.NewRecorder()
+	server.DrainNodeHandler(drainRecorder, drainReq)
+	if drainRecorder.Code != http.StatusAccepted {
+		t.Fatalf("expected status 202, got %d: %s", drainRecorder.Code, drainRecorder.Body.String())
+	}
+
+	waitForNodeState(t, storageManager, "node1", storage.NodeDrained)
+
+	removeReq := httptest.NewRequest(http.MethodDelete, "/admin/nodes/node1", nil)
+	removeReq.SetPathValue("id", "node1")
+	removeRecorder := httptest.NewRecorder()
+	server.RemoveNodeHandler(removeRecorder, removeReq)
+	if removeRecorder.Code != http.StatusNoContent {
+		t.Fatalf("expected status 204, got %d: %s", removeRecorder.Code, removeRecorder.Body.String())
+	}
+
+	// All objects remain readable with full replication on the new membership
+	for _, objectID := range objectIDs {
+		getReq := httptest.NewRequest(http.MethodGet, fmt.Sprintf("/object/%s", objectID), nil)
+		getReq.SetPathValue("id", objectID)
+		getRecorder := httptest.NewRecorder()
+		server.GetObjectHandler(getRecorder, getReq)
+		if getRecorder.Code != http.StatusOK {
+			t.Errorf("expected status 200 for %s, got %d", objectID, getRecorder.Code)
+		}
+
+		if replicas := storageManager.CheckReplicas(objectID); len(replicas) != 2 {
+			t.Errorf("object %s: expected 2 replicas, found %v", objectID, replicas)
+		}
+	}
+
+	listRecorder := httptest.NewRecorder()
+	server.ListNodesHandler(listRecorder, httptest.NewRequest(http.MethodGet, "/admin/nodes", nil))
+	var nodes []storage.NodeRecord
+	if err := json.Unmarshal(listRecorder.Body.Bytes(), &nodes); err != nil {
+		t.Fatalf("failed to parse node list: %v", err)
+	}
+	if len(nodes) != 3 || nodes[0].ID != "node2" || nodes[2].ID != "node4" {
+		t.Errorf("unexpected node list: %+v", nodes)
+	}
+}
+
+func TestAdminDrainRefused(t *testing.T) {
+	server, storageManager, _ := newTestServer(t)
+
+	drain := func(nodeID string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/admin/nodes/"+nodeID+"/drain", nil)
+		req.SetPathValue("id", nodeID)
+		recorder := httptest.NewRecorder()
+		server.DrainNodeHandler(recorder, req)
+		return recorder
+	}
+
+	if drained := drain("node1"); drained.Code != http.StatusAccepted {
+		t.Fatalf("expected status 202, got %d: %s", drained.Code, drained.Body.String())
+	}
+	waitForNodeState(t, storageManager, "node1", storage.NodeDrained)
+
+	// Two nodes are left for two replicas, so a further drain is refused
+	// before anything changes
+	if refused := drain("node2"); refused.Code != http.StatusConflict {
+		t.Fatalf("expected status 409, got %d: %s", refused.Code, refused.Body.String())
+	}
+	for _, record := range storageManager.Nodes() {
+		if record.ID == "node2" && record.State != storage.NodeActive {
+			t.Errorf("expected node2 to stay active, got %s", record.State)
+		}
+	}
+}
+
+func TestAdminToken(t *testing.T) {
+	server, _, _ := newTestServer(t)
+
+	status := func(token, header string) int {
+		req := httptest.NewRequest(http.MethodGet, "/admin/nodes", nil)
+		if header != "" {
+			req.Header.Set("Authorization", header)
+		}
+		recorder := httptest.NewRecorder()
+		api.AdminOnly(token, server.ListNodesHandler)(recorder, req)
+		return recorder.Code
+	}
+
+	if code := status("", ""); code != http.StatusForbidden {
+		t.Errorf("expected admin requests to be refused without a token configured, got %d", code)
+	}
+	if code := status("secret", ""); code != http.StatusUnauthorized {
+		t.Errorf("expected a missing token to be rejected, got %d", code)
+	}
+	if code := status("secret", "Bearer wrong"); code != http.StatusUnauthorized {
+		t.Errorf("expected a wrong token to be rejected, got %d", code)
+	}
+	if code := status("secret", "Bearer secret"); code != http.StatusOK {
+		t.Errorf("expected the right token to be accepted, got %d", code)
+	}
+}
+
+// waitForNodeState polls the node list until a node reaches the given state
+func waitForNodeState(t *testing.T, storageManager *storage.Manager, nodeID, state string) {
+	t.Helper()
+
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		for _, record := range storageManager.Nodes() {
+			if record.ID == nodeID && record.State == state {
+				return
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("node %s did not reach state %s", nodeID, state)
+}
+
+// waitForRebalance polls until a rebalance has run and finished
+func waitForRebalance(t *testing.T, storageManager *storage.Manager) {
+	t.Helper()
+
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		progress := storageManager.RebalanceProgress()
+		if !progress.Running && !progress.FinishedAt.IsZero() {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("rebalance did not finish")
+}
+
+func TestGetObjectRangesAndConditionals(t *testing.T) {
+	server, _, _ := newTestServer(t)
+	content := "0123456789abcdefghijklmnopqrstuvwxyz"
+	objectID := uploadFile(t, server, content)
+
+	get := func(method string, headers map[string]string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/object/"+objectID, nil)
+		req.SetPathValue("id", objectID)
+		for name, value := range headers {
+			req.Header.Set(name, value)
+		}
+		recorder := httptest.NewRecorder()
+		server.GetObjectHandler(recorder, req)
+		return recorder
+	}
+
+	full := get(http.MethodGet, nil)
+	etag := full.Header().Get("ETag")
+	if full.Code != http.StatusOK || full.Body.String() != content {
+		t.Fatalf("expected full body, got %d: %q", full.Code, full.Body.String())
+	}
+	if etag != `"`+objectID+`"` {
+		t.Errorf("expected the object ID as ETag, got %s", etag)
+	}
+	if full.Header().Get("Content-Length") != fmt.Sprint(len(content)) || full.Header().Get("Last-Modified") == "" {
+		t.Errorf("missing Content-Length or Last-Modified: %v", full.Header())
+	}
+
+	// A single range resumes a download
+	partial := get(http.MethodGet, map[string]string{"Range": "bytes=10-15"})
+	if partial.Code != http.StatusPartialContent || partial.Body.String() != "abcdef" {
+		t.Errorf("expected 206 with abcdef, got %d: %q", partial.Code, partial.Body.String())
+	}
+
+	// Several ranges come back as a multipart body
+	multi := get(http.MethodGet, map[string]string{"Range": "bytes=0-1,30-"})
+	if multi.Code != http.StatusPartialContent || !strings.HasPrefix(multi.Header().Get("Content-Type"), "multipart/byteranges") {
+		t.Errorf("expected a multipart 206, got %d with %s", multi.Code, multi.Header().Get("Content-Type"))
+	}
+
+	// If-Range with a stale validator ignores the range
+	stale := get(http.MethodGet, map[string]string{"Range": "bytes=0-1", "If-Range": `"stale"`})
+	if stale.Code != http.StatusOK || stale.Body.String() != content {
+		t.Errorf("expected the full body for a stale If-Range, got %d", stale.Code)
+	}
+
+	// Cached copies are revalidated without a body
+	if notModified := get(http.MethodGet, map[string]string{"If-None-Match": etag}); notModified.Code != http.StatusNotModified {
+		t.Errorf("expected 304 for a matching ETag, got %d", notModified.Code)
+	}
+	lastModified := full.Header().Get("Last-Modified")
+	if notModified := get(http.MethodGet, map[string]string{"If-Modified-Since": lastModified}); notModified.Code != http.StatusNotModified {
+		t.Errorf("expected 304 for If-Modified-Since, got %d", notModified.Code)
+	}
+
+	head := get(http.MethodHead, nil)
+	if head.Code != http.StatusOK || head.Body.Len() != 0 || head.Header().Get("Content-Length") != fmt.Sprint(len(content)) {
+		t.Errorf("expected an empty HEAD response with Content-Length, got %d: %v", head.Code, head.Header())
+	}
+}
+
+func TestGetObjectInvalidID(t *testing.T) {
+	server, _, _ := newTestServer(t)
+
+	// IDs that are not content hashes never reach the nodes, so a path in
+	// one cannot make a node read or quarantine files outside its directory
+	for _, objectID := range []string{"../../../etc/hostname", "ab/../../cd", "", "a", "abc", strings.Repeat("A", 64)} {
+		for _, handler := range []http.HandlerFunc{server.GetObjectHandler, server.GetMetadataHandler} {
+			req := httptest.NewRequest(http.MethodGet, "/object/x", nil)
+			req.SetPathValue("id", objectID)
+			req.Header.Set("Range", "bytes=0-1")
+			recorder := httptest.NewRecorder()
+			handler(recorder, req)
+			if recorder.Code != http.StatusBadRequest {
+				t.Errorf("expected 400 for %q, got %d", objectID, recorder.Code)
+			}
+		}
+	}
+
+	// A well-formed ID of content that was never stored is not found
+	unknown := strings.Repeat("ab", 32)
+	for _, handler := range []http.HandlerFunc{server.GetObjectHandler, server.GetMetadataHandler} {
+		req := httptest.NewRequest(http.MethodGet, "/object/"+unknown, nil)
+		req.SetPathValue("id", unknown)
+		recorder := httptest.NewRecorder()
+		handler(recorder, req)
+		if recorder.Code != http.StatusNotFound {
+			t.Errorf("expected 404 for an unknown object, got %d", recorder.Code)
+		}
+	}
+}
+
+func TestBucketsAndKeys(t *testing.T) {
+	server, _, _ := newTestServer(t)
+
+	do := func(handler http.HandlerFunc, method, target, bucket, key, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		req.SetPathValue("bucket", bucket)
+		req.SetPathValue("key", key)
+		recorder := httptest.NewRecorder()
+		handler(recorder, req)
+		return recorder
+	}
+
+	if created := do(server.CreateBucketHandler, http.MethodPut, "/buckets/docs", "docs", "", ""); created.Code != http.StatusCreated {
+		t.Fatalf("expected 201 creating bucket, got %d: %s", created.Code, created.Body.String())
+	}
+	if conflict := do(server.CreateBucketHandler, http.MethodPut, "/buckets/docs", "docs", "", ""); conflict.Code != http.StatusConflict {
+		t.Errorf("expected 409 for an existing bucket, got %d", conflict.Code)
+	}
+	if missing := do(server.PutKeyHandler, http.MethodPut, "/buckets/nope/a.txt", "nope", "a.txt", "x"); missing.Code != http.StatusNotFound {
+		t.Errorf("expected 404 putting into a missing bucket, got %d", missing.Code)
+	}
+
+	// Two keys with the same content share one object
+	content := "named content"
+	var ids []string
+	for _, key := range []string{"reports/q1.txt", "reports/copy.txt"} {
+		put := do(server.PutKeyHandler, http.MethodPut, "/buckets/docs/"+key, "docs", key, content)
+		if put.Code != http.StatusCreated {
+			t.Fatalf("expected 201 putting %s, got %d: %s", key, put.Code, put.Body.String())
+		}
+		var response map[string]interface{}
+		json.Unmarshal(put.Body.Bytes(), &response)
+		ids = append(ids, response["id"].(string))
+	}
+	if ids[0] != ids[1] {
+		t.Errorf("expected identical content to share an object, got %v", ids)
+	}
+
+	// Uploads through the form endpoint keep the file name as key
+	var requestBody bytes.Buffer
+	writer := multipart.NewWriter(&requestBody)
+	part, _ := writer.CreateFormFile("file", "notes.txt")
+	part.Write([]byte("uploaded by form"))
+	writer.Close()
+	uploadReq := httptest.NewRequest(http.MethodPost, "/upload?bucket=docs", &requestBody)
+	uploadReq.Header.Set("Content-Type", writer.FormDataContentType())
+	upload := httptest.NewRecorder()
+	server.UploadHandler(upload, uploadReq)
+	if upload.Code != http.StatusCreated {
+		t.Fatalf("expected 201 uploading into a bucket, got %d: %s", upload.Code, upload.Body.String())
+	}
+
+	get := do(server.GetKeyHandler, http.MethodGet, "/buckets/docs/notes.txt", "docs", "notes.txt", "")
+	if get.Code != http.StatusOK || get.Body.String() != "uploaded by form" {
+		t.Errorf("expected uploaded content, got %d: %q", get.Code, get.Body.String())
+	}
+	if disposition := get.Header().Get("Content-Disposition"); !strings.Contains(disposition, "notes.txt") {
+		t.Errorf("expected the key's file name in Content-Disposition, got %q", disposition)
+	}
+
+	list := do(server.ListKeysHandler, http.MethodGet, "/buckets/docs?delimiter=/", "docs", "", "")
+	var listing struct {
+		Keys []struct {
+			Key string `json:"key"`
+		} `json:"keys"`
+		CommonPrefixes []string `json:"common_prefixes"`
+	}
+	if err := json.Unmarshal(list.Body.Bytes(), &listing); err != nil {
+		t.Fatalf("failed to parse listing: %v", err)
+	}
+	if len(listing.Keys) != 1 || listing.Keys[0].Key != "notes.txt" || !slices.Equal(listing.CommonPrefixes, []string{"reports/"}) {
+		t.Errorf("unexpected listing: %s", list.Body.String())
+	}
+
+	// Deleting a key keeps content that another key points at
+	if deleted := do(server.DeleteKeyHandler, http.MethodDelete, "/buckets/docs/reports/q1.txt", "docs", "reports/q1.txt", ""); deleted.Code != http.StatusNoContent {
+		t.Fatalf("expected 204 deleting key, got %d", deleted.Code)
+	}
+	if gone := do(server.GetKeyHandler, http.MethodGet, "/buckets/docs/reports/q1.txt", "docs", "reports/q1.txt", ""); gone.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for a deleted key, got %d", gone.Code)
+	}
+	if kept := do(server.GetKeyHandler, http.MethodGet, "/buckets/docs/reports/copy.txt", "docs", "reports/copy.txt", ""); kept.Body.String() != content {
+		t.Errorf("expected shared content to survive, got %d: %q", kept.Code, kept.Body.String())
+	}
+
+	// Content a key points at cannot be deleted by ID
+	object := func(method string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/object/"+ids[0], nil)
+		req.SetPathValue("id", ids[0])
+		recorder := httptest.NewRecorder()
+		if method == http.MethodDelete {
+			server.DeleteObjectHandler(recorder, req)
+		} else {
+			server.GetObjectHandler(recorder, req)
+		}
+		return recorder
+	}
+	if referenced := object(http.MethodDelete); referenced.Code != http.StatusConflict {
+		t.Errorf("expected 409 deleting referenced content, got %d", referenced.Code)
+	}
+
+	// Overwriting the last key pointing at content deletes it
+	if put := do(server.PutKeyHandler, http.MethodPut, "/buckets/docs/reports/copy.txt", "docs", "reports/copy.txt", "new content"); put.Code != http.StatusOK {
+		t.Fatalf("expected 200 overwriting key, got %d: %s", put.Code, put.Body.String())
+	}
+	if gone := object(http.MethodGet); gone.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for content no key points at, got %d", gone.Code)
+	}
+
+	if notEmpty := do(server.DeleteBucketHandler, http.MethodDelete, "/buckets/docs", "docs", "", ""); notEmpty.Code != http.StatusConflict {
+		t.Errorf("expected 409 deleting a non-empty bucket, got %d", notEmpty.Code)
+	}
+}
+
+func TestListObjects(t *testing.T) {
+	server, _, _ := newTestServer(t)
+
+	var expected []string
+	for i := 0; i < 5; i++ {
+		expected = append(expected, uploadFile(t, server, fmt.Sprintf("listed object %d", i)))
+	}
+	slices.Sort(expected)
+
+	// Walk the objects two at a time
+	var listed []string
+	token := ""
+	for pages := 0; ; pages++ {
+		if pages > 5 {
+			t.Fatal("listing did not terminate")
+		}
+		req := httptest.NewRequest(http.MethodGet, "/objects?limit=2&continuation_token="+token, nil)
+		recorder := httptest.NewRecorder()
+		server.ListObjectsHandler(recorder, req)
+		if recorder.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %d: %s", recorder.Code, recorder.Body.String())
+		}
+
+		var page struct {
+			Objects []struct {
+				ID string `json:"id"`
+			} `json:"objects"`
+			Truncated bool   `json:"truncated"`
+			Next      string `json:"next_continuation_token"`
+		}
+		if err := json.Unmarshal(recorder.Body.Bytes(), &page); err != nil {
+			t.Fatalf("failed to parse listing: %v", err)
+		}
+		for _, object := range page.Objects {
+			listed = append(listed, object.ID)
+		}
+		if !page.Truncated {
+			break
+		}
+		token = page.Next
+	}
+
+	if !slices.Equal(listed, expected) {
+		t.Errorf("expected objects %v in order, got %v", expected, listed)
+	}
+
+	// A prefix narrows the listing to matching IDs
+	req := httptest.NewRequest(http.MethodGet, "/objects?prefix="+expected[0][:8], nil)
+	recorder := httptest.NewRecorder()
+	server.ListObjectsHandler(recorder, req)
+	var page struct {
+		Objects []struct {
+			ID string `json:"id"`
+		} `json:"objects"`
+	}
+	if err := json.Unmarshal(recorder.Body.Bytes(), &page); err != nil {
+		t.Fatalf("failed to parse listing: %v", err)
+	}
+	if len(page.Objects) != 1 || page.Objects[0].ID != expected[0] {
+		t.Errorf("expected only %s for its prefix, got %s", expected[0], recorder.Body.String())
+	}
+}
+
+// enableUploads gives server a store of resumable upload sessions
+func enableUploads(t *testing.T, server *api.Server) {
+	t.Helper()
+
+	logger := slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelError}))
+	sessions, err := upload.New(upload.Config{Dir: t.TempDir()}, logger)
+	if err != nil {
+		t.Fatalf("failed to create upload sessions: %v", err)
+	}
+	server.SetUploadSessions(sessions)
+}
+
+func TestResumableUpload(t *testing.T) {
+	server, _, _ := newTestServer(t)
+	enableUploads(t, server)
+
+	content := "resumable upload content sent in parts"
+	createReq := httptest.NewRequest(http.MethodPost, "/uploads", strings.NewReader(fmt.Sprintf(`{"size": %d, "content_type": "text/plain"}`, len(content))))
+	createRecorder := httptest.NewRecorder()
+	server.CreateUploadHandler(createRecorder, createReq)
+	if createRecorder.Code != http.StatusCreated {
+		t.Fatalf("expected 201 creating an upload, got %d: %s", createRecorder.Code, createRecorder.Body.String())
+	}
+	var created struct {
+		ID string `json:"id"`
+	}
+	if err := json.Unmarshal(createRecorder.Body.Bytes(), &created); err != nil {
+		t.Fatalf("failed to parse upload: %v", err)
+	}
+
+	do := func(handler http.HandlerFunc, method, target, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		req.SetPathValue("id", created.ID)
+		recorder := httptest.NewRecorder()
+		handler(recorder, req)
+		return recorder
+	}
+	part := func(offset int) *httptest.ResponseRecorder {
+		end := min(offset+10, len(content))
+		return do(server.PutUploadPartHandler, http.MethodPut, fmt.Sprintf("/uploads/%s?offset=%d", created.ID, offset), content[offset:end])
+	}
+
+	// Send the parts out of order, leaving a gap
+	for _, offset := range []int{30, 0, 20} {
+		if recorder := part(offset); recorder.Code != http.StatusOK {
+			t.Fatalf("expected 200 for part at %d, got %d: %s", offset, recorder.Code, recorder.Body.String())
+		}
+	}
+	if recorder := do(server.CompleteUploadHandler, http.MethodPost, "/uploads/"+created.ID+"/complete", ""); recorder.Code != http.StatusConflict {
+		t.Fatalf("expected 409 completing an incomplete upload, got %d", recorder.Code)
+	}
+
+	// The status lists the received ranges so the client can fill the gap
+	status := do(server.GetUploadHandler, http.MethodGet, "/uploads/"+created.ID, "")
+	var progress struct {
+		Received []upload.Range `json:"received"`
+	}
+	if err := json.Unmarshal(status.Body.Bytes(), &progress); err != nil {
+		t.Fatalf("failed to parse upload status: %v", err)
+	}
+	expected := []upload.Range{{Start: 0, End: 10}, {Start: 20, End: int64(len(content))}}
+	if !slices.Equal(progress.Received, expected) {
+		t.Errorf("expected received ranges %v, got %v", expected, progress.Received)
+	}
+
+	if recorder := part(10); recorder.Code != http.StatusOK {
+		t.Fatalf("expected 200 for the missing part, got %d", recorder.Code)
+	}
+	if recorder := do(server.PutUploadPartHandler, http.MethodPut, fmt.Sprintf("/uploads/%s?offset=%d", created.ID, len(content)-2), "too long"); recorder.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for a part past the end, got %d", recorder.Code)
+	}
+
+	complete := do(server.CompleteUploadHandler, http.MethodPost, "/uploads/"+created.ID+"/complete", "")
+	if complete.Code != http.StatusCreated {
+		t.Fatalf("expected 201 completing the upload, got %d: %s", complete.Code, complete.Body.String())
+	}
+	sum := sha256.Sum256([]byte(content))
+	objectID := hex.EncodeToString(sum[:])
+	var object struct {
+		ID          string `json:"id"`
+		ContentType string `json:"content_type"`
+	}
+	if err := json.Unmarshal(complete.Body.Bytes(), &object); err != nil {
+		t.Fatalf("failed to parse completed upload: %v", err)
+	}
+	if object.ID != objectID || object.ContentType != "text/plain" {
+		t.Errorf("expected object %s of type text/plain, got %s", objectID, complete.Body.String())
+	}
+
+	getReq := httptest.NewRequest(http.MethodGet, "/object/"+objectID, nil)
+	getReq.SetPathValue("id", objectID)
+	getRecorder := httptest.NewRecorder()
+	server.GetObjectHandler(getRecorder, getReq)
+	if getRecorder.Body.String() != content {
+		t.Errorf("expected stored content %q, got %q", content, getRecorder.Body.String())
+	}
+
+	// The session ends once the upload is stored
+	if recorder := do(server.GetUploadHandler, http.MethodGet, "/uploads/"+created.ID, ""); recorder.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for a completed upload, got %d", recorder.Code)
+	}
+}
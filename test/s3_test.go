@@ -0,0 +1,329 @@
+package test
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/caskos/caskos/internal/api"
+	"github.com/caskos/caskos/internal/hashring"
+	"github.com/caskos/caskos/internal/metadata"
+	"github.com/caskos/caskos/internal/storage"
+)
+
+const (
+	testAccessKey = "test-access-key"
+	testSecretKey = "test-secret-key"
+	testRegion    = "us-east-1"
+)
+
+// newS3Gateway starts an S3 gateway over a three-node cluster
+func newS3Gateway(t *testing.T) (*httptest.Server, *metadata.Store) {
+	t.Helper()
+
+	tmpDir, err := os.MkdirTemp("", "caskos-s3")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(tmpDir) })
+
+	metaStore, err := metadata.NewStore(filepath.Join(tmpDir, "meta"))
+	if err != nil {
+		t.Fatalf("failed to create metadata store: %v", err)
+	}
+
+	logger := slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelError}))
+	ring := hashring.NewHashRing(3)
+	storageManager := storage.NewManager(ring, 2, logger)
+	for i := 1; i <= 3; i++ {
+		nodeID := fmt.Sprintf("node%d", i)
+		node, err := storage.NewNode(nodeID, filepath.Join(tmpDir, nodeID))
+		if err != nil {
+			t.Fatalf("failed to create node: %v", err)
+		}
+		ring.AddNode(nodeID)
+		storageManager.AddNode(nodeID, node)
+	}
+
+	server := api.NewServer(storageManager, metaStore, logger, 2)
+	gateway, err := api.NewS3Gateway(server, api.S3Config{
+		Region:      testRegion,
+		Credentials: map[string]string{testAccessKey: testSecretKey},
+		StagingDir:  filepath.Join(tmpDir, "s3-uploads"),
+	})
+	if err != nil {
+		t.Fatalf("failed to create S3 gateway: %v", err)
+	}
+
+	httpServer := httptest.NewServer(gateway)
+	t.Cleanup(httpServer.Close)
+	return httpServer, metaStore
+}
+
+// s3Do sends a request signed with Signature Version 4
+func s3Do(t *testing.T, server *httptest.Server, method, target string, body []byte, headers map[string]string) *http.Response {
+	t.Helper()
+
+	req := s3Request(t, server, method, target, body, headers)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("%s %s failed: %v", method, target, err)
+	}
+	return resp
+}
+
+// s3Request builds a request signed with Signature Version 4. Paths and
+// queries must not need escaping beyond what url.Values.Encode does. The
+// payload hash is that of body unless headers set X-Amz-Content-Sha256.
+func s3Request(t *testing.T, server *httptest.Server, method, target string, body []byte, headers map[string]string) *http.Request {
+	t.Helper()
+
+	req, err := http.NewRequest(method, server.URL+target, bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("failed to create request: %v", err)
+	}
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+
+	now := time.Now().UTC()
+	date := now.Format("20060102")
+	req.Header.Set("X-Amz-Date", now.Format("20060102T150405Z"))
+	if req.Header.Get("X-Amz-Content-Sha256") == "" {
+		payloadHash := sha256.Sum256(body)
+		req.Header.Set("X-Amz-Content-Sha256", hex.EncodeToString(payloadHash[:]))
+	}
+
+	canonical := strings.Join([]string{
+		method,
+		req.URL.EscapedPath(),
+		req.URL.Query().Encode(),
+		"host:" + req.URL.Host,
+		"x-amz-content-sha256:" + req.Header.Get("X-Amz-Content-Sha256"),
+		"x-amz-date:" + req.Header.Get("X-Amz-Date"),
+		"",
+		"host;x-amz-content-sha256;x-amz-date",
+		req.Header.Get("X-Amz-Content-Sha256"),
+	}, "\n")
+	canonicalHash := sha256.Sum256([]byte(canonical))
+	scope := date + "/" + testRegion + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + req.Header.Get("X-Amz-Date") + "\n" + scope + "\n" + hex.EncodeToString(canonicalHash[:])
+
+	key := []byte("AWS4" + testSecretKey)
+	for _, part := range []string{date, testRegion, "s3", "aws4_request", stringToSign} {
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(part))
+		key = mac.Sum(nil)
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s,SignedHeaders=host;x-amz-content-sha256;x-amz-date,Signature=%x",
+		testAccessKey, scope, key))
+
+	return req
+}
+
+// expectStatus checks the status of a response and returns its body
+func expectStatus(t *testing.T, resp *http.Response, status int) []byte {
+	t.Helper()
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != status {
+		t.Fatalf("%s %s: expected status %d, got %d: %s", resp.Request.Method, resp.Request.URL.Path, status, resp.StatusCode, body)
+	}
+	return body
+}
+
+func TestS3BucketsAndObjects(t *testing.T) {
+	server, metaStore := newS3Gateway(t)
+
+	expectStatus(t, s3Do(t, server, http.MethodPut, "/photos", nil, nil), http.StatusOK)
+	expectStatus(t, s3Do(t, server, http.MethodPut, "/photos", nil, nil), http.StatusConflict)
+
+	// The same content under two keys is stored once
+	content := []byte("S3 content stored in CaskOS")
+	resp := s3Do(t, server, http.MethodPut, "/photos/2024/a.txt", content, map[string]string{
+		"Content-Type":      "text/plain",
+		"X-Amz-Meta-Author": "alice",
+	})
+	expectStatus(t, resp, http.StatusOK)
+	etag := resp.Header.Get("ETag")
+	expectStatus(t, s3Do(t, server, http.MethodPut, "/photos/2024/b.txt", content, nil), http.StatusOK)
+	expectStatus(t, s3Do(t, server, http.MethodPut, "/photos/top.txt", []byte("other"), nil), http.StatusOK)
+
+	a, err := metaStore.GetKey("photos", "2024/a.txt")
+	if err != nil {
+		t.Fatalf("failed to get key: %v", err)
+	}
+	b, err := metaStore.GetKey("photos", "2024/b.txt")
+	if err != nil {
+		t.Fatalf("failed to get key: %v", err)
+	}
+	if a.ObjectID != b.ObjectID {
+		t.Errorf("expected identical content to share an object, got %s and %s", a.ObjectID, b.ObjectID)
+	}
+
+	// Ranged GET returns user metadata and the MD5 ETag
+	resp = s3Do(t, server, http.MethodGet, "/photos/2024/a.txt", nil, map[string]string{"Range": "bytes=0-1"})
+	body := expectStatus(t, resp, http.StatusPartialContent)
+	if string(body) != "S3" || resp.Header.Get("ETag") != etag || resp.Header.Get("X-Amz-Meta-Author") != "alice" {
+		t.Errorf("unexpected ranged GET: body %q, headers %v", body, resp.Header)
+	}
+
+	// ListObjectsV2 rolls keys up by delimiter
+	var listing struct {
+		Contents       []struct{ Key string }
+		CommonPrefixes []struct{ Prefix string }
+		KeyCount       int
+	}
+	body = expectStatus(t, s3Do(t, server, http.MethodGet, "/photos?list-type=2&delimiter=/", nil, nil), http.StatusOK)
+	if err := xml.Unmarshal(body, &listing); err != nil {
+		t.Fatalf("failed to parse listing: %v", err)
+	}
+	if len(listing.Contents) != 1 || listing.Contents[0].Key != "top.txt" ||
+		len(listing.CommonPrefixes) != 1 || listing.CommonPrefixes[0].Prefix != "2024/" || listing.KeyCount != 2 {
+		t.Errorf("unexpected listing: %s", body)
+	}
+
+	// Deleting a key leaves content shared with another key readable
+	expectStatus(t, s3Do(t, server, http.MethodDelete, "/photos/2024/a.txt", nil, nil), http.StatusNoContent)
+	expectStatus(t, s3Do(t, server, http.MethodGet, "/photos/2024/a.txt", nil, nil), http.StatusNotFound)
+	body = expectStatus(t, s3Do(t, server, http.MethodGet, "/photos/2024/b.txt", nil, nil), http.StatusOK)
+	if !bytes.Equal(body, content) {
+		t.Errorf("expected shared content to survive the delete, got %q", body)
+	}
+
+	// Copying points a new key at the same object
+	expectStatus(t, s3Do(t, server, http.MethodPut, "/photos/copy.txt", nil, map[string]string{
+		"X-Amz-Copy-Source": "/photos/2024/b.txt",
+	}), http.StatusOK)
+	body = expectStatus(t, s3Do(t, server, http.MethodGet, "/photos/copy.txt", nil, nil), http.StatusOK)
+	if !bytes.Equal(body, content) {
+		t.Errorf("expected copied content, got %q", body)
+	}
+
+	expectStatus(t, s3Do(t, server, http.MethodDelete, "/photos", nil, nil), http.StatusConflict)
+}
+
+func TestS3MultipartUpload(t *testing.T) {
+	server, _ := newS3Gateway(t)
+	expectStatus(t, s3Do(t, server, http.MethodPut, "/media", nil, nil), http.StatusOK)
+
+	var initiated struct{ UploadId string }
+	body := expectStatus(t, s3Do(t, server, http.MethodPost, "/media/video.bin?uploads", nil, nil), http.StatusOK)
+	if err := xml.Unmarshal(body, &initiated); err != nil || initiated.UploadId == "" {
+		t.Fatalf("failed to parse initiate response %s: %v", body, err)
+	}
+
+	parts := [][]byte{bytes.Repeat([]byte("x"), 5<<20), []byte("tail")}
+	var complete strings.Builder
+	complete.WriteString("<CompleteMultipartUpload>")
+	for i, part := range parts {
+		target := fmt.Sprintf("/media/video.bin?partNumber=%d&uploadId=%s", i+1, initiated.UploadId)
+		resp := s3Do(t, server, http.MethodPut, target, part, nil)
+		expectStatus(t, resp, http.StatusOK)
+		fmt.Fprintf(&complete, "<Part><PartNumber>%d</PartNumber><ETag>%s</ETag></Part>", i+1, resp.Header.Get("ETag"))
+	}
+	complete.WriteString("</CompleteMultipartUpload>")
+
+	target := "/media/video.bin?uploadId=" + initiated.UploadId
+
+	// A part list changed after signing is refused, even though the XML
+	// ends before the body does
+	forged := fmt.Sprintf("<CompleteMultipartUpload><Part><PartNumber>1</PartNumber><ETag>%s</ETag></Part></CompleteMultipartUpload>",
+		strings.SplitN(strings.SplitN(complete.String(), "<ETag>", 2)[1], "</ETag>", 2)[0])
+	forged += strings.Repeat(" ", complete.Len()-len(forged))
+	req := s3Request(t, server, http.MethodPost, target, []byte(complete.String()), nil)
+	req.Body = io.NopCloser(strings.NewReader(forged))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	if body := expectStatus(t, resp, http.StatusBadRequest); !strings.Contains(string(body), "XAmzContentSHA256Mismatch") {
+		t.Errorf("expected XAmzContentSHA256Mismatch for a forged part list, got %s", body)
+	}
+
+	body = expectStatus(t, s3Do(t, server, http.MethodPost, target, []byte(complete.String()), nil), http.StatusOK)
+	if !strings.Contains(string(body), "-2&#34;</ETag>") {
+		t.Errorf("expected a multipart ETag, got %s", body)
+	}
+
+	body = expectStatus(t, s3Do(t, server, http.MethodGet, "/media/video.bin", nil, nil), http.StatusOK)
+	if !bytes.Equal(body, bytes.Join(parts, nil)) {
+		t.Errorf("expected concatenated parts, got %d bytes", len(body))
+	}
+
+	// The upload is gone once completed
+	expectStatus(t, s3Do(t, server, http.MethodGet, target, nil, nil), http.StatusNotFound)
+}
+
+func TestS3RejectsBadSignatures(t *testing.T) {
+	server, _ := newS3Gateway(t)
+
+	resp, err := http.Get(server.URL + "/")
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	expectStatus(t, resp, http.StatusForbidden)
+
+	expectStatus(t, s3Do(t, server, http.MethodPut, "/bucket", nil, nil), http.StatusOK)
+
+	// A body that does not match the signed payload hash is refused
+	req := s3Request(t, server, http.MethodPut, "/bucket/key", []byte("signed"), nil)
+	req.Body = io.NopCloser(strings.NewReader("forged"))
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	body := expectStatus(t, resp, http.StatusBadRequest)
+	if !strings.Contains(string(body), "XAmzContentSHA256Mismatch") {
+		t.Errorf("expected XAmzContentSHA256Mismatch, got %s", body)
+	}
+	expectStatus(t, s3Do(t, server, http.MethodGet, "/bucket/key", nil, nil), http.StatusNotFound)
+}
+
+func TestS3ChunkedUploads(t *testing.T) {
+	server, _ := newS3Gateway(t)
+	expectStatus(t, s3Do(t, server, http.MethodPut, "/bucket", nil, nil), http.StatusOK)
+
+	put := func(key, body, decodedLength string) *http.Response {
+		headers := map[string]string{
+			"Content-Encoding":     "aws-chunked",
+			"X-Amz-Content-Sha256": "STREAMING-UNSIGNED-PAYLOAD-TRAILER",
+		}
+		if decodedLength != "" {
+			headers["X-Amz-Decoded-Content-Length"] = decodedLength
+		}
+		return s3Do(t, server, http.MethodPut, "/bucket/"+key, []byte(body), headers)
+	}
+
+	expectStatus(t, put("complete", "5\r\nhello\r\n0\r\n\r\n", "5"), http.StatusOK)
+	if body := expectStatus(t, s3Do(t, server, http.MethodGet, "/bucket/complete", nil, nil), http.StatusOK); string(body) != "hello" {
+		t.Errorf("expected %q, got %q", "hello", body)
+	}
+
+	// Bodies without the final chunk, or with another length than declared,
+	// store nothing
+	for key, body := range map[string]string{
+		"truncated": "5\r\nhello\r\n",
+		"short":     "3\r\nhel\r\n0\r\n\r\n",
+	} {
+		if body := expectStatus(t, put(key, body, "5"), http.StatusBadRequest); !strings.Contains(string(body), "IncompleteBody") {
+			t.Errorf("%s: expected IncompleteBody, got %s", key, body)
+		}
+		expectStatus(t, s3Do(t, server, http.MethodGet, "/bucket/"+key, nil, nil), http.StatusNotFound)
+	}
+
+	expectStatus(t, put("unknown", "5\r\nhello\r\n0\r\n\r\n", ""), http.StatusLengthRequired)
+}
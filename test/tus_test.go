@@ -0,0 +1,210 @@
+package test
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/caskos/caskos/internal/api"
+)
+
+// tusDo sends a tus request for an upload to a handler
+func tusDo(handler http.HandlerFunc, method, id, body string, headers map[string]string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, "/files/"+id, strings.NewReader(body))
+	req.SetPathValue("id", id)
+	req.Header.Set("Tus-Resumable", "1.0.0")
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+	recorder := httptest.NewRecorder()
+	handler(recorder, req)
+	return recorder
+}
+
+// tusMetadata encodes an Upload-Metadata value
+func tusMetadata(pairs ...string) string {
+	var values []string
+	for i := 0; i < len(pairs); i += 2 {
+		values = append(values, pairs[i]+" "+base64.StdEncoding.EncodeToString([]byte(pairs[i+1])))
+	}
+	return strings.Join(values, ",")
+}
+
+func TestTusUpload(t *testing.T) {
+	server, _, _ := newTestServer(t)
+	enableUploads(t, server)
+
+	content := "uploaded with the tus protocol"
+
+	// Creation carries the first part of the upload
+	create := tusDo(server.TusCreateHandler, http.MethodPost, "", content[:10], map[string]string{
+		"Upload-Length":   strconv.Itoa(len(content)),
+		"Upload-Metadata": tusMetadata("filename", "tus.txt", "filetype", "text/plain"),
+		"Content-Type":    "application/offset+octet-stream",
+	})
+	if create.Code != http.StatusCreated {
+		t.Fatalf("expected 201 creating an upload, got %d: %s", create.Code, create.Body.String())
+	}
+	if create.Header().Get("Upload-Offset") != "10" {
+		t.Errorf("expected offset 10 after creation, got %q", create.Header().Get("Upload-Offset"))
+	}
+	id := strings.TrimPrefix(create.Header().Get("Location"), "/files/")
+
+	patch := func(offset int, part, checksum string) *httptest.ResponseRecorder {
+		headers := map[string]string{
+			"Upload-Offset": strconv.Itoa(offset),
+			"Content-Type":  "application/offset+octet-stream",
+		}
+		if checksum != "" {
+			headers["Upload-Checksum"] = checksum
+		}
+		return tusDo(server.TusPatchHandler, http.MethodPatch, id, part, headers)
+	}
+
+	if recorder := patch(5, content[5:], ""); recorder.Code != http.StatusConflict {
+		t.Errorf("expected 409 for a wrong offset, got %d", recorder.Code)
+	}
+	wrongSum := sha1.Sum([]byte("something else"))
+	if recorder := patch(10, content[10:20], "sha1 "+base64.StdEncoding.EncodeToString(wrongSum[:])); recorder.Code != 460 {
+		t.Errorf("expected 460 for a checksum mismatch, got %d", recorder.Code)
+	}
+
+	// A part sent while another one is still being written is refused, even
+	// at the same offset
+	body, writer := io.Pipe()
+	first := make(chan *httptest.ResponseRecorder)
+	go func() {
+		req := httptest.NewRequest(http.MethodPatch, "/files/"+id, body)
+		req.SetPathValue("id", id)
+		req.Header.Set("Tus-Resumable", "1.0.0")
+		req.Header.Set("Upload-Offset", "10")
+		req.Header.Set("Content-Type", "application/offset+octet-stream")
+		recorder := httptest.NewRecorder()
+		server.TusPatchHandler(recorder, req)
+		first <- recorder
+	}()
+	writer.Write([]byte(content[10:15]))
+	if recorder := patch(10, content[10:20], ""); recorder.Code != http.StatusConflict {
+		t.Errorf("expected 409 for a concurrent part, got %d", recorder.Code)
+	}
+	writer.Close()
+	if recorder := <-first; recorder.Code != http.StatusNoContent || recorder.Header().Get("Upload-Offset") != "15" {
+		t.Fatalf("expected 204 at offset 15 for the first part, got %d at %q", recorder.Code, recorder.Header().Get("Upload-Offset"))
+	}
+
+	sum := sha1.Sum([]byte(content[15:20]))
+	if recorder := patch(15, content[15:20], "sha1 "+base64.StdEncoding.EncodeToString(sum[:])); recorder.Code != http.StatusNoContent || recorder.Header().Get("Upload-Offset") != "20" {
+		t.Fatalf("expected 204 at offset 20, got %d at %q", recorder.Code, recorder.Header().Get("Upload-Offset"))
+	}
+
+	head := tusDo(server.TusHeadHandler, http.MethodHead, id, "", nil)
+	if head.Header().Get("Upload-Offset") != "20" || head.Header().Get("Upload-Length") != strconv.Itoa(len(content)) {
+		t.Errorf("expected offset 20 of %d, got %q of %q", len(content), head.Header().Get("Upload-Offset"), head.Header().Get("Upload-Length"))
+	}
+
+	// The last part stores the object
+	last := patch(20, content[20:], "")
+	if last.Code != http.StatusNoContent {
+		t.Fatalf("expected 204 for the last part, got %d: %s", last.Code, last.Body.String())
+	}
+	contentSum := sha256.Sum256([]byte(content))
+	objectID := hex.EncodeToString(contentSum[:])
+	if last.Header().Get(api.ObjectIDHeader) != objectID {
+		t.Errorf("expected object %s, got %q", objectID, last.Header().Get(api.ObjectIDHeader))
+	}
+
+	getReq := httptest.NewRequest(http.MethodGet, "/object/"+objectID, nil)
+	getReq.SetPathValue("id", objectID)
+	getRecorder := httptest.NewRecorder()
+	server.GetObjectHandler(getRecorder, getReq)
+	if getRecorder.Body.String() != content || getRecorder.Header().Get("Content-Type") != "text/plain" {
+		t.Errorf("expected stored text/plain content %q, got %q of type %q", content, getRecorder.Body.String(), getRecorder.Header().Get("Content-Type"))
+	}
+
+	// A finished upload still reports its offset and object
+	head = tusDo(server.TusHeadHandler, http.MethodHead, id, "", nil)
+	if head.Header().Get("Upload-Offset") != strconv.Itoa(len(content)) || head.Header().Get(api.ObjectIDHeader) != objectID {
+		t.Errorf("expected a finished upload, got offset %q and object %q", head.Header().Get("Upload-Offset"), head.Header().Get(api.ObjectIDHeader))
+	}
+
+	if recorder := tusDo(server.TusDeleteHandler, http.MethodDelete, id, "", nil); recorder.Code != http.StatusNoContent {
+		t.Errorf("expected 204 terminating the upload, got %d", recorder.Code)
+	}
+	if recorder := tusDo(server.TusHeadHandler, http.MethodHead, id, "", nil); recorder.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for a terminated upload, got %d", recorder.Code)
+	}
+}
+
+func TestTusUploadIntoBucket(t *testing.T) {
+	server, _, metaStore := newTestServer(t)
+	enableUploads(t, server)
+
+	headers := map[string]string{
+		"Upload-Length":   "5",
+		"Upload-Metadata": tusMetadata("bucket", "docs", "filename", "hello.txt"),
+	}
+	if recorder := tusDo(server.TusCreateHandler, http.MethodPost, "", "", headers); recorder.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for a missing bucket, got %d", recorder.Code)
+	}
+
+	if _, err := metaStore.CreateBucket("docs", ""); err != nil {
+		t.Fatalf("failed to create bucket: %v", err)
+	}
+	create := tusDo(server.TusCreateHandler, http.MethodPost, "", "", headers)
+	if create.Code != http.StatusCreated {
+		t.Fatalf("expected 201 creating an upload, got %d: %s", create.Code, create.Body.String())
+	}
+	id := strings.TrimPrefix(create.Header().Get("Location"), "/files/")
+
+	patchHeaders := func(offset string) map[string]string {
+		return map[string]string{"Upload-Offset": offset, "Content-Type": "application/offset+octet-stream"}
+	}
+
+	// An upload that cannot be stored keeps its data, and HEAD does not store
+	// it but asks for the last byte again
+	if err := metaStore.DeleteBucket("docs"); err != nil {
+		t.Fatalf("failed to delete bucket: %v", err)
+	}
+	if recorder := tusDo(server.TusPatchHandler, http.MethodPatch, id, "hello", patchHeaders("0")); recorder.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 storing into a missing bucket, got %d", recorder.Code)
+	}
+	if _, err := metaStore.CreateBucket("docs", ""); err != nil {
+		t.Fatalf("failed to create bucket: %v", err)
+	}
+	head := tusDo(server.TusHeadHandler, http.MethodHead, id, "", nil)
+	if head.Header().Get("Upload-Offset") != "4" || head.Header().Get(api.ObjectIDHeader) != "" {
+		t.Errorf("expected offset 4 without an object, got %q and %q", head.Header().Get("Upload-Offset"), head.Header().Get(api.ObjectIDHeader))
+	}
+	if _, err := metaStore.GetKey("docs", "hello.txt"); err == nil {
+		t.Error("expected HEAD not to store the upload")
+	}
+
+	patch := tusDo(server.TusPatchHandler, http.MethodPatch, id, "o", patchHeaders("4"))
+	if patch.Code != http.StatusNoContent {
+		t.Fatalf("expected 204, got %d: %s", patch.Code, patch.Body.String())
+	}
+
+	entry, err := metaStore.GetKey("docs", "hello.txt")
+	if err != nil {
+		t.Fatalf("expected the upload under its file name: %v", err)
+	}
+	if entry.ObjectID != patch.Header().Get(api.ObjectIDHeader) {
+		t.Errorf("expected key to point at %s, got %s", patch.Header().Get(api.ObjectIDHeader), entry.ObjectID)
+	}
+
+	// Requests for other protocol versions are refused
+	req := httptest.NewRequest(http.MethodPost, "/files/", nil)
+	req.Header.Set("Upload-Length", "5")
+	recorder := httptest.NewRecorder()
+	server.TusCreateHandler(recorder, req)
+	if recorder.Code != http.StatusPreconditionFailed || recorder.Header().Get("Tus-Version") != "1.0.0" {
+		t.Errorf("expected 412 with the supported version, got %d", recorder.Code)
+	}
+}
@@ -1,3 +1,6 @@
+const TUS_VERSION = '1.0.0';
+const CHUNK_SIZE = 8 * 1024 * 1024;
+
 document.addEventListener('DOMContentLoaded', function() {
     const form = document.getElementById('uploadForm');
     const fileInput = document.getElementById('fileInput');
@@ -30,22 +33,17 @@ document.addEventListener('DOMContentLoaded', function() {
         uploadButton.innerHTML = '<span class="loading"></span> Uploading...';
         resultSection.classList.add('hidden');
 
-        const formData = new FormData();
-        formData.append('file', file);
-
         try {
-            const response = await fetch('/upload', {
-                method: 'POST',
-                body: formData
+            const objectID = await tusUpload(file, function(offset, size) {
+                const percent = size === 0 ? 100 : Math.floor(offset / size * 100);
+                uploadButton.innerHTML = '<span class="loading"></span> Uploading... ' + percent + '%';
             });
 
-            const data = await response.json();
-
-            if (response.ok) {
-                showSuccessResult(data, file.name);
-            } else {
-                showResult('error', 'Upload failed: ' + (data.error || response.statusText));
+            const response = await fetch('/metadata/' + objectID);
+            if (!response.ok) {
+                throw new Error(await response.text() || response.statusText);
             }
+            showSuccessResult(await response.json(), file.name);
         } catch (error) {
             showResult('error', 'Upload failed: ' + error.message);
         } finally {
@@ -55,6 +53,81 @@ document.addEventListener('DOMContentLoaded', function() {
         }
     });
 
+    // Files are sent with the tus protocol in chunks. The upload URL is kept
+    // in localStorage, so choosing the same file again after a page reload
+    // resumes the upload where it stopped.
+    async function tusUpload(file, onProgress) {
+        const fingerprint = 'tus::' + file.name + '::' + file.size + '::' + file.lastModified;
+        let location = localStorage.getItem(fingerprint);
+        let offset = 0;
+        let objectID = null;
+
+        if (location) {
+            const response = await fetch(location, {
+                method: 'HEAD',
+                headers: { 'Tus-Resumable': TUS_VERSION }
+            });
+            if (response.ok) {
+                offset = parseInt(response.headers.get('Upload-Offset'), 10);
+                objectID = response.headers.get('X-Object-Id');
+            } else {
+                location = null;
+            }
+        }
+
+        if (!location) {
+            let metadata = 'filename ' + base64(file.name);
+            if (file.type) {
+                metadata += ',filetype ' + base64(file.type);
+            }
+
+            const response = await fetch('/files/', {
+                method: 'POST',
+                headers: {
+                    'Tus-Resumable': TUS_VERSION,
+                    'Upload-Length': String(file.size),
+                    'Upload-Metadata': metadata
+                }
+            });
+            if (!response.ok) {
+                throw new Error(await response.text() || response.statusText);
+            }
+            location = response.headers.get('Location');
+            objectID = response.headers.get('X-Object-Id');
+            localStorage.setItem(fingerprint, location);
+        }
+
+        while (!objectID) {
+            onProgress(offset, file.size);
+            const response = await fetch(location, {
+                method: 'PATCH',
+                headers: {
+                    'Tus-Resumable': TUS_VERSION,
+                    'Upload-Offset': String(offset),
+                    'Content-Type': 'application/offset+octet-stream'
+                },
+                body: file.slice(offset, offset + CHUNK_SIZE)
+            });
+            if (!response.ok) {
+                throw new Error(await response.text() || response.statusText);
+            }
+            offset = parseInt(response.headers.get('Upload-Offset'), 10);
+            objectID = response.headers.get('X-Object-Id');
+        }
+
+        onProgress(file.size, file.size);
+        localStorage.removeItem(fingerprint);
+        return objectID;
+    }
+
+    function base64(text) {
+        let binary = '';
+        new TextEncoder().encode(text).forEach(function(b) {
+            binary += String.fromCharCode(b);
+        });
+        return btoa(binary);
+    }
+
     function showSuccessResult(data, fileName) {
         const objectID = data.id;
         const size = formatFileSize(data.size);